@@ -1,10 +1,14 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"runtime"
+	"strconv"
 	"strings"
 
 	"github.com/OhMyDitzzy/go-payload-dumper/internal/dumper"
@@ -12,44 +16,190 @@ import (
 
 var version = "dev" // this will be overridden by -ldflags during build
 
+// errUsage is returned by run after printing the usage message.
+var errUsage = errors.New("usage")
+
 func main() {
+	// run returns instead of exiting, so that its deferred calls, like
+	// removing the temporary files of the dumper, run before the exit.
+	if err := run(); err != nil {
+		if !errors.Is(err, errUsage) {
+			log.Print(err)
+		}
+		os.Exit(1)
+	}
+}
+
+func run() error {
 	showVersion := flag.Bool("version", false, "show version and exit")
 	payloadPath := flag.String("payload", "", "payload file path or URL (can be a zip file)")
 	outDir := flag.String("out", "output", "output directory")
 	diff := flag.Bool("diff", false, "extract differential OTA")
 	oldDir := flag.String("old", "old", "directory with original images for differential OTA")
 	images := flag.String("images", "", "comma-separated list of images to extract")
+	keys := flag.String("keys", "", "comma-separated list of PEM/DER certificates or public keys that must verify the payload signature")
+	list := flag.Bool("list", false, "print the partitions and manifest details and exit without extracting")
+	jsonOutput := flag.Bool("json", false, "print -list output as JSON")
+	skipVerify := flag.Bool("skip-verify", false, "do not check extracted images against the hashes in the manifest")
+	allowUnverifiable := flag.Bool("allow-unverifiable", false, "extract partitions whose dm-verity hash tree or FEC data cannot be generated, without it and unverified, instead of failing")
+	verify := flag.Bool("verify", false, "verify the whole-payload signature against -keys and exit without extracting")
+	jobs := flag.Int("jobs", 1, "number of partitions to extract concurrently")
+	workers := flag.Int("workers", runtime.NumCPU(), "number of operations of a partition to process concurrently")
+	sparse := flag.Bool("sparse", false, "write images in the Android sparse format for fastboot")
+	sparseCRC := flag.Bool("sparse-crc", false, "add a CRC32 chunk to sparse images")
+	sparseMaxSize := flag.String("sparse-max-size", "", "split sparse images into files of at most this size, e.g. 512M")
+	compress := flag.String("compress", "", "write compressed images: zstd, xz or gzip")
+	compressLevel := flag.Int("compress-level", -1, "compression level for -compress (-1 selects the default)")
+	super := flag.Bool("super", false, "also build a flashable super.img from the dynamic partitions (use -sparse for a sparse super.img)")
+	superSize := flag.String("super-size", "", "size of the super partition, e.g. 8G (default: computed from the group sizes)")
+	warnProperties := flag.Bool("warn-properties", false, "only warn when payload_properties.txt does not match the payload")
 	flag.Parse()
 
 	if *showVersion {
 		fmt.Println("go-payload-dumper version", version)
-		return
+		return nil
 	}
 
 	if *payloadPath == "" {
 		fmt.Println("Usage: go-payload-dumper -payload <path> [options]")
 		flag.PrintDefaults()
-		os.Exit(1)
+		return errUsage
 	}
 
-	if err := os.MkdirAll(*outDir, 0755); err != nil {
-		log.Fatalf("Failed to create output directory: %v", err)
+	if *verify && *keys == "" {
+		return errors.New("-verify requires -keys")
+	}
+	if *jsonOutput && !*list {
+		fmt.Println("-json requires -list")
+		flag.PrintDefaults()
+		return errUsage
+	}
+
+	maxSize, err := parseSize(*sparseMaxSize)
+	if err != nil {
+		return fmt.Errorf("Invalid -sparse-max-size: %v", err)
+	}
+	superBytes, err := parseSize(*superSize)
+	if err != nil {
+		return fmt.Errorf("Invalid -super-size: %v", err)
+	}
+	if *super && *compress != "" {
+		return errors.New("-super cannot be combined with -compress")
 	}
 
-	d, err := dumper.New(*payloadPath, *outDir, *oldDir, *diff)
+	var publicKeys []dumper.PublicKey
+	if *keys != "" {
+		publicKeys, err = dumper.LoadPublicKeys(strings.Split(*keys, ","))
+		if err != nil {
+			return fmt.Errorf("Failed to load public keys: %v", err)
+		}
+	}
+
+	d, err := dumper.New(*payloadPath, dumper.Options{
+		OutDir:                   *outDir,
+		OldDir:                   *oldDir,
+		UseDiff:                  *diff,
+		WarnOnPropertiesMismatch: *warnProperties,
+		PublicKeys:               publicKeys,
+		ManifestOnly:             *list,
+		SkipVerify:               *skipVerify,
+		AllowUnverifiable:        *allowUnverifiable,
+		Jobs:                     *jobs,
+		Workers:                  *workers,
+		SparseImage:              *sparse && !*super,
+		SparseCRC:                *sparseCRC,
+		SparseMaxSize:            maxSize,
+		Compression:              *compress,
+		CompressionLevel:         *compressLevel,
+	})
 	if err != nil {
-		log.Fatalf("Failed to initialize dumper: %v", err)
+		return fmt.Errorf("Failed to initialize dumper: %v", err)
 	}
 	defer d.Close()
 
+	if *list {
+		info := d.Info()
+		if *jsonOutput {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			err = enc.Encode(info)
+		} else {
+			err = info.WriteText(os.Stdout)
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to print payload info: %v", err)
+		}
+		return nil
+	}
+
+	if *verify {
+		key, err := d.VerifyPayloadSignature(publicKeys)
+		if err != nil {
+			return fmt.Errorf("Payload signature verification failed: %v", err)
+		}
+		fmt.Printf("Payload signature verified with %s\n", key.Name)
+		return nil
+	}
+
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		return fmt.Errorf("Failed to create output directory: %v", err)
+	}
+
 	var imageList []string
 	if *images != "" {
 		imageList = strings.Split(*images, ",")
 	}
 
-	if err := d.Extract(imageList); err != nil {
-		log.Fatalf("Failed to extract payload: %v", err)
+	err = d.Extract(imageList)
+
+	fmt.Println()
+	d.WriteSummary(os.Stdout)
+
+	if err != nil {
+		return fmt.Errorf("Failed to extract payload: %v", err)
+	}
+
+	if *super {
+		// super.img is built from the raw images of its members, so with
+		// -super only super.img itself is written as a sparse image.
+		err := d.BuildSuperImage(dumper.SuperOptions{
+			Size:          superBytes,
+			Sparse:        *sparse,
+			SparseCRC:     *sparseCRC,
+			SparseMaxSize: maxSize,
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to build super image: %v", err)
+		}
+		fmt.Println("Built super.img")
 	}
 
 	fmt.Println("Extraction completed successfully!")
-}
\ No newline at end of file
+	return nil
+}
+
+// parseSize parses a byte count with an optional K, M or G suffix.
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	shift := 0
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		shift = 10
+	case "M":
+		shift = 20
+	case "G":
+		shift = 30
+	}
+	if shift > 0 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n << shift, nil
+}
@@ -2,9 +2,9 @@ module github.com/OhMyDitzzy/go-payload-dumper
 
 go 1.25.4
 
-require google.golang.org/protobuf v1.36.10
-
 require (
-	github.com/klauspost/compress v1.18.2 // indirect
-	github.com/ulikunitz/xz v0.5.15 // indirect
+	github.com/andybalholm/brotli v1.2.0
+	github.com/klauspost/compress v1.18.2
+	github.com/ulikunitz/xz v0.5.15
+	google.golang.org/protobuf v1.36.10
 )
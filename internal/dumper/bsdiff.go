@@ -1,145 +1,175 @@
 package dumper
 
 import (
-    "bytes"
-    "compress/bzip2"
-    "encoding/binary"
-    "fmt"
-    "io"
+	"bytes"
+	"compress/bzip2"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/andybalholm/brotli"
+)
 
-    "github.com/klauspost/compress/zstd"
+const (
+	BSDIFF_MAGIC = "BSDIFF40"
+	BSDF2_MAGIC  = "BSDF2"
 )
 
+// Compressor ids used in the BSDF2 header, one byte per stream.
 const (
-    BSDIFF_MAGIC = "BSDIFF40"
-    BSDF2_MAGIC  = "BSDF2"
+	bsdf2None   = 0
+	bsdf2BZ2    = 1
+	bsdf2Brotli = 2
 )
 
+// ApplyBSDIFF applies a BSDIFF40 or BSDF2 patch to oldData. Every length
+// and position in the patch is checked, so a malformed patch returns an error
+// instead of panicking in a worker goroutine.
 func ApplyBSDIFF(oldData, patchData []byte) ([]byte, error) {
-    reader := bytes.NewReader(patchData)
-
-    magic := make([]byte, 8)
-    if _, err := io.ReadFull(reader, magic); err != nil {
-        return nil, err
-    }
-
-    var algControl, algDiff, algExtra int
-    if string(magic[:8]) == BSDIFF_MAGIC {
-        algControl, algDiff, algExtra = 1, 1, 1
-    } else if string(magic[:5]) == BSDF2_MAGIC {
-        algControl = int(magic[5])
-        algDiff = int(magic[6])
-        algExtra = int(magic[7])
-    } else {
-        return nil, fmt.Errorf("invalid bsdiff magic")
-    }
-
-    ctrlLen, err := readInt64(reader)
-    if err != nil {
-        return nil, err
-    }
-    diffLen, err := readInt64(reader)
-    if err != nil {
-        return nil, err
-    }
-    newSize, err := readInt64(reader)
-    if err != nil {
-        return nil, err
-    }
-
-    ctrlData := make([]byte, ctrlLen)
-    if _, err := io.ReadFull(reader, ctrlData); err != nil {
-        return nil, err
-    }
-    ctrlBlock, err := decompressBSDF2(algControl, ctrlData)
-    if err != nil {
-        return nil, err
-    }
-
-    diffData := make([]byte, diffLen)
-    if _, err := io.ReadFull(reader, diffData); err != nil {
-        return nil, err
-    }
-    diffBlock, err := decompressBSDF2(algDiff, diffData)
-    if err != nil {
-        return nil, err
-    }
-
-    extraData, err := io.ReadAll(reader)
-    if err != nil {
-        return nil, err
-    }
-    extraBlock, err := decompressBSDF2(algExtra, extraData)
-    if err != nil {
-        return nil, err
-    }
-
-    newData := make([]byte, newSize)
-    oldPos, newPos := 0, 0
-    diffPos, extraPos := 0, 0
-
-    ctrlReader := bytes.NewReader(ctrlBlock)
-    for newPos < int(newSize) {
-        addSize, err := readInt64(ctrlReader)
-        if err != nil {
-            break
-        }
-        copySize, err := readInt64(ctrlReader)
-        if err != nil {
-            break
-        }
-        seekAmount, err := readInt64(ctrlReader)
-        if err != nil {
-            break
-        }
-
-        for i := 0; i < int(addSize); i++ {
-            if oldPos+i < len(oldData) && diffPos+i < len(diffBlock) {
-                newData[newPos+i] = oldData[oldPos+i] + diffBlock[diffPos+i]
-            } else if diffPos+i < len(diffBlock) {
-                newData[newPos+i] = diffBlock[diffPos+i]
-            }
-        }
-
-        newPos += int(addSize)
-        oldPos += int(addSize)
-        diffPos += int(addSize)
-
-        for i := 0; i < int(copySize); i++ {
-            if extraPos+i < len(extraBlock) {
-                newData[newPos+i] = extraBlock[extraPos+i]
-            }
-        }
-
-        newPos += int(copySize)
-        extraPos += int(copySize)
-        oldPos += int(seekAmount)
-    }
-
-    return newData, nil
+	reader := bytes.NewReader(patchData)
+
+	magic := make([]byte, 8)
+	if _, err := io.ReadFull(reader, magic); err != nil {
+		return nil, err
+	}
+
+	var algControl, algDiff, algExtra int
+	if string(magic[:8]) == BSDIFF_MAGIC {
+		algControl, algDiff, algExtra = 1, 1, 1
+	} else if string(magic[:5]) == BSDF2_MAGIC {
+		algControl = int(magic[5])
+		algDiff = int(magic[6])
+		algExtra = int(magic[7])
+	} else {
+		return nil, fmt.Errorf("invalid bsdiff magic")
+	}
+
+	ctrlLen, err := readInt64(reader)
+	if err != nil {
+		return nil, err
+	}
+	diffLen, err := readInt64(reader)
+	if err != nil {
+		return nil, err
+	}
+	newSize, err := readInt64(reader)
+	if err != nil {
+		return nil, err
+	}
+	if ctrlLen < 0 || diffLen < 0 || newSize < 0 || ctrlLen > int64(reader.Len()) || diffLen > int64(reader.Len())-ctrlLen {
+		return nil, fmt.Errorf("invalid bsdiff header: control %d, diff %d, new size %d bytes in a %d byte patch", ctrlLen, diffLen, newSize, len(patchData))
+	}
+
+	ctrlData := make([]byte, ctrlLen)
+	if _, err := io.ReadFull(reader, ctrlData); err != nil {
+		return nil, err
+	}
+	ctrlBlock, err := decompressBSDF2(algControl, ctrlData)
+	if err != nil {
+		return nil, fmt.Errorf("control stream: %w", err)
+	}
+
+	diffData := make([]byte, diffLen)
+	if _, err := io.ReadFull(reader, diffData); err != nil {
+		return nil, err
+	}
+	diffBlock, err := decompressBSDF2(algDiff, diffData)
+	if err != nil {
+		return nil, fmt.Errorf("diff stream: %w", err)
+	}
+
+	extraData, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	extraBlock, err := decompressBSDF2(algExtra, extraData)
+	if err != nil {
+		return nil, fmt.Errorf("extra stream: %w", err)
+	}
+
+	// Every output byte comes from the diff or the extra stream, so the
+	// output can never legitimately outgrow them. Growing it as the control
+	// stream is followed keeps a bogus newSize from allocating memory.
+	if newSize > int64(len(diffBlock))+int64(len(extraBlock)) {
+		return nil, fmt.Errorf("new size %d exceeds the %d bytes of diff and extra data", newSize, len(diffBlock)+len(extraBlock))
+	}
+	newData := make([]byte, 0, newSize)
+	var oldPos int64
+	diffPos, extraPos := 0, 0
+
+	ctrlReader := bytes.NewReader(ctrlBlock)
+	for int64(len(newData)) < newSize {
+		addSize, err := readInt64(ctrlReader)
+		if err != nil {
+			return nil, fmt.Errorf("truncated control stream: %w", err)
+		}
+		copySize, err := readInt64(ctrlReader)
+		if err != nil {
+			return nil, fmt.Errorf("truncated control stream: %w", err)
+		}
+		seekAmount, err := readInt64(ctrlReader)
+		if err != nil {
+			return nil, fmt.Errorf("truncated control stream: %w", err)
+		}
+
+		remaining := newSize - int64(len(newData))
+		if addSize < 0 || addSize > remaining || addSize > int64(len(diffBlock)-diffPos) {
+			return nil, fmt.Errorf("invalid add length %d at output offset %d", addSize, len(newData))
+		}
+		if copySize < 0 || copySize > remaining-addSize || copySize > int64(len(extraBlock)-extraPos) {
+			return nil, fmt.Errorf("invalid copy length %d at output offset %d", copySize, int64(len(newData))+addSize)
+		}
+
+		// Bytes outside of the old data are taken from the diff stream as
+		// is, like bspatch does.
+		for i := int64(0); i < addSize; i++ {
+			b := diffBlock[diffPos+int(i)]
+			if pos := oldPos + i; pos >= 0 && pos < int64(len(oldData)) {
+				b += oldData[pos]
+			}
+			newData = append(newData, b)
+		}
+		diffPos += int(addSize)
+
+		newData = append(newData, extraBlock[extraPos:extraPos+int(copySize)]...)
+		extraPos += int(copySize)
+
+		oldPos += addSize
+		if (seekAmount > 0 && oldPos > math.MaxInt64-seekAmount) || (seekAmount < 0 && oldPos < math.MinInt64-seekAmount) {
+			return nil, fmt.Errorf("invalid seek %d at old offset %d", seekAmount, oldPos)
+		}
+		oldPos += seekAmount
+	}
+
+	return newData, nil
 }
 
 func decompressBSDF2(alg int, data []byte) ([]byte, error) {
-    switch alg {
-    case 0:
-        return data, nil
-    case 1:
-        reader := bzip2.NewReader(bytes.NewReader(data))
-        return io.ReadAll(reader)
-    case 2:
-        decoder, err := zstd.NewReader(bytes.NewReader(data))
-        if err != nil {
-            return nil, err
-        }
-        defer decoder.Close()
-        return io.ReadAll(decoder)
-    default:
-        return nil, fmt.Errorf("unsupported compression algorithm: %d", alg)
-    }
+	switch alg {
+	case bsdf2None:
+		return data, nil
+	case bsdf2BZ2:
+		reader := bzip2.NewReader(bytes.NewReader(data))
+		return io.ReadAll(reader)
+	case bsdf2Brotli:
+		reader := brotli.NewReader(bytes.NewReader(data))
+		return io.ReadAll(reader)
+	default:
+		return nil, fmt.Errorf("unsupported BSDF2 compression algorithm %d (supported: 0 none, 1 bzip2, 2 brotli)", alg)
+	}
 }
 
+// readInt64 reads bsdiff's offtin encoding: little endian magnitude with the
+// sign in the top bit, not two's complement.
 func readInt64(r io.Reader) (int64, error) {
-    var val int64
-    err := binary.Read(r, binary.LittleEndian, &val)
-    return val, err
-}
\ No newline at end of file
+	var buf [8]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return 0, err
+	}
+	val := int64(binary.LittleEndian.Uint64(buf[:]) &^ (1 << 63))
+	if buf[7]&0x80 != 0 {
+		val = -val
+	}
+	return val, nil
+}
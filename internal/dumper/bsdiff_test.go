@@ -0,0 +1,99 @@
+package dumper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func appendOfftin(b []byte, v int64) []byte {
+	if v < 0 {
+		return binary.LittleEndian.AppendUint64(b, uint64(-v)|1<<63)
+	}
+	return binary.LittleEndian.AppendUint64(b, uint64(v))
+}
+
+// makeBSDF2 builds a BSDF2 patch from control triples (add, copy, seek) and
+// the raw diff and extra streams, compressing all three streams with alg.
+func makeBSDF2(t *testing.T, alg byte, ctrl [][3]int64, diff, extra []byte, newSize int64) []byte {
+	t.Helper()
+
+	var c []byte
+	for _, entry := range ctrl {
+		for _, v := range entry {
+			c = appendOfftin(c, v)
+		}
+	}
+	if alg == bsdf2Brotli {
+		c, diff, extra = brotliBytes(t, c), brotliBytes(t, diff), brotliBytes(t, extra)
+	}
+
+	patch := append([]byte(BSDF2_MAGIC), alg, alg, alg)
+	patch = appendOfftin(patch, int64(len(c)))
+	patch = appendOfftin(patch, int64(len(diff)))
+	patch = appendOfftin(patch, newSize)
+	patch = append(patch, c...)
+	patch = append(patch, diff...)
+	return append(patch, extra...)
+}
+
+func TestApplyBSDIFF(t *testing.T) {
+	old := []byte("0123456789abcdefghij")
+
+	// "01234" + "XY" from extra, then back 3 bytes to "234" + 1 and
+	// "QRS" past the end of old, which stays as is.
+	ctrl := [][3]int64{{5, 2, -3}, {3, 0, 100}, {3, 0, 0}}
+	diff := []byte{0, 0, 0, 0, 0, 1, 1, 1, 'Q', 'R', 'S'}
+	want := []byte("01234XY345QRS")
+
+	for _, alg := range []byte{bsdf2None, bsdf2Brotli} {
+		got, err := ApplyBSDIFF(old, makeBSDF2(t, alg, ctrl, diff, []byte("XY"), int64(len(want))))
+		if err != nil {
+			t.Fatalf("alg %d: %v", alg, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("alg %d: got %q, want %q", alg, got, want)
+		}
+	}
+}
+
+func TestApplyBSDIFFMalformed(t *testing.T) {
+	old := []byte("0123456789")
+	diff := make([]byte, 4)
+	extra := []byte("abcd")
+
+	header := func(ctrlLen, diffLen, newSize int64) []byte {
+		p := append([]byte(BSDF2_MAGIC), 0, 0, 0)
+		p = appendOfftin(p, ctrlLen)
+		p = appendOfftin(p, diffLen)
+		return appendOfftin(p, newSize)
+	}
+
+	tests := []struct {
+		name  string
+		patch []byte
+	}{
+		{"bad magic", []byte("BSDIFF41" + string(make([]byte, 24)))},
+		{"negative control length", header(-1, 0, 0)},
+		{"negative diff length", header(0, -8, 0)},
+		{"negative new size", header(0, 0, -1)},
+		{"control length past the end", header(1<<40, 0, 0)},
+		{"diff length past the end", header(0, 1<<62, 0)},
+		{"new size larger than the streams", makeBSDF2(t, 0, [][3]int64{{4, 4, 0}}, diff, extra, 1<<50)},
+		{"negative add", makeBSDF2(t, 0, [][3]int64{{-4, 4, 0}}, diff, extra, 8)},
+		{"add past the diff stream", makeBSDF2(t, 0, [][3]int64{{5, 3, 0}}, diff, extra, 8)},
+		{"add past the new size", makeBSDF2(t, 0, [][3]int64{{4, 0, 0}}, diff, extra, 2)},
+		{"negative copy", makeBSDF2(t, 0, [][3]int64{{4, -1, 0}}, diff, extra, 8)},
+		{"copy past the extra stream", makeBSDF2(t, 0, [][3]int64{{3, 5, 0}}, diff, extra, 8)},
+		{"seek overflow", makeBSDF2(t, 0, [][3]int64{{2, 0, 1<<63 - 1}, {2, 4, 0}}, diff, extra, 8)},
+		{"truncated control stream", makeBSDF2(t, 0, [][3]int64{{4, 0, 0}}, diff, extra, 8)},
+		{"unknown compressor", append(append([]byte(BSDF2_MAGIC), 9, 0, 0), header(0, 0, 0)[8:]...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ApplyBSDIFF(old, tt.patch); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
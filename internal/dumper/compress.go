@@ -0,0 +1,103 @@
+package dumper
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression methods for extracted images.
+const (
+	CompressionZstd = "zstd"
+	CompressionXZ   = "xz"
+	CompressionGzip = "gzip"
+)
+
+// xzDictCaps are the dictionary sizes of the xz presets 0 to 9.
+var xzDictCaps = []int{256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+
+// compressedExtension returns the file name suffix for method, or an error
+// if the method is unknown.
+func compressedExtension(method string) (string, error) {
+	switch method {
+	case CompressionZstd:
+		return ".zst", nil
+	case CompressionXZ:
+		return ".xz", nil
+	case CompressionGzip:
+		return ".gz", nil
+	default:
+		return "", fmt.Errorf("unknown compression method %q", method)
+	}
+}
+
+// newCompressor wraps w in a compressor for method. A level of -1 selects the
+// compressor's default; otherwise it is interpreted like the level of the
+// zstd, xz and gzip command line tools, so gzip level 0 stores the data and
+// zstd level 0 is zstd's default. The xz encoder has a single match finder,
+// so xz levels only choose the dictionary size of the preset.
+func newCompressor(w io.Writer, method string, level int) (io.WriteCloser, error) {
+	if level < -1 {
+		return nil, fmt.Errorf("invalid compression level %d", level)
+	}
+
+	switch method {
+	case CompressionZstd:
+		opts := []zstd.EOption{}
+		if level > 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	case CompressionXZ:
+		cfg := xz.WriterConfig{}
+		if level != -1 {
+			if level >= len(xzDictCaps) {
+				return nil, fmt.Errorf("xz level must be between 0 and %d", len(xzDictCaps)-1)
+			}
+			cfg.DictCap = xzDictCaps[level]
+		}
+		return cfg.NewWriter(w)
+	case CompressionGzip:
+		// gzip.DefaultCompression is -1 as well.
+		return gzip.NewWriterLevel(w, level)
+	default:
+		return nil, fmt.Errorf("unknown compression method %q", method)
+	}
+}
+
+// writeCompressedImage compresses the first size bytes of raw into path and
+// returns the size of the compressed file.
+func writeCompressedImage(path string, raw io.ReaderAt, size int64, method string, level int) (uint64, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	bw := bufio.NewWriterSize(f, copyBufferSize)
+	cw, err := newCompressor(bw, method, level)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.CopyBuffer(cw, io.NewSectionReader(raw, 0, size), make([]byte, copyBufferSize)); err != nil {
+		cw.Close()
+		return 0, err
+	}
+	if err := cw.Close(); err != nil {
+		return 0, err
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return uint64(stat.Size()), f.Close()
+}
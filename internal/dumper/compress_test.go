@@ -0,0 +1,87 @@
+package dumper
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+func decompress(t *testing.T, method string, data []byte) []byte {
+	t.Helper()
+
+	var r io.Reader
+	var err error
+	switch method {
+	case CompressionZstd:
+		var d *zstd.Decoder
+		d, err = zstd.NewReader(bytes.NewReader(data))
+		if err == nil {
+			defer d.Close()
+		}
+		r = d
+	case CompressionXZ:
+		r, err = newXZReader(bytes.NewReader(data))
+	case CompressionGzip:
+		r, err = gzip.NewReader(bytes.NewReader(data))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestNewCompressor(t *testing.T) {
+	data := testCorpus(256 << 10)
+
+	tests := []struct {
+		method  string
+		level   int
+		wantErr bool
+	}{
+		{method: CompressionZstd, level: -1},
+		{method: CompressionZstd, level: 0},
+		{method: CompressionZstd, level: 19},
+		{method: CompressionXZ, level: -1},
+		{method: CompressionXZ, level: 0},
+		{method: CompressionXZ, level: 9},
+		{method: CompressionXZ, level: 10, wantErr: true},
+		{method: CompressionGzip, level: -1},
+		{method: CompressionGzip, level: 0},
+		{method: CompressionGzip, level: 9},
+		{method: CompressionGzip, level: 10, wantErr: true},
+		{method: CompressionGzip, level: -2, wantErr: true},
+		{method: "lz4", level: -1, wantErr: true},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		w, err := newCompressor(&buf, tt.method, tt.level)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s level %d: expected an error", tt.method, tt.level)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s level %d: %v", tt.method, tt.level, err)
+		}
+		w.Write(data)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := decompress(t, tt.method, buf.Bytes()); !bytes.Equal(got, data) {
+			t.Fatalf("%s level %d: round trip does not match", tt.method, tt.level)
+		}
+		// gzip level 0 stores the data instead of selecting the default.
+		if stored := buf.Len() > len(data); stored != (tt.method == CompressionGzip && tt.level == 0) {
+			t.Errorf("%s level %d: %d bytes compressed to %d", tt.method, tt.level, len(data), buf.Len())
+		}
+	}
+}
@@ -3,14 +3,16 @@ package dumper
 import (
 	"archive/zip"
 	"bytes"
-	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"google.golang.org/protobuf/proto"
@@ -23,34 +25,139 @@ const (
 )
 
 type Dumper struct {
-	payloadFile io.ReadSeeker
-	closer      io.Closer
-	manifest    *pb.DeltaArchiveManifest
-	dataOffset  int64
-	outDir      string
-	oldDir      string
-	useDiff     bool
+	payloadFile       io.ReaderAt
+	closer            io.Closer
+	payloadSize       int64
+	remote            bool
+	properties        []byte
+	manifest          *pb.DeltaArchiveManifest
+	metadataSize      int64
+	metadataSignature []byte
+	dataOffset        int64
+	outDir            string
+	oldDir            string
+	useDiff           bool
+	skipVerify        bool
+	allowUnverifiable bool
+	jobs              int
+	workers           int
+	sparseImage       bool
+	sparseCRC         bool
+	sparseMaxSize     int64
+	compression       string
+	compressionLevel  int
+	results           []PartitionResult
 }
 
-func New(payloadPath, outDir, oldDir string, useDiff bool) (*Dumper, error) {
-	file, closer, err := openPayloadFile(payloadPath)
+type Options struct {
+	OutDir  string
+	OldDir  string
+	UseDiff bool
+	// WarnOnPropertiesMismatch reports payload_properties.txt mismatches
+	// as warnings instead of failing.
+	WarnOnPropertiesMismatch bool
+	// PublicKeys, when set, must verify the payload metadata signature.
+	PublicKeys []PublicKey
+	// ManifestOnly opens the payload just to inspect its manifest: only the
+	// header and manifest are read, and payload_properties.txt and the
+	// metadata signature are not checked.
+	ManifestOnly bool
+	// SkipVerify disables checking extracted images against the
+	// new_partition_info hashes from the manifest.
+	SkipVerify bool
+	// AllowUnverifiable extracts partitions whose hash tree or FEC data the
+	// dumper cannot generate, without that data and without checking them,
+	// instead of failing.
+	AllowUnverifiable bool
+	// Jobs is the number of partitions extracted concurrently. Values
+	// below 1 extract one partition at a time.
+	Jobs int
+	// Workers is the number of operations of a partition processed
+	// concurrently. Values below 1 process one operation at a time.
+	Workers int
+	// SparseImage writes images in the Android sparse format used by
+	// fastboot instead of as raw images.
+	SparseImage bool
+	// SparseCRC adds a CRC32 chunk to sparse images.
+	SparseCRC bool
+	// SparseMaxSize, when set, splits sparse images that are larger into
+	// several files of at most this many bytes.
+	SparseMaxSize int64
+	// Compression, when set to CompressionZstd, CompressionXZ or
+	// CompressionGzip, writes images compressed with that method, as
+	// <name>.img.zst, <name>.img.xz or <name>.img.gz.
+	Compression string
+	// CompressionLevel is the compression level. -1 selects the default of
+	// the method; for xz the level only chooses the dictionary size.
+	CompressionLevel int
+}
+
+func New(payloadPath string, opts Options) (*Dumper, error) {
+	if opts.Compression != "" {
+		if opts.SparseImage {
+			return nil, fmt.Errorf("sparse images cannot be compressed")
+		}
+		cw, err := newCompressor(io.Discard, opts.Compression, opts.CompressionLevel)
+		if err != nil {
+			return nil, err
+		}
+		cw.Close()
+	}
+
+	src, err := openPayloadFile(payloadPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open payload: %w", err)
 	}
 
 	d := &Dumper{
-		payloadFile: file,
-		closer:      closer,
-		outDir:      outDir,
-		oldDir:      oldDir,
-		useDiff:     useDiff,
+		payloadFile:       src.reader,
+		closer:            src.closer,
+		payloadSize:       src.size,
+		remote:            src.remote,
+		properties:        src.properties,
+		outDir:            opts.OutDir,
+		oldDir:            opts.OldDir,
+		useDiff:           opts.UseDiff,
+		skipVerify:        opts.SkipVerify,
+		allowUnverifiable: opts.AllowUnverifiable,
+		jobs:              max(opts.Jobs, 1),
+		workers:           max(opts.Workers, 1),
+		sparseImage:       opts.SparseImage,
+		sparseCRC:         opts.SparseCRC,
+		sparseMaxSize:     opts.SparseMaxSize,
+		compression:       opts.Compression,
+		compressionLevel:  opts.CompressionLevel,
 	}
 
 	if err := d.parseHeader(); err != nil {
-		closer.Close()
+		d.Close()
 		return nil, fmt.Errorf("failed to parse header: %w", err)
 	}
 
+	if opts.ManifestOnly {
+		return d, nil
+	}
+
+	if len(opts.PublicKeys) > 0 {
+		key, err := d.verifyMetadataSignature(opts.PublicKeys)
+		if err != nil {
+			d.Close()
+			return nil, fmt.Errorf("metadata signature verification failed: %w", err)
+		}
+		fmt.Printf("Metadata signature verified with %s\n", key.Name)
+	}
+
+	if d.properties != nil {
+		fmt.Printf("Checking payload against %s\n", src.propertiesPath)
+		if err := d.verifyProperties(); err != nil {
+			if !opts.WarnOnPropertiesMismatch {
+				d.Close()
+				return nil, fmt.Errorf("payload_properties.txt check failed: %w", err)
+			}
+			fmt.Printf("Warning: payload_properties.txt check failed: %v\n", err)
+		}
+	}
+
 	return d, nil
 }
 
@@ -61,104 +168,256 @@ func (d *Dumper) Close() error {
 	return nil
 }
 
-func openPayloadFile(path string) (io.ReadSeeker, io.Closer, error) {
+type payloadSource struct {
+	reader     io.ReaderAt
+	closer     io.Closer
+	size       int64
+	remote     bool
+	properties []byte
+	// propertiesPath names the payload_properties.txt that was found.
+	propertiesPath string
+}
+
+func openPayloadFile(path string) (*payloadSource, error) {
 	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
 		return openRemoteFile(path)
 	}
 	return openLocalFile(path)
 }
 
-func openLocalFile(path string) (io.ReadSeeker, io.Closer, error) {
+func openLocalFile(path string) (*payloadSource, error) {
 	f, err := os.Open(path)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
 	}
 
 	if strings.HasSuffix(strings.ToLower(path), ".zip") {
-		stat, err := f.Stat()
+		src, err := openZipPayload(f, stat.Size())
 		if err != nil {
 			f.Close()
-			return nil, nil, err
+			return nil, err
 		}
+		src.closer = multiCloser{src.closer, f}
+		return src, nil
+	}
 
-		zr, err := zip.NewReader(f, stat.Size())
-		if err != nil {
-			f.Close()
-			return nil, nil, err
+	src := &payloadSource{reader: f, closer: f, size: stat.Size()}
+
+	// A payload_properties.txt next to a bare payload.bin may be left over
+	// from another OTA in the same folder, so it is only used when its
+	// FILE_SIZE matches the payload.
+	propsPath := filepath.Join(filepath.Dir(path), "payload_properties.txt")
+	if props, err := os.ReadFile(propsPath); err == nil {
+		parsed, err := parsePayloadProperties(props)
+		switch {
+		case err != nil:
+			fmt.Printf("Warning: ignoring %s: %v\n", propsPath, err)
+		case parsed.fileSize < 0:
+			fmt.Printf("Warning: ignoring %s: it has no FILE_SIZE to match against the payload\n", propsPath)
+		case parsed.fileSize != stat.Size():
+			fmt.Printf("Warning: ignoring %s: FILE_SIZE %d does not match the payload size %d\n", propsPath, parsed.fileSize, stat.Size())
+		default:
+			src.properties = props
+			src.propertiesPath = propsPath
 		}
+	}
 
-		for _, file := range zr.File {
-			if file.Name == "payload.bin" {
-				rc, err := file.Open()
-				if err != nil {
-					f.Close()
-					return nil, nil, err
-				}
+	return src, nil
+}
 
-				data, err := io.ReadAll(rc)
-				rc.Close()
-				if err != nil {
-					f.Close()
-					return nil, nil, err
-				}
+func openRemoteFile(url string) (*payloadSource, error) {
+	client := &http.Client{}
 
-				f.Close()
-				reader := bytes.NewReader(data)
-				return reader, io.NopCloser(reader), nil
-			}
+	remote, err := newHTTPReaderAt(client, url)
+	if err == errRangeUnsupported {
+		return downloadRemoteFile(client, url)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	closer := closerFunc(func() error {
+		client.CloseIdleConnections()
+		return nil
+	})
+
+	if strings.HasSuffix(strings.ToLower(url), ".zip") {
+		src, err := openZipPayload(remote, remote.Size())
+		if err != nil {
+			closer.Close()
+			return nil, err
 		}
-		f.Close()
-		return nil, nil, fmt.Errorf("payload.bin not found in zip")
+		src.closer = multiCloser{src.closer, closer}
+		src.remote = true
+		return src, nil
 	}
 
-	return f, f, nil
+	return &payloadSource{
+		reader: io.NewSectionReader(remote, 0, remote.Size()),
+		closer: closer,
+		size:   remote.Size(),
+		remote: true,
+	}, nil
 }
 
-func openRemoteFile(url string) (io.ReadSeeker, io.Closer, error) {
-	resp, err := http.Get(url)
+func downloadRemoteFile(client *http.Client, url string) (*payloadSource, error) {
+	resp, err := client.Get(url)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download failed: %s", resp.Status)
 	}
 
-	data, err := io.ReadAll(resp.Body)
-	resp.Body.Close()
+	tmp, err := spoolToTemp(resp.Body)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+
+	stat, err := tmp.Stat()
+	if err != nil {
+		tmp.Close()
+		return nil, err
 	}
 
 	if strings.HasSuffix(strings.ToLower(url), ".zip") {
-		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		src, err := openZipPayload(tmp, stat.Size())
 		if err != nil {
-			return nil, nil, err
+			tmp.Close()
+			return nil, err
 		}
+		src.closer = multiCloser{src.closer, tmp}
+		return src, nil
+	}
 
-		for _, file := range zr.File {
-			if file.Name == "payload.bin" {
-				rc, err := file.Open()
-				if err != nil {
-					return nil, nil, err
-				}
+	return &payloadSource{reader: tmp, closer: tmp, size: stat.Size()}, nil
+}
 
-				payloadData, err := io.ReadAll(rc)
-				rc.Close()
-				if err != nil {
-					return nil, nil, err
-				}
+func openZipPayload(r io.ReaderAt, size int64) (*payloadSource, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
 
-				reader := bytes.NewReader(payloadData)
-				return reader, io.NopCloser(reader), nil
+	var payload *zip.File
+	var properties []byte
+	for _, file := range zr.File {
+		switch file.Name {
+		case "payload.bin":
+			payload = file
+		case "payload_properties.txt":
+			if properties, err = readZipFile(file); err != nil {
+				return nil, err
 			}
 		}
-		return nil, nil, fmt.Errorf("payload.bin not found in zip")
 	}
 
-	reader := bytes.NewReader(data)
-	return reader, io.NopCloser(reader), nil
+	if payload == nil {
+		return nil, fmt.Errorf("payload.bin not found in zip")
+	}
+
+	src := &payloadSource{
+		size:       int64(payload.UncompressedSize64),
+		properties: properties,
+	}
+	if properties != nil {
+		src.propertiesPath = "payload_properties.txt in the zip"
+	}
+
+	if payload.Method == zip.Store {
+		offset, err := payload.DataOffset()
+		if err != nil {
+			return nil, err
+		}
+		src.reader = io.NewSectionReader(r, offset, src.size)
+		src.closer = io.NopCloser(nil)
+		return src, nil
+	}
+
+	rc, err := payload.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	tmp, err := spoolToTemp(rc)
+	if err != nil {
+		return nil, err
+	}
+	src.reader = tmp
+	src.closer = tmp
+	return src, nil
+}
+
+func readZipFile(file *zip.File) ([]byte, error) {
+	rc, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+type tempFile struct {
+	*os.File
+}
+
+func spoolToTemp(r io.Reader) (*tempFile, error) {
+	f, err := os.CreateTemp("", "payload-*.bin")
+	if err != nil {
+		return nil, err
+	}
+	tmp := &tempFile{f}
+
+	if _, err := io.Copy(f, r); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+
+	return tmp, nil
+}
+
+func (t *tempFile) Close() error {
+	err := t.File.Close()
+	os.Remove(t.Name())
+	return err
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+type multiCloser []io.Closer
+
+func (m multiCloser) Close() error {
+	var firstErr error
+	for _, c := range m {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
 
 func (d *Dumper) parseHeader() error {
+	r := io.NewSectionReader(d.payloadFile, 0, d.payloadSize)
+
 	magic := make([]byte, 4)
-	if _, err := io.ReadFull(d.payloadFile, magic); err != nil {
+	if _, err := io.ReadFull(r, magic); err != nil {
 		return err
 	}
 	if string(magic) != Magic {
@@ -166,7 +425,7 @@ func (d *Dumper) parseHeader() error {
 	}
 
 	var fileFormatVersion uint64
-	if err := binary.Read(d.payloadFile, binary.BigEndian, &fileFormatVersion); err != nil {
+	if err := binary.Read(r, binary.BigEndian, &fileFormatVersion); err != nil {
 		return err
 	}
 	if fileFormatVersion != FileFormatV2 {
@@ -174,27 +433,28 @@ func (d *Dumper) parseHeader() error {
 	}
 
 	var manifestSize uint64
-	if err := binary.Read(d.payloadFile, binary.BigEndian, &manifestSize); err != nil {
+	if err := binary.Read(r, binary.BigEndian, &manifestSize); err != nil {
 		return err
 	}
 
 	var metadataSignatureSize uint32
-	if err := binary.Read(d.payloadFile, binary.BigEndian, &metadataSignatureSize); err != nil {
+	if err := binary.Read(r, binary.BigEndian, &metadataSignatureSize); err != nil {
 		return err
 	}
 
+	d.metadataSize = int64(len(Magic)+8+8+4) + int64(manifestSize)
+
 	manifestData := make([]byte, manifestSize)
-	if _, err := io.ReadFull(d.payloadFile, manifestData); err != nil {
+	if _, err := io.ReadFull(r, manifestData); err != nil {
 		return err
 	}
 
-	if metadataSignatureSize > 0 {
-		if _, err := d.payloadFile.Seek(int64(metadataSignatureSize), io.SeekCurrent); err != nil {
-			return err
-		}
+	d.metadataSignature = make([]byte, metadataSignatureSize)
+	if _, err := io.ReadFull(r, d.metadataSignature); err != nil {
+		return err
 	}
 
-	d.dataOffset, _ = d.payloadFile.Seek(0, io.SeekCurrent)
+	d.dataOffset, _ = r.Seek(0, io.SeekCurrent)
 
 	d.manifest = &pb.DeltaArchiveManifest{}
 	if err := proto.Unmarshal(manifestData, d.manifest); err != nil {
@@ -204,6 +464,9 @@ func (d *Dumper) parseHeader() error {
 	return nil
 }
 
+// Extract writes the selected partitions, or all of them when images is
+// empty, to the output directory. Up to Options.Jobs partitions are
+// extracted at once; after the first failure no new partitions are started.
 func (d *Dumper) Extract(images []string) error {
 	blockSize := uint64(4096)
 	if d.manifest.BlockSize != nil {
@@ -218,13 +481,43 @@ func (d *Dumper) Extract(images []string) error {
 		}
 	}
 
-	for i, part := range partitions {
-		if err := d.dumpPartition(part, blockSize, i+1, len(partitions)); err != nil {
-			return fmt.Errorf("failed to dump partition %s: %w", *part.PartitionName, err)
+	jobs := min(d.jobs, len(partitions))
+	prog := newProgress(os.Stdout, jobs)
+	results := make([]*PartitionResult, len(partitions))
+	errs := make([]error, len(partitions))
+
+	var wg sync.WaitGroup
+	var failed atomic.Bool
+	next := make(chan int)
+	for range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				part := partitions[i]
+				results[i], errs[i] = d.dumpPartition(part, blockSize, prog)
+				if errs[i] != nil {
+					errs[i] = fmt.Errorf("failed to dump partition %s: %w", *part.PartitionName, errs[i])
+					failed.Store(true)
+				}
+			}
+		}()
+	}
+	for i := range partitions {
+		if failed.Load() {
+			break
 		}
+		next <- i
 	}
+	close(next)
+	wg.Wait()
 
-	return nil
+	for _, r := range results {
+		if r != nil {
+			d.results = append(d.results, *r)
+		}
+	}
+	return errors.Join(errs...)
 }
 
 func (d *Dumper) filterPartitions(images []string) []*pb.PartitionUpdate {
@@ -243,23 +536,55 @@ func (d *Dumper) filterPartitions(images []string) []*pb.PartitionUpdate {
 	return result
 }
 
-func (d *Dumper) dumpPartition(part *pb.PartitionUpdate, blockSize uint64, current, total int) error {
+// dumpPartition extracts a single partition. The result is returned even
+// when output verification fails, so the mismatch shows up in the summary.
+func (d *Dumper) dumpPartition(part *pb.PartitionUpdate, blockSize uint64, prog *progress) (*PartitionResult, error) {
 	partName := *part.PartitionName
 	totalOps := len(part.Operations)
 
+	var oldFile *os.File
+	if d.useDiff && needsBaseImage(part) {
+		oldPath := filepath.Join(d.oldDir, partName+".img")
+		f, err := os.Open(oldPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open base image: %w", err)
+		}
+		defer f.Close()
+		oldFile = f
+
+		prog.note("Checking base image '%s'...", oldPath)
+		if err := verifyBaseImage(oldFile, part.OldPartitionInfo); err != nil {
+			prog.endLine()
+			return nil, fmt.Errorf("base image mismatch for %s: %w", partName, err)
+		}
+	}
+
+	// Sparse and compressed images are converted from a raw image extracted
+	// next to them.
 	outPath := filepath.Join(d.outDir, partName+".img")
-	outFile, err := os.Create(outPath)
+	var f *os.File
+	var err error
+	if d.sparseImage || d.compression != "" {
+		f, err = os.CreateTemp(d.outDir, "."+partName+"-*.img")
+		if err == nil {
+			defer os.Remove(f.Name())
+		}
+	} else {
+		f, err = os.Create(outPath)
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer outFile.Close()
+	defer f.Close()
 
-	var oldFile *os.File
-	if d.useDiff {
-		oldPath := filepath.Join(d.oldDir, partName+".img")
-		oldFile, _ = os.Open(oldPath)
-		if oldFile != nil {
-			defer oldFile.Close()
+	inPlace := d.manifest.GetMinorVersion() == inPlaceMinorVersion && oldFile != nil
+	outFile := &outputImage{File: f, sparse: !inPlace}
+	if inPlace {
+		if _, err := oldFile.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(outFile, oldFile); err != nil {
+			return nil, fmt.Errorf("failed to copy base image: %w", err)
 		}
 	}
 
@@ -269,90 +594,115 @@ func (d *Dumper) dumpPartition(part *pb.PartitionUpdate, blockSize uint64, curre
 	} else {
 		for _, op := range part.Operations {
 			for _, extent := range op.DstExtents {
-				if extent.NumBlocks != nil {
-					totalSize += *extent.NumBlocks * blockSize
+				if extent.StartBlock != nil && extent.NumBlocks != nil {
+					totalSize = max(totalSize, (*extent.StartBlock+*extent.NumBlocks)*blockSize)
 				}
 			}
 		}
 	}
 
+	// Operations write anywhere in the image, possibly concurrently, so the
+	// output is sized up front instead of growing with each write. Blocks
+	// that are never written, zeroed or discarded stay holes.
+	if outFile.sparse {
+		if err := outFile.Truncate(int64(totalSize)); err != nil {
+			return nil, err
+		}
+	}
+
 	startTime := time.Now()
-	var processedSize uint64
 
-	fmt.Printf("Processing '%s' partitions [%s]   0%% | 0B/%s | Elapsed: 00:00:00 | ETA: --:--:--\r", 
-		partName, strings.Repeat("-", 30), formatBytes(totalSize))
+	bar := prog.start(partName, totalOps, totalSize)
 
-	for i, op := range part.Operations {
-		if err := d.processOperation(op, outFile, oldFile, blockSize); err != nil {
-			return err
-		}
+	discardedSize, err := d.applyOperations(part, outFile, oldFile, inPlace, blockSize, bar)
+	if err != nil {
+		bar.fail()
+		return nil, err
+	}
 
-		for _, extent := range op.DstExtents {
-			if extent.NumBlocks != nil {
-				processedSize += *extent.NumBlocks * blockSize
+	if inPlace {
+		if stat, err := outFile.Stat(); err == nil && stat.Size() > int64(totalSize) {
+			if err := outFile.Truncate(int64(totalSize)); err != nil {
+				bar.fail()
+				return nil, err
 			}
 		}
+	}
 
-		progress := float64(i+1) / float64(totalOps) * 100
-		barLength := 30
-		filled := int(float64(barLength) * float64(i+1) / float64(totalOps))
+	// new_partition_info covers the verity data that update_engine writes
+	// after the operations, so it is generated before verification. An
+	// image without it is incomplete, so it is only kept, as unverifiable,
+	// when that was asked for.
+	verityErr := writeHashTree(f, part, blockSize)
+	if verityErr == nil {
+		verityErr = writeFEC(f, part, blockSize, d.workers)
+	}
+	if verityErr != nil && !(d.allowUnverifiable && errors.Is(verityErr, errVerityUnsupported)) {
+		bar.fail()
+		return nil, fmt.Errorf("failed to generate verity data: %w", verityErr)
+	}
 
-		var bar string
-		if filled > 0 {
-			bar = strings.Repeat("=", filled-1) + ">" + strings.Repeat("-", barLength-filled)
-		} else {
-			bar = strings.Repeat("-", barLength)
-		}
+	result := &PartitionResult{Name: partName, Size: totalSize, Discarded: discardedSize, Verification: VerificationSkipped}
+	switch {
+	case d.skipVerify:
+	case verityErr != nil:
+		result.Verification = VerificationUnverifiable
+	default:
+		result.Verification, err = verifyImage(f, part.NewPartitionInfo)
+	}
+	result.Duration = time.Since(startTime)
+	if err != nil {
+		bar.fail()
+		return result, fmt.Errorf("output verification failed: %w", err)
+	}
 
-		elapsed := time.Since(startTime)
-		elapsedStr := formatDuration(elapsed)
-
-		var etaStr string
-		if i > 0 {
-			avgTimePerOp := elapsed / time.Duration(i+1)
-			remainingOps := totalOps - (i + 1)
-			eta := avgTimePerOp * time.Duration(remainingOps)
-			etaStr = formatDuration(eta)
-		} else {
-			etaStr = "--:--:--"
+	switch {
+	case d.sparseImage:
+		blocks := uint32((totalSize + blockSize - 1) / blockSize)
+		care := sparseCareMap(part, blockSize, blocks, inPlace)
+		result.OutputSize, err = writeSparseImage(outPath, f, int64(totalSize), uint32(blockSize), care, d.sparseCRC, d.sparseMaxSize)
+		if err != nil {
+			err = fmt.Errorf("failed to write sparse image: %w", err)
+		}
+	case d.compression != "":
+		ext, _ := compressedExtension(d.compression)
+		result.OutputSize, err = writeCompressedImage(outPath+ext, f, int64(totalSize), d.compression, d.compressionLevel)
+		if err != nil {
+			err = fmt.Errorf("failed to write compressed image: %w", err)
 		}
-
-		processedSizeStr := formatBytes(processedSize)
-		totalSizeStr := formatBytes(totalSize)
-		
-		fmt.Printf("Processing '%s' partitions [%s] %3.0f%% | %s/%s | Elapsed: %s | ETA: %s\r", 
-			partName, bar, progress, processedSizeStr, totalSizeStr, elapsedStr, etaStr)
+	}
+	result.Duration = time.Since(startTime)
+	if err != nil {
+		bar.fail()
+		return result, err
 	}
 
-	totalTime := time.Since(startTime)
-	totalTimeStr := formatDuration(totalTime)
-
-	fmt.Printf("Processing '%s' partitions [%s] ✓ Done | %s | Time: %s          \n", 
-		partName, strings.Repeat("=", 30), formatBytes(totalSize), totalTimeStr)
+	bar.done()
 
-	return nil
+	return result, nil
 }
 
-func (d *Dumper) processOperation(op *pb.InstallOperation, outFile, oldFile *os.File, blockSize uint64) error {
-	var data []byte
-	if op.DataLength != nil && *op.DataLength > 0 {
-		if _, err := d.payloadFile.Seek(d.dataOffset+int64(*op.DataOffset), io.SeekStart); err != nil {
-			return err
-		}
-		data = make([]byte, *op.DataLength)
-		if _, err := io.ReadFull(d.payloadFile, data); err != nil {
-			return err
-		}
+func (d *Dumper) processOperation(op *pb.InstallOperation, outFile *outputImage, oldFile *os.File, blockSize uint64) error {
+	if isInPlaceOperation(op) && d.manifest.GetMinorVersion() != inPlaceMinorVersion {
+		return fmt.Errorf("%v operations are only valid in minor version %d payloads, this one is version %d",
+			op.GetType(), inPlaceMinorVersion, d.manifest.GetMinorVersion())
+	}
 
-		if op.DataSha256Hash != nil {
-			hash := sha256.Sum256(data)
-			if !bytes.Equal(hash[:], op.DataSha256Hash) {
-				return fmt.Errorf("data hash mismatch")
-			}
-		}
+	if op.DataLength == nil || *op.DataLength == 0 {
+		return processOperationType(op, bytes.NewReader(nil), outFile, oldFile, blockSize)
 	}
 
-	return processOperationType(op, data, outFile, oldFile, blockSize)
+	blob := io.NewSectionReader(d.payloadFile, d.dataOffset+int64(*op.DataOffset), int64(*op.DataLength))
+	data := newHashingReader(blob, op.DataSha256Hash)
+
+	err := processOperationType(op, data, outFile, oldFile, blockSize)
+
+	// The hash covers the whole blob, including anything a decoder left
+	// unread. A mismatch also explains most decoder errors, so it wins.
+	if herr := data.drain(); herr != nil {
+		return herr
+	}
+	return err
 }
 
 func formatDuration(d time.Duration) string {
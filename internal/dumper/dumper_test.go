@@ -0,0 +1,84 @@
+package dumper
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/OhMyDitzzy/go-payload-dumper/protos"
+	"google.golang.org/protobuf/proto"
+)
+
+// replaceOp returns a REPLACE operation writing data, which starts at offset
+// in the payload's data blobs, to the given blocks.
+func replaceOp(data []byte, offset, start, blocks uint64) *pb.InstallOperation {
+	sum := sha256.Sum256(data)
+	return &pb.InstallOperation{
+		Type:           pb.InstallOperation_REPLACE.Enum(),
+		DataOffset:     proto.Uint64(offset),
+		DataLength:     proto.Uint64(uint64(len(data))),
+		DataSha256Hash: sum[:],
+		DstExtents:     []*pb.Extent{testExtent(start, blocks)},
+	}
+}
+
+// newTestDumper returns a Dumper extracting the payload with the given
+// manifest and data blobs to a temporary directory.
+func newTestDumper(t *testing.T, manifest *pb.DeltaArchiveManifest, blobs []byte) *Dumper {
+	t.Helper()
+
+	return &Dumper{
+		payloadFile: bytes.NewReader(blobs),
+		payloadSize: int64(len(blobs)),
+		manifest:    manifest,
+		outDir:      t.TempDir(),
+		jobs:        1,
+		workers:     1,
+	}
+}
+
+func TestDumpPartitionUnsupportedVerity(t *testing.T) {
+	data := testCorpus(4 * 4096)
+	image := append(bytes.Clone(data), make([]byte, 2*4096)...)
+	sum := sha256.Sum256(image)
+
+	// The hash tree uses an algorithm the dumper cannot generate.
+	part := &pb.PartitionUpdate{
+		PartitionName:      proto.String("system"),
+		Operations:         []*pb.InstallOperation{replaceOp(data, 0, 0, 4)},
+		NewPartitionInfo:   &pb.PartitionInfo{Size: proto.Uint64(uint64(len(image))), Hash: sum[:]},
+		HashTreeDataExtent: testExtent(0, 4),
+		HashTreeExtent:     testExtent(4, 2),
+		HashTreeAlgorithm:  proto.String("md5"),
+	}
+
+	for _, allow := range []bool{false, true} {
+		d := newTestDumper(t, &pb.DeltaArchiveManifest{}, data)
+		d.allowUnverifiable = allow
+
+		result, err := d.dumpPartition(part, 4096, newProgress(io.Discard, 1))
+		if !allow {
+			if !errors.Is(err, errVerityUnsupported) {
+				t.Fatalf("err = %v, want %v", err, errVerityUnsupported)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Verification != VerificationUnverifiable {
+			t.Fatalf("verification = %q, want %q", result.Verification, VerificationUnverifiable)
+		}
+		got, err := os.ReadFile(filepath.Join(d.outDir, "system.img"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, image) {
+			t.Fatal("image does not match")
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package dumper
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	pb "github.com/OhMyDitzzy/go-payload-dumper/protos"
+)
+
+// Forward error correction as written by libfec and update_engine: a
+// Reed-Solomon RS(255, 255-roots) code over GF(2^8) with the generator
+// polynomial 0x11d, first consecutive root 0 and primitive element 1.
+const (
+	fecRSM        = 255
+	fecGFPoly     = 0x11d
+	fecBlockSize  = 4096
+	fecMagic      = 0xfecfecfe
+	fecHeaderSize = 60
+)
+
+// rsEncoder is a systematic Reed-Solomon encoder, a port of Phil Karn's
+// encode_rs_char that libfec uses.
+type rsEncoder struct {
+	nroots  int
+	alphaTo [fecRSM + 1]byte
+	indexOf [fecRSM + 1]int
+	genpoly []int
+}
+
+func newRSEncoder(nroots int) *rsEncoder {
+	rs := &rsEncoder{nroots: nroots}
+
+	rs.indexOf[0] = fecRSM
+	rs.alphaTo[fecRSM] = 0
+	sr := 1
+	for i := 0; i < fecRSM; i++ {
+		rs.indexOf[sr] = i
+		rs.alphaTo[i] = byte(sr)
+		sr <<= 1
+		if sr&0x100 != 0 {
+			sr ^= fecGFPoly
+		}
+		sr &= fecRSM
+	}
+
+	genpoly := make([]int, nroots+1)
+	genpoly[0] = 1
+	for i, root := 0, 0; i < nroots; i, root = i+1, root+1 {
+		genpoly[i+1] = 1
+		for j := i; j > 0; j-- {
+			if genpoly[j] != 0 {
+				genpoly[j] = genpoly[j-1] ^ int(rs.alphaTo[(rs.indexOf[genpoly[j]]+root)%fecRSM])
+			} else {
+				genpoly[j] = genpoly[j-1]
+			}
+		}
+		genpoly[0] = int(rs.alphaTo[(rs.indexOf[genpoly[0]]+root)%fecRSM])
+	}
+	for i := range genpoly {
+		genpoly[i] = rs.indexOf[genpoly[i]]
+	}
+	rs.genpoly = genpoly
+
+	return rs
+}
+
+// encode computes the nroots parity bytes of the 255-nroots bytes of data.
+func (rs *rsEncoder) encode(data, parity []byte) {
+	clear(parity)
+	for _, b := range data {
+		feedback := rs.indexOf[b^parity[0]]
+		if feedback != fecRSM {
+			for j := 1; j < rs.nroots; j++ {
+				parity[j] ^= rs.alphaTo[(feedback+rs.genpoly[rs.nroots-j])%fecRSM]
+			}
+		}
+		copy(parity, parity[1:])
+		if feedback != fecRSM {
+			parity[rs.nroots-1] = rs.alphaTo[(feedback+rs.genpoly[0])%fecRSM]
+		} else {
+			parity[rs.nroots-1] = 0
+		}
+	}
+}
+
+// writeFEC computes the forward error correction data of the partition's
+// fec_data_extent and writes it to fec_extent, like update_engine does on the
+// device after writing the hash tree.
+//
+// The code is interleaved over the whole input: round i of the encoding takes
+// byte k of the blocks i, i+rounds, i+2*rounds, ... as the message of its
+// k-th codeword, so a damaged block only costs one byte of each codeword. The
+// rounds are independent and are spread over workers.
+func writeFEC(f *os.File, part *pb.PartitionUpdate, blockSize uint64, workers int) error {
+	dataExt, fecExt := part.FecDataExtent, part.FecExtent
+	if fecExt.GetNumBlocks() == 0 {
+		return nil
+	}
+
+	roots := int(part.GetFecRoots())
+	if roots <= 0 || roots >= fecRSM {
+		return fmt.Errorf("%w: %d FEC roots", errVerityUnsupported, roots)
+	}
+	if blockSize != fecBlockSize {
+		return fmt.Errorf("%w: FEC needs %d byte blocks, the payload uses %d", errVerityUnsupported, fecBlockSize, blockSize)
+	}
+
+	rsN := uint64(fecRSM - roots)
+	dataBlocks := dataExt.GetNumBlocks()
+	dataOffset := int64(dataExt.GetStartBlock() * blockSize)
+	rounds := (dataBlocks + rsN - 1) / rsN
+
+	// libfec appends a header block to the parity data. avbtool strips it
+	// again, so it is only written when the extent has room for it.
+	fecSize := rounds * uint64(roots) * blockSize
+	extentSize := fecExt.GetNumBlocks() * blockSize
+	if extentSize != fecSize && extentSize != fecSize+fecBlockSize {
+		return fmt.Errorf("%w: FEC extent holds %d bytes, %d rounds of %d roots need %d", errVerityUnsupported, extentSize, rounds, roots, fecSize)
+	}
+	fecOffset := int64(fecExt.GetStartBlock() * blockSize)
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	next := make(chan uint64)
+	for range max(workers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rs := newRSEncoder(roots)
+			block := make([]byte, blockSize)
+			message := make([]byte, blockSize*rsN)
+			parity := make([]byte, blockSize*uint64(roots))
+			for i := range next {
+				err := encodeFECRound(f, rs, i, rounds, dataBlocks, dataOffset, block, message, parity)
+				if err == nil {
+					_, err = f.WriteAt(parity, fecOffset+int64(i)*int64(len(parity)))
+				}
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for i := uint64(0); i < rounds; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+
+	if extentSize == fecSize {
+		return nil
+	}
+	header, err := fecHeader(f, fecOffset, fecSize, roots, dataBlocks*blockSize)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(header, fecOffset+int64(fecSize))
+	return err
+}
+
+// encodeFECRound computes the parity of one round. Blocks past the end of
+// the data are treated as zeros.
+func encodeFECRound(r io.ReaderAt, rs *rsEncoder, round, rounds, dataBlocks uint64, dataOffset int64, block, message, parity []byte) error {
+	blockSize := uint64(len(block))
+	rsN := uint64(len(message)) / blockSize
+	roots := uint64(rs.nroots)
+
+	for j := uint64(0); j < rsN; j++ {
+		if index := j*rounds + round; index < dataBlocks {
+			if _, err := r.ReadAt(block, dataOffset+int64(index*blockSize)); err != nil {
+				return err
+			}
+		} else {
+			clear(block)
+		}
+		for k, b := range block {
+			message[uint64(k)*rsN+j] = b
+		}
+	}
+
+	for k := uint64(0); k < blockSize; k++ {
+		rs.encode(message[k*rsN:(k+1)*rsN], parity[k*roots:(k+1)*roots])
+	}
+	return nil
+}
+
+// fecHeader builds libfec's header block: a fec_header at its start and a
+// copy at its end.
+func fecHeader(r io.ReaderAt, fecOffset int64, fecSize uint64, roots int, inputSize uint64) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r, fecOffset, int64(fecSize))); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, fecHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:], fecMagic)
+	binary.LittleEndian.PutUint32(header[4:], 0)
+	binary.LittleEndian.PutUint32(header[8:], fecHeaderSize)
+	binary.LittleEndian.PutUint32(header[12:], uint32(roots))
+	binary.LittleEndian.PutUint32(header[16:], uint32(fecSize))
+	binary.LittleEndian.PutUint64(header[20:], inputSize)
+	copy(header[28:], h.Sum(nil))
+
+	block := make([]byte, fecBlockSize)
+	copy(block, header)
+	copy(block[fecBlockSize-fecHeaderSize:], header)
+	return block, nil
+}
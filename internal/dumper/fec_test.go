@@ -0,0 +1,86 @@
+package dumper
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	pb "github.com/OhMyDitzzy/go-payload-dumper/protos"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestWriteFECGolden(t *testing.T) {
+	// FEC covers the data and the sha256 hash tree after it, see
+	// testdata/verity/gen.py.
+	image := append(verityTestData(), readTestdata(t, "verity/tree-sha256-salt.bin")...)
+	imageBlocks := uint64(len(image)) / 4096
+
+	tests := []struct {
+		name    string
+		roots   uint32
+		golden  string
+		header  bool
+		workers int
+	}{
+		{"2 roots", 2, "fec-2.bin", true, 1},
+		{"2 roots without header", 2, "fec-2.bin", false, 4},
+		{"8 roots", 8, "fec-8.bin", true, 3},
+		{"8 roots without header", 8, "fec-8.bin", false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := readTestdata(t, "verity/"+tt.golden)
+			if !tt.header {
+				want = want[:len(want)-fecBlockSize]
+			}
+			fecBlocks := uint64(len(want)) / 4096
+
+			f := writeTestImage(t, image, imageBlocks+fecBlocks)
+			part := &pb.PartitionUpdate{
+				FecDataExtent: testExtent(0, imageBlocks),
+				FecExtent:     testExtent(imageBlocks, fecBlocks),
+				FecRoots:      proto.Uint32(tt.roots),
+			}
+			if err := writeFEC(f, part, 4096, tt.workers); err != nil {
+				t.Fatal(err)
+			}
+
+			got := make([]byte, len(want))
+			if _, err := f.ReadAt(got, int64(imageBlocks*4096)); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatal("FEC data does not match the golden file")
+			}
+		})
+	}
+}
+
+func TestWriteFECUnsupported(t *testing.T) {
+	tests := []struct {
+		name      string
+		roots     uint32
+		fecBlocks uint64
+		blockSize uint64
+	}{
+		{"no roots", 0, 1, 4096},
+		{"too many roots", 255, 1, 4096},
+		{"extent size", 2, 4, 4096},
+		{"block size", 2, 1, 512},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// One data block needs one round: 2 blocks of parity for 2
+			// roots and the header block, so 4 blocks fit neither layout.
+			f := writeTestImage(t, make([]byte, 4096), 5)
+			part := &pb.PartitionUpdate{
+				FecDataExtent: testExtent(0, 1),
+				FecExtent:     testExtent(1, tt.fecBlocks),
+				FecRoots:      proto.Uint32(tt.roots),
+			}
+			if err := writeFEC(f, part, tt.blockSize, 1); !errors.Is(err, errVerityUnsupported) {
+				t.Fatalf("err = %v, want %v", err, errVerityUnsupported)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package dumper
+
+import (
+	"fmt"
+)
+
+var (
+	lengthBases       = [29]uint16{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	lengthExtraBits   = [29]uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	distanceBases     = [30]uint16{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	distanceExtraBits = [30]uint8{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+	codeLengthOrder   = [19]uint8{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+)
+
+const maxHuffmanBits = 15
+
+// huffmanCode is a canonical deflate Huffman code. codes holds the bit
+// reversed code of every symbol, ready to be written LSB first, and table
+// maps the next maxBits input bits to symbol<<4 | length.
+type huffmanCode struct {
+	lens    []uint8
+	codes   []uint16
+	table   []uint32
+	maxBits uint
+}
+
+func newHuffmanCode(lens []uint8) (*huffmanCode, error) {
+	var count [maxHuffmanBits + 1]int
+	maxBits := uint(0)
+	for _, l := range lens {
+		if l > maxHuffmanBits {
+			return nil, fmt.Errorf("invalid huffman code length %d", l)
+		}
+		count[l]++
+		if uint(l) > maxBits {
+			maxBits = uint(l)
+		}
+	}
+	count[0] = 0
+
+	left := 1
+	for l := 1; l <= maxHuffmanBits; l++ {
+		left <<= 1
+		left -= count[l]
+		if left < 0 {
+			return nil, fmt.Errorf("over-subscribed huffman code")
+		}
+	}
+
+	var next [maxHuffmanBits + 2]uint16
+	code := uint16(0)
+	for l := 1; l <= maxHuffmanBits; l++ {
+		code = (code + uint16(count[l-1])) << 1
+		next[l] = code
+	}
+
+	h := &huffmanCode{
+		lens:    lens,
+		codes:   make([]uint16, len(lens)),
+		table:   make([]uint32, 1<<maxBits),
+		maxBits: maxBits,
+	}
+
+	for sym, l := range lens {
+		if l == 0 {
+			continue
+		}
+		rev := reverseBits(next[l], uint(l))
+		next[l]++
+		h.codes[sym] = rev
+
+		for i := uint32(rev); i < uint32(len(h.table)); i += 1 << l {
+			h.table[i] = uint32(sym)<<4 | uint32(l)
+		}
+	}
+
+	return h, nil
+}
+
+func reverseBits(code uint16, n uint) uint16 {
+	var rev uint16
+	for i := uint(0); i < n; i++ {
+		rev = rev<<1 | code&1
+		code >>= 1
+	}
+	return rev
+}
+
+func (h *huffmanCode) decode(br *bitReader) (int, error) {
+	br.fill(h.maxBits)
+	entry := h.table[br.peek(h.maxBits)]
+	if entry == 0 {
+		return 0, fmt.Errorf("invalid huffman code")
+	}
+
+	n := uint(entry & 0xF)
+	if n > br.nbits {
+		return 0, fmt.Errorf("unexpected end of deflate stream")
+	}
+	br.drop(n)
+	return int(entry >> 4), nil
+}
+
+func (h *huffmanCode) encode(bw *bitWriter, sym int) error {
+	if sym >= len(h.lens) || h.lens[sym] == 0 {
+		return fmt.Errorf("symbol %d has no huffman code", sym)
+	}
+	bw.writeBits(uint32(h.codes[sym]), uint(h.lens[sym]))
+	return nil
+}
+
+var fixedLiteralCode, fixedDistanceCode = func() (*huffmanCode, *huffmanCode) {
+	lens := make([]uint8, 288)
+	for i := range lens {
+		switch {
+		case i < 144:
+			lens[i] = 8
+		case i < 256:
+			lens[i] = 9
+		case i < 280:
+			lens[i] = 7
+		default:
+			lens[i] = 8
+		}
+	}
+	lit, _ := newHuffmanCode(lens)
+
+	dlens := make([]uint8, 30)
+	for i := range dlens {
+		dlens[i] = 5
+	}
+	dist, _ := newHuffmanCode(dlens)
+
+	return lit, dist
+}()
+
+// bitReader reads deflate's LSB-first bit stream.
+type bitReader struct {
+	data  []byte
+	index int
+	cache uint64
+	nbits uint
+}
+
+func newBitReader(data []byte, bitOffset uint64) *bitReader {
+	br := &bitReader{data: data, index: int(bitOffset / 8)}
+	if skip := uint(bitOffset % 8); skip > 0 {
+		br.fill(skip)
+		br.drop(skip)
+	}
+	return br
+}
+
+func (br *bitReader) fill(n uint) {
+	for br.nbits < n && br.index < len(br.data) {
+		br.cache |= uint64(br.data[br.index]) << br.nbits
+		br.index++
+		br.nbits += 8
+	}
+}
+
+func (br *bitReader) peek(n uint) uint32 {
+	return uint32(br.cache & (1<<n - 1))
+}
+
+func (br *bitReader) drop(n uint) {
+	br.cache >>= n
+	br.nbits -= n
+}
+
+func (br *bitReader) readBits(n uint) (uint32, error) {
+	br.fill(n)
+	if br.nbits < n {
+		return 0, fmt.Errorf("unexpected end of deflate stream")
+	}
+	v := br.peek(n)
+	br.drop(n)
+	return v, nil
+}
+
+// offset returns the position of the next unread bit.
+func (br *bitReader) offset() uint64 {
+	return uint64(br.index)*8 - uint64(br.nbits)
+}
+
+// bitWriter writes deflate's LSB-first bit stream.
+type bitWriter struct {
+	out   []byte
+	cache uint64
+	nbits uint
+}
+
+func (bw *bitWriter) writeBits(v uint32, n uint) {
+	bw.cache |= uint64(v&(1<<n-1)) << bw.nbits
+	bw.nbits += n
+	for bw.nbits >= 8 {
+		bw.out = append(bw.out, byte(bw.cache))
+		bw.cache >>= 8
+		bw.nbits -= 8
+	}
+}
+
+func (bw *bitWriter) offset() uint64 {
+	return uint64(len(bw.out))*8 + uint64(bw.nbits)
+}
+
+// bytes returns everything written so far, zero padding the last byte.
+func (bw *bitWriter) bytes() []byte {
+	if bw.nbits > 0 {
+		return append(bw.out, byte(bw.cache))
+	}
+	return bw.out
+}
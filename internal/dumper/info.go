@@ -0,0 +1,147 @@
+package dumper
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+type ManifestInfo struct {
+	BlockSize              uint32          `json:"block_size"`
+	MinorVersion           uint32          `json:"minor_version"`
+	PartialUpdate          bool            `json:"partial_update"`
+	SecurityPatchLevel     string          `json:"security_patch_level,omitempty"`
+	MaxTimestamp           int64           `json:"max_timestamp,omitempty"`
+	DynamicPartitionGroups []GroupInfo     `json:"dynamic_partition_groups,omitempty"`
+	Partitions             []PartitionInfo `json:"partitions"`
+}
+
+type GroupInfo struct {
+	Name       string   `json:"name"`
+	Size       uint64   `json:"size"`
+	Partitions []string `json:"partitions"`
+}
+
+type PartitionInfo struct {
+	Name           string         `json:"name"`
+	FilesystemType string         `json:"filesystem_type,omitempty"`
+	Version        string         `json:"version,omitempty"`
+	OldSize        uint64         `json:"old_size,omitempty"`
+	OldHash        string         `json:"old_hash,omitempty"`
+	NewSize        uint64         `json:"new_size"`
+	NewHash        string         `json:"new_hash,omitempty"`
+	Operations     int            `json:"operations"`
+	OperationTypes map[string]int `json:"operation_types"`
+	DataSize       uint64         `json:"data_size"`
+}
+
+// Info describes the payload manifest without extracting anything.
+func (d *Dumper) Info() *ManifestInfo {
+	m := d.manifest
+	info := &ManifestInfo{
+		BlockSize:          m.GetBlockSize(),
+		MinorVersion:       m.GetMinorVersion(),
+		PartialUpdate:      m.GetPartialUpdate(),
+		SecurityPatchLevel: m.GetSecurityPatchLevel(),
+		MaxTimestamp:       m.GetMaxTimestamp(),
+		Partitions:         []PartitionInfo{},
+	}
+
+	for _, group := range m.GetDynamicPartitionMetadata().GetGroups() {
+		info.DynamicPartitionGroups = append(info.DynamicPartitionGroups, GroupInfo{
+			Name:       group.GetName(),
+			Size:       group.GetSize(),
+			Partitions: group.GetPartitionNames(),
+		})
+	}
+
+	for _, part := range m.Partitions {
+		p := PartitionInfo{
+			Name:           part.GetPartitionName(),
+			FilesystemType: part.GetFilesystemType(),
+			Version:        part.GetVersion(),
+			OldSize:        part.GetOldPartitionInfo().GetSize(),
+			OldHash:        hex.EncodeToString(part.GetOldPartitionInfo().GetHash()),
+			NewSize:        part.GetNewPartitionInfo().GetSize(),
+			NewHash:        hex.EncodeToString(part.GetNewPartitionInfo().GetHash()),
+			Operations:     len(part.Operations),
+			OperationTypes: make(map[string]int),
+		}
+		for _, op := range part.Operations {
+			p.OperationTypes[op.GetType().String()]++
+			p.DataSize += op.GetDataLength()
+		}
+		info.Partitions = append(info.Partitions, p)
+	}
+
+	return info
+}
+
+func (info *ManifestInfo) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Block size:\t%d\n", info.BlockSize)
+	fmt.Fprintf(tw, "Minor version:\t%d\n", info.MinorVersion)
+	fmt.Fprintf(tw, "Partial update:\t%t\n", info.PartialUpdate)
+	if info.SecurityPatchLevel != "" {
+		fmt.Fprintf(tw, "Security patch level:\t%s\n", info.SecurityPatchLevel)
+	}
+	if info.MaxTimestamp != 0 {
+		fmt.Fprintf(tw, "Max timestamp:\t%d\n", info.MaxTimestamp)
+	}
+
+	if len(info.DynamicPartitionGroups) > 0 {
+		fmt.Fprintf(tw, "\nDynamic partition groups:\n")
+		for _, group := range info.DynamicPartitionGroups {
+			fmt.Fprintf(tw, "  %s\t%s\t%s\n", group.Name, formatBytes(group.Size), strings.Join(group.Partitions, ", "))
+		}
+	}
+
+	fmt.Fprintf(tw, "\nPartitions:\n")
+	fmt.Fprintf(tw, "  NAME\tFS\tOLD SIZE\tNEW SIZE\tDATA\tOPERATIONS\n")
+	for _, part := range info.Partitions {
+		oldSize := "-"
+		if part.OldSize > 0 {
+			oldSize = formatBytes(part.OldSize)
+		}
+		fsType := part.FilesystemType
+		if fsType == "" {
+			fsType = "-"
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\t%s\t%s\n", part.Name, fsType, oldSize,
+			formatBytes(part.NewSize), formatBytes(part.DataSize), formatOperationTypes(part.OperationTypes))
+	}
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\nHashes:\n")
+	for _, part := range info.Partitions {
+		if part.OldHash != "" {
+			fmt.Fprintf(w, "  %s (old): %s\n", part.Name, part.OldHash)
+		}
+		if part.NewHash != "" {
+			fmt.Fprintf(w, "  %s (new): %s\n", part.Name, part.NewHash)
+		}
+	}
+
+	return nil
+}
+
+func formatOperationTypes(counts map[string]int) string {
+	types := make([]string, 0, len(counts))
+	for t := range counts {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+
+	parts := make([]string, len(types))
+	for i, t := range types {
+		parts[i] = fmt.Sprintf("%s:%d", t, counts[t])
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,306 @@
+package dumper
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// LZ4 block format helpers. The compressors are ports of the lz4 1.9.4
+// reference implementation: lz4diff patches are generated against the exact
+// bytes that LZ4_compress_destSize and LZ4_compress_HC_destSize produce, so
+// any deviation in match selection breaks the postfix patches.
+
+const (
+	lz4MinMatch     = 4
+	lz4LastLiterals = 5
+	lz4MFLimit      = 12
+	lz4MinLength    = lz4MFLimit + 1
+	lz4MLBits       = 4
+	lz4MLMask       = 1<<lz4MLBits - 1
+	lz4RunMask      = 1<<(8-lz4MLBits) - 1
+	lz4DistanceMax  = 65535
+	lz4HashLog      = 12
+	lz4SkipTrigger  = 6
+	lz4Limit64K     = 64<<10 + lz4MFLimit - 1
+)
+
+func lz4CompressBound(n int) int {
+	return n + n/255 + 16
+}
+
+// lz4DecompressPartial decodes an LZ4 block until target bytes have been
+// produced, ignoring whatever follows in src.
+func lz4DecompressPartial(src []byte, target int) ([]byte, error) {
+	dst := make([]byte, 0, target)
+	i := 0
+
+	readLength := func(n int) (int, error) {
+		if n != 15 {
+			return n, nil
+		}
+		for {
+			if i >= len(src) {
+				return 0, fmt.Errorf("truncated lz4 block")
+			}
+			b := src[i]
+			i++
+			n += int(b)
+			if b != 255 {
+				return n, nil
+			}
+		}
+	}
+
+	for len(dst) < target {
+		if i >= len(src) {
+			return nil, fmt.Errorf("truncated lz4 block")
+		}
+		token := src[i]
+		i++
+
+		litLen, err := readLength(int(token >> 4))
+		if err != nil {
+			return nil, err
+		}
+		if litLen > len(src)-i {
+			return nil, fmt.Errorf("truncated lz4 block")
+		}
+		dst = append(dst, src[i:i+litLen]...)
+		i += litLen
+		if len(dst) >= target {
+			break
+		}
+
+		if i+2 > len(src) {
+			return nil, fmt.Errorf("truncated lz4 block")
+		}
+		offset := int(binary.LittleEndian.Uint16(src[i:]))
+		i += 2
+		if offset == 0 || offset > len(dst) {
+			return nil, fmt.Errorf("invalid lz4 match offset %d", offset)
+		}
+
+		matchLen, err := readLength(int(token & lz4MLMask))
+		if err != nil {
+			return nil, err
+		}
+		matchLen += lz4MinMatch
+
+		start := len(dst) - offset
+		if offset >= matchLen {
+			dst = append(dst, dst[start:start+matchLen]...)
+		} else {
+			for k := 0; k < matchLen; k++ {
+				dst = append(dst, dst[start+k])
+			}
+		}
+	}
+
+	if len(dst) > target {
+		dst = dst[:target]
+	}
+	return dst, nil
+}
+
+// lz4Count returns how many bytes starting at a and b are equal, without
+// reading at or beyond limit on the a side.
+func lz4Count(src []byte, a, b, limit int) int {
+	n := 0
+	for a+n < limit && src[a+n] == src[b+n] {
+		n++
+	}
+	return n
+}
+
+func lz4Read32(src []byte, i int) uint32 {
+	return binary.LittleEndian.Uint32(src[i:])
+}
+
+func lz4PutLength(dst []byte, op, n int) int {
+	for ; n >= 255; n -= 255 {
+		dst[op] = 255
+		op++
+	}
+	dst[op] = byte(n)
+	return op + 1
+}
+
+// lz4Compressor is LZ4_compress_generic for a single, dictionary-less input.
+type lz4Compressor struct {
+	src   []byte
+	dst   []byte
+	byU16 bool
+	fill  bool
+	table []uint32
+
+	op     int
+	olimit int
+	anchor int
+}
+
+func (c *lz4Compressor) hash(p int) uint32 {
+	if c.byU16 {
+		return (lz4Read32(c.src, p) * 2654435761) >> (32 - (lz4HashLog + 1))
+	}
+	seq := binary.LittleEndian.Uint64(c.src[p:])
+	return uint32(((seq << 24) * 889523592379) >> (64 - lz4HashLog))
+}
+
+// lz4CompressDestSize compresses as much of src as fits into dstSize bytes,
+// like LZ4_compress_destSize. It returns the block and the number of source
+// bytes it covers.
+func lz4CompressDestSize(src []byte, dstSize int) ([]byte, int) {
+	c := &lz4Compressor{
+		src:   src,
+		byU16: len(src) < lz4Limit64K,
+		fill:  dstSize < lz4CompressBound(len(src)),
+	}
+	if c.fill && dstSize < 1 {
+		return nil, 0
+	}
+
+	if c.byU16 {
+		c.table = make([]uint32, 1<<(lz4HashLog+1))
+	} else {
+		c.table = make([]uint32, 1<<lz4HashLog)
+	}
+	c.olimit = dstSize
+	c.dst = make([]byte, lz4CompressBound(len(src))+16)
+
+	if len(src) >= lz4MinLength {
+		c.sequences()
+	}
+
+	src, dst := c.src, c.dst
+	lastRun := len(src) - c.anchor
+	if c.fill && c.op+lastRun+1+(lastRun+255-lz4RunMask)/255 > c.olimit {
+		lastRun = c.olimit - c.op - 1
+		lastRun -= (lastRun + 256 - lz4RunMask) / 256
+	}
+	if lastRun >= lz4RunMask {
+		dst[c.op] = lz4RunMask << lz4MLBits
+		c.op = lz4PutLength(dst, c.op+1, lastRun-lz4RunMask)
+	} else {
+		dst[c.op] = byte(lastRun << lz4MLBits)
+		c.op++
+	}
+	c.op += copy(dst[c.op:], src[c.anchor:c.anchor+lastRun])
+
+	return dst[:c.op], c.anchor + lastRun
+}
+
+func (c *lz4Compressor) sequences() {
+	src, dst := c.src, c.dst
+	iend := len(src)
+	mflimitPlusOne := iend - lz4MFLimit + 1
+	matchlimit := iend - lz4LastLiterals
+
+	c.table[c.hash(0)] = 0
+	ip := 1
+	forwardH := c.hash(ip)
+
+	for {
+		var match int
+
+		forwardIp := ip
+		step := 1
+		searchMatchNb := 1 << lz4SkipTrigger
+		for {
+			h := forwardH
+			current := forwardIp
+			matchIndex := int(c.table[h])
+			ip = forwardIp
+			forwardIp += step
+			step = searchMatchNb >> lz4SkipTrigger
+			searchMatchNb++
+
+			if forwardIp > mflimitPlusOne {
+				return
+			}
+
+			match = matchIndex
+			forwardH = c.hash(forwardIp)
+			c.table[h] = uint32(current)
+
+			if !c.byU16 && matchIndex+lz4DistanceMax < current {
+				continue
+			}
+			if lz4Read32(src, match) == lz4Read32(src, ip) {
+				break
+			}
+		}
+
+		filledIp := ip
+		for ip > c.anchor && match > 0 && src[ip-1] == src[match-1] {
+			ip--
+			match--
+		}
+
+		litLength := ip - c.anchor
+		token := c.op
+		c.op++
+		if c.fill && c.op+(litLength+240)/255+litLength+2+1+lz4MFLimit-lz4MinMatch > c.olimit {
+			c.op--
+			return
+		}
+		if litLength >= lz4RunMask {
+			dst[token] = lz4RunMask << lz4MLBits
+			c.op = lz4PutLength(dst, c.op, litLength-lz4RunMask)
+		} else {
+			dst[token] = byte(litLength << lz4MLBits)
+		}
+		c.op += copy(dst[c.op:], src[c.anchor:ip])
+
+		for {
+			if c.fill && c.op+2+1+lz4MFLimit-lz4MinMatch > c.olimit {
+				c.op = token
+				return
+			}
+
+			binary.LittleEndian.PutUint16(dst[c.op:], uint16(ip-match))
+			c.op += 2
+
+			matchCode := lz4Count(src, ip+lz4MinMatch, match+lz4MinMatch, matchlimit)
+			ip += matchCode + lz4MinMatch
+
+			if c.fill && c.op+1+lz4LastLiterals+(matchCode+240)/255 > c.olimit {
+				newMatchCode := 15 - 1 + (c.olimit-c.op-1-lz4LastLiterals)*255
+				ip -= matchCode - newMatchCode
+				matchCode = newMatchCode
+				if ip <= filledIp {
+					for p := ip; p <= filledIp; p++ {
+						c.table[c.hash(p)] = 0
+					}
+				}
+			}
+			if matchCode >= lz4MLMask {
+				dst[token] += lz4MLMask
+				c.op = lz4PutLength(dst, c.op, matchCode-lz4MLMask)
+			} else {
+				dst[token] += byte(matchCode)
+			}
+
+			c.anchor = ip
+			if ip >= mflimitPlusOne {
+				return
+			}
+
+			c.table[c.hash(ip-2)] = uint32(ip - 2)
+
+			h := c.hash(ip)
+			matchIndex := int(c.table[h])
+			match = matchIndex
+			c.table[h] = uint32(ip)
+			if (c.byU16 || matchIndex+lz4DistanceMax >= ip) && lz4Read32(src, match) == lz4Read32(src, ip) {
+				token = c.op
+				c.op++
+				dst[token] = 0
+				continue
+			}
+			break
+		}
+
+		ip++
+		forwardH = c.hash(ip)
+	}
+}
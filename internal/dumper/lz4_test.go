@@ -0,0 +1,218 @@
+package dumper
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The golden data in testdata/lz4 comes from lz4 1.9.4:
+//
+//	lz4 -B4 -1 input.bin input.B4-1.lz4 (likewise -B4/-B5 with -1, -9, -12)
+//	python3 gen_destsize.py liblz4.so.1.9.4
+//	python3 gen_lz4diff.py liblz4.so.1.9.4
+
+func readTestdata(t *testing.T, name string) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// lz4FrameBlocks returns the data blocks of an LZ4 frame and whether each
+// one is stored uncompressed.
+func lz4FrameBlocks(t *testing.T, frame []byte) (blocks [][]byte, raw []bool) {
+	t.Helper()
+
+	if len(frame) < 7 || binary.LittleEndian.Uint32(frame) != 0x184D2204 {
+		t.Fatal("not an LZ4 frame")
+	}
+	flg := frame[4]
+	pos := 7
+	if flg&0x08 != 0 {
+		pos += 8
+	}
+	if flg&0x01 != 0 {
+		pos += 4
+	}
+
+	for {
+		size := binary.LittleEndian.Uint32(frame[pos:])
+		pos += 4
+		if size == 0 {
+			return blocks, raw
+		}
+		n := int(size &^ (1 << 31))
+		blocks = append(blocks, frame[pos:pos+n])
+		raw = append(raw, size&(1<<31) != 0)
+		pos += n
+		if flg&0x10 != 0 {
+			pos += 4
+		}
+	}
+}
+
+func lz4Compress(src []byte, dstSize, level int) ([]byte, int) {
+	if level < 3 {
+		return lz4CompressDestSize(src, dstSize)
+	}
+	return lz4hcCompressDestSize(src, dstSize, level)
+}
+
+func TestLZ4FrameGolden(t *testing.T) {
+	input := readTestdata(t, "lz4/input.bin")
+
+	tests := []struct {
+		frame     string
+		blockSize int
+		level     int
+	}{
+		{"input.B4-1.lz4", 64 << 10, 1},
+		{"input.B4-9.lz4", 64 << 10, 9},
+		{"input.B4-12.lz4", 64 << 10, 12},
+		{"input.B5-1.lz4", 256 << 10, 1},
+		{"input.B5-9.lz4", 256 << 10, 9},
+		{"input.B5-12.lz4", 256 << 10, 12},
+	}
+	for _, tt := range tests {
+		t.Run(tt.frame, func(t *testing.T) {
+			blocks, raw := lz4FrameBlocks(t, readTestdata(t, "lz4/"+tt.frame))
+			if want := (len(input) + tt.blockSize - 1) / tt.blockSize; len(blocks) != want {
+				t.Fatalf("frame has %d blocks, want %d", len(blocks), want)
+			}
+
+			for i, want := range blocks {
+				src := input[i*tt.blockSize : min((i+1)*tt.blockSize, len(input))]
+				if raw[i] {
+					t.Fatalf("block %d is stored uncompressed", i)
+				}
+
+				got, n := lz4Compress(src, lz4CompressBound(len(src)), tt.level)
+				if n != len(src) || !bytes.Equal(got, want) {
+					t.Fatalf("block %d: compressed %d of %d bytes into %d bytes, lz4 wrote %d bytes", i, n, len(src), len(got), len(want))
+				}
+
+				decoded, err := lz4DecompressPartial(want, len(src))
+				if err != nil {
+					t.Fatalf("block %d: %v", i, err)
+				}
+				if !bytes.Equal(decoded, src) {
+					t.Fatalf("block %d does not decompress to the input", i)
+				}
+			}
+		})
+	}
+}
+
+func TestLZ4CompressDestSizeGolden(t *testing.T) {
+	input := readTestdata(t, "lz4/input.bin")
+
+	// Level 0 is LZ4_compress_destSize, the others LZ4_compress_HC_destSize.
+	tests := []struct {
+		offset, target, level int
+		consumed, size        int
+		sha256                string
+	}{
+		{0, 64, 0, 3390, 64, "bb1d55f5d2a215c8110d280c052872fa889857d6cd4c1d88aaceea9b35f0e192"},
+		{0, 64, 3, 3390, 64, "bb1d55f5d2a215c8110d280c052872fa889857d6cd4c1d88aaceea9b35f0e192"},
+		{0, 64, 9, 3390, 64, "bb1d55f5d2a215c8110d280c052872fa889857d6cd4c1d88aaceea9b35f0e192"},
+		{0, 64, 10, 3390, 64, "bb1d55f5d2a215c8110d280c052872fa889857d6cd4c1d88aaceea9b35f0e192"},
+		{0, 64, 11, 3390, 64, "bb1d55f5d2a215c8110d280c052872fa889857d6cd4c1d88aaceea9b35f0e192"},
+		{0, 64, 12, 3390, 64, "bb1d55f5d2a215c8110d280c052872fa889857d6cd4c1d88aaceea9b35f0e192"},
+		{0, 1000, 0, 8680, 1000, "87fd9c566257db862454d371d7e665768c54e3c2cb4443f1a9f70af76d0065d9"},
+		{0, 1000, 3, 8927, 1000, "3e73fa082d975c15fb3683e3dde091f3433b47af74f96527d88bcf1de59674b3"},
+		{0, 1000, 9, 8950, 1000, "3bb8867e4442528a5253ebfa773f0019143fdac542423e0a48a187aeeeef8f21"},
+		{0, 1000, 10, 8950, 1000, "87d5480fc648f7d1f41e0669b39ebc9988d1a0bf97dfd23bcad6bf82cf706006"},
+		{0, 1000, 11, 8962, 1000, "206dd2d7a7de9007fefa0be4d4b99a09ef532b190557b008b99bc0da0e7613cc"},
+		{0, 1000, 12, 8962, 1000, "08be9dafa792ea12ff49bd5a91b6d752f549b615ec03f03a4ac464a4c3d56c02"},
+		{0, 4096, 0, 30125, 4096, "0c10ec3639ae6b0201fa31253882e91f9e37cc762832f290ac5349ea0aaf2374"},
+		{0, 4096, 3, 33812, 4096, "d478e6e4e6ffc932fba00765f329d891b3dbc4cc879900f14ffab7452304515a"},
+		{0, 4096, 9, 33903, 4096, "3e1a9e44593f6fea0ade3aef769492af8c15e3cb9351c133685d2e40190928b9"},
+		{0, 4096, 10, 33934, 4096, "90fcbda8c39e09f73c4cbceb42ef4ac0135ecaf1583ecd71c19c2d170955c2a6"},
+		{0, 4096, 11, 33947, 4096, "e076a3722c7d586a89093fe1128d373e95370dfbb431ae35e1d0056632550e08"},
+		{0, 4096, 12, 33952, 4096, "669850bda33332a0d99b349f2a130a4a82a98448fee22513262aec6dd0abbc65"},
+		{30000, 64, 0, 62, 64, "2abc251dc862d6052062f221fef25aee5dcba780a02f79f53b176170e4d58657"},
+		{30000, 64, 3, 62, 64, "2abc251dc862d6052062f221fef25aee5dcba780a02f79f53b176170e4d58657"},
+		{30000, 64, 9, 62, 64, "2abc251dc862d6052062f221fef25aee5dcba780a02f79f53b176170e4d58657"},
+		{30000, 64, 10, 62, 64, "2abc251dc862d6052062f221fef25aee5dcba780a02f79f53b176170e4d58657"},
+		{30000, 64, 11, 62, 64, "2abc251dc862d6052062f221fef25aee5dcba780a02f79f53b176170e4d58657"},
+		{30000, 64, 12, 62, 64, "2abc251dc862d6052062f221fef25aee5dcba780a02f79f53b176170e4d58657"},
+		{30000, 1000, 0, 3382, 1000, "bf81cbe453afa95c765c8600defa74dd299582a7a54b94642334c31e61731e83"},
+		{30000, 1000, 3, 3650, 1000, "596c75bcf005bc671a03f22dacbc3456df9a2c02634dd55b775b8a90d7d61a96"},
+		{30000, 1000, 9, 3656, 1000, "ce72c84076be7d52f815daf4ad415218424fb5a6566e0519a0712f3409ab9d83"},
+		{30000, 1000, 10, 3660, 1000, "5447643244fa498e10983684b1c9cea40abae9ed83c438d49e351d34dafcf922"},
+		{30000, 1000, 11, 3660, 1000, "5447643244fa498e10983684b1c9cea40abae9ed83c438d49e351d34dafcf922"},
+		{30000, 1000, 12, 3660, 1000, "88c4008f6182241e29e8b08c8e7b92901a66e7fb0bb5d364f713d4b990eb80a3"},
+		{30000, 4096, 0, 34027, 4096, "86f9950e63dd104a32c4970fee250cfc0a785cef23fc9c23f24ac25d70112f8d"},
+		{30000, 4096, 3, 37901, 4096, "fc338afc100d2ad39d2fb873fb20a9bfed150ff7d86fc99cc5d480848eefcef4"},
+		{30000, 4096, 9, 37961, 4096, "f1f0b1a66efe27185f1995de99af4ebbe69941acef9143b4fd90d6865766f198"},
+		{30000, 4096, 10, 37968, 4096, "a7ff37617f4bca5ff7a88e8329273d76aa6e27ef9b0c4eb21bc47fcab22411e1"},
+		{30000, 4096, 11, 37981, 4096, "75fb13ac726dc78879bdadc8b8e4f19c38b91e6be15496cc15109d49f08cccbd"},
+		{30000, 4096, 12, 37991, 4096, "12a8ba11ef4005dcb8fae377dd2576a2341c15332356ac1a4acefa5144ac761a"},
+		{70000, 64, 0, 910, 64, "7f27ca0cc2c5bc6658fc8d6fc88408847bf274dd0e9f6e6112c525e24a05dcf6"},
+		{70000, 64, 3, 910, 64, "7f27ca0cc2c5bc6658fc8d6fc88408847bf274dd0e9f6e6112c525e24a05dcf6"},
+		{70000, 64, 9, 910, 64, "7f27ca0cc2c5bc6658fc8d6fc88408847bf274dd0e9f6e6112c525e24a05dcf6"},
+		{70000, 64, 10, 910, 64, "7f27ca0cc2c5bc6658fc8d6fc88408847bf274dd0e9f6e6112c525e24a05dcf6"},
+		{70000, 64, 11, 910, 64, "7f27ca0cc2c5bc6658fc8d6fc88408847bf274dd0e9f6e6112c525e24a05dcf6"},
+		{70000, 64, 12, 910, 64, "7f27ca0cc2c5bc6658fc8d6fc88408847bf274dd0e9f6e6112c525e24a05dcf6"},
+		{70000, 1000, 0, 10667, 1000, "3b49f52df7ac24a99e8b72ebe3158e740df0aa2d7cc4c016ef2f3ef984e6f7d1"},
+		{70000, 1000, 3, 11698, 1000, "e46c99ef1bf348c05a7ac33ab28f962ed22de829a298d676254187d67b99dea3"},
+		{70000, 1000, 9, 11769, 1000, "006d24ec5589e6a08140aa3264f14026e75abb031f524ff5be613837a5d41250"},
+		{70000, 1000, 10, 11786, 1000, "af9615424ffdfec837fe22840852a60ef90fb9cc9d54a26ad88c9d1f35c84e2e"},
+		{70000, 1000, 11, 11786, 1000, "af9615424ffdfec837fe22840852a60ef90fb9cc9d54a26ad88c9d1f35c84e2e"},
+		{70000, 1000, 12, 11787, 1000, "7d4987de9f5580360399c65c02dd422a7ae12c6db0d383a5f0dbff9a1de7dca9"},
+		{70000, 4096, 0, 26536, 4096, "6aed0e1357bdb9b69088896d7835820195c6902169f20745e6c556eb0baab5ce"},
+		{70000, 4096, 3, 32400, 3659, "cb08743cee57c83e4a37c25826f979675747ab7592b78e7b9d6d75bcd3b51387"},
+		{70000, 4096, 9, 32400, 3583, "007fb70b9ff73aa8ba25c1c0823d59d31ba8104efa0945c585d7b3eee4eabb4c"},
+		{70000, 4096, 10, 32400, 3556, "87d7ee885b33b578b932397f3c39850ed5588cd0c7fcb7353d7bcb9bcd06da21"},
+		{70000, 4096, 11, 32400, 3556, "87d7ee885b33b578b932397f3c39850ed5588cd0c7fcb7353d7bcb9bcd06da21"},
+		{70000, 4096, 12, 32400, 3551, "31c3e5df140358d2190fd9bb3481d4a32d9cc898507e5feb67d023bdf945d0c3"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("offset %d target %d level %d", tt.offset, tt.target, tt.level), func(t *testing.T) {
+			src := input[tt.offset:min(tt.offset+64<<10, len(input))]
+			got, n := lz4Compress(src, tt.target, tt.level)
+			sum := sha256.Sum256(got)
+			if n != tt.consumed || len(got) != tt.size || hex.EncodeToString(sum[:]) != tt.sha256 {
+				t.Fatalf("compressed %d bytes into %d, want %d into %d (sha256 match: %v)",
+					n, len(got), tt.consumed, tt.size, hex.EncodeToString(sum[:]) == tt.sha256)
+			}
+
+			decoded, err := lz4DecompressPartial(got, n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decoded, src[:n]) {
+				t.Fatal("block does not decompress to the input")
+			}
+		})
+	}
+}
+
+func TestApplyLz4DiffFixture(t *testing.T) {
+	src := readTestdata(t, "lz4/lz4diff.src")
+	patch := readTestdata(t, "lz4/lz4diff.patch")
+	want := readTestdata(t, "lz4/lz4diff.dst")
+
+	got, err := ApplyLz4Diff(src, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("patched output does not match the destination")
+	}
+
+	corrupt := bytes.Clone(src)
+	corrupt[len(corrupt)-100] ^= 0xFF
+	if _, err := ApplyLz4Diff(corrupt, patch); err == nil {
+		t.Fatal("expected an error for a corrupted source")
+	}
+}
@@ -0,0 +1,261 @@
+package dumper
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	lz4diffMagic   = "LZ4DIFF"
+	lz4diffVersion = 1
+
+	lz4diffInnerBsdiff   = 0
+	lz4diffInnerPuffdiff = 1
+
+	lz4AlgoLZ4   = 1
+	lz4AlgoLZ4HC = 2
+)
+
+type lz4diffBlock struct {
+	uncompressedOffset uint64
+	uncompressedLength uint64
+	compressedLength   uint64
+	postfixBspatch     []byte
+	sha256Hash         []byte
+}
+
+func (b *lz4diffBlock) compressed() bool {
+	return b.compressedLength < b.uncompressedLength
+}
+
+type lz4diffFile struct {
+	blocks      []lz4diffBlock
+	algo        int32
+	level       uint32
+	zeroPadding bool
+}
+
+type lz4diffHeader struct {
+	src       lz4diffFile
+	dst       lz4diffFile
+	innerType int32
+}
+
+// ApplyLz4Diff applies an lz4diff patch as used by LZ4DIFF_BSDIFF and
+// LZ4DIFF_PUFFDIFF: the LZ4 compressed source blocks are decompressed, the
+// inner patch is applied to the decompressed data, and the result is
+// recompressed with the recorded LZ4 parameters and fixed up with the per
+// block postfix patches.
+func ApplyLz4Diff(src, patch []byte) ([]byte, error) {
+	if len(patch) < len(lz4diffMagic)+8 || string(patch[:len(lz4diffMagic)]) != lz4diffMagic {
+		return nil, fmt.Errorf("invalid lz4diff magic")
+	}
+	patch = patch[len(lz4diffMagic):]
+
+	if version := binary.BigEndian.Uint32(patch); version != lz4diffVersion {
+		return nil, fmt.Errorf("unsupported lz4diff version %d", version)
+	}
+	headerSize := binary.BigEndian.Uint32(patch[4:])
+	patch = patch[8:]
+	if uint64(headerSize) > uint64(len(patch)) {
+		return nil, fmt.Errorf("truncated lz4diff header")
+	}
+
+	header, err := parseLz4diffHeader(patch[:headerSize])
+	if err != nil {
+		return nil, fmt.Errorf("invalid lz4diff header: %w", err)
+	}
+	inner := patch[headerSize:]
+
+	decompressed, err := decompressLz4diffFile(src, &header.src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress source: %w", err)
+	}
+
+	var patched []byte
+	switch header.innerType {
+	case lz4diffInnerBsdiff:
+		patched, err = ApplyBSDIFF(decompressed, inner)
+	case lz4diffInnerPuffdiff:
+		patched, err = ApplyPuffPatch(decompressed, inner)
+	default:
+		return nil, fmt.Errorf("unsupported lz4diff inner patch type %d", header.innerType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return compressLz4diffFile(patched, &header.dst)
+}
+
+func decompressLz4diffFile(data []byte, file *lz4diffFile) ([]byte, error) {
+	if len(file.blocks) == 0 {
+		return data, nil
+	}
+
+	var uncompressedSize, compressedSize uint64
+	for i, block := range file.blocks {
+		if block.uncompressedOffset != uncompressedSize {
+			return nil, fmt.Errorf("block %d starts at %d, expected %d", i, block.uncompressedOffset, uncompressedSize)
+		}
+		uncompressedSize += block.uncompressedLength
+		compressedSize += block.compressedLength
+	}
+	if compressedSize > uint64(len(data)) {
+		return nil, fmt.Errorf("compressed blocks need %d bytes, only %d available", compressedSize, len(data))
+	}
+
+	out := make([]byte, 0, uncompressedSize+uint64(len(data))-compressedSize)
+	var pos uint64
+	for i, block := range file.blocks {
+		cluster := data[pos : pos+block.compressedLength]
+		pos += block.compressedLength
+
+		if !block.compressed() {
+			out = append(out, cluster[:block.uncompressedLength]...)
+			continue
+		}
+
+		margin := 0
+		if file.zeroPadding {
+			for margin < len(cluster) && margin < 4096 && cluster[margin] == 0 {
+				margin++
+			}
+		}
+
+		decoded, err := lz4DecompressPartial(cluster[margin:], int(block.uncompressedLength))
+		if err != nil {
+			return nil, fmt.Errorf("block %d: %w", i, err)
+		}
+		if uint64(len(decoded)) != block.uncompressedLength {
+			return nil, fmt.Errorf("block %d decompressed to %d bytes, expected %d", i, len(decoded), block.uncompressedLength)
+		}
+		out = append(out, decoded...)
+	}
+
+	return append(out, data[compressedSize:]...), nil
+}
+
+func compressLz4diffFile(data []byte, file *lz4diffFile) ([]byte, error) {
+	if len(file.blocks) == 0 {
+		return data, nil
+	}
+
+	var out []byte
+	var uncompressedSize uint64
+	for i, block := range file.blocks {
+		end := block.uncompressedOffset + block.uncompressedLength
+		if end > uint64(len(data)) {
+			return nil, fmt.Errorf("block %d is out of range", i)
+		}
+		chunk := data[block.uncompressedOffset:end]
+		uncompressedSize += block.uncompressedLength
+
+		recompressed := chunk
+		if block.compressed() {
+			var c []byte
+			switch file.algo {
+			case lz4AlgoLZ4:
+				c, _ = lz4CompressDestSize(chunk, int(block.compressedLength))
+			case lz4AlgoLZ4HC:
+				c, _ = lz4hcCompressDestSize(chunk, int(block.compressedLength), int(file.level))
+			default:
+				return nil, fmt.Errorf("unsupported lz4diff compression algorithm %d", file.algo)
+			}
+			if len(c) == 0 {
+				return nil, fmt.Errorf("block %d: lz4 compression failed", i)
+			}
+
+			recompressed = make([]byte, block.compressedLength)
+			if file.zeroPadding {
+				copy(recompressed[len(recompressed)-len(c):], c)
+			} else {
+				copy(recompressed, c)
+			}
+		}
+
+		if len(block.sha256Hash) > 0 {
+			hash := sha256.Sum256(recompressed)
+			if !bytes.Equal(hash[:], block.sha256Hash) {
+				return nil, fmt.Errorf("block %d: recompressed data does not match the patch (generated with a different lz4 version?)", i)
+			}
+		}
+
+		if len(block.postfixBspatch) > 0 {
+			fixed, err := ApplyBSDIFF(recompressed, block.postfixBspatch)
+			if err != nil {
+				return nil, fmt.Errorf("block %d: postfix patch failed: %w", i, err)
+			}
+			recompressed = fixed
+		}
+
+		out = append(out, recompressed...)
+	}
+
+	if uncompressedSize < uint64(len(data)) {
+		out = append(out, data[uncompressedSize:]...)
+	}
+	return out, nil
+}
+
+func parseLz4diffHeader(b []byte) (*lz4diffHeader, error) {
+	header := &lz4diffHeader{}
+	err := parseProtoFields(b, func(num protowire.Number, typ protowire.Type, v uint64, msg []byte) error {
+		var err error
+		switch num {
+		case 1:
+			err = parseLz4diffFile(msg, &header.src)
+		case 2:
+			err = parseLz4diffFile(msg, &header.dst)
+		case 3:
+			header.innerType = int32(v)
+		}
+		return err
+	})
+	return header, err
+}
+
+func parseLz4diffFile(b []byte, file *lz4diffFile) error {
+	return parseProtoFields(b, func(num protowire.Number, typ protowire.Type, v uint64, msg []byte) error {
+		switch num {
+		case 1:
+			var block lz4diffBlock
+			err := parseProtoFields(msg, func(num protowire.Number, typ protowire.Type, v uint64, msg []byte) error {
+				switch num {
+				case 1:
+					block.uncompressedOffset = v
+				case 2:
+					block.uncompressedLength = v
+				case 3:
+					block.compressedLength = v
+				case 4:
+					block.postfixBspatch = msg
+				case 5:
+					block.sha256Hash = msg
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			file.blocks = append(file.blocks, block)
+		case 2:
+			return parseProtoFields(msg, func(num protowire.Number, typ protowire.Type, v uint64, msg []byte) error {
+				switch num {
+				case 1:
+					file.algo = int32(v)
+				case 2:
+					file.level = uint32(v)
+				}
+				return nil
+			})
+		case 3:
+			file.zeroPadding = v != 0
+		}
+		return nil
+	})
+}
@@ -0,0 +1,676 @@
+package dumper
+
+import "encoding/binary"
+
+const (
+	lz4hcHashLog      = 15
+	lz4hcMaxD         = 1 << 16
+	lz4hcDefaultLevel = 9
+	lz4hcMaxLevel     = 12
+	lz4hcOptimalML    = lz4MLMask - 1 + lz4MinMatch
+	lz4OptNum         = 1 << 12
+	lz4TrailingLits   = 3
+
+	// lz4hcPrefix is the index of the first input byte; a fresh lz4hc
+	// context starts counting at 64 KiB so that index 0 means "empty".
+	lz4hcPrefix = 64 << 10
+)
+
+var lz4hcLevels = [lz4hcMaxLevel + 1]struct {
+	optimal      bool
+	nbSearches   int
+	targetLength int
+}{
+	{false, 2, 16},
+	{false, 2, 16},
+	{false, 2, 16},
+	{false, 4, 16},
+	{false, 8, 16},
+	{false, 16, 16},
+	{false, 32, 16},
+	{false, 64, 16},
+	{false, 128, 16},
+	{false, 256, 16},
+	{true, 96, 64},
+	{true, 512, 128},
+	{true, 16384, lz4OptNum},
+}
+
+type lz4hc struct {
+	src          []byte
+	hashTable    [1 << lz4hcHashLog]uint32
+	chainTable   [lz4hcMaxD]uint16
+	nextToUpdate uint32
+}
+
+type lz4hcOptimal struct {
+	price  int
+	off    int
+	mlen   int
+	litlen int
+}
+
+// lz4hcCompressDestSize compresses as much of src as fits into dstSize bytes
+// at the given level, like LZ4_compress_HC_destSize. It returns the block and
+// the number of source bytes it covers.
+func lz4hcCompressDestSize(src []byte, dstSize, level int) ([]byte, int) {
+	if dstSize < 1 {
+		return nil, 0
+	}
+	if level < 1 {
+		level = lz4hcDefaultLevel
+	}
+	if level > lz4hcMaxLevel {
+		level = lz4hcMaxLevel
+	}
+
+	h := &lz4hc{src: src, nextToUpdate: lz4hcPrefix}
+	params := lz4hcLevels[level]
+	if params.optimal {
+		return h.compressOptimal(dstSize, params.nbSearches, params.targetLength, level == lz4hcMaxLevel)
+	}
+	return h.compressHashChain(dstSize, params.nbSearches)
+}
+
+func (h *lz4hc) hashPtr(p int) uint32 {
+	return (lz4Read32(h.src, p) * 2654435761) >> (32 - lz4hcHashLog)
+}
+
+func (h *lz4hc) insert(ip int) {
+	target := uint32(ip) + lz4hcPrefix
+	for idx := h.nextToUpdate; idx < target; idx++ {
+		hv := h.hashPtr(int(idx - lz4hcPrefix))
+		delta := idx - h.hashTable[hv]
+		if delta > lz4DistanceMax {
+			delta = lz4DistanceMax
+		}
+		h.chainTable[uint16(idx)] = uint16(delta)
+		h.hashTable[hv] = idx
+	}
+	h.nextToUpdate = target
+}
+
+func (h *lz4hc) countBack(ip, match, iMin int) int {
+	back := 0
+	min := iMin - ip
+	if -match > min {
+		min = -match
+	}
+	for back > min && h.src[ip+back-1] == h.src[match+back-1] {
+		back--
+	}
+	return back
+}
+
+// countPattern counts the bytes from ip that continue the repeating 1, 2 or
+// 4 byte pattern.
+func (h *lz4hc) countPattern(ip, iEnd int, pattern uint32) int {
+	n := 0
+	for ip+n < iEnd && h.src[ip+n] == byte(pattern>>(8*(n%4))) {
+		n++
+	}
+	return n
+}
+
+func (h *lz4hc) reverseCountPattern(ip, iLow int, pattern uint32) int {
+	n := 0
+	for ip-n > iLow && h.src[ip-n-1] == byte(pattern>>(8*(3-n%4))) {
+		n++
+	}
+	return n
+}
+
+const (
+	lz4RepUntested = iota
+	lz4RepNot
+	lz4RepConfirmed
+)
+
+// widerMatch is LZ4HC_InsertAndGetWiderMatch. matchpos and startpos are
+// only replaced when a match longer than longest is found.
+func (h *lz4hc) widerMatch(ip, iLowLimit, iHighLimit, longest, matchpos, startpos, maxNbAttempts int, patternAnalysis, chainSwap bool) (int, int, int) {
+	src := h.src
+	ipIndex := uint32(ip) + lz4hcPrefix
+	lowestMatchIndex := uint32(lz4hcPrefix)
+	if lz4hcPrefix+lz4DistanceMax+1 <= ipIndex {
+		lowestMatchIndex = ipIndex - lz4DistanceMax
+	}
+	lookBackLength := ip - iLowLimit
+	nbAttempts := maxNbAttempts
+	matchChainPos := uint32(0)
+	pattern := lz4Read32(src, ip)
+	repeat := lz4RepUntested
+	srcPatternLength := 0
+
+	h.insert(ip)
+	matchIndex := h.hashTable[h.hashPtr(ip)]
+
+	for matchIndex >= lowestMatchIndex && nbAttempts > 0 {
+		matchLength := 0
+		nbAttempts--
+
+		matchPtr := int(matchIndex - lz4hcPrefix)
+		if binary.LittleEndian.Uint16(src[iLowLimit+longest-1:]) == binary.LittleEndian.Uint16(src[matchPtr-lookBackLength+longest-1:]) &&
+			lz4Read32(src, matchPtr) == pattern {
+			back := 0
+			if lookBackLength > 0 {
+				back = h.countBack(ip, matchPtr, iLowLimit)
+			}
+			matchLength = lz4MinMatch + lz4Count(src, ip+lz4MinMatch, matchPtr+lz4MinMatch, iHighLimit)
+			matchLength -= back
+			if matchLength > longest {
+				longest = matchLength
+				matchpos = matchPtr + back
+				startpos = ip + back
+			}
+		}
+
+		if chainSwap && matchLength == longest && matchIndex+uint32(longest) <= ipIndex {
+			const kTrigger = 4
+			distanceToNextMatch := uint32(1)
+			end := longest - lz4MinMatch + 1
+			step := 1
+			accel := 1 << kTrigger
+			for pos := 0; pos < end; pos += step {
+				candidateDist := uint32(h.chainTable[uint16(matchIndex+uint32(pos))])
+				step = accel >> kTrigger
+				accel++
+				if candidateDist > distanceToNextMatch {
+					distanceToNextMatch = candidateDist
+					matchChainPos = uint32(pos)
+					accel = 1 << kTrigger
+				}
+			}
+			if distanceToNextMatch > 1 {
+				if distanceToNextMatch > matchIndex {
+					break
+				}
+				matchIndex -= distanceToNextMatch
+				continue
+			}
+		}
+
+		distNextMatch := h.chainTable[uint16(matchIndex)]
+		if patternAnalysis && distNextMatch == 1 && matchChainPos == 0 {
+			matchCandidateIdx := matchIndex - 1
+			if repeat == lz4RepUntested {
+				if pattern&0xFFFF == pattern>>16 && pattern&0xFF == pattern>>24 {
+					repeat = lz4RepConfirmed
+					srcPatternLength = h.countPattern(ip+4, iHighLimit, pattern) + 4
+				} else {
+					repeat = lz4RepNot
+				}
+			}
+
+			if repeat == lz4RepConfirmed && matchCandidateIdx >= lowestMatchIndex {
+				matchPtr := int(matchCandidateIdx - lz4hcPrefix)
+				if lz4Read32(src, matchPtr) == pattern {
+					forwardPatternLength := h.countPattern(matchPtr+4, iHighLimit, pattern) + 4
+					backLength := h.reverseCountPattern(matchPtr, 0, pattern)
+
+					lowest := matchCandidateIdx - uint32(backLength)
+					if lowest < lowestMatchIndex {
+						lowest = lowestMatchIndex
+					}
+					backLength = int(matchCandidateIdx - lowest)
+					currentSegmentLength := backLength + forwardPatternLength
+
+					if currentSegmentLength >= srcPatternLength && forwardPatternLength <= srcPatternLength {
+						matchIndex = matchCandidateIdx + uint32(forwardPatternLength) - uint32(srcPatternLength)
+					} else {
+						matchIndex = matchCandidateIdx - uint32(backLength)
+						if lookBackLength == 0 {
+							maxML := currentSegmentLength
+							if srcPatternLength < maxML {
+								maxML = srcPatternLength
+							}
+							if longest < maxML {
+								if ipIndex-matchIndex > lz4DistanceMax {
+									break
+								}
+								longest = maxML
+								matchpos = int(matchIndex - lz4hcPrefix)
+								startpos = ip
+							}
+							distToNextPattern := uint32(h.chainTable[uint16(matchIndex)])
+							if distToNextPattern > matchIndex {
+								break
+							}
+							matchIndex -= distToNextPattern
+						}
+					}
+					continue
+				}
+			}
+		}
+
+		matchIndex -= uint32(h.chainTable[uint16(matchIndex+matchChainPos)])
+	}
+
+	return longest, matchpos, startpos
+}
+
+// encodeSequence writes the literals from anchor to ip followed by a match.
+// With limit set it reports true instead of writing past oend.
+func (h *lz4hc) encodeSequence(dst []byte, ip, op, anchor *int, matchLength, match int, limit bool, oend int) bool {
+	token := *op
+	*op++
+
+	length := *ip - *anchor
+	if limit && *op+length/255+length+2+1+lz4LastLiterals > oend {
+		return true
+	}
+	if length >= lz4RunMask {
+		dst[token] = lz4RunMask << lz4MLBits
+		*op = lz4PutLength(dst, *op, length-lz4RunMask)
+	} else {
+		dst[token] = byte(length << lz4MLBits)
+	}
+	*op += copy(dst[*op:], h.src[*anchor:*ip])
+
+	binary.LittleEndian.PutUint16(dst[*op:], uint16(*ip-match))
+	*op += 2
+
+	length = matchLength - lz4MinMatch
+	if limit && *op+length/255+1+lz4LastLiterals > oend {
+		return true
+	}
+	if length >= lz4MLMask {
+		dst[token] += lz4MLMask
+		*op = lz4PutLength(dst, *op, length-lz4MLMask)
+	} else {
+		dst[token] += byte(length)
+	}
+
+	*ip += matchLength
+	*anchor = *ip
+	return false
+}
+
+// lastLiterals flushes the final literal run, truncating it to what still
+// fits before oend.
+func (h *lz4hc) lastLiterals(dst []byte, op, anchor, oend int) ([]byte, int) {
+	lastRunSize := len(h.src) - anchor
+	llAdd := (lastRunSize + 255 - lz4RunMask) / 255
+	if op+1+llAdd+lastRunSize > oend {
+		lastRunSize = oend - op - 1
+		llAdd = (lastRunSize + 256 - lz4RunMask) / 256
+		lastRunSize -= llAdd
+	}
+
+	if lastRunSize >= lz4RunMask {
+		dst[op] = lz4RunMask << lz4MLBits
+		op = lz4PutLength(dst, op+1, lastRunSize-lz4RunMask)
+	} else {
+		dst[op] = byte(lastRunSize << lz4MLBits)
+		op++
+	}
+	op += copy(dst[op:], h.src[anchor:anchor+lastRunSize])
+
+	return dst[:op], anchor + lastRunSize
+}
+
+// overflowSequence shortens the sequence that did not fit so that it ends
+// exactly at the output limit, when that is still worth a match.
+func (h *lz4hc) overflowSequence(dst []byte, ip, op, anchor *int, ml, ref, oend int) {
+	ll := *ip - *anchor
+	llTotalCost := 1 + (ll+240)/255 + ll
+	maxLitPos := oend - 3
+	if *op+llTotalCost > maxLitPos {
+		return
+	}
+
+	bytesLeftForMl := maxLitPos - (*op + llTotalCost)
+	maxMlSize := lz4MinMatch + lz4MLMask - 1 + bytesLeftForMl*255
+	if ml > maxMlSize {
+		ml = maxMlSize
+	}
+	if oend+lz4LastLiterals-(*op+llTotalCost+2)-1+ml >= lz4MFLimit {
+		h.encodeSequence(dst, ip, op, anchor, ml, ref, false, oend)
+	}
+}
+
+func (h *lz4hc) compressHashChain(dstCapacity, maxNbAttempts int) ([]byte, int) {
+	var (
+		patternAnalysis = maxNbAttempts > 128
+
+		ip, anchor = 0, 0
+		iend       = len(h.src)
+		mflimit    = iend - lz4MFLimit
+		matchlimit = iend - lz4LastLiterals
+
+		dst      = make([]byte, dstCapacity+lz4LastLiterals+16)
+		op, optr = 0, 0
+		oend     = dstCapacity - lz4LastLiterals
+
+		ml0, ml, ml2, ml3                             int
+		start0, ref0, ref, start2, ref2, start3, ref3 int
+	)
+
+	if iend < lz4MinLength {
+		goto lastLiterals
+	}
+
+	for ip <= mflimit {
+		ml, ref, _ = h.widerMatch(ip, ip, matchlimit, lz4MinMatch-1, ref, ip, maxNbAttempts, patternAnalysis, false)
+		if ml < lz4MinMatch {
+			ip++
+			continue
+		}
+
+		start0, ref0, ml0 = ip, ref, ml
+
+	search2:
+		if ip+ml <= mflimit {
+			ml2, ref2, start2 = h.widerMatch(ip+ml-2, ip, matchlimit, ml, ref2, start2, maxNbAttempts, patternAnalysis, false)
+		} else {
+			ml2 = ml
+		}
+
+		if ml2 == ml {
+			optr = op
+			if h.encodeSequence(dst, &ip, &op, &anchor, ml, ref, true, oend) {
+				goto destOverflow
+			}
+			continue
+		}
+
+		if start0 < ip && start2 < ip+ml0 {
+			ip, ref, ml = start0, ref0, ml0
+		}
+
+		if start2-ip < 3 {
+			ml, ip, ref = ml2, start2, ref2
+			goto search2
+		}
+
+	search3:
+		if start2-ip < lz4hcOptimalML {
+			newML := ml
+			if newML > lz4hcOptimalML {
+				newML = lz4hcOptimalML
+			}
+			if ip+newML > start2+ml2-lz4MinMatch {
+				newML = start2 - ip + ml2 - lz4MinMatch
+			}
+			if correction := newML - (start2 - ip); correction > 0 {
+				start2 += correction
+				ref2 += correction
+				ml2 -= correction
+			}
+		}
+
+		if start2+ml2 <= mflimit {
+			ml3, ref3, start3 = h.widerMatch(start2+ml2-3, start2, matchlimit, ml2, ref3, start3, maxNbAttempts, patternAnalysis, false)
+		} else {
+			ml3 = ml2
+		}
+
+		if ml3 == ml2 {
+			if start2 < ip+ml {
+				ml = start2 - ip
+			}
+			optr = op
+			if h.encodeSequence(dst, &ip, &op, &anchor, ml, ref, true, oend) {
+				goto destOverflow
+			}
+			ip = start2
+			optr = op
+			if h.encodeSequence(dst, &ip, &op, &anchor, ml2, ref2, true, oend) {
+				ml, ref = ml2, ref2
+				goto destOverflow
+			}
+			continue
+		}
+
+		if start3 < ip+ml+3 {
+			if start3 >= ip+ml {
+				if start2 < ip+ml {
+					correction := ip + ml - start2
+					start2 += correction
+					ref2 += correction
+					ml2 -= correction
+					if ml2 < lz4MinMatch {
+						start2, ref2, ml2 = start3, ref3, ml3
+					}
+				}
+
+				optr = op
+				if h.encodeSequence(dst, &ip, &op, &anchor, ml, ref, true, oend) {
+					goto destOverflow
+				}
+				ip, ref, ml = start3, ref3, ml3
+				start0, ref0, ml0 = start2, ref2, ml2
+				goto search2
+			}
+
+			start2, ref2, ml2 = start3, ref3, ml3
+			goto search3
+		}
+
+		if start2 < ip+ml {
+			if start2-ip < lz4hcOptimalML {
+				if ml > lz4hcOptimalML {
+					ml = lz4hcOptimalML
+				}
+				if ip+ml > start2+ml2-lz4MinMatch {
+					ml = start2 - ip + ml2 - lz4MinMatch
+				}
+				if correction := ml - (start2 - ip); correction > 0 {
+					start2 += correction
+					ref2 += correction
+					ml2 -= correction
+				}
+			} else {
+				ml = start2 - ip
+			}
+		}
+		optr = op
+		if h.encodeSequence(dst, &ip, &op, &anchor, ml, ref, true, oend) {
+			goto destOverflow
+		}
+
+		ip, ref, ml = start2, ref2, ml2
+		start2, ref2, ml2 = start3, ref3, ml3
+		goto search3
+	}
+
+lastLiterals:
+	return h.lastLiterals(dst, op, anchor, oend+lz4LastLiterals)
+
+destOverflow:
+	op = optr
+	h.overflowSequence(dst, &ip, &op, &anchor, ml, ref, oend)
+	goto lastLiterals
+}
+
+func lz4LiteralsPrice(litlen int) int {
+	price := litlen
+	if litlen >= lz4RunMask {
+		price += 1 + (litlen-lz4RunMask)/255
+	}
+	return price
+}
+
+func lz4SequencePrice(litlen, mlen int) int {
+	price := 1 + 2 + lz4LiteralsPrice(litlen)
+	if mlen >= lz4MLMask+lz4MinMatch {
+		price += 1 + (mlen-(lz4MLMask+lz4MinMatch))/255
+	}
+	return price
+}
+
+func (h *lz4hc) findLongerMatch(ip, iHighLimit, minLen, nbSearches int) (int, int) {
+	length, matchPtr, start := h.widerMatch(ip, ip, iHighLimit, minLen, 0, ip, nbSearches, true, true)
+	if length <= minLen {
+		return 0, 0
+	}
+	return length, start - matchPtr
+}
+
+func (h *lz4hc) compressOptimal(dstCapacity, nbSearches, sufficientLen int, fullUpdate bool) ([]byte, int) {
+	var (
+		opt = make([]lz4hcOptimal, lz4OptNum+lz4TrailingLits)
+
+		ip, anchor = 0, 0
+		iend       = len(h.src)
+		mflimit    = iend - lz4MFLimit
+		matchlimit = iend - lz4LastLiterals
+
+		dst         = make([]byte, dstCapacity+lz4LastLiterals+16)
+		op, opSaved = 0, 0
+		oend        = dstCapacity - lz4LastLiterals
+		ovml        = lz4MinMatch
+		ovref       = 0
+
+		llen, cur, lastMatchPos   int
+		bestMlen, bestOff         int
+		firstLen, firstOff        int
+		newLen, newOff            int
+		candidatePos, rPos        int
+		selectedMlen, selectedOff int
+	)
+
+	if sufficientLen >= lz4OptNum {
+		sufficientLen = lz4OptNum - 1
+	}
+
+	for ip <= mflimit {
+		llen = ip - anchor
+		lastMatchPos = 0
+
+		firstLen, firstOff = h.findLongerMatch(ip, matchlimit, lz4MinMatch-1, nbSearches)
+		if firstLen == 0 {
+			ip++
+			continue
+		}
+
+		if firstLen > sufficientLen {
+			opSaved = op
+			if h.encodeSequence(dst, &ip, &op, &anchor, firstLen, ip-firstOff, true, oend) {
+				ovml, ovref = firstLen, ip-firstOff
+				goto destOverflow
+			}
+			continue
+		}
+
+		for p := 0; p < lz4MinMatch; p++ {
+			opt[p] = lz4hcOptimal{price: lz4LiteralsPrice(llen + p), mlen: 1, litlen: llen + p}
+		}
+		for mlen := lz4MinMatch; mlen <= firstLen; mlen++ {
+			opt[mlen] = lz4hcOptimal{price: lz4SequencePrice(llen, mlen), off: firstOff, mlen: mlen, litlen: llen}
+		}
+		lastMatchPos = firstLen
+		for addLit := 1; addLit <= lz4TrailingLits; addLit++ {
+			opt[lastMatchPos+addLit] = lz4hcOptimal{price: opt[lastMatchPos].price + lz4LiteralsPrice(addLit), mlen: 1, litlen: addLit}
+		}
+
+		for cur = 1; cur < lastMatchPos; cur++ {
+			curPtr := ip + cur
+			if curPtr > mflimit {
+				break
+			}
+
+			if fullUpdate {
+				if opt[cur+1].price <= opt[cur].price && opt[cur+lz4MinMatch].price < opt[cur].price+3 {
+					continue
+				}
+			} else if opt[cur+1].price <= opt[cur].price {
+				continue
+			}
+
+			if fullUpdate {
+				newLen, newOff = h.findLongerMatch(curPtr, matchlimit, lz4MinMatch-1, nbSearches)
+			} else {
+				newLen, newOff = h.findLongerMatch(curPtr, matchlimit, lastMatchPos-cur, nbSearches)
+			}
+			if newLen == 0 {
+				continue
+			}
+
+			if newLen > sufficientLen || newLen+cur >= lz4OptNum {
+				bestMlen, bestOff = newLen, newOff
+				lastMatchPos = cur + 1
+				goto encode
+			}
+
+			baseLitlen := opt[cur].litlen
+			for litlen := 1; litlen < lz4MinMatch; litlen++ {
+				price := opt[cur].price - lz4LiteralsPrice(baseLitlen) + lz4LiteralsPrice(baseLitlen+litlen)
+				pos := cur + litlen
+				if price < opt[pos].price {
+					opt[pos] = lz4hcOptimal{price: price, mlen: 1, litlen: baseLitlen + litlen}
+				}
+			}
+
+			for ml := lz4MinMatch; ml <= newLen; ml++ {
+				pos := cur + ml
+				var price, ll int
+				if opt[cur].mlen == 1 {
+					ll = opt[cur].litlen
+					if cur > ll {
+						price = opt[cur-ll].price
+					}
+					price += lz4SequencePrice(ll, ml)
+				} else {
+					price = opt[cur].price + lz4SequencePrice(0, ml)
+				}
+
+				if pos > lastMatchPos+lz4TrailingLits || price <= opt[pos].price {
+					if ml == newLen && lastMatchPos < pos {
+						lastMatchPos = pos
+					}
+					opt[pos] = lz4hcOptimal{price: price, off: newOff, mlen: ml, litlen: ll}
+				}
+			}
+
+			for addLit := 1; addLit <= lz4TrailingLits; addLit++ {
+				opt[lastMatchPos+addLit] = lz4hcOptimal{price: opt[lastMatchPos].price + lz4LiteralsPrice(addLit), mlen: 1, litlen: addLit}
+			}
+		}
+
+		bestMlen = opt[lastMatchPos].mlen
+		bestOff = opt[lastMatchPos].off
+		cur = lastMatchPos - bestMlen
+
+	encode:
+		candidatePos = cur
+		selectedMlen, selectedOff = bestMlen, bestOff
+		for {
+			nextMlen := opt[candidatePos].mlen
+			nextOff := opt[candidatePos].off
+			opt[candidatePos].mlen = selectedMlen
+			opt[candidatePos].off = selectedOff
+			selectedMlen, selectedOff = nextMlen, nextOff
+			if nextMlen > candidatePos {
+				break
+			}
+			candidatePos -= nextMlen
+		}
+
+		rPos = 0
+		for rPos < lastMatchPos {
+			ml := opt[rPos].mlen
+			offset := opt[rPos].off
+			if ml == 1 {
+				ip++
+				rPos++
+				continue
+			}
+			rPos += ml
+			opSaved = op
+			if h.encodeSequence(dst, &ip, &op, &anchor, ml, ip-offset, true, oend) {
+				ovml, ovref = ml, ip-offset
+				goto destOverflow
+			}
+		}
+	}
+
+lastLiterals:
+	return h.lastLiterals(dst, op, anchor, oend+lz4LastLiterals)
+
+destOverflow:
+	op = opSaved
+	h.overflowSequence(dst, &ip, &op, &anchor, ovml, ovref, oend)
+	goto lastLiterals
+}
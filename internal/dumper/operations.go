@@ -6,14 +6,30 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 
 	"github.com/klauspost/compress/zstd"
-	"github.com/ulikunitz/xz"
 	pb "github.com/OhMyDitzzy/go-payload-dumper/protos"
 )
 
-func processOperationType(op *pb.InstallOperation, data []byte, outFile, oldFile *os.File, blockSize uint64) error {
+// inPlaceMinorVersion is the minor version of payloads that update the
+// partition in place. The output starts out as a copy of the base image and
+// MOVE and BSDIFF read their source extents from it, so blocks written by
+// earlier operations are visible to later ones.
+const inPlaceMinorVersion = 1
+
+func isInPlaceOperation(op *pb.InstallOperation) bool {
+	t := op.GetType()
+	return t == pb.InstallOperation_MOVE || t == pb.InstallOperation_BSDIFF
+}
+
+// copyBufferSize bounds the memory used to stream operation data into the
+// output.
+const copyBufferSize = 1 << 20
+
+// processOperationType applies op to outFile. data yields the operation's
+// blob from the payload; REPLACE-family operations decompress it straight
+// into the destination extents, patch operations read it into memory.
+func processOperationType(op *pb.InstallOperation, data io.Reader, outFile *outputImage, oldFile *os.File, blockSize uint64) error {
 	opType := *op.Type
 
 	switch opType {
@@ -27,228 +43,401 @@ func processOperationType(op *pb.InstallOperation, data []byte, outFile, oldFile
 		return processZSTD(op, data, outFile, blockSize)
 	case pb.InstallOperation_SOURCE_COPY:
 		return processSourceCopy(op, outFile, oldFile, blockSize)
+	case pb.InstallOperation_MOVE:
+		return processMove(op, outFile, oldFile, blockSize)
+	case pb.InstallOperation_BSDIFF:
+		return processInPlaceBSDIFF(op, data, outFile, oldFile, blockSize)
 	case pb.InstallOperation_SOURCE_BSDIFF, pb.InstallOperation_BROTLI_BSDIFF:
 		return processBSDIFF(op, data, outFile, oldFile, blockSize)
+	case pb.InstallOperation_PUFFDIFF:
+		return processPuffdiff(op, data, outFile, oldFile, blockSize)
+	case pb.InstallOperation_ZUCCHINI:
+		return processZucchini(op, data, outFile, oldFile, blockSize)
+	case pb.InstallOperation_LZ4DIFF_BSDIFF, pb.InstallOperation_LZ4DIFF_PUFFDIFF:
+		return processLz4diff(op, data, outFile, oldFile, blockSize)
 	case pb.InstallOperation_ZERO:
 		return processZero(op, outFile, blockSize)
+	case pb.InstallOperation_DISCARD:
+		return processDiscard(op, outFile, blockSize)
 	default:
 		return fmt.Errorf("unsupported operation type: %v", opType)
 	}
 }
 
-func processReplace(op *pb.InstallOperation, data []byte, outFile *os.File, blockSize uint64) error {
-	if len(op.DstExtents) == 0 {
-		return fmt.Errorf("no destination extents")
-	}
-	offset := int64(*op.DstExtents[0].StartBlock * blockSize)
-	_, err := outFile.Seek(offset, io.SeekStart)
+func processReplace(op *pb.InstallOperation, data io.Reader, outFile *outputImage, blockSize uint64) error {
+	return streamDstExtents(op, data, outFile, blockSize)
+}
+
+func processReplaceBZ(op *pb.InstallOperation, data io.Reader, outFile *outputImage, blockSize uint64) error {
+	return streamDstExtents(op, bzip2.NewReader(data), outFile, blockSize)
+}
+
+func processReplaceXZ(op *pb.InstallOperation, data io.Reader, outFile *outputImage, blockSize uint64) error {
+	reader, err := newXZReader(data)
 	if err != nil {
-		return err
+		return fmt.Errorf("xz decompression failed: %w", err)
 	}
-	_, err = outFile.Write(data)
-	return err
+	return streamDstExtents(op, reader, outFile, blockSize)
 }
 
-func processReplaceBZ(op *pb.InstallOperation, data []byte, outFile *os.File, blockSize uint64) error {
-	reader := bzip2.NewReader(bytes.NewReader(data))
-	decompressed, err := io.ReadAll(reader)
+func processZSTD(op *pb.InstallOperation, data io.Reader, outFile *outputImage, blockSize uint64) error {
+	decoder, err := zstd.NewReader(data, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
 	if err != nil {
 		return err
 	}
+	defer decoder.Close()
+
+	return streamDstExtents(op, decoder, outFile, blockSize)
+}
 
-	if len(op.DstExtents) == 0 {
-		return fmt.Errorf("no destination extents")
+func processSourceCopy(op *pb.InstallOperation, outFile *outputImage, oldFile *os.File, blockSize uint64) error {
+	if oldFile == nil {
+		return fmt.Errorf("SOURCE_COPY requires old file for differential OTA")
 	}
-	offset := int64(*op.DstExtents[0].StartBlock * blockSize)
-	_, err = outFile.Seek(offset, io.SeekStart)
-	if err != nil {
-		return err
+
+	readers := make([]io.Reader, 0, len(op.SrcExtents))
+	for _, ext := range op.SrcExtents {
+		offset := int64(*ext.StartBlock * blockSize)
+		size := int64(*ext.NumBlocks * blockSize)
+		readers = append(readers, io.NewSectionReader(oldFile, offset, size))
 	}
-	_, err = outFile.Write(decompressed)
-	return err
+
+	return streamDstExtents(op, io.MultiReader(readers...), outFile, blockSize)
 }
 
-func processReplaceXZ(op *pb.InstallOperation, data []byte, outFile *os.File, blockSize uint64) error {
-	decompressed, err := decompressXZNative(data)
-	if err != nil {
-		decompressed, err = decompressXZCommand(data)
+// processZero zeroes the destination extents. A sparse output already reads
+// as zeros there, so the blocks are left as holes.
+func processZero(op *pb.InstallOperation, outFile *outputImage, blockSize uint64) error {
+	if outFile.sparse {
+		return nil
+	}
+	return zeroExtents(op.DstExtents, outFile, blockSize)
+}
+
+// processDiscard leaves the discarded blocks zeroed, the same way as ZERO.
+func processDiscard(op *pb.InstallOperation, outFile *outputImage, blockSize uint64) error {
+	return processZero(op, outFile, blockSize)
+}
+
+// zeroExtents zeroes extents of an image that may hold data, such as the base
+// image copy of an in-place update. Where the filesystem supports it the
+// blocks are punched out as holes instead of being written.
+func zeroExtents(extents []*pb.Extent, outFile *outputImage, blockSize uint64) error {
+	for _, ext := range extents {
+		offset := int64(*ext.StartBlock * blockSize)
+		size := int64(*ext.NumBlocks * blockSize)
+
+		info, err := outFile.Stat()
 		if err != nil {
-			return fmt.Errorf("xz decompression failed (native and command): %w", err)
+			return err
+		}
+		if end := offset + size; end > info.Size() {
+			if err := outFile.Truncate(end); err != nil {
+				return err
+			}
+			if offset >= info.Size() {
+				continue
+			}
+		}
+
+		if err := punchHole(outFile.File, offset, size); err == nil {
+			continue
 		}
+
+		zeros := make([]byte, min(size, copyBufferSize))
+		for n := int64(0); n < size; n += int64(len(zeros)) {
+			chunk := zeros[:min(size-n, int64(len(zeros)))]
+			if _, err := outFile.WriteAt(chunk, offset+n); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func processBSDIFF(op *pb.InstallOperation, data io.Reader, outFile *outputImage, oldFile *os.File, blockSize uint64) error {
+	if oldFile == nil {
+		return fmt.Errorf("BSDIFF requires old file for differential OTA")
 	}
 
-	if len(op.DstExtents) == 0 {
-		return fmt.Errorf("no destination extents")
+	patch, err := io.ReadAll(data)
+	if err != nil {
+		return err
 	}
-	offset := int64(*op.DstExtents[0].StartBlock * blockSize)
-	_, err = outFile.Seek(offset, io.SeekStart)
+
+	oldData, err := readSourceExtents(op, oldFile, blockSize)
 	if err != nil {
 		return err
 	}
-	_, err = outFile.Write(decompressed)
-	return err
-}
 
-func decompressXZNative(data []byte) ([]byte, error) {
-	reader, err := xz.NewReader(bytes.NewReader(data))
+	patched, err := ApplyBSDIFF(oldData, patch)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return io.ReadAll(reader)
+
+	return writeDstExtents(op, patched, outFile, blockSize)
 }
 
-func decompressXZCommand(data []byte) ([]byte, error) {
-	if _, err := exec.LookPath("xz"); err != nil {
-		return nil, fmt.Errorf("xz command not found in PATH")
+// processMove copies blocks within the partition being built. All source
+// extents are read before anything is written, so overlapping extents move
+// the old data.
+func processMove(op *pb.InstallOperation, outFile *outputImage, oldFile *os.File, blockSize uint64) error {
+	if oldFile == nil {
+		return fmt.Errorf("MOVE requires old file for differential OTA")
 	}
 
-	cmd := exec.Command("xz", "-d", "-c")
-	cmd.Stdin = bytes.NewReader(data)
-	
-	var out bytes.Buffer
-	var errBuf bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &errBuf
-
-	if err := cmd.Run(); err != nil {
-		return nil, fmt.Errorf("xz command failed: %w, stderr: %s", err, errBuf.String())
+	data, err := readSourceExtents(op, outFile, blockSize)
+	if err != nil {
+		return err
 	}
 
-	return out.Bytes(), nil
+	return writeDstExtents(op, data, outFile, blockSize)
 }
 
-func processZSTD(op *pb.InstallOperation, data []byte, outFile *os.File, blockSize uint64) error {
-	decoder, err := zstd.NewReader(bytes.NewReader(data))
+func processInPlaceBSDIFF(op *pb.InstallOperation, data io.Reader, outFile *outputImage, oldFile *os.File, blockSize uint64) error {
+	if oldFile == nil {
+		return fmt.Errorf("BSDIFF requires old file for differential OTA")
+	}
+
+	patch, err := io.ReadAll(data)
 	if err != nil {
 		return err
 	}
-	defer decoder.Close()
 
-	decompressed, err := io.ReadAll(decoder)
+	oldData, err := readSourceExtents(op, outFile, blockSize)
 	if err != nil {
 		return err
 	}
-
-	if len(op.DstExtents) == 0 {
-		return fmt.Errorf("no destination extents")
+	if op.SrcLength != nil && *op.SrcLength < uint64(len(oldData)) {
+		oldData = oldData[:*op.SrcLength]
 	}
-	offset := int64(*op.DstExtents[0].StartBlock * blockSize)
-	_, err = outFile.Seek(offset, io.SeekStart)
+
+	patched, err := ApplyBSDIFF(oldData, patch)
 	if err != nil {
 		return err
 	}
-	_, err = outFile.Write(decompressed)
-	return err
+
+	// The patch only covers dst_length bytes; the rest of the last block is
+	// zeroed like update_engine does.
+	var dstSize uint64
+	for _, ext := range op.DstExtents {
+		dstSize += *ext.NumBlocks * blockSize
+	}
+	if uint64(len(patched)) < dstSize {
+		patched = append(patched, make([]byte, dstSize-uint64(len(patched)))...)
+	}
+
+	return writeDstExtents(op, patched, outFile, blockSize)
 }
 
-func processSourceCopy(op *pb.InstallOperation, outFile, oldFile *os.File, blockSize uint64) error {
+func processPuffdiff(op *pb.InstallOperation, data io.Reader, outFile *outputImage, oldFile *os.File, blockSize uint64) error {
 	if oldFile == nil {
-		return fmt.Errorf("SOURCE_COPY requires old file for differential OTA")
+		return fmt.Errorf("PUFFDIFF requires old file for differential OTA")
 	}
 
-	if len(op.DstExtents) == 0 {
-		return fmt.Errorf("no destination extents")
+	patch, err := io.ReadAll(data)
+	if err != nil {
+		return err
 	}
-	outOffset := int64(*op.DstExtents[0].StartBlock * blockSize)
-	_, err := outFile.Seek(outOffset, io.SeekStart)
+
+	oldData, err := readSourceExtents(op, oldFile, blockSize)
 	if err != nil {
 		return err
 	}
 
-	for _, ext := range op.SrcExtents {
-		offset := int64(*ext.StartBlock * blockSize)
-		size := int64(*ext.NumBlocks * blockSize)
+	patched, err := ApplyPuffPatch(oldData, patch)
+	if err != nil {
+		return fmt.Errorf("puffpatch failed: %w", err)
+	}
 
-		_, err := oldFile.Seek(offset, io.SeekStart)
-		if err != nil {
-			return err
-		}
+	return writeDstExtents(op, patched, outFile, blockSize)
+}
 
-		data := make([]byte, size)
-		_, err = io.ReadFull(oldFile, data)
-		if err != nil {
-			return err
-		}
+func processZucchini(op *pb.InstallOperation, data io.Reader, outFile *outputImage, oldFile *os.File, blockSize uint64) error {
+	if oldFile == nil {
+		return fmt.Errorf("ZUCCHINI requires old file for differential OTA")
+	}
 
-		_, err = outFile.Write(data)
-		if err != nil {
-			return err
-		}
+	patch, err := io.ReadAll(data)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	oldData, err := readSourceExtents(op, oldFile, blockSize)
+	if err != nil {
+		return err
+	}
+
+	patched, err := ApplyZucchini(oldData, patch)
+	if err != nil {
+		return fmt.Errorf("zucchini failed: %w", err)
+	}
+
+	return writeDstExtents(op, patched, outFile, blockSize)
 }
 
-func processZero(op *pb.InstallOperation, outFile *os.File, blockSize uint64) error {
-	for _, ext := range op.DstExtents {
-		offset := int64(*ext.StartBlock * blockSize)
-		size := int64(*ext.NumBlocks * blockSize)
+func processLz4diff(op *pb.InstallOperation, data io.Reader, outFile *outputImage, oldFile *os.File, blockSize uint64) error {
+	if oldFile == nil {
+		return fmt.Errorf("LZ4DIFF requires old file for differential OTA")
+	}
 
-		_, err := outFile.Seek(offset, io.SeekStart)
-		if err != nil {
-			return err
-		}
+	patch, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
 
-		zeros := make([]byte, size)
-		_, err = outFile.Write(zeros)
-		if err != nil {
-			return err
-		}
+	oldData, err := readSourceExtents(op, oldFile, blockSize)
+	if err != nil {
+		return err
 	}
-	return nil
-}
 
-func processBSDIFF(op *pb.InstallOperation, data []byte, outFile, oldFile *os.File, blockSize uint64) error {
-	if oldFile == nil {
-		return fmt.Errorf("BSDIFF requires old file for differential OTA")
+	patched, err := ApplyLz4Diff(oldData, patch)
+	if err != nil {
+		return fmt.Errorf("lz4diff failed: %w", err)
 	}
 
+	return writeDstExtents(op, patched, outFile, blockSize)
+}
+
+func readSourceExtents(op *pb.InstallOperation, src io.ReaderAt, blockSize uint64) ([]byte, error) {
 	var oldData bytes.Buffer
 	for _, ext := range op.SrcExtents {
 		offset := int64(*ext.StartBlock * blockSize)
 		size := int64(*ext.NumBlocks * blockSize)
 
-		_, err := oldFile.Seek(offset, io.SeekStart)
-		if err != nil {
-			return err
-		}
-
 		buffer := make([]byte, size)
-		_, err = io.ReadFull(oldFile, buffer)
+		_, err := io.ReadFull(io.NewSectionReader(src, offset, size), buffer)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		oldData.Write(buffer)
 	}
 
-	patched, err := ApplyBSDIFF(oldData.Bytes(), data)
-	if err != nil {
+	return oldData.Bytes(), nil
+}
+
+// streamDstExtents copies r into the destination extents of op through a
+// bounded buffer.
+func streamDstExtents(op *pb.InstallOperation, r io.Reader, outFile *outputImage, blockSize uint64) error {
+	w := newExtentWriter(outFile, op.DstExtents, blockSize)
+	if _, err := io.CopyBuffer(w, r, make([]byte, copyBufferSize)); err != nil {
 		return err
 	}
+	return w.Close()
+}
 
-	n := uint64(0)
-	for _, ext := range op.DstExtents {
-		offset := int64(*ext.StartBlock * blockSize)
-		size := *ext.NumBlocks * blockSize
+func writeDstExtents(op *pb.InstallOperation, data []byte, outFile *outputImage, blockSize uint64) error {
+	w := newExtentWriter(outFile, op.DstExtents, blockSize)
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	return w.Close()
+}
 
-		_, err := outFile.Seek(offset, io.SeekStart)
-		if err != nil {
-			return err
+// outputImage is the image being extracted.
+type outputImage struct {
+	*os.File
+	// sparse is set when the image was created empty and sized up front.
+	// Blocks that are never written read as zeros, so zero data does not
+	// have to be written and is left as holes instead.
+	sparse bool
+}
+
+// extentWriter writes a stream across the destination extents of an
+// operation, filling each extent before moving on to the next one. Blocks
+// of zeros are skipped when the output is sparse.
+type extentWriter struct {
+	f         *outputImage
+	extents   []*pb.Extent
+	blockSize uint64
+	pos       uint64
+	written   uint64
+	total     uint64
+	zeros     []byte
+}
+
+func newExtentWriter(f *outputImage, extents []*pb.Extent, blockSize uint64) *extentWriter {
+	w := &extentWriter{f: f, extents: extents, blockSize: blockSize}
+	for _, ext := range extents {
+		w.total += *ext.NumBlocks * blockSize
+	}
+	if f.sparse {
+		w.zeros = make([]byte, blockSize)
+	}
+	return w
+}
+
+func (w *extentWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if len(w.extents) == 0 {
+			return n, fmt.Errorf("data exceeds destination extents (%d blocks)", w.total/w.blockSize)
 		}
 
-		end := n + size
-		if end > uint64(len(patched)) {
-			end = uint64(len(patched))
+		ext := w.extents[0]
+		size := *ext.NumBlocks * w.blockSize
+		chunk := p
+		if left := size - w.pos; uint64(len(chunk)) > left {
+			chunk = chunk[:left]
 		}
 
-		_, err = outFile.Write(patched[n:end])
+		m, err := w.writeAt(chunk, *ext.StartBlock*w.blockSize+w.pos)
+		n += m
+		w.pos += uint64(m)
+		w.written += uint64(m)
 		if err != nil {
-			return err
+			return n, err
+		}
+
+		p = p[m:]
+		if w.pos == size {
+			w.extents = w.extents[1:]
+			w.pos = 0
 		}
+	}
+	return n, nil
+}
+
+// writeAt writes p at offset, leaving out the blocks that are all zeros when
+// the output is sparse. Runs of data blocks are written with a single call.
+func (w *extentWriter) writeAt(p []byte, offset uint64) (int, error) {
+	if w.zeros == nil {
+		return w.f.WriteAt(p, int64(offset))
+	}
 
+	n, start := 0, 0
+	for n < len(p) {
+		end := min(n+int(w.blockSize-(offset+uint64(n))%w.blockSize), len(p))
+		if bytes.Equal(p[n:end], w.zeros[:end-n]) {
+			if start < n {
+				if m, err := w.f.WriteAt(p[start:n], int64(offset)+int64(start)); err != nil {
+					return start + m, err
+				}
+			}
+			start = end
+		}
 		n = end
 	}
+	if start < n {
+		if m, err := w.f.WriteAt(p[start:n], int64(offset)+int64(start)); err != nil {
+			return start + m, err
+		}
+	}
+	return n, nil
+}
 
+// Close zero-pads a partially written last block, like update_engine does for
+// data that is not a multiple of the block size, and checks that every
+// destination block was written.
+func (w *extentWriter) Close() error {
+	if rem := w.written % w.blockSize; rem != 0 && len(w.extents) > 0 {
+		if _, err := w.Write(make([]byte, w.blockSize-rem)); err != nil {
+			return err
+		}
+	}
+	if w.written != w.total {
+		return fmt.Errorf("data covers %d of %d destination blocks", w.written/w.blockSize, w.total/w.blockSize)
+	}
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,115 @@
+package dumper
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pb "github.com/OhMyDitzzy/go-payload-dumper/protos"
+)
+
+// newTestOutput returns an output image of the given size filled with dots,
+// so bytes the test does not expect to be written stand out.
+func newTestOutput(t *testing.T, size int) *outputImage {
+	t.Helper()
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "out.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	if _, err := f.Write(bytes.Repeat([]byte("."), size)); err != nil {
+		t.Fatal(err)
+	}
+	return &outputImage{File: f}
+}
+
+func readTestOutput(t *testing.T, out *outputImage) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestExtentWriter(t *testing.T) {
+	// Four byte blocks and an eight block image.
+	tests := []struct {
+		name     string
+		extents  []*pb.Extent
+		data     string
+		want     string
+		writeErr string
+		closeErr string
+	}{
+		{
+			name:    "single extent",
+			extents: []*pb.Extent{testExtent(1, 2)},
+			data:    "abcdefgh",
+			want:    "....abcdefgh............",
+		},
+		{
+			name:    "multiple extents",
+			extents: []*pb.Extent{testExtent(4, 1), testExtent(0, 2), testExtent(3, 1)},
+			data:    "abcdefghijklmnop",
+			want:    "efghijkl....mnopabcd....",
+		},
+		{
+			name:    "partial last block",
+			extents: []*pb.Extent{testExtent(2, 1), testExtent(0, 1)},
+			data:    "abcdef",
+			want:    "ef\x00\x00....abcd............",
+		},
+		{
+			name:     "data longer than the extents",
+			extents:  []*pb.Extent{testExtent(1, 1), testExtent(3, 1)},
+			data:     "abcdefghij",
+			want:     "....abcd....efgh........",
+			writeErr: "data exceeds destination extents (2 blocks)",
+		},
+		{
+			name:     "data shorter than the extents",
+			extents:  []*pb.Extent{testExtent(0, 1), testExtent(2, 2)},
+			data:     "abcdef",
+			want:     "abcd....ef\x00\x00............",
+			closeErr: "data covers 2 of 3 destination blocks",
+		},
+	}
+	for _, tt := range tests {
+		// Written at once and in pieces that straddle the block and extent
+		// boundaries.
+		for _, piece := range []int{len(tt.data), 3} {
+			t.Run(fmt.Sprintf("%s/%d byte writes", tt.name, piece), func(t *testing.T) {
+				out := newTestOutput(t, 24)
+				w := newExtentWriter(out, tt.extents, 4)
+
+				var err error
+				for data := tt.data; len(data) > 0 && err == nil; {
+					n := min(piece, len(data))
+					_, err = w.Write([]byte(data[:n]))
+					data = data[n:]
+				}
+				if tt.writeErr != "" {
+					if err == nil || !strings.Contains(err.Error(), tt.writeErr) {
+						t.Fatalf("Write err = %v, want it to contain %q", err, tt.writeErr)
+					}
+				} else if err != nil {
+					t.Fatal(err)
+				} else if err := w.Close(); tt.closeErr == "" && err != nil {
+					t.Fatal(err)
+				} else if tt.closeErr != "" && (err == nil || !strings.Contains(err.Error(), tt.closeErr)) {
+					t.Fatalf("Close err = %v, want it to contain %q", err, tt.closeErr)
+				}
+
+				if got := readTestOutput(t, out); string(got) != tt.want {
+					t.Fatalf("image = %q, want %q", got, tt.want)
+				}
+			})
+		}
+	}
+}
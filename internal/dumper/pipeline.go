@@ -0,0 +1,104 @@
+package dumper
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	pb "github.com/OhMyDitzzy/go-payload-dumper/protos"
+)
+
+// applyOperations runs the operations of part against outFile and returns the
+// number of discarded bytes.
+//
+// Operations of a payload write disjoint destination extents and read only
+// the payload and the base image, so up to d.workers of them are read,
+// checked, decompressed and written with positional writes at once. In-place
+// payloads are the exception: their operations read blocks written by earlier
+// ones and are applied one at a time, in manifest order.
+func (d *Dumper) applyOperations(part *pb.PartitionUpdate, outFile *outputImage, oldFile *os.File, inPlace bool, blockSize uint64, bar *partitionProgress) (uint64, error) {
+	workers := min(d.workers, len(part.Operations))
+	if inPlace {
+		workers = 1
+	}
+
+	var (
+		mu                       sync.Mutex
+		done                     int
+		processedSize, discarded uint64
+		firstErr                 error
+	)
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				// Operations handed out while another one was failing are
+				// not started.
+				mu.Lock()
+				failed := firstErr != nil
+				mu.Unlock()
+				if failed {
+					continue
+				}
+
+				op := part.Operations[i]
+				err := d.applyOperation(part, i, outFile, oldFile, inPlace, blockSize)
+
+				mu.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					continue
+				}
+				done++
+				for _, extent := range op.DstExtents {
+					if extent.NumBlocks != nil {
+						processedSize += *extent.NumBlocks * blockSize
+						if op.GetType() == pb.InstallOperation_DISCARD {
+							discarded += *extent.NumBlocks * blockSize
+						}
+					}
+				}
+				bar.update(done, processedSize)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for i := range part.Operations {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	return discarded, firstErr
+}
+
+func (d *Dumper) applyOperation(part *pb.PartitionUpdate, i int, outFile *outputImage, oldFile *os.File, inPlace bool, blockSize uint64) error {
+	op := part.Operations[i]
+
+	if oldFile != nil && op.SrcSha256Hash != nil {
+		var srcFile io.ReaderAt = oldFile
+		if inPlace {
+			srcFile = outFile
+		}
+		if err := verifySourceHash(op, srcFile, blockSize); err != nil {
+			return fmt.Errorf("base image mismatch for %s: operation %d: %w", *part.PartitionName, i, err)
+		}
+	}
+
+	return d.processOperation(op, outFile, oldFile, blockSize)
+}
@@ -0,0 +1,159 @@
+package dumper
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/OhMyDitzzy/go-payload-dumper/protos"
+	"google.golang.org/protobuf/proto"
+)
+
+// slowReaderAt delays reads of the blob at offset, so that the other workers
+// get ahead of the operation reading it.
+type slowReaderAt struct {
+	io.ReaderAt
+	offset int64
+}
+
+func (r slowReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off == r.offset {
+		time.Sleep(50 * time.Millisecond)
+	}
+	return r.ReaderAt.ReadAt(p, off)
+}
+
+func TestApplyOperations(t *testing.T) {
+	const blockSize = 4096
+	corpus := testCorpus(16 * blockSize)
+	bar := newProgress(io.Discard, 1).start("system", 0, 0)
+
+	// create returns an empty sparse image of the given number of blocks.
+	create := func(t *testing.T, blocks int64) *outputImage {
+		f, err := os.Create(filepath.Join(t.TempDir(), "system.img"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Close() })
+		if err := f.Truncate(blocks * blockSize); err != nil {
+			t.Fatal(err)
+		}
+		return &outputImage{File: f, sparse: true}
+	}
+	read := func(t *testing.T, f *outputImage) []byte {
+		data, err := os.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	t.Run("parallel", func(t *testing.T) {
+		// One block per operation, written out of order, and a DISCARD.
+		var ops []*pb.InstallOperation
+		for i := range 15 {
+			block := uint64(14 - i)
+			ops = append(ops, replaceOp(corpus[block*blockSize:(block+1)*blockSize], block*blockSize, block, 1))
+		}
+		ops = append(ops, &pb.InstallOperation{
+			Type:       pb.InstallOperation_DISCARD.Enum(),
+			DstExtents: []*pb.Extent{testExtent(15, 1)},
+		})
+
+		d := newTestDumper(t, &pb.DeltaArchiveManifest{}, corpus)
+		d.workers = 4
+		out := create(t, 16)
+		discarded, err := d.applyOperations(&pb.PartitionUpdate{PartitionName: proto.String("system"), Operations: ops}, out, nil, false, blockSize, bar)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if discarded != blockSize {
+			t.Errorf("discarded %d bytes, want %d", discarded, blockSize)
+		}
+		want := append(bytes.Clone(corpus[:15*blockSize]), make([]byte, blockSize)...)
+		if !bytes.Equal(read(t, out), want) {
+			t.Fatal("image does not match the operations")
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		// The third operation's data does not match its hash, and is read
+		// slowly enough for the next one to be handed out meanwhile. With a
+		// single worker the operations after it are still never started.
+		var ops []*pb.InstallOperation
+		for block := range uint64(8) {
+			ops = append(ops, replaceOp(corpus[block*blockSize:(block+1)*blockSize], block*blockSize, block, 1))
+		}
+		ops[2].DataSha256Hash = make([]byte, sha256.Size)
+
+		d := newTestDumper(t, &pb.DeltaArchiveManifest{}, corpus)
+		d.payloadFile = slowReaderAt{d.payloadFile, 2 * blockSize}
+		d.workers = 1
+		out := create(t, 8)
+		_, err := d.applyOperations(&pb.PartitionUpdate{PartitionName: proto.String("system"), Operations: ops}, out, nil, false, blockSize, bar)
+		if !errors.Is(err, errDataHashMismatch) {
+			t.Fatalf("err = %v, want %v", err, errDataHashMismatch)
+		}
+		got := read(t, out)
+		if !bytes.Equal(got[:2*blockSize], corpus[:2*blockSize]) {
+			t.Error("operations before the failing one were not applied")
+		}
+		if !bytes.Equal(got[3*blockSize:], make([]byte, 5*blockSize)) {
+			t.Error("operations after the failing one were applied")
+		}
+
+		// With several workers only the error matters, whichever operations
+		// ran concurrently with the failing one.
+		d.workers = 4
+		if _, err := d.applyOperations(&pb.PartitionUpdate{PartitionName: proto.String("system"), Operations: ops}, create(t, 8), nil, false, blockSize, bar); !errors.Is(err, errDataHashMismatch) {
+			t.Fatalf("err = %v with 4 workers, want %v", err, errDataHashMismatch)
+		}
+	})
+
+	t.Run("in place", func(t *testing.T) {
+		// Each BSDIFF copies the block the previous one wrote to the next
+		// block, checking its source hash against the output. They only all
+		// find the first block when they run one after another, even though
+		// the first one reads its patch slowly.
+		base := corpus[:4*blockSize]
+		first := sha256.Sum256(base[:blockSize])
+		patch := makeRawBSDF2(base[:blockSize], base[:blockSize])
+		sum := sha256.Sum256(patch)
+		var ops []*pb.InstallOperation
+		var blobs []byte
+		for block := range uint64(3) {
+			ops = append(ops, &pb.InstallOperation{
+				Type:           pb.InstallOperation_BSDIFF.Enum(),
+				DataOffset:     proto.Uint64(uint64(len(blobs))),
+				DataLength:     proto.Uint64(uint64(len(patch))),
+				DataSha256Hash: sum[:],
+				SrcExtents:     []*pb.Extent{testExtent(block, 1)},
+				DstExtents:     []*pb.Extent{testExtent(block+1, 1)},
+				SrcSha256Hash:  first[:],
+			})
+			blobs = append(blobs, patch...)
+		}
+
+		oldFile := writeTestImage(t, base, 4)
+		out := create(t, 0)
+		out.sparse = false
+		if _, err := out.Write(base); err != nil {
+			t.Fatal(err)
+		}
+
+		d := newTestDumper(t, &pb.DeltaArchiveManifest{MinorVersion: proto.Uint32(inPlaceMinorVersion)}, blobs)
+		d.payloadFile = slowReaderAt{d.payloadFile, 0}
+		d.workers = 4
+		if _, err := d.applyOperations(&pb.PartitionUpdate{PartitionName: proto.String("system"), Operations: ops}, out, oldFile, true, blockSize, bar); err != nil {
+			t.Fatal(err)
+		}
+		if want := bytes.Repeat(base[:blockSize], 4); !bytes.Equal(read(t, out), want) {
+			t.Fatal("in-place operations did not run in manifest order")
+		}
+	})
+}
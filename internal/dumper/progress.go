@@ -0,0 +1,186 @@
+package dumper
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	progressBarLength = 30
+
+	// progressInterval throttles redraws when several partitions are
+	// extracted at once.
+	progressInterval = 100 * time.Millisecond
+)
+
+// progress renders the per-partition progress bars. With a single job the
+// line of the current partition is rewritten in place. With several jobs the
+// partitions being extracted get one line each at the bottom of the output,
+// redrawn with ANSI cursor movement, and messages and finished partitions
+// are printed above them.
+type progress struct {
+	mu     sync.Mutex
+	w      io.Writer
+	multi  bool
+	active []*partitionProgress
+	lines  int
+	last   time.Time
+}
+
+type partitionProgress struct {
+	p         *progress
+	name      string
+	totalOps  int
+	totalSize uint64
+	start     time.Time
+
+	ops       int
+	processed uint64
+}
+
+func newProgress(w io.Writer, jobs int) *progress {
+	return &progress{w: w, multi: jobs > 1}
+}
+
+// note prints a transient status message, such as the base image check.
+func (p *progress) note(format string, args ...any) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	msg := fmt.Sprintf(format, args...)
+	if !p.multi {
+		fmt.Fprintf(p.w, "%s\r", msg)
+		return
+	}
+	p.redraw(msg)
+}
+
+// endLine finishes a transient single-job line before an error is reported.
+func (p *progress) endLine() {
+	if !p.multi {
+		fmt.Fprintln(p.w)
+	}
+}
+
+func (p *progress) start(name string, totalOps int, totalSize uint64) *partitionProgress {
+	pp := &partitionProgress{p: p, name: name, totalOps: totalOps, totalSize: totalSize, start: time.Now()}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.multi {
+		fmt.Fprintf(p.w, "%s\r", pp.line())
+		return pp
+	}
+	p.active = append(p.active, pp)
+	p.redraw("")
+	return pp
+}
+
+// update records that ops operations covering processed bytes are done.
+func (pp *partitionProgress) update(ops int, processed uint64) {
+	p := pp.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pp.ops, pp.processed = ops, processed
+	if !p.multi {
+		fmt.Fprintf(p.w, "%s\r", pp.line())
+		return
+	}
+	if ops == pp.totalOps || time.Since(p.last) >= progressInterval {
+		p.redraw("")
+	}
+}
+
+func (pp *partitionProgress) done() {
+	p := pp.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	line := fmt.Sprintf("Processing '%s' partitions [%s] ✓ Done | %s | Time: %s",
+		pp.name, strings.Repeat("=", progressBarLength), formatBytes(pp.totalSize), formatDuration(time.Since(pp.start)))
+	if !p.multi {
+		fmt.Fprintf(p.w, "%s          \n", line)
+		return
+	}
+	p.remove(pp)
+	p.redraw(line)
+}
+
+// fail drops the partition's bar before its error is reported.
+func (pp *partitionProgress) fail() {
+	p := pp.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.multi {
+		fmt.Fprintln(p.w)
+		return
+	}
+	p.remove(pp)
+	p.redraw("")
+}
+
+func (p *progress) remove(pp *partitionProgress) {
+	for i, a := range p.active {
+		if a == pp {
+			p.active = append(p.active[:i], p.active[i+1:]...)
+			return
+		}
+	}
+}
+
+// redraw replaces the block of active bars, printing msg above it first.
+func (p *progress) redraw(msg string) {
+	var b strings.Builder
+	if p.lines > 0 {
+		fmt.Fprintf(&b, "\033[%dA", p.lines)
+	}
+	printed := len(p.active)
+	if msg != "" {
+		fmt.Fprintf(&b, "\033[2K%s\n", msg)
+		printed++
+	}
+	for _, pp := range p.active {
+		fmt.Fprintf(&b, "\033[2K%s\n", pp.line())
+	}
+	if extra := p.lines - printed; extra > 0 {
+		// Clear the lines left over from bars that went away.
+		for i := 0; i < extra; i++ {
+			b.WriteString("\033[2K\n")
+		}
+		fmt.Fprintf(&b, "\033[%dA", extra)
+	}
+	p.lines = len(p.active)
+	p.last = time.Now()
+	io.WriteString(p.w, b.String())
+}
+
+func (pp *partitionProgress) line() string {
+	var percent float64
+	filled := 0
+	if pp.totalOps > 0 {
+		percent = float64(pp.ops) / float64(pp.totalOps) * 100
+		filled = progressBarLength * pp.ops / pp.totalOps
+	}
+
+	var bar string
+	if filled > 0 {
+		bar = strings.Repeat("=", filled-1) + ">" + strings.Repeat("-", progressBarLength-filled)
+	} else {
+		bar = strings.Repeat("-", progressBarLength)
+	}
+
+	elapsed := time.Since(pp.start)
+	eta := "--:--:--"
+	if pp.ops > 1 {
+		eta = formatDuration(elapsed / time.Duration(pp.ops) * time.Duration(pp.totalOps-pp.ops))
+	}
+
+	return fmt.Sprintf("Processing '%s' partitions [%s] %3.0f%% | %s/%s | Elapsed: %s | ETA: %s",
+		pp.name, bar, percent, formatBytes(pp.processed), formatBytes(pp.totalSize), formatDuration(elapsed), eta)
+}
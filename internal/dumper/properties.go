@@ -0,0 +1,99 @@
+package dumper
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type payloadProperties struct {
+	fileHash     []byte
+	fileSize     int64
+	metadataHash []byte
+	metadataSize int64
+}
+
+func parsePayloadProperties(data []byte) (*payloadProperties, error) {
+	props := &payloadProperties{fileSize: -1, metadataSize: -1}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok {
+			continue
+		}
+
+		var err error
+		switch key {
+		case "FILE_HASH":
+			props.fileHash, err = base64.StdEncoding.DecodeString(value)
+		case "FILE_SIZE":
+			props.fileSize, err = strconv.ParseInt(value, 10, 64)
+		case "METADATA_HASH":
+			props.metadataHash, err = base64.StdEncoding.DecodeString(value)
+		case "METADATA_SIZE":
+			props.metadataSize, err = strconv.ParseInt(value, 10, 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", key, err)
+		}
+	}
+
+	return props, scanner.Err()
+}
+
+func (d *Dumper) verifyProperties() error {
+	props, err := parsePayloadProperties(d.properties)
+	if err != nil {
+		return err
+	}
+
+	if props.fileSize >= 0 && props.fileSize != d.payloadSize {
+		return fmt.Errorf("payload size mismatch: expected %d, got %d", props.fileSize, d.payloadSize)
+	}
+	if props.metadataSize >= 0 && props.metadataSize != d.metadataSize {
+		return fmt.Errorf("metadata size mismatch: expected %d, got %d", props.metadataSize, d.metadataSize)
+	}
+
+	if props.metadataHash != nil {
+		hash, err := d.hashPayloadRange(0, d.metadataSize)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(hash, props.metadataHash) {
+			return fmt.Errorf("metadata hash mismatch: expected %s, got %s",
+				base64.StdEncoding.EncodeToString(props.metadataHash), base64.StdEncoding.EncodeToString(hash))
+		}
+	}
+
+	if props.fileHash != nil {
+		if d.remote {
+			fmt.Println("Skipping FILE_HASH check for remote payload")
+			return nil
+		}
+
+		hash, err := d.hashPayloadRange(0, d.payloadSize)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(hash, props.fileHash) {
+			return fmt.Errorf("payload hash mismatch: expected %s, got %s",
+				base64.StdEncoding.EncodeToString(props.fileHash), base64.StdEncoding.EncodeToString(hash))
+		}
+	}
+
+	return nil
+}
+
+func (d *Dumper) hashPayloadRange(offset, length int64) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.CopyN(h, io.NewSectionReader(d.payloadFile, offset, length), length); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,117 @@
+package dumper
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testProperties returns a payload and the payload_properties.txt lines
+// update_engine's brillo_update_payload writes for it.
+func testProperties() (payload []byte, metadataSize int64, lines []string) {
+	payload = make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(payload)
+	metadataSize = 4000
+
+	fileHash := sha256.Sum256(payload)
+	metadataHash := sha256.Sum256(payload[:metadataSize])
+	lines = []string{
+		"FILE_HASH=" + base64.StdEncoding.EncodeToString(fileHash[:]),
+		fmt.Sprintf("FILE_SIZE=%d", len(payload)),
+		"METADATA_HASH=" + base64.StdEncoding.EncodeToString(metadataHash[:]),
+		fmt.Sprintf("METADATA_SIZE=%d", metadataSize),
+	}
+	return payload, metadataSize, lines
+}
+
+func TestVerifyProperties(t *testing.T) {
+	payload, metadataSize, lines := testProperties()
+	wrongHash := "FILE_HASH=" + base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	tests := []struct {
+		name    string
+		lines   []string
+		remote  bool
+		wantErr string
+	}{
+		{name: "good file", lines: lines},
+		{name: "CRLF line endings", lines: []string{lines[0] + "\r", lines[1] + "\r", lines[2] + "\r", lines[3] + "\r"}},
+		{name: "missing keys", lines: lines[1:2]},
+		{name: "no keys", lines: nil},
+		{name: "wrong file hash", lines: []string{wrongHash, lines[1]}, wantErr: "payload hash mismatch"},
+		{name: "wrong file hash of a remote payload", lines: []string{wrongHash, lines[1]}, remote: true},
+		{name: "wrong metadata hash", lines: []string{"METADATA_HASH=" + strings.TrimPrefix(wrongHash, "FILE_HASH="), lines[3]}, wantErr: "metadata hash mismatch"},
+		{name: "wrong file size", lines: []string{lines[0], "FILE_SIZE=9999", lines[2], lines[3]}, wantErr: "payload size mismatch"},
+		{name: "wrong metadata size", lines: []string{lines[0], lines[1], lines[2], "METADATA_SIZE=4001"}, wantErr: "metadata size mismatch"},
+		{name: "invalid hash", lines: []string{"FILE_HASH=not base64!"}, wantErr: "invalid FILE_HASH"},
+		{name: "invalid size", lines: []string{"FILE_SIZE=ten"}, wantErr: "invalid FILE_SIZE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Dumper{
+				payloadFile:  bytes.NewReader(payload),
+				payloadSize:  int64(len(payload)),
+				metadataSize: metadataSize,
+				remote:       tt.remote,
+				properties:   []byte(strings.Join(tt.lines, "\n")),
+			}
+			err := d.verifyProperties()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOpenLocalFileProperties(t *testing.T) {
+	payload, _, lines := testProperties()
+
+	tests := []struct {
+		name  string
+		lines []string
+		used  bool
+	}{
+		{name: "matching FILE_SIZE", lines: lines, used: true},
+		{name: "wrong FILE_SIZE", lines: []string{lines[0], "FILE_SIZE=12345"}},
+		{name: "missing FILE_SIZE", lines: []string{lines[0], lines[2], lines[3]}},
+		{name: "invalid FILE_SIZE", lines: []string{lines[0], "FILE_SIZE=-"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "payload.bin")
+			if err := os.WriteFile(path, payload, 0644); err != nil {
+				t.Fatal(err)
+			}
+			props := []byte(strings.Join(tt.lines, "\n"))
+			if err := os.WriteFile(filepath.Join(dir, "payload_properties.txt"), props, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			src, err := openLocalFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer src.closer.Close()
+
+			if used := src.properties != nil; used != tt.used {
+				t.Fatalf("properties used = %v, want %v", used, tt.used)
+			}
+			if tt.used && !bytes.Equal(src.properties, props) {
+				t.Fatal("properties do not match the file")
+			}
+		})
+	}
+}
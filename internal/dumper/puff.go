@@ -0,0 +1,545 @@
+package dumper
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Puffing turns a deflate bit stream into puffin's byte aligned "puff"
+// representation, which keeps everything needed to rebuild the exact same
+// bits: block headers and Huffman code lengths go into a block metadata
+// record, followed by literal runs, length/distance pairs and an end of block
+// marker. Diffing puffed data instead of compressed data is what makes
+// PUFFDIFF patches small, so both directions have to match puffin bit for bit.
+//
+// Record layout:
+//
+//	block metadata  2 byte big endian length-1, then F|TT|SSSSS and, for
+//	                dynamic blocks, HLIT, HDIST, HCLEN, the code length code
+//	                lengths as nibbles and the encoded code lengths
+//	literals        0LLLLLLL (1-127 literals) or 0x7F + uint16 (length-128)
+//	length/distance 1LLLLLLL (length 3-129) or 0xFF + byte (length-130),
+//	                followed by uint16 distance-1
+//	end of block    0xFF 0x81
+
+const (
+	puffLiteralsHeader = 0x00
+	puffLenDistHeader  = 0x80
+	puffMaxLiterals    = 127 + 1 + 0xFFFF
+)
+
+type puffWriter struct {
+	out      []byte
+	literals []byte
+}
+
+func (w *puffWriter) flushLiterals() {
+	for len(w.literals) > 0 {
+		n := len(w.literals)
+		if n > puffMaxLiterals {
+			n = puffMaxLiterals
+		}
+
+		if n <= 127 {
+			w.out = append(w.out, puffLiteralsHeader|byte(n-1))
+		} else {
+			w.out = append(w.out, puffLiteralsHeader|127)
+			w.out = binary.BigEndian.AppendUint16(w.out, uint16(n-128))
+		}
+		w.out = append(w.out, w.literals[:n]...)
+		w.literals = w.literals[n:]
+	}
+	w.literals = w.literals[:0]
+}
+
+func (w *puffWriter) blockMetadata(meta []byte) {
+	w.flushLiterals()
+	w.out = binary.BigEndian.AppendUint16(w.out, uint16(len(meta)-1))
+	w.out = append(w.out, meta...)
+}
+
+func (w *puffWriter) literal(b ...byte) {
+	w.literals = append(w.literals, b...)
+}
+
+func (w *puffWriter) lenDist(length, distance int) {
+	w.flushLiterals()
+	if length < 130 {
+		w.out = append(w.out, puffLenDistHeader|byte(length-3))
+	} else {
+		w.out = append(w.out, puffLenDistHeader|127, byte(length-130))
+	}
+	w.out = binary.BigEndian.AppendUint16(w.out, uint16(distance-1))
+}
+
+func (w *puffWriter) endOfBlock() {
+	w.flushLiterals()
+	w.out = append(w.out, puffLenDistHeader|127, 259-130)
+}
+
+func (w *puffWriter) bytes() []byte {
+	w.flushLiterals()
+	return w.out
+}
+
+// puffDeflate puffs the deflate blocks in bits [start, end) of data.
+func puffDeflate(data []byte, start, end uint64, w *puffWriter) error {
+	br := newBitReader(data, start)
+
+	for end-br.offset() >= 8 {
+		header, err := br.readBits(3)
+		if err != nil {
+			return err
+		}
+		final := header & 1
+		blockType := header >> 1
+		meta := []byte{byte(final<<7 | blockType<<5)}
+
+		var lit, dist *huffmanCode
+		switch blockType {
+		case 0:
+			skipped := uint(br.nbits % 8)
+			bits, _ := br.readBits(skipped)
+			meta[0] |= byte(bits)
+
+			lens, err := br.readBits(32)
+			if err != nil {
+				return err
+			}
+			length, nlength := lens&0xFFFF, lens>>16
+			if length^nlength != 0xFFFF {
+				return fmt.Errorf("invalid stored block length %d/%d", length, nlength)
+			}
+
+			w.blockMetadata(meta)
+			for i := uint32(0); i < length; i++ {
+				b, err := br.readBits(8)
+				if err != nil {
+					return err
+				}
+				w.literal(byte(b))
+			}
+			w.endOfBlock()
+			continue
+
+		case 1:
+			lit, dist = fixedLiteralCode, fixedDistanceCode
+			w.blockMetadata(meta)
+
+		case 2:
+			meta, lit, dist, err = readDynamicHeader(br, meta)
+			if err != nil {
+				return err
+			}
+			w.blockMetadata(meta)
+
+		default:
+			return fmt.Errorf("invalid deflate block type %d", blockType)
+		}
+
+		for {
+			sym, err := lit.decode(br)
+			if err != nil {
+				return err
+			}
+
+			if sym < 256 {
+				w.literal(byte(sym))
+				continue
+			}
+			if sym == 256 {
+				w.endOfBlock()
+				break
+			}
+
+			sym -= 257
+			if sym >= len(lengthBases) {
+				return fmt.Errorf("invalid length symbol %d", sym+257)
+			}
+			extra, err := br.readBits(uint(lengthExtraBits[sym]))
+			if err != nil {
+				return err
+			}
+			length := int(lengthBases[sym]) + int(extra)
+
+			dsym, err := dist.decode(br)
+			if err != nil {
+				return err
+			}
+			if dsym >= len(distanceBases) {
+				return fmt.Errorf("invalid distance symbol %d", dsym)
+			}
+			extra, err = br.readBits(uint(distanceExtraBits[dsym]))
+			if err != nil {
+				return err
+			}
+			w.lenDist(length, int(distanceBases[dsym])+int(extra))
+		}
+	}
+
+	return nil
+}
+
+// readDynamicHeader reads a dynamic block's Huffman tables and appends their
+// puffed form to meta.
+func readDynamicHeader(br *bitReader, meta []byte) ([]byte, *huffmanCode, *huffmanCode, error) {
+	counts, err := br.readBits(14)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	hlit, hdist, hclen := counts&0x1F, counts>>5&0x1F, counts>>10
+	numLit, numDist, numCodes := int(hlit)+257, int(hdist)+1, int(hclen)+4
+	if numLit > 286 || numDist > 30 {
+		return nil, nil, nil, fmt.Errorf("invalid dynamic block header")
+	}
+	meta = append(meta, byte(hlit), byte(hdist), byte(hclen))
+
+	clens := make([]uint8, 19)
+	for i := 0; i < numCodes; i++ {
+		l, err := br.readBits(3)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		clens[codeLengthOrder[i]] = uint8(l)
+		if i%2 == 0 {
+			meta = append(meta, byte(l)<<4)
+		} else {
+			meta[len(meta)-1] |= byte(l)
+		}
+	}
+
+	clcode, err := newHuffmanCode(clens)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	lens := make([]uint8, 0, numLit+numDist)
+	for len(lens) < numLit+numDist {
+		sym, err := clcode.decode(br)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		if sym < 16 {
+			meta = append(meta, byte(sym))
+			lens = append(lens, uint8(sym))
+			continue
+		}
+
+		var repeat int
+		var value uint8
+		switch sym {
+		case 16:
+			if len(lens) == 0 {
+				return nil, nil, nil, fmt.Errorf("repeat code with no previous length")
+			}
+			extra, err := br.readBits(2)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			meta = append(meta, byte(16+extra))
+			repeat, value = 3+int(extra), lens[len(lens)-1]
+		case 17:
+			extra, err := br.readBits(3)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			meta = append(meta, byte(20+extra))
+			repeat = 3 + int(extra)
+		case 18:
+			extra, err := br.readBits(7)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			meta = append(meta, byte(28+extra))
+			repeat = 11 + int(extra)
+		default:
+			return nil, nil, nil, fmt.Errorf("invalid code length symbol %d", sym)
+		}
+
+		for i := 0; i < repeat; i++ {
+			lens = append(lens, value)
+		}
+	}
+	if len(lens) != numLit+numDist {
+		return nil, nil, nil, fmt.Errorf("code lengths overflow the dynamic block header")
+	}
+
+	lit, err := newHuffmanCode(lens[:numLit])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	dist, err := newHuffmanCode(lens[numLit:])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return meta, lit, dist, nil
+}
+
+// huffDeflate rebuilds the deflate bit stream of a single puff.
+func huffDeflate(puff []byte, bw *bitWriter) error {
+	r := &puffReader{data: puff}
+
+	for r.pos < len(puff) {
+		meta, err := r.blockMetadata()
+		if err != nil {
+			return err
+		}
+
+		bw.writeBits(uint32(meta[0]>>7), 1)
+		blockType := meta[0] >> 5 & 3
+		bw.writeBits(uint32(blockType), 2)
+
+		var lit, dist *huffmanCode
+		switch blockType {
+		case 0:
+			if err := huffStoredBlock(r, meta, bw); err != nil {
+				return err
+			}
+			continue
+		case 1:
+			lit, dist = fixedLiteralCode, fixedDistanceCode
+		case 2:
+			lit, dist, err = writeDynamicHeader(meta[1:], bw)
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("invalid puffed block type %d", blockType)
+		}
+
+		for done := false; !done; {
+			kind, literals, length, distance, err := r.next()
+			if err != nil {
+				return err
+			}
+
+			switch kind {
+			case puffLiterals:
+				for _, b := range literals {
+					if err := lit.encode(bw, int(b)); err != nil {
+						return err
+					}
+				}
+			case puffLenDist:
+				sym := lengthSymbol(length)
+				if err := lit.encode(bw, 257+sym); err != nil {
+					return err
+				}
+				bw.writeBits(uint32(length-int(lengthBases[sym])), uint(lengthExtraBits[sym]))
+
+				dsym := distanceSymbol(distance)
+				if err := dist.encode(bw, dsym); err != nil {
+					return err
+				}
+				bw.writeBits(uint32(distance-int(distanceBases[dsym])), uint(distanceExtraBits[dsym]))
+			case puffEndOfBlock:
+				if err := lit.encode(bw, 256); err != nil {
+					return err
+				}
+				done = true
+			}
+		}
+	}
+
+	return nil
+}
+
+func huffStoredBlock(r *puffReader, meta []byte, bw *bitWriter) error {
+	pad := (8 - bw.nbits%8) % 8
+	bw.writeBits(uint32(meta[0]&0x1F), pad)
+
+	var data []byte
+	for {
+		kind, literals, _, _, err := r.next()
+		if err != nil {
+			return err
+		}
+		if kind == puffEndOfBlock {
+			break
+		}
+		if kind != puffLiterals {
+			return fmt.Errorf("length/distance pair in stored block")
+		}
+		data = append(data, literals...)
+	}
+
+	if len(data) > 0xFFFF {
+		return fmt.Errorf("stored block too long")
+	}
+	bw.writeBits(uint32(len(data)), 16)
+	bw.writeBits(uint32(^uint16(len(data))), 16)
+	for _, b := range data {
+		bw.writeBits(uint32(b), 8)
+	}
+	return nil
+}
+
+func writeDynamicHeader(meta []byte, bw *bitWriter) (*huffmanCode, *huffmanCode, error) {
+	if len(meta) < 3 {
+		return nil, nil, fmt.Errorf("truncated dynamic block metadata")
+	}
+	hlit, hdist, hclen := meta[0], meta[1], meta[2]
+	numLit, numDist, numCodes := int(hlit)+257, int(hdist)+1, int(hclen)+4
+	bw.writeBits(uint32(hlit), 5)
+	bw.writeBits(uint32(hdist), 5)
+	bw.writeBits(uint32(hclen), 4)
+
+	nibbles := meta[3:]
+	if len(nibbles) < (numCodes+1)/2 {
+		return nil, nil, fmt.Errorf("truncated dynamic block metadata")
+	}
+	clens := make([]uint8, 19)
+	for i := 0; i < numCodes; i++ {
+		l := nibbles[i/2] >> 4
+		if i%2 == 1 {
+			l = nibbles[i/2] & 0xF
+		}
+		if l > 7 {
+			return nil, nil, fmt.Errorf("invalid code length code length %d", l)
+		}
+		clens[codeLengthOrder[i]] = l
+		bw.writeBits(uint32(l), 3)
+	}
+
+	clcode, err := newHuffmanCode(clens)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lens := make([]uint8, 0, numLit+numDist)
+	for _, v := range nibbles[(numCodes+1)/2:] {
+		var sym, extraBits int
+		var extra uint32
+		repeat := 0
+		var value uint8
+
+		switch {
+		case v < 16:
+			sym = int(v)
+			lens = append(lens, v)
+		case v < 20:
+			if len(lens) == 0 {
+				return nil, nil, fmt.Errorf("repeat code with no previous length")
+			}
+			sym, extraBits, extra = 16, 2, uint32(v-16)
+			repeat, value = 3+int(extra), lens[len(lens)-1]
+		case v < 28:
+			sym, extraBits, extra = 17, 3, uint32(v-20)
+			repeat = 3 + int(extra)
+		case v < 156:
+			sym, extraBits, extra = 18, 7, uint32(v-28)
+			repeat = 11 + int(extra)
+		default:
+			return nil, nil, fmt.Errorf("invalid puffed code length %d", v)
+		}
+
+		if err := clcode.encode(bw, sym); err != nil {
+			return nil, nil, err
+		}
+		bw.writeBits(extra, uint(extraBits))
+		for i := 0; i < repeat; i++ {
+			lens = append(lens, value)
+		}
+	}
+	if len(lens) != numLit+numDist {
+		return nil, nil, fmt.Errorf("dynamic block metadata has %d code lengths, expected %d", len(lens), numLit+numDist)
+	}
+
+	lit, err := newHuffmanCode(lens[:numLit])
+	if err != nil {
+		return nil, nil, err
+	}
+	dist, err := newHuffmanCode(lens[numLit:])
+	if err != nil {
+		return nil, nil, err
+	}
+	return lit, dist, nil
+}
+
+func lengthSymbol(length int) int {
+	if length == 258 {
+		return 28
+	}
+	sym := 0
+	for sym+1 < len(lengthBases)-1 && int(lengthBases[sym+1]) <= length {
+		sym++
+	}
+	return sym
+}
+
+func distanceSymbol(distance int) int {
+	sym := 0
+	for sym+1 < len(distanceBases) && int(distanceBases[sym+1]) <= distance {
+		sym++
+	}
+	return sym
+}
+
+const (
+	puffLiterals = iota
+	puffLenDist
+	puffEndOfBlock
+)
+
+type puffReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *puffReader) take(n int) ([]byte, error) {
+	if r.pos+n > len(r.data) {
+		return nil, fmt.Errorf("truncated puff stream")
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *puffReader) blockMetadata() ([]byte, error) {
+	b, err := r.take(2)
+	if err != nil {
+		return nil, err
+	}
+	return r.take(int(binary.BigEndian.Uint16(b)) + 1)
+}
+
+func (r *puffReader) next() (kind int, literals []byte, length, distance int, err error) {
+	b, err := r.take(1)
+	if err != nil {
+		return 0, nil, 0, 0, err
+	}
+	header := b[0]
+
+	if header&puffLenDistHeader == 0 {
+		n := int(header&0x7F) + 1
+		if n == 128 {
+			ext, err := r.take(2)
+			if err != nil {
+				return 0, nil, 0, 0, err
+			}
+			n = int(binary.BigEndian.Uint16(ext)) + 128
+		}
+		literals, err = r.take(n)
+		return puffLiterals, literals, 0, 0, err
+	}
+
+	length = int(header&0x7F) + 3
+	if length == 130 {
+		ext, err := r.take(1)
+		if err != nil {
+			return 0, nil, 0, 0, err
+		}
+		if ext[0] == 259-130 {
+			return puffEndOfBlock, nil, 0, 0, nil
+		}
+		length = int(ext[0]) + 130
+	}
+
+	d, err := r.take(2)
+	if err != nil {
+		return 0, nil, 0, 0, err
+	}
+	return puffLenDist, nil, length, int(binary.BigEndian.Uint16(d)) + 1, nil
+}
@@ -0,0 +1,161 @@
+package dumper
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/hex"
+	"math/rand"
+	"testing"
+)
+
+// testCorpus returns data that compresses into a mix of literal runs, long
+// matches and incompressible stretches.
+func testCorpus(size int) []byte {
+	rng := rand.New(rand.NewSource(1))
+	words := []string{"system", "vendor", "payload", "partition", "extent", "block", "\n", " ", "0x", "ota"}
+
+	var buf bytes.Buffer
+	for buf.Len() < size {
+		switch rng.Intn(4) {
+		case 0:
+			b := make([]byte, rng.Intn(300))
+			rng.Read(b)
+			buf.Write(b)
+		default:
+			for i := rng.Intn(200); i > 0; i-- {
+				buf.WriteString(words[rng.Intn(len(words))])
+			}
+		}
+	}
+	return buf.Bytes()[:size]
+}
+
+func deflateBytes(t *testing.T, data []byte, level int, flushEvery int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(data) > 0 {
+		n := len(data)
+		if flushEvery > 0 {
+			n = min(n, flushEvery)
+		}
+		w.Write(data[:n])
+		data = data[n:]
+		if flushEvery > 0 {
+			w.Flush()
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func puffBytes(t *testing.T, deflate []byte) []byte {
+	t.Helper()
+
+	w := &puffWriter{}
+	if err := puffDeflate(deflate, 0, uint64(len(deflate))*8, w); err != nil {
+		t.Fatalf("puffDeflate: %v", err)
+	}
+	return w.bytes()
+}
+
+func huffBytes(t *testing.T, puff []byte) []byte {
+	t.Helper()
+
+	bw := &bitWriter{}
+	if err := huffDeflate(puff, bw); err != nil {
+		t.Fatalf("huffDeflate: %v", err)
+	}
+	return bw.bytes()
+}
+
+func TestPuffHuffRoundTrip(t *testing.T) {
+	corpus := testCorpus(300 << 10)
+
+	tests := []struct {
+		name       string
+		level      int
+		flushEvery int
+	}{
+		{"stored", flate.NoCompression, 0},
+		{"huffman only", flate.HuffmanOnly, 0},
+		{"level 1", flate.BestSpeed, 0},
+		{"level 5", 5, 0},
+		{"level 6", flate.DefaultCompression, 0},
+		{"level 9", flate.BestCompression, 0},
+		{"level 6 with sync flushes", flate.DefaultCompression, 10000},
+		{"level 9 with sync flushes", flate.BestCompression, 777},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deflate := deflateBytes(t, corpus, tt.level, tt.flushEvery)
+			if got := huffBytes(t, puffBytes(t, deflate)); !bytes.Equal(got, deflate) {
+				t.Fatalf("huffed %d bytes do not match the %d byte deflate stream", len(got), len(deflate))
+			}
+		})
+	}
+}
+
+// The deflate streams below are zlib's raw output; the puffs were worked out
+// by hand from the puff record layout.
+func TestPuffGolden(t *testing.T) {
+	tests := []struct {
+		name    string
+		deflate string
+		puff    string
+	}{
+		{
+			// Fixed block for "abcabcabc": literals "abca", then length 5
+			// at distance 3.
+			name:    "fixed",
+			deflate: "4b4c4a4e042300",
+			puff:    "0000a0" + "0361626361" + "820002" + "ff81",
+		},
+		{
+			// Stored block: five skipped bits, then "xyz".
+			name:    "stored",
+			deflate: "010300fcff78797a",
+			puff:    "000080" + "0278797a" + "ff81",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deflate, _ := hex.DecodeString(tt.deflate)
+			want, _ := hex.DecodeString(tt.puff)
+
+			puff := puffBytes(t, deflate)
+			if !bytes.Equal(puff, want) {
+				t.Fatalf("puff = %x, want %x", puff, want)
+			}
+			if got := huffBytes(t, puff); !bytes.Equal(got, deflate) {
+				t.Fatalf("huff = %x, want %x", got, deflate)
+			}
+		})
+	}
+}
+
+func TestPuffInvalidDeflate(t *testing.T) {
+	tests := []struct {
+		name    string
+		deflate string
+	}{
+		{"reserved block type", "07"},
+		{"stored length check", "0103000000"},
+		{"truncated", "4b4c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deflate, _ := hex.DecodeString(tt.deflate)
+			w := &puffWriter{}
+			if err := puffDeflate(deflate, 0, uint64(len(deflate))*8, w); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
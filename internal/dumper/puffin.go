@@ -0,0 +1,272 @@
+package dumper
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	puffinMagic = "PUF1"
+
+	puffinPatchBsdiff   = 0
+	puffinPatchZucchini = 1
+)
+
+type bitExtent struct {
+	offset uint64
+	length uint64
+}
+
+type puffinStreamInfo struct {
+	deflates   []bitExtent
+	puffs      []bitExtent
+	puffLength uint64
+}
+
+type puffinHeader struct {
+	version   int32
+	src       puffinStreamInfo
+	dst       puffinStreamInfo
+	patchType int32
+}
+
+// ApplyPuffPatch applies a puffin PUFFDIFF patch: src is puffed, the inner
+// patch is applied to the puffed data, and the result is huffed back into
+// deflate streams.
+func ApplyPuffPatch(src, patch []byte) ([]byte, error) {
+	if len(patch) < len(puffinMagic)+4 || string(patch[:len(puffinMagic)]) != puffinMagic {
+		return nil, fmt.Errorf("invalid puffdiff magic")
+	}
+	patch = patch[len(puffinMagic):]
+
+	headerSize := binary.BigEndian.Uint32(patch)
+	patch = patch[4:]
+	if uint64(headerSize) > uint64(len(patch)) {
+		return nil, fmt.Errorf("truncated puffdiff header")
+	}
+
+	header, err := parsePuffinHeader(patch[:headerSize])
+	if err != nil {
+		return nil, fmt.Errorf("invalid puffdiff header: %w", err)
+	}
+	inner := patch[headerSize:]
+
+	puffedSrc, err := puffStream(src, &header.src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to puff source: %w", err)
+	}
+
+	var puffedDst []byte
+	switch header.patchType {
+	case puffinPatchBsdiff:
+		puffedDst, err = ApplyBSDIFF(puffedSrc, inner)
+	case puffinPatchZucchini:
+		puffedDst, err = ApplyZucchini(puffedSrc, inner)
+	default:
+		return nil, fmt.Errorf("unsupported puffdiff patch type %d", header.patchType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(len(puffedDst)) != header.dst.puffLength {
+		return nil, fmt.Errorf("puffed output is %d bytes, expected %d", len(puffedDst), header.dst.puffLength)
+	}
+
+	return huffStream(puffedDst, &header.dst)
+}
+
+// puffStream replaces every deflate stream in data with its puff. Bytes
+// between deflates are copied as is, except that bits belonging to a deflate
+// that starts or ends in the middle of a byte are shifted out.
+func puffStream(data []byte, info *puffinStreamInfo) ([]byte, error) {
+	if len(info.deflates) != len(info.puffs) {
+		return nil, fmt.Errorf("%d deflates but %d puffs", len(info.deflates), len(info.puffs))
+	}
+
+	// puffLength comes from the patch, so it only sizes the buffer up to
+	// a bound instead of being trusted for the allocation.
+	out := make([]byte, 0, min(info.puffLength, 2*uint64(len(data))))
+	limit := uint64(len(data)) * 8
+	var prevEnd uint64
+	for i, deflate := range info.deflates {
+		puff := info.puffs[i]
+		if deflate.offset < prevEnd || deflate.offset > limit || deflate.length > limit-deflate.offset {
+			return nil, fmt.Errorf("deflate %d is out of order or out of range", i)
+		}
+
+		out = appendRawBits(out, data, prevEnd, deflate.offset)
+		if uint64(len(out)) != puff.offset {
+			return nil, fmt.Errorf("puff %d starts at %d, expected %d", i, len(out), puff.offset)
+		}
+
+		w := &puffWriter{out: out}
+		if err := puffDeflate(data, deflate.offset, deflate.offset+deflate.length, w); err != nil {
+			return nil, fmt.Errorf("deflate %d: %w", i, err)
+		}
+		out = w.bytes()
+		if uint64(len(out))-puff.offset != puff.length {
+			return nil, fmt.Errorf("puff %d is %d bytes, expected %d", i, uint64(len(out))-puff.offset, puff.length)
+		}
+
+		prevEnd = deflate.offset + deflate.length
+	}
+
+	out = appendRawBits(out, data, prevEnd, uint64(len(data))*8)
+	if uint64(len(out)) != info.puffLength {
+		return nil, fmt.Errorf("puffed stream is %d bytes, expected %d", len(out), info.puffLength)
+	}
+	return out, nil
+}
+
+// appendRawBits appends the bytes covering bits [start, end) of data,
+// dropping the bits outside of that range.
+func appendRawBits(out, data []byte, start, end uint64) []byte {
+	if start >= end {
+		if start%8 != 0 && start == end {
+			out = append(out, 0)
+		}
+		return out
+	}
+
+	first, last := start/8, (end+7)/8
+	for i := first; i < last; i++ {
+		b := data[i]
+		if i == end/8 && end%8 != 0 {
+			b &= 1<<(end%8) - 1
+		}
+		if i == first {
+			b >>= start % 8
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// huffStream is the inverse of puffStream.
+func huffStream(puffed []byte, info *puffinStreamInfo) ([]byte, error) {
+	if len(info.deflates) != len(info.puffs) {
+		return nil, fmt.Errorf("%d deflates but %d puffs", len(info.deflates), len(info.puffs))
+	}
+
+	bw := &bitWriter{}
+	var pos uint64
+	for i, deflate := range info.deflates {
+		puff := info.puffs[i]
+		if puff.offset < pos || puff.offset > uint64(len(puffed)) || puff.length > uint64(len(puffed))-puff.offset {
+			return nil, fmt.Errorf("puff %d is out of order or out of range", i)
+		}
+
+		writeRawBits(bw, puffed[pos:puff.offset], deflate.offset)
+		if bw.offset() != deflate.offset {
+			return nil, fmt.Errorf("deflate %d starts at bit %d, expected %d", i, bw.offset(), deflate.offset)
+		}
+
+		if err := huffDeflate(puffed[puff.offset:puff.offset+puff.length], bw); err != nil {
+			return nil, fmt.Errorf("puff %d: %w", i, err)
+		}
+		if bw.offset() != deflate.offset+deflate.length {
+			return nil, fmt.Errorf("deflate %d ends at bit %d, expected %d", i, bw.offset(), deflate.offset+deflate.length)
+		}
+
+		pos = puff.offset + puff.length
+	}
+
+	writeRawBits(bw, puffed[pos:], ^uint64(0))
+	return bw.bytes(), nil
+}
+
+// writeRawBits writes raw puff bytes until the bit stream reaches end. The
+// first byte only fills up the current partial byte and the last byte only
+// the bits before end.
+func writeRawBits(bw *bitWriter, raw []byte, end uint64) {
+	for _, b := range raw {
+		n := 8 - bw.offset()%8
+		if remaining := end - bw.offset(); remaining < n {
+			n = remaining
+		}
+		bw.writeBits(uint32(b), uint(n))
+	}
+}
+
+func parsePuffinHeader(b []byte) (*puffinHeader, error) {
+	header := &puffinHeader{}
+	err := parseProtoFields(b, func(num protowire.Number, typ protowire.Type, v uint64, msg []byte) error {
+		var err error
+		switch num {
+		case 1:
+			header.version = int32(v)
+		case 2:
+			err = parsePuffinStreamInfo(msg, &header.src)
+		case 3:
+			err = parsePuffinStreamInfo(msg, &header.dst)
+		case 4:
+			header.patchType = int32(v)
+		}
+		return err
+	})
+	return header, err
+}
+
+func parsePuffinStreamInfo(b []byte, info *puffinStreamInfo) error {
+	return parseProtoFields(b, func(num protowire.Number, typ protowire.Type, v uint64, msg []byte) error {
+		switch num {
+		case 1, 2:
+			var ext bitExtent
+			err := parseProtoFields(msg, func(num protowire.Number, typ protowire.Type, v uint64, msg []byte) error {
+				switch num {
+				case 1:
+					ext.offset = v
+				case 2:
+					ext.length = v
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if num == 1 {
+				info.deflates = append(info.deflates, ext)
+			} else {
+				info.puffs = append(info.puffs, ext)
+			}
+		case 3:
+			info.puffLength = v
+		}
+		return nil
+	})
+}
+
+// parseProtoFields walks the fields of a serialized protobuf message, passing
+// varint values in v and length-delimited payloads in msg.
+func parseProtoFields(b []byte, fn func(num protowire.Number, typ protowire.Type, v uint64, msg []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var v uint64
+		var msg []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			msg, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if err := fn(num, typ, v, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
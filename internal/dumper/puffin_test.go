@@ -0,0 +1,309 @@
+package dumper
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func appendStreamInfo(b []byte, info *puffinStreamInfo) []byte {
+	extent := func(e bitExtent) []byte {
+		var m []byte
+		m = protowire.AppendTag(m, 1, protowire.VarintType)
+		m = protowire.AppendVarint(m, e.offset)
+		m = protowire.AppendTag(m, 2, protowire.VarintType)
+		return protowire.AppendVarint(m, e.length)
+	}
+
+	var m []byte
+	for _, e := range info.deflates {
+		m = protowire.AppendTag(m, 1, protowire.BytesType)
+		m = protowire.AppendBytes(m, extent(e))
+	}
+	for _, e := range info.puffs {
+		m = protowire.AppendTag(m, 2, protowire.BytesType)
+		m = protowire.AppendBytes(m, extent(e))
+	}
+	m = protowire.AppendTag(m, 3, protowire.VarintType)
+	m = protowire.AppendVarint(m, info.puffLength)
+	return protowire.AppendBytes(b, m)
+}
+
+// makePuffPatch wraps an inner patch into a puffin patch the way puffdiff
+// writes it: magic, header size, PatchHeader, inner patch.
+func makePuffPatch(src, dst *puffinStreamInfo, patchType int32, inner []byte) []byte {
+	var header []byte
+	header = protowire.AppendTag(header, 1, protowire.VarintType)
+	header = protowire.AppendVarint(header, 1)
+	header = protowire.AppendTag(header, 2, protowire.BytesType)
+	header = appendStreamInfo(header, src)
+	header = protowire.AppendTag(header, 3, protowire.BytesType)
+	header = appendStreamInfo(header, dst)
+	header = protowire.AppendTag(header, 4, protowire.VarintType)
+	header = protowire.AppendVarint(header, uint64(patchType))
+
+	patch := []byte(puffinMagic)
+	patch = binary.BigEndian.AppendUint32(patch, uint32(len(header)))
+	patch = append(patch, header...)
+	return append(patch, inner...)
+}
+
+// makeRawBSDF2 builds an uncompressed BSDF2 patch with a single control
+// entry: the common prefix is added to old, the rest comes from the extra
+// stream.
+func makeRawBSDF2(old, new []byte) []byte {
+	add := min(len(old), len(new))
+
+	var ctrl []byte
+	ctrl = binary.LittleEndian.AppendUint64(ctrl, uint64(add))
+	ctrl = binary.LittleEndian.AppendUint64(ctrl, uint64(len(new)-add))
+	ctrl = binary.LittleEndian.AppendUint64(ctrl, 0)
+
+	diff := make([]byte, add)
+	for i := range diff {
+		diff[i] = new[i] - old[i]
+	}
+
+	patch := append([]byte(BSDF2_MAGIC), bsdf2None, bsdf2None, bsdf2None)
+	patch = binary.LittleEndian.AppendUint64(patch, uint64(len(ctrl)))
+	patch = binary.LittleEndian.AppendUint64(patch, uint64(len(diff)))
+	patch = binary.LittleEndian.AppendUint64(patch, uint64(len(new)))
+	patch = append(patch, ctrl...)
+	patch = append(patch, diff...)
+	return append(patch, new[add:]...)
+}
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestApplyPuffPatchKnown(t *testing.T) {
+	// The source holds a stored deflate block, the destination a fixed one
+	// ending two bits into its last byte. Both are framed by raw bytes.
+	src := mustHex("474a" + "010300fcff78797a" + "2121")
+	dst := mustHex("474a" + "4b4c4a4e042300" + "2121")
+	srcInfo := &puffinStreamInfo{
+		deflates:   []bitExtent{{offset: 16, length: 64}},
+		puffs:      []bitExtent{{offset: 2, length: 9}},
+		puffLength: 13,
+	}
+	dstInfo := &puffinStreamInfo{
+		deflates:   []bitExtent{{offset: 16, length: 54}},
+		puffs:      []bitExtent{{offset: 2, length: 13}},
+		puffLength: 18,
+	}
+	puffedSrc := mustHex("474a" + "000080" + "0278797a" + "ff81" + "2121")
+	puffedDst := mustHex("474a" + "0000a0" + "0361626361" + "820002" + "ff81" + "00" + "2121")
+
+	patch := makePuffPatch(srcInfo, dstInfo, puffinPatchBsdiff, makeRawBSDF2(puffedSrc, puffedDst))
+	got, err := ApplyPuffPatch(src, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, dst) {
+		t.Fatalf("got %x, want %x", got, dst)
+	}
+}
+
+func TestApplyPuffPatchFlate(t *testing.T) {
+	// Two deflate streams separated by raw bytes, like the entries of a zip.
+	// compress/flate ends a stream with an empty fixed block and pads the
+	// last byte, so the exact length is taken from huffing the puff again.
+	corpus := testCorpus(64 << 10)
+	build := func(a, b []byte, level int) ([]byte, *puffinStreamInfo) {
+		var file, puffed []byte
+		info := &puffinStreamInfo{}
+		for i, part := range [][]byte{a, b} {
+			raw := []byte{'P', 'K', byte(i)}
+			file = append(file, raw...)
+			puffed = append(puffed, raw...)
+
+			deflate := deflateBytes(t, part, level, 0)
+			puff := puffBytes(t, deflate)
+			bw := &bitWriter{}
+			if err := huffDeflate(puff, bw); err != nil {
+				t.Fatal(err)
+			}
+			info.deflates = append(info.deflates, bitExtent{offset: uint64(len(file)) * 8, length: bw.offset()})
+			info.puffs = append(info.puffs, bitExtent{offset: uint64(len(puffed)), length: uint64(len(puff))})
+			file = append(file, deflate...)
+			puffed = append(puffed, puff...)
+			if bw.offset()%8 != 0 {
+				// The padding bits of the last byte follow the puff as a
+				// raw byte.
+				puffed = append(puffed, 0)
+			}
+		}
+		file = append(file, "end"...)
+		puffed = append(puffed, "end"...)
+		info.puffLength = uint64(len(puffed))
+		return file, info
+	}
+
+	tests := []struct {
+		name  string
+		level int
+	}{
+		{"level 1", flate.BestSpeed},
+		{"level 6", flate.DefaultCompression},
+		{"level 9", flate.BestCompression},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, srcInfo := build(corpus[:30000], corpus[30000:50000], tt.level)
+			dst, dstInfo := build(corpus[:31000], corpus[29000:52000], tt.level)
+
+			puffedSrc, err := puffStream(src, srcInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			puffedDst, err := puffStream(dst, dstInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			patch := makePuffPatch(srcInfo, dstInfo, puffinPatchBsdiff, makeRawBSDF2(puffedSrc, puffedDst))
+			got, err := ApplyPuffPatch(src, patch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, dst) {
+				t.Fatal("patched output does not match the destination")
+			}
+		})
+	}
+}
+
+// gzipStreamInfo locates the deflate stream of a gzip file written with -n,
+// which has a 10 byte header and an 8 byte trailer.
+func gzipStreamInfo(t *testing.T, file []byte) *puffinStreamInfo {
+	t.Helper()
+
+	puff := puffBytes(t, file[10:len(file)-8])
+	bw := &bitWriter{}
+	if err := huffDeflate(puff, bw); err != nil {
+		t.Fatal(err)
+	}
+	info := &puffinStreamInfo{
+		deflates:   []bitExtent{{offset: 80, length: bw.offset()}},
+		puffs:      []bitExtent{{offset: 10, length: uint64(len(puff))}},
+		puffLength: 10 + uint64(len(puff)) + 8,
+	}
+	if bw.offset()%8 != 0 {
+		info.puffLength++
+	}
+	return info
+}
+
+func TestApplyPuffPatchGzip(t *testing.T) {
+	// Deflate streams from gzip 1.12, see testdata/puffin/gen.sh.
+	src := readTestdata(t, "puffin/src.gz")
+	dst := readTestdata(t, "puffin/dst.gz")
+
+	t.Run("round trip", func(t *testing.T) {
+		for _, file := range [][]byte{src, dst} {
+			deflate := file[10 : len(file)-8]
+			if got := huffBytes(t, puffBytes(t, deflate)); !bytes.Equal(got, deflate) {
+				t.Fatal("huffed puff does not match the gzip deflate stream")
+			}
+		}
+	})
+
+	t.Run("bsdiff", func(t *testing.T) {
+		srcInfo, dstInfo := gzipStreamInfo(t, src), gzipStreamInfo(t, dst)
+		puffedSrc, err := puffStream(src, srcInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		puffedDst, err := puffStream(dst, dstInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		patch := makePuffPatch(srcInfo, dstInfo, puffinPatchBsdiff, makeRawBSDF2(puffedSrc, puffedDst))
+		got, err := ApplyPuffPatch(src, patch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, dst) {
+			t.Fatal("patched output does not match dst.gz")
+		}
+	})
+
+	t.Run("puffin", func(t *testing.T) {
+		// Made by puffin's own puffdiff, so it checks the puff format and
+		// the patch header against puffin rather than against this code.
+		patch, err := os.ReadFile(filepath.Join("testdata", "puffin", "gzip.puffdiff"))
+		if errors.Is(err, fs.ErrNotExist) {
+			t.Skip("testdata/puffin/gzip.puffdiff has not been generated, see gen.sh there")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := ApplyPuffPatch(src, patch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, dst) {
+			t.Fatal("patched output does not match dst.gz")
+		}
+	})
+}
+
+func TestApplyPuffPatchErrors(t *testing.T) {
+	src := mustHex("474a" + "010300fcff78797a" + "2121")
+	info := &puffinStreamInfo{
+		deflates:   []bitExtent{{offset: 16, length: 64}},
+		puffs:      []bitExtent{{offset: 2, length: 9}},
+		puffLength: 13,
+	}
+	valid := makePuffPatch(info, info, puffinPatchBsdiff, makeRawBSDF2(src, src))
+	withDeflate := func(e bitExtent) *puffinStreamInfo {
+		c := *info
+		c.deflates = []bitExtent{e}
+		return &c
+	}
+	withPuff := func(e bitExtent) *puffinStreamInfo {
+		c := *info
+		c.puffs = []bitExtent{e}
+		return &c
+	}
+
+	tests := []struct {
+		name  string
+		src   []byte
+		patch []byte
+	}{
+		{"bad magic", src, append([]byte("PUF0"), valid[4:]...)},
+		{"truncated header", src, valid[:10]},
+		{"source puff length", src[:len(src)-1], valid},
+		{"unknown patch type", src, makePuffPatch(info, info, 7, nil)},
+		// Offsets and lengths whose sum wraps around must not get past the
+		// range checks.
+		{"deflate length overflows", src, makePuffPatch(withDeflate(bitExtent{16, 1<<64 - 8}), info, puffinPatchBsdiff, makeRawBSDF2(src, src))},
+		{"deflate past the end", src, makePuffPatch(withDeflate(bitExtent{1 << 40, 64}), info, puffinPatchBsdiff, makeRawBSDF2(src, src))},
+		{"puff length overflows", src, makePuffPatch(info, withPuff(bitExtent{2, 1<<64 - 1}), puffinPatchBsdiff, makeRawBSDF2(src, src))},
+		{"puff past the end", src, makePuffPatch(info, withPuff(bitExtent{1 << 40, 9}), puffinPatchBsdiff, makeRawBSDF2(src, src))},
+		{"huge puff length", src, makePuffPatch(&puffinStreamInfo{puffLength: 1 << 62}, info, puffinPatchBsdiff, nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ApplyPuffPatch(tt.src, tt.patch); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,17 @@
+package dumper
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	fallocKeepSize  = 0x01
+	fallocPunchHole = 0x02
+)
+
+// punchHole deallocates the given byte range of f, leaving a hole that reads
+// back as zeros.
+func punchHole(f *os.File, offset, size int64) error {
+	return syscall.Fallocate(int(f.Fd()), fallocPunchHole|fallocKeepSize, offset, size)
+}
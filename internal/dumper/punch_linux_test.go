@@ -0,0 +1,128 @@
+package dumper
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	pb "github.com/OhMyDitzzy/go-payload-dumper/protos"
+)
+
+const seekData = 3
+
+// isHole reports whether f holds no data in [offset, offset+size).
+func isHole(t *testing.T, f *os.File, offset, size int64) bool {
+	t.Helper()
+
+	data, err := f.Seek(offset, seekData)
+	if errors.Is(err, syscall.ENXIO) {
+		return true
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data >= offset+size
+}
+
+// newHoleTestImage returns an image of the given number of blocks. A sparse
+// one starts as a single hole, the other one is filled with data. The test is
+// skipped where the filesystem does not report holes.
+func newHoleTestImage(t *testing.T, blocks int64, sparse bool) *outputImage {
+	t.Helper()
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "system.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	if err := f.Truncate(blocks * 4096); err != nil {
+		t.Fatal(err)
+	}
+	if !isHole(t, f, 0, blocks*4096) {
+		t.Skip("the filesystem of the temporary directory does not report holes")
+	}
+	if !sparse {
+		if _, err := f.WriteAt(testCorpus(int(blocks*4096)), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &outputImage{File: f, sparse: sparse}
+}
+
+func TestSparseOutputHoles(t *testing.T) {
+	const blockSize = 4096
+
+	// checkBlocks checks the contents of the image and which of its blocks
+	// are holes.
+	checkBlocks := func(t *testing.T, out *outputImage, want []byte, holes []bool) {
+		t.Helper()
+
+		got, err := os.ReadFile(out.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatal("image does not match")
+		}
+		for i, hole := range holes {
+			if got := isHole(t, out.File, int64(i)*blockSize, blockSize); got != hole {
+				t.Errorf("block %d: hole = %v, want %v", i, got, hole)
+			}
+		}
+	}
+
+	t.Run("zero blocks", func(t *testing.T) {
+		// Data, zeros, a never written block, zeros and data ending in a
+		// partial block, padded with zeros by Close.
+		corpus := testCorpus(2 * blockSize)
+		data := bytes.Clone(corpus[:blockSize])
+		data = append(data, make([]byte, blockSize)...)
+		data = append(data, make([]byte, blockSize)...)
+		data = append(data, corpus[blockSize:2*blockSize-100]...)
+
+		out := newHoleTestImage(t, 6, true)
+		w := newExtentWriter(out, []*pb.Extent{testExtent(0, 2), testExtent(3, 2)}, blockSize)
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		want := make([]byte, 6*blockSize)
+		copy(want, corpus[:blockSize])
+		copy(want[4*blockSize:], corpus[blockSize:2*blockSize-100])
+		checkBlocks(t, out, want, []bool{false, true, true, true, false, true})
+	})
+
+	for _, typ := range []pb.InstallOperation_Type{pb.InstallOperation_ZERO, pb.InstallOperation_DISCARD} {
+		op := &pb.InstallOperation{
+			Type:       typ.Enum(),
+			DstExtents: []*pb.Extent{testExtent(1, 2), testExtent(4, 1)},
+		}
+
+		t.Run(typ.String(), func(t *testing.T) {
+			// Left alone in a new sparse image.
+			out := newHoleTestImage(t, 6, true)
+			if err := processOperationType(op, bytes.NewReader(nil), out, nil, blockSize); err != nil {
+				t.Fatal(err)
+			}
+			checkBlocks(t, out, make([]byte, 6*blockSize), []bool{true, true, true, true, true, true})
+		})
+
+		t.Run(typ.String()+" in place", func(t *testing.T) {
+			// Punched out of the copy of the base image.
+			out := newHoleTestImage(t, 6, false)
+			if err := processOperationType(op, bytes.NewReader(nil), out, nil, blockSize); err != nil {
+				t.Fatal(err)
+			}
+			want := testCorpus(6 * blockSize)
+			clear(want[1*blockSize : 3*blockSize])
+			clear(want[4*blockSize : 5*blockSize])
+			checkBlocks(t, out, want, []bool{false, true, true, false, true, false})
+		})
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package dumper
+
+import (
+	"errors"
+	"os"
+)
+
+func punchHole(f *os.File, offset, size int64) error {
+	return errors.ErrUnsupported
+}
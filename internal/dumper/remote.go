@@ -0,0 +1,195 @@
+package dumper
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	remoteBlockSize   = 1 << 20
+	remoteCacheBlocks = 32
+)
+
+// httpReaderAt serves reads from a remote file with HTTP Range requests,
+// keeping the most recently used blocks in memory.
+type httpReaderAt struct {
+	url    string
+	client *http.Client
+	size   int64
+
+	mu     sync.Mutex
+	blocks map[int64]*list.Element
+	lru    *list.List
+}
+
+type cachedBlock struct {
+	index int64
+	data  []byte
+}
+
+func newHTTPReaderAt(client *http.Client, url string) (*httpReaderAt, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, errRangeUnsupported
+	}
+
+	size, err := parseContentRangeSize(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &httpReaderAt{
+		url:    url,
+		client: client,
+		size:   size,
+		blocks: make(map[int64]*list.Element),
+		lru:    list.New(),
+	}, nil
+}
+
+var errRangeUnsupported = fmt.Errorf("server does not support range requests")
+
+func parseContentRangeSize(header string) (int64, error) {
+	idx := strings.LastIndexByte(header, '/')
+	if idx < 0 || header[idx+1:] == "*" {
+		return 0, fmt.Errorf("invalid Content-Range header: %q", header)
+	}
+	return strconv.ParseInt(header[idx+1:], 10, 64)
+}
+
+func (r *httpReaderAt) Size() int64 {
+	return r.size
+}
+
+func (r *httpReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset")
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	want := len(p)
+	if remaining := r.size - off; int64(want) > remaining {
+		want = int(remaining)
+	}
+
+	n := 0
+	for n < want {
+		pos := off + int64(n)
+		index := pos / remoteBlockSize
+
+		block := r.cached(index)
+		if block == nil {
+			lastIndex := (off + int64(want) - 1) / remoteBlockSize
+			end := index + 1
+			for end <= lastIndex && r.cached(end) == nil {
+				end++
+			}
+
+			var err error
+			block, err = r.fetch(index, end)
+			if err != nil {
+				return n, err
+			}
+		}
+
+		n += copy(p[n:want], block[pos-index*remoteBlockSize:])
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *httpReaderAt) cached(index int64) []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if elem, ok := r.blocks[index]; ok {
+		r.lru.MoveToFront(elem)
+		return elem.Value.(*cachedBlock).data
+	}
+	return nil
+}
+
+func (r *httpReaderAt) store(index int64, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if elem, ok := r.blocks[index]; ok {
+		r.lru.MoveToFront(elem)
+		return
+	}
+
+	r.blocks[index] = r.lru.PushFront(&cachedBlock{index: index, data: data})
+	for r.lru.Len() > remoteCacheBlocks {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.blocks, oldest.Value.(*cachedBlock).index)
+	}
+}
+
+// fetch downloads blocks [first, end) with a single request, caches them and
+// returns the first one.
+func (r *httpReaderAt) fetch(first, end int64) ([]byte, error) {
+	start := first * remoteBlockSize
+	stop := end * remoteBlockSize
+	if stop > r.size {
+		stop = r.size
+	}
+
+	req, err := http.NewRequest(http.MethodGet, r.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, stop-1))
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("range request failed: %s", resp.Status)
+	}
+
+	var firstBlock []byte
+	for index := first; index < end; index++ {
+		blockStart := index * remoteBlockSize
+		blockEnd := blockStart + remoteBlockSize
+		if blockEnd > r.size {
+			blockEnd = r.size
+		}
+
+		data := make([]byte, blockEnd-blockStart)
+		if _, err := io.ReadFull(resp.Body, data); err != nil {
+			return nil, fmt.Errorf("range request truncated: %w", err)
+		}
+
+		r.store(index, data)
+		if firstBlock == nil {
+			firstBlock = data
+		}
+	}
+
+	return firstBlock, nil
+}
@@ -0,0 +1,217 @@
+package dumper
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rangeServer serves data, with or without support for Range requests, and
+// records the Range header of every request.
+type rangeServer struct {
+	data   []byte
+	ranges bool
+
+	mu       sync.Mutex
+	requests []string
+}
+
+func (s *rangeServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, req.Header.Get("Range"))
+	s.mu.Unlock()
+
+	if s.ranges {
+		http.ServeContent(w, req, "payload.bin", time.Time{}, bytes.NewReader(s.data))
+		return
+	}
+	w.Write(s.data)
+}
+
+// take returns the requests made since the last call.
+func (s *rangeServer) take() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	requests := s.requests
+	s.requests = nil
+	return requests
+}
+
+func newRangeServer(t *testing.T, size int, ranges bool) (*rangeServer, string) {
+	t.Helper()
+
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	s := &rangeServer{data: data, ranges: ranges}
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	return s, server.URL + "/payload.bin"
+}
+
+func TestHTTPReaderAt(t *testing.T) {
+	// Three and a half blocks, so the last block is partial.
+	size := 3*remoteBlockSize + remoteBlockSize/2
+	s, url := newRangeServer(t, size, true)
+
+	r, err := newHTTPReaderAt(http.DefaultClient, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != int64(size) {
+		t.Fatalf("size = %d, want %d", r.Size(), size)
+	}
+	if got := s.take(); len(got) != 1 || got[0] != "bytes=0-0" {
+		t.Fatalf("probe requests = %q", got)
+	}
+
+	tests := []struct {
+		name     string
+		off      int64
+		n        int
+		requests []string
+		wantErr  error
+	}{
+		{
+			name:     "within a block",
+			off:      100,
+			n:        1000,
+			requests: []string{"bytes=0-1048575"},
+		},
+		{
+			name:     "cached block",
+			off:      5000,
+			n:        10,
+			requests: nil,
+		},
+		{
+			// Block 0 is cached, blocks 1 and 2 are fetched together.
+			name:     "spanning blocks",
+			off:      remoteBlockSize - 10,
+			n:        remoteBlockSize + 20,
+			requests: []string{"bytes=1048576-3145727"},
+		},
+		{
+			name:     "partial last block",
+			off:      int64(size) - 100,
+			n:        100,
+			requests: []string{"bytes=3145728-3670015"},
+		},
+		{
+			name:     "past the end",
+			off:      int64(size) - 10,
+			n:        20,
+			requests: nil,
+			wantErr:  io.EOF,
+		},
+		{
+			name:    "at the end",
+			off:     int64(size),
+			n:       1,
+			wantErr: io.EOF,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := make([]byte, tt.n)
+			n, err := r.ReadAt(p, tt.off)
+			if err != tt.wantErr {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			want := s.data[min(tt.off, int64(size)):min(tt.off+int64(tt.n), int64(size))]
+			if n != len(want) || !bytes.Equal(p[:n], want) {
+				t.Fatalf("read %d bytes at %d, want %d matching bytes", n, tt.off, len(want))
+			}
+			got := s.take()
+			if len(got) != len(tt.requests) {
+				t.Fatalf("requests = %q, want %q", got, tt.requests)
+			}
+			for i := range got {
+				if got[i] != tt.requests[i] {
+					t.Fatalf("requests = %q, want %q", got, tt.requests)
+				}
+			}
+		})
+	}
+}
+
+func TestHTTPReaderAtEviction(t *testing.T) {
+	s, url := newRangeServer(t, (remoteCacheBlocks+1)*remoteBlockSize, true)
+
+	r, err := newHTTPReaderAt(http.DefaultClient, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.take()
+
+	// Read every block once, one at a time. The last one evicts block 0.
+	p := make([]byte, 1)
+	for i := int64(0); i <= remoteCacheBlocks; i++ {
+		if _, err := r.ReadAt(p, i*remoteBlockSize); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := len(s.take()); got != remoteCacheBlocks+1 {
+		t.Fatalf("%d requests, want %d", got, remoteCacheBlocks+1)
+	}
+	if r.lru.Len() != remoteCacheBlocks || len(r.blocks) != remoteCacheBlocks {
+		t.Fatalf("%d cached blocks, want %d", r.lru.Len(), remoteCacheBlocks)
+	}
+
+	// Block 1 is still cached; reading it makes block 2 the oldest.
+	if _, err := r.ReadAt(p, remoteBlockSize); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.take(); len(got) != 0 {
+		t.Fatalf("cached block was fetched again: %q", got)
+	}
+
+	// Block 0 was evicted and is fetched again, evicting block 2.
+	if _, err := r.ReadAt(p, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.take(); len(got) != 1 || got[0] != "bytes=0-1048575" {
+		t.Fatalf("requests = %q, want block 0", got)
+	}
+	if _, ok := r.blocks[1]; !ok {
+		t.Fatal("recently used block 1 was evicted")
+	}
+	if _, ok := r.blocks[2]; ok {
+		t.Fatal("least recently used block 2 was not evicted")
+	}
+}
+
+func TestOpenRemoteFileWithoutRanges(t *testing.T) {
+	s, url := newRangeServer(t, 3*remoteBlockSize/2, false)
+
+	if _, err := newHTTPReaderAt(http.DefaultClient, url); !errors.Is(err, errRangeUnsupported) {
+		t.Fatalf("err = %v, want %v", err, errRangeUnsupported)
+	}
+	s.take()
+
+	// The payload is downloaded once instead.
+	src, err := openRemoteFile(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.closer.Close()
+
+	if src.remote || src.size != int64(len(s.data)) {
+		t.Fatalf("remote = %v, size = %d, want a local copy of %d bytes", src.remote, src.size, len(s.data))
+	}
+	got := make([]byte, len(s.data))
+	if _, err := src.reader.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, s.data) {
+		t.Fatal("downloaded payload does not match")
+	}
+	if requests := s.take(); len(requests) != 2 {
+		t.Fatalf("requests = %q, want the probe and one download", requests)
+	}
+}
@@ -0,0 +1,182 @@
+package dumper
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	pb "github.com/OhMyDitzzy/go-payload-dumper/protos"
+	"google.golang.org/protobuf/proto"
+)
+
+// PublicKey is a key that OTA signatures can be checked against. Name
+// identifies the key in verification results.
+type PublicKey struct {
+	Name string
+	Key  crypto.PublicKey
+}
+
+// LoadPublicKeys reads RSA or EC public keys from PEM or DER encoded
+// certificates and public key files, such as the AOSP testkey.x509.pem.
+func LoadPublicKeys(paths []string) ([]PublicKey, error) {
+	var keys []PublicKey
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		parsed, err := parsePublicKeys(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		for i, key := range parsed {
+			name := path
+			if len(parsed) > 1 {
+				name = fmt.Sprintf("%s#%d", path, i)
+			}
+			keys = append(keys, PublicKey{Name: name, Key: key})
+		}
+	}
+	return keys, nil
+}
+
+func parsePublicKeys(data []byte) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		var key crypto.PublicKey
+		var err error
+		switch block.Type {
+		case "CERTIFICATE":
+			key, err = parseCertificateKey(block.Bytes)
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) > 0 {
+		return keys, nil
+	}
+
+	if key, err := parseCertificateKey(data); err == nil {
+		return []crypto.PublicKey{key}, nil
+	}
+	if key, err := x509.ParsePKIXPublicKey(data); err == nil {
+		return []crypto.PublicKey{key}, nil
+	}
+	return nil, fmt.Errorf("no certificate or public key found")
+}
+
+func parseCertificateKey(der []byte) (crypto.PublicKey, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return cert.PublicKey, nil
+}
+
+// verifySignatures checks a serialized Signatures message against digest and
+// returns the first key that produced one of its signatures.
+func verifySignatures(blob, digest []byte, keys []PublicKey) (*PublicKey, error) {
+	sigs := &pb.Signatures{}
+	if err := proto.Unmarshal(blob, sigs); err != nil {
+		return nil, fmt.Errorf("failed to parse signatures: %w", err)
+	}
+	if len(sigs.Signatures) == 0 {
+		return nil, fmt.Errorf("no signatures present")
+	}
+
+	for _, sig := range sigs.Signatures {
+		data := sig.Data
+		if sig.UnpaddedSignatureSize != nil && int(*sig.UnpaddedSignatureSize) <= len(data) {
+			data = data[:*sig.UnpaddedSignatureSize]
+		}
+
+		for i := range keys {
+			if verifySignature(keys[i].Key, digest, data) {
+				return &keys[i], nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("none of the %d signatures matches the supplied keys", len(sigs.Signatures))
+}
+
+func verifySignature(key crypto.PublicKey, digest, sig []byte) bool {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest, sig) == nil
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, digest, sig)
+	default:
+		return false
+	}
+}
+
+func (d *Dumper) verifyMetadataSignature(keys []PublicKey) (*PublicKey, error) {
+	if len(d.metadataSignature) == 0 {
+		return nil, fmt.Errorf("payload has no metadata signature")
+	}
+
+	digest, err := d.hashPayloadRange(0, d.metadataSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return verifySignatures(d.metadataSignature, digest, keys)
+}
+
+// VerifyPayloadSignature checks the signature blob referenced by the manifest
+// signatures_offset/size against keys. The signed hash covers everything from
+// the start of the payload up to the signature blob itself.
+func (d *Dumper) VerifyPayloadSignature(keys []PublicKey) (*PublicKey, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no public keys supplied")
+	}
+	if d.manifest.SignaturesOffset == nil || d.manifest.SignaturesSize == nil || *d.manifest.SignaturesSize == 0 {
+		return nil, fmt.Errorf("payload is not signed")
+	}
+
+	// Both fields are unchecked uint64s, so the range is checked before
+	// either one is converted to an offset.
+	dataSize := uint64(d.payloadSize - d.dataOffset)
+	if *d.manifest.SignaturesOffset > dataSize || *d.manifest.SignaturesSize > dataSize-*d.manifest.SignaturesOffset {
+		return nil, fmt.Errorf("signature blob at %d+%d is beyond the end of the payload data (%d bytes)",
+			*d.manifest.SignaturesOffset, *d.manifest.SignaturesSize, dataSize)
+	}
+	sigOffset := d.dataOffset + int64(*d.manifest.SignaturesOffset)
+	sigSize := int64(*d.manifest.SignaturesSize)
+
+	digest, err := d.hashPayloadRange(0, sigOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	blob := make([]byte, sigSize)
+	if _, err := d.payloadFile.ReadAt(blob, sigOffset); err != nil {
+		return nil, err
+	}
+
+	return verifySignatures(blob, digest, keys)
+}
@@ -0,0 +1,291 @@
+package dumper
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"strings"
+	"testing"
+
+	pb "github.com/OhMyDitzzy/go-payload-dumper/protos"
+	"google.golang.org/protobuf/proto"
+)
+
+// testSigner signs SHA-256 digests the way update_engine does for its key.
+type testSigner struct {
+	key  PublicKey
+	sign func(digest []byte) []byte
+}
+
+func newTestSigners(t *testing.T) (rsaSigner, ecSigner testSigner) {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaSigner = testSigner{
+		key: PublicKey{Name: "rsa", Key: &rsaKey.PublicKey},
+		sign: func(digest []byte) []byte {
+			sig, err := rsa.SignPKCS1v15(nil, rsaKey, crypto.SHA256, digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return sig
+		},
+	}
+	ecSigner = testSigner{
+		key: PublicKey{Name: "ec", Key: &ecKey.PublicKey},
+		sign: func(digest []byte) []byte {
+			sig, err := ecdsa.SignASN1(rand.Reader, ecKey, digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return sig
+		},
+	}
+	return rsaSigner, ecSigner
+}
+
+// signaturesBlob serializes a Signatures message. A negative unpadded size
+// leaves unpadded_signature_size unset.
+func signaturesBlob(t *testing.T, sigs [][]byte, unpadded []int) []byte {
+	t.Helper()
+
+	msg := &pb.Signatures{}
+	for i, data := range sigs {
+		sig := &pb.Signatures_Signature{Data: data}
+		if unpadded[i] >= 0 {
+			sig.UnpaddedSignatureSize = proto.Uint32(uint32(unpadded[i]))
+		}
+		msg.Signatures = append(msg.Signatures, sig)
+	}
+	blob, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blob
+}
+
+func TestVerifyMetadataSignature(t *testing.T) {
+	rsaSigner, ecSigner := newTestSigners(t)
+	_, otherSigner := newTestSigners(t)
+
+	metadata := testCorpus(3000)
+	digest := sha256.Sum256(metadata)
+	rsaSig := rsaSigner.sign(digest[:])
+	ecSig := ecSigner.sign(digest[:])
+
+	// update_engine pads EC signatures to the largest DER size and records
+	// the real size in unpadded_signature_size. A signature that already has
+	// that size would not be padded, so the padded cases need a shorter one.
+	for len(ecSig) == 72 {
+		ecSig = ecSigner.sign(digest[:])
+	}
+	paddedECSig := append(bytes.Clone(ecSig), make([]byte, 72-len(ecSig))...)
+	tamperedRSASig := bytes.Clone(rsaSig)
+	tamperedRSASig[len(tamperedRSASig)/2] ^= 1
+
+	tests := []struct {
+		name     string
+		blob     []byte
+		metadata []byte
+		keys     []PublicKey
+		wantKey  string
+		wantErr  string
+	}{
+		{
+			name:    "RSA",
+			blob:    signaturesBlob(t, [][]byte{rsaSig}, []int{-1}),
+			keys:    []PublicKey{rsaSigner.key},
+			wantKey: "rsa",
+		},
+		{
+			name:    "EC",
+			blob:    signaturesBlob(t, [][]byte{ecSig}, []int{len(ecSig)}),
+			keys:    []PublicKey{ecSigner.key},
+			wantKey: "ec",
+		},
+		{
+			name:    "padded EC",
+			blob:    signaturesBlob(t, [][]byte{paddedECSig}, []int{len(ecSig)}),
+			keys:    []PublicKey{ecSigner.key},
+			wantKey: "ec",
+		},
+		{
+			name:    "padded EC without unpadded size",
+			blob:    signaturesBlob(t, [][]byte{paddedECSig}, []int{-1}),
+			keys:    []PublicKey{ecSigner.key},
+			wantErr: "none of the 1 signatures",
+		},
+		{
+			name:    "unpadded size past the data",
+			blob:    signaturesBlob(t, [][]byte{rsaSig}, []int{len(rsaSig) + 1}),
+			keys:    []PublicKey{rsaSigner.key},
+			wantKey: "rsa",
+		},
+		{
+			name:    "second key",
+			blob:    signaturesBlob(t, [][]byte{ecSig}, []int{-1}),
+			keys:    []PublicKey{rsaSigner.key, otherSigner.key, ecSigner.key},
+			wantKey: "ec",
+		},
+		{
+			name:    "second signature",
+			blob:    signaturesBlob(t, [][]byte{rsaSig, ecSig}, []int{-1, -1}),
+			keys:    []PublicKey{ecSigner.key},
+			wantKey: "ec",
+		},
+		{
+			name:    "wrong key",
+			blob:    signaturesBlob(t, [][]byte{ecSig}, []int{-1}),
+			keys:    []PublicKey{otherSigner.key, rsaSigner.key},
+			wantErr: "none of the 1 signatures",
+		},
+		{
+			name:    "tampered signature",
+			blob:    signaturesBlob(t, [][]byte{tamperedRSASig}, []int{-1}),
+			keys:    []PublicKey{rsaSigner.key},
+			wantErr: "none of the 1 signatures",
+		},
+		{
+			name:     "tampered metadata",
+			blob:     signaturesBlob(t, [][]byte{rsaSig, ecSig}, []int{-1, -1}),
+			metadata: append([]byte{metadata[0] ^ 1}, metadata[1:]...),
+			keys:     []PublicKey{rsaSigner.key, ecSigner.key},
+			wantErr:  "none of the 2 signatures",
+		},
+		{
+			name:    "empty blob",
+			blob:    nil,
+			keys:    []PublicKey{rsaSigner.key},
+			wantErr: "no metadata signature",
+		},
+		{
+			name:    "malformed blob",
+			blob:    []byte{0x0a, 0xff},
+			keys:    []PublicKey{rsaSigner.key},
+			wantErr: "failed to parse signatures",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := metadata
+			if tt.metadata != nil {
+				data = tt.metadata
+			}
+			// The signature is followed by the data blobs, which it does
+			// not cover.
+			payload := append(bytes.Clone(data), tt.blob...)
+			payload = append(payload, testCorpus(500)...)
+			d := &Dumper{
+				payloadFile:       bytes.NewReader(payload),
+				payloadSize:       int64(len(payload)),
+				metadataSize:      int64(len(data)),
+				metadataSignature: tt.blob,
+			}
+
+			key, err := d.verifyMetadataSignature(tt.keys)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key.Name != tt.wantKey {
+				t.Fatalf("verified with %s, want %s", key.Name, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestVerifySignaturesEmpty(t *testing.T) {
+	rsaSigner, _ := newTestSigners(t)
+	digest := sha256.Sum256(nil)
+
+	// A Signatures message without signatures serializes to nothing.
+	for _, blob := range [][]byte{nil, signaturesBlob(t, nil, nil), {0x0a, 0x00}} {
+		if _, err := verifySignatures(blob, digest[:], []PublicKey{rsaSigner.key}); err == nil {
+			t.Fatalf("blob %x verified", blob)
+		}
+	}
+}
+
+func TestVerifyPayloadSignature(t *testing.T) {
+	rsaSigner, ecSigner := newTestSigners(t)
+
+	// Header and manifest, then the data blobs, then the signature blob
+	// at signatures_offset into the data and whatever follows it. The
+	// signature covers everything before the blob.
+	const dataOffset = 1000
+	signed := testCorpus(5000)
+	digest := sha256.Sum256(signed)
+	blob := signaturesBlob(t, [][]byte{rsaSigner.sign(digest[:])}, []int{-1})
+	payload := append(bytes.Clone(signed), blob...)
+	payload = append(payload, testCorpus(100)...)
+
+	tests := []struct {
+		name    string
+		flip    int
+		offset  uint64
+		size    uint64
+		keys    []PublicKey
+		wantErr string
+	}{
+		{name: "signed", flip: -1, offset: 4000, size: uint64(len(blob)), keys: []PublicKey{ecSigner.key, rsaSigner.key}},
+		{name: "wrong key", flip: -1, offset: 4000, size: uint64(len(blob)), keys: []PublicKey{ecSigner.key}, wantErr: "none of the 1 signatures"},
+		{name: "flipped header byte", flip: 10, offset: 4000, size: uint64(len(blob)), keys: []PublicKey{rsaSigner.key}, wantErr: "none of the 1 signatures"},
+		{name: "flipped data byte", flip: len(signed) - 1, offset: 4000, size: uint64(len(blob)), keys: []PublicKey{rsaSigner.key}, wantErr: "none of the 1 signatures"},
+		{name: "flipped byte after the blob", flip: len(payload) - 1, offset: 4000, size: uint64(len(blob)), keys: []PublicKey{rsaSigner.key}},
+		{name: "flipped signature byte", flip: len(signed) + len(blob) - 1, offset: 4000, size: uint64(len(blob)), keys: []PublicKey{rsaSigner.key}, wantErr: "none of the 1 signatures"},
+		{name: "blob past the end", flip: -1, offset: 4101, size: uint64(len(blob)), keys: []PublicKey{rsaSigner.key}, wantErr: "beyond the end"},
+		{name: "offset past the end", flip: -1, offset: 1 << 20, size: 1, keys: []PublicKey{rsaSigner.key}, wantErr: "beyond the end"},
+		{name: "offset overflows", flip: -1, offset: 1 << 63, size: 1, keys: []PublicKey{rsaSigner.key}, wantErr: "beyond the end"},
+		{name: "size overflows", flip: -1, offset: 4000, size: 1<<64 - 4000, keys: []PublicKey{rsaSigner.key}, wantErr: "beyond the end"},
+		{name: "not signed", flip: -1, offset: 4000, size: 0, keys: []PublicKey{rsaSigner.key}, wantErr: "not signed"},
+		{name: "no keys", flip: -1, offset: 4000, size: uint64(len(blob)), wantErr: "no public keys"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := bytes.Clone(payload)
+			if tt.flip >= 0 {
+				data[tt.flip] ^= 1
+			}
+			d := &Dumper{
+				payloadFile: bytes.NewReader(data),
+				payloadSize: int64(len(data)),
+				dataOffset:  dataOffset,
+				manifest: &pb.DeltaArchiveManifest{
+					SignaturesOffset: proto.Uint64(tt.offset),
+					SignaturesSize:   proto.Uint64(tt.size),
+				},
+			}
+
+			key, err := d.VerifyPayloadSignature(tt.keys)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key.Name != "rsa" {
+				t.Fatalf("verified with %s, want rsa", key.Name)
+			}
+		})
+	}
+}
@@ -0,0 +1,384 @@
+package dumper
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+
+	pb "github.com/OhMyDitzzy/go-payload-dumper/protos"
+)
+
+// Android sparse image format, as written by libsparse and img2simg.
+const (
+	sparseMagic           = 0xed26ff3a
+	sparseMajorVersion    = 1
+	sparseHeaderSize      = 28
+	sparseChunkHeaderSize = 12
+
+	chunkTypeRaw      = 0xcac1
+	chunkTypeFill     = 0xcac2
+	chunkTypeDontCare = 0xcac3
+	chunkTypeCRC32    = 0xcac4
+)
+
+// sparseChunk is a run of blocks that is stored the same way.
+type sparseChunk struct {
+	kind   uint16
+	start  uint32
+	blocks uint32
+	fill   uint32
+}
+
+func (c sparseChunk) size(blockSize uint32) int64 {
+	switch c.kind {
+	case chunkTypeRaw:
+		return sparseChunkHeaderSize + int64(c.blocks)*int64(blockSize)
+	case chunkTypeFill, chunkTypeCRC32:
+		return sparseChunkHeaderSize + 4
+	default:
+		return sparseChunkHeaderSize
+	}
+}
+
+// sparseImage describes how an image is laid out as sparse chunks.
+type sparseImage struct {
+	raw       io.ReaderAt
+	size      int64
+	blockSize uint32
+	blocks    uint32
+	chunks    []sparseChunk
+}
+
+// sparseCareMap reports which blocks of a partition hold data. Blocks that no
+// operation writes, and the extents of ZERO and DISCARD operations, become
+// DONT_CARE chunks. The generated hash tree and FEC data are data too.
+// In-place updates start from the base image, so every block is kept except
+// the zeroed ones.
+func sparseCareMap(part *pb.PartitionUpdate, blockSize uint64, blocks uint32, inPlace bool) []bool {
+	care := make([]bool, blocks)
+	if inPlace {
+		for i := range care {
+			care[i] = true
+		}
+	}
+
+	mark := func(ext *pb.Extent, v bool) {
+		for b := ext.GetStartBlock(); b < ext.GetStartBlock()+ext.GetNumBlocks() && b < uint64(blocks); b++ {
+			care[b] = v
+		}
+	}
+	for _, op := range part.Operations {
+		zeroed := op.GetType() == pb.InstallOperation_ZERO || op.GetType() == pb.InstallOperation_DISCARD
+		for _, ext := range op.DstExtents {
+			mark(ext, !zeroed)
+		}
+	}
+	for _, ext := range []*pb.Extent{part.HashTreeExtent, part.FecExtent} {
+		if ext != nil {
+			mark(ext, true)
+		}
+	}
+	return care
+}
+
+// planSparseImage classifies the blocks of raw. Blocks outside care are
+// DONT_CARE, blocks made of a single repeated 32-bit word are FILL chunks and
+// everything else is stored as RAW chunks of at most maxRawBlocks blocks.
+func planSparseImage(raw io.ReaderAt, size int64, blockSize uint32, care []bool, maxRawBlocks uint32) (*sparseImage, error) {
+	img := &sparseImage{
+		raw:       raw,
+		size:      size,
+		blockSize: blockSize,
+		blocks:    uint32((size + int64(blockSize) - 1) / int64(blockSize)),
+	}
+
+	add := func(c sparseChunk) {
+		if n := len(img.chunks); n > 0 {
+			last := &img.chunks[n-1]
+			if last.kind == c.kind && last.fill == c.fill && last.start+last.blocks == c.start &&
+				(c.kind != chunkTypeRaw || last.blocks < maxRawBlocks) {
+				last.blocks++
+				return
+			}
+		}
+		img.chunks = append(img.chunks, c)
+	}
+
+	const batchBlocks = 256
+	buf := make([]byte, batchBlocks*int(blockSize))
+	for b := uint32(0); b < img.blocks; {
+		if b < uint32(len(care)) && !care[b] {
+			add(sparseChunk{kind: chunkTypeDontCare, start: b, blocks: 1})
+			b++
+			continue
+		}
+
+		n := uint32(1)
+		for n < batchBlocks && b+n < img.blocks && (b+n >= uint32(len(care)) || care[b+n]) {
+			n++
+		}
+		batch := buf[:int(n)*int(blockSize)]
+		if err := readPadded(raw, batch, int64(b)*int64(blockSize)); err != nil {
+			return nil, err
+		}
+
+		for i := uint32(0); i < n; i++ {
+			block := batch[int(i)*int(blockSize) : int(i+1)*int(blockSize)]
+			if fill, ok := fillValue(block); ok {
+				add(sparseChunk{kind: chunkTypeFill, start: b + i, blocks: 1, fill: fill})
+			} else {
+				add(sparseChunk{kind: chunkTypeRaw, start: b + i, blocks: 1})
+			}
+		}
+		b += n
+	}
+
+	return img, nil
+}
+
+// readPadded fills p from r at off, zero-padding past the end of r like
+// libsparse does for the last partial block.
+func readPadded(r io.ReaderAt, p []byte, off int64) error {
+	n, err := r.ReadAt(p, off)
+	if err == io.EOF {
+		clear(p[n:])
+		return nil
+	}
+	return err
+}
+
+func fillValue(block []byte) (uint32, bool) {
+	if len(block) < 4 || !bytes.Equal(block[4:], block[:len(block)-4]) {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(block), true
+}
+
+// split groups the chunks into images of at most maxSize bytes each. Every
+// image covers the whole partition; the blocks before and after its chunks
+// are DONT_CARE.
+func (img *sparseImage) split(maxSize int64, withCRC bool) ([][]sparseChunk, error) {
+	if maxSize <= 0 {
+		return [][]sparseChunk{img.chunks}, nil
+	}
+
+	budget := maxSize - sparseOverhead(withCRC)
+	var parts [][]sparseChunk
+	var cur []sparseChunk
+	var used int64
+	for _, c := range img.chunks {
+		size := c.size(img.blockSize)
+		if size > budget {
+			return nil, fmt.Errorf("sparse chunk of %d bytes does not fit in %d bytes", size, maxSize)
+		}
+		if used+size > budget {
+			parts = append(parts, cur)
+			cur, used = nil, 0
+		}
+		cur = append(cur, c)
+		used += size
+	}
+	return append(parts, cur), nil
+}
+
+// sparseOverhead is the size of a sparse file apart from its chunks: the
+// header, the DONT_CARE chunks padding it to the full partition and the CRC32
+// chunk.
+func sparseOverhead(withCRC bool) int64 {
+	n := int64(sparseHeaderSize + 2*sparseChunkHeaderSize)
+	if withCRC {
+		n += sparseChunkHeaderSize + 4
+	}
+	return n
+}
+
+// writeSparseImage writes raw to path in the Android sparse format. When
+// maxSize is set and the image does not fit, it is split into files named
+// path_sparsechunk.N that fastboot flashes one after another. The total size
+// of the written files is returned.
+func writeSparseImage(path string, raw io.ReaderAt, size int64, blockSize uint32, care []bool, withCRC bool, maxSize int64) (uint64, error) {
+	maxRawBlocks, err := sparseMaxRawBlocks(blockSize, withCRC, maxSize)
+	if err != nil {
+		return 0, err
+	}
+
+	img, err := planSparseImage(raw, size, blockSize, care, maxRawBlocks)
+	if err != nil {
+		return 0, err
+	}
+
+	parts, err := img.split(maxSize, withCRC)
+	if err != nil {
+		return 0, err
+	}
+
+	names := []string{path}
+	if len(parts) > 1 {
+		names = names[:0]
+		for i := range parts {
+			names = append(names, fmt.Sprintf("%s_sparsechunk.%d", path, i))
+		}
+	}
+
+	var total uint64
+	for i, chunks := range parts {
+		if err := img.writeFile(names[i], chunks, withCRC); err != nil {
+			return 0, err
+		}
+		stat, err := os.Stat(names[i])
+		if err != nil {
+			return 0, err
+		}
+		total += uint64(stat.Size())
+	}
+	return total, nil
+}
+
+// sparseMaxRawBlocks returns how many blocks a RAW chunk may hold. The chunk
+// size, header included, is a 32-bit field, and with maxSize set a chunk must
+// also fit in a single file.
+func sparseMaxRawBlocks(blockSize uint32, withCRC bool, maxSize int64) (uint32, error) {
+	maxRawBlocks := uint32((1<<32 - sparseChunkHeaderSize) / int64(blockSize))
+	if maxSize > 0 {
+		budget := maxSize - sparseOverhead(withCRC) - sparseChunkHeaderSize
+		if budget < int64(blockSize) {
+			return 0, fmt.Errorf("sparse file size limit %d is too small", maxSize)
+		}
+		maxRawBlocks = uint32(min(budget/int64(blockSize), int64(maxRawBlocks)))
+	}
+	return maxRawBlocks, nil
+}
+
+func (img *sparseImage) writeFile(path string, chunks []sparseChunk, withCRC bool) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Pad to the full partition so every file of a split image is valid on
+	// its own.
+	var start, end uint32
+	if len(chunks) > 0 {
+		start = chunks[0].start
+		last := chunks[len(chunks)-1]
+		end = last.start + last.blocks
+	}
+	if start > 0 {
+		chunks = append([]sparseChunk{{kind: chunkTypeDontCare, blocks: start}}, chunks...)
+	}
+	if end < img.blocks {
+		chunks = append(chunks, sparseChunk{kind: chunkTypeDontCare, start: end, blocks: img.blocks - end})
+	}
+
+	totalChunks := len(chunks)
+	if withCRC {
+		totalChunks++
+	}
+
+	w := bufio.NewWriterSize(f, copyBufferSize)
+	header := []any{
+		uint32(sparseMagic),
+		uint16(sparseMajorVersion),
+		uint16(0),
+		uint16(sparseHeaderSize),
+		uint16(sparseChunkHeaderSize),
+		img.blockSize,
+		img.blocks,
+		uint32(totalChunks),
+		uint32(0),
+	}
+	for _, v := range header {
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+
+	crc := crc32.NewIEEE()
+	for _, c := range chunks {
+		if err := img.writeChunk(w, c, crc, withCRC); err != nil {
+			return err
+		}
+	}
+
+	if withCRC {
+		crcChunk := sparseChunk{kind: chunkTypeCRC32}
+		if err := writeChunkHeader(w, crcChunk, crcChunk.size(img.blockSize)); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, crc.Sum32()); err != nil {
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeChunk writes c. When withCRC is set, crc is updated with the chunk as
+// it expands on the device, DONT_CARE blocks counting as zeros like in
+// libsparse.
+func (img *sparseImage) writeChunk(w io.Writer, c sparseChunk, crc io.Writer, withCRC bool) error {
+	length := int64(c.blocks) * int64(img.blockSize)
+	if err := writeChunkHeader(w, c, c.size(img.blockSize)); err != nil {
+		return err
+	}
+
+	switch c.kind {
+	case chunkTypeRaw:
+		buf := make([]byte, min(length, copyBufferSize))
+		for off := int64(0); off < length; off += int64(len(buf)) {
+			chunk := buf[:min(length-off, int64(len(buf)))]
+			if err := readPadded(img.raw, chunk, int64(c.start)*int64(img.blockSize)+off); err != nil {
+				return err
+			}
+			if _, err := w.Write(chunk); err != nil {
+				return err
+			}
+			if withCRC {
+				crc.Write(chunk)
+			}
+		}
+	case chunkTypeFill:
+		if err := binary.Write(w, binary.LittleEndian, c.fill); err != nil {
+			return err
+		}
+		if withCRC {
+			writeRepeated(crc, c.fill, length)
+		}
+	case chunkTypeDontCare:
+		if withCRC {
+			writeRepeated(crc, 0, length)
+		}
+	}
+	return nil
+}
+
+func writeChunkHeader(w io.Writer, c sparseChunk, totalSize int64) error {
+	if totalSize > math.MaxUint32 {
+		return fmt.Errorf("sparse chunk of %d bytes does not fit in the chunk header", totalSize)
+	}
+	header := make([]byte, sparseChunkHeaderSize)
+	binary.LittleEndian.PutUint16(header[0:], c.kind)
+	binary.LittleEndian.PutUint32(header[4:], c.blocks)
+	binary.LittleEndian.PutUint32(header[8:], uint32(totalSize))
+	_, err := w.Write(header)
+	return err
+}
+
+func writeRepeated(w io.Writer, word uint32, n int64) {
+	buf := make([]byte, min(n, copyBufferSize))
+	for i := 0; i < len(buf); i += 4 {
+		binary.LittleEndian.PutUint32(buf[i:], word)
+	}
+	for ; n > 0; n -= int64(len(buf)) {
+		w.Write(buf[:min(n, int64(len(buf)))])
+	}
+}
@@ -0,0 +1,246 @@
+package dumper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// unsparse applies the sparse file data onto out the way fastboot flashes
+// it, checking the header and the CRC32 chunk when there is one.
+func unsparse(t *testing.T, data, out []byte) (chunkTypes []uint16) {
+	t.Helper()
+
+	if binary.LittleEndian.Uint32(data) != sparseMagic {
+		t.Fatal("bad sparse magic")
+	}
+	blockSize := int(binary.LittleEndian.Uint32(data[12:]))
+	if blocks := int(binary.LittleEndian.Uint32(data[16:])); blocks*blockSize != len(out) {
+		t.Fatalf("sparse image has %d blocks of %d bytes, want %d bytes", blocks, blockSize, len(out))
+	}
+	total := int(binary.LittleEndian.Uint32(data[20:]))
+
+	crc := crc32.NewIEEE()
+	pos, off := 0, sparseHeaderSize
+	for i := 0; i < total; i++ {
+		kind := binary.LittleEndian.Uint16(data[off:])
+		n := int(binary.LittleEndian.Uint32(data[off+4:])) * blockSize
+		size := int(binary.LittleEndian.Uint32(data[off+8:]))
+		body := data[off+sparseChunkHeaderSize : off+size]
+		chunkTypes = append(chunkTypes, kind)
+
+		switch kind {
+		case chunkTypeRaw:
+			if len(body) != n {
+				t.Fatalf("raw chunk of %d blocks holds %d bytes", n/blockSize, len(body))
+			}
+			copy(out[pos:], body)
+			crc.Write(body)
+		case chunkTypeFill:
+			for j := 0; j < n; j += 4 {
+				copy(out[pos+j:], body[:4])
+			}
+			crc.Write(out[pos : pos+n])
+		case chunkTypeDontCare:
+			crc.Write(make([]byte, n))
+		case chunkTypeCRC32:
+			if binary.LittleEndian.Uint32(body) != crc.Sum32() {
+				t.Fatal("CRC32 chunk does not match the image")
+			}
+		}
+		pos += n
+		off += size
+	}
+	if off != len(data) || pos != len(out) {
+		t.Fatalf("chunks cover %d of %d bytes and %d of %d blocks", off, len(data), pos/blockSize, len(out)/blockSize)
+	}
+	return chunkTypes
+}
+
+func TestWriteSparseImage(t *testing.T) {
+	const blockSize = 4096
+
+	// Random blocks, a run of zeros, a fill pattern, blocks outside the
+	// care map and a partial last block.
+	raw := make([]byte, 39*blockSize+100)
+	rand.New(rand.NewSource(1)).Read(raw)
+	clear(raw[5*blockSize : 10*blockSize])
+	for i := 10 * blockSize; i < 15*blockSize; i += 4 {
+		binary.LittleEndian.PutUint32(raw[i:], 0xdeadbeef)
+	}
+	care := make([]bool, 40)
+	for i := range care {
+		care[i] = i < 15 || i >= 20
+	}
+
+	want := make([]byte, 40*blockSize)
+	copy(want, raw)
+	clear(want[15*blockSize : 20*blockSize])
+
+	tests := []struct {
+		name    string
+		withCRC bool
+		maxSize int64
+		files   int
+	}{
+		{name: "single file", files: 1},
+		{name: "with CRC", withCRC: true, files: 1},
+		{name: "split", maxSize: 8*blockSize + 200, files: 4},
+		{name: "split with CRC", withCRC: true, maxSize: 8*blockSize + 200, files: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "system.img")
+			total, err := writeSparseImage(path, bytes.NewReader(raw), int64(len(raw)), blockSize, care, tt.withCRC, tt.maxSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			names := []string{path}
+			if tt.files > 1 {
+				names, _ = filepath.Glob(path + "_sparsechunk.*")
+			}
+			if len(names) != tt.files {
+				t.Fatalf("wrote %d files, want %d", len(names), tt.files)
+			}
+
+			got := make([]byte, len(want))
+			var size int64
+			kinds := map[uint16]int{}
+			for _, name := range names {
+				data, err := os.ReadFile(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tt.maxSize > 0 && int64(len(data)) > tt.maxSize {
+					t.Fatalf("%s is %d bytes, over the %d byte limit", name, len(data), tt.maxSize)
+				}
+				size += int64(len(data))
+				for _, kind := range unsparse(t, data, got) {
+					kinds[kind]++
+				}
+			}
+			if uint64(size) != total {
+				t.Fatalf("reported %d bytes, wrote %d", total, size)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatal("unsparsed image does not match")
+			}
+			if kinds[chunkTypeFill] == 0 || kinds[chunkTypeDontCare] == 0 || (kinds[chunkTypeCRC32] > 0) != tt.withCRC {
+				t.Fatalf("unexpected chunk types %v", kinds)
+			}
+		})
+	}
+}
+
+func TestSparseMaxRawBlocks(t *testing.T) {
+	tests := []struct {
+		name      string
+		blockSize uint32
+		withCRC   bool
+		maxSize   int64
+		want      uint32
+		wantErr   bool
+	}{
+		// RAW chunk sizes must fit in 32 bits with the chunk header.
+		{name: "4K blocks", blockSize: 4096, want: 1<<20 - 1},
+		{name: "512 byte blocks", blockSize: 512, want: 1<<23 - 1},
+		{name: "64K blocks", blockSize: 65536, want: 1<<16 - 1},
+		{name: "size limit", blockSize: 4096, maxSize: 1 << 20, want: 255},
+		{name: "size limit with CRC", blockSize: 4096, withCRC: true, maxSize: 256<<12 + 80, want: 256},
+		{name: "size limit with CRC one byte short", blockSize: 4096, withCRC: true, maxSize: 256<<12 + 79, want: 255},
+		{name: "size limit above 4G", blockSize: 4096, maxSize: 8 << 30, want: 1<<20 - 1},
+		{name: "size limit too small", blockSize: 4096, maxSize: 4096, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sparseMaxRawBlocks(tt.blockSize, tt.withCRC, tt.maxSize)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("got %d blocks, want %d", got, tt.want)
+			}
+			if size := (sparseChunk{kind: chunkTypeRaw, blocks: got}).size(tt.blockSize); size >= 1<<32 {
+				t.Fatalf("a chunk of %d blocks is %d bytes", got, size)
+			}
+		})
+	}
+}
+
+func TestWriteChunkHeaderOverflow(t *testing.T) {
+	c := sparseChunk{kind: chunkTypeRaw, blocks: 1 << 20}
+	if err := writeChunkHeader(io.Discard, c, c.size(4096)); err == nil {
+		t.Fatal("expected an error for a 4 GiB chunk")
+	}
+	c.blocks--
+	if err := writeChunkHeader(io.Discard, c, c.size(4096)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// patternReader is an image of random blocks that repeat every MiB.
+type patternReader struct {
+	pattern []byte
+	size    int64
+}
+
+func (r *patternReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), r.size-off))
+	for i := 0; i < n; {
+		i += copy(p[i:n], r.pattern[(off+int64(i))%int64(len(r.pattern)):])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func TestPlanSparseImageOver4GiB(t *testing.T) {
+	const blockSize = 4096
+	pattern := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(pattern)
+	raw := &patternReader{pattern: pattern, size: 9 << 29}
+
+	maxRawBlocks, err := sparseMaxRawBlocks(blockSize, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := planSparseImage(raw, raw.size, blockSize, nil, maxRawBlocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 4.5 GiB of data needs two RAW chunks, the first one as large as a
+	// chunk header allows.
+	if len(img.chunks) != 2 {
+		t.Fatalf("got %d chunks, want 2", len(img.chunks))
+	}
+	var blocks uint32
+	for _, c := range img.chunks {
+		if c.kind != chunkTypeRaw {
+			t.Fatalf("chunk at block %d has type %#x", c.start, c.kind)
+		}
+		if err := writeChunkHeader(io.Discard, c, c.size(blockSize)); err != nil {
+			t.Fatal(err)
+		}
+		blocks += c.blocks
+	}
+	if img.chunks[0].blocks != maxRawBlocks || blocks != img.blocks {
+		t.Fatalf("chunks of %d and %d blocks for an image of %d blocks", img.chunks[0].blocks, img.chunks[1].blocks, img.blocks)
+	}
+}
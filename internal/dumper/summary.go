@@ -0,0 +1,54 @@
+package dumper
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+type PartitionResult struct {
+	Name         string
+	Size         uint64
+	Duration     time.Duration
+	Discarded    uint64
+	Verification VerificationStatus
+	// OutputSize is the size of the written files when the image is stored
+	// as a sparse or compressed image, and 0 for raw images.
+	OutputSize uint64
+}
+
+// Results returns the outcome of every partition processed by Extract so far.
+func (d *Dumper) Results() []PartitionResult {
+	return d.results
+}
+
+// WriteSummary prints a table of the processed partitions. The OUTPUT column
+// with the size of the written files is only shown for sparse or compressed
+// output.
+func (d *Dumper) WriteSummary(w io.Writer) error {
+	showOutput := d.sparseImage || d.compression != ""
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "PARTITION\tSIZE\t")
+	if showOutput {
+		fmt.Fprintf(tw, "OUTPUT\t")
+	}
+	fmt.Fprintf(tw, "DISCARDED\tTIME\tHASH CHECK\n")
+	for _, r := range d.results {
+		discarded := "-"
+		if r.Discarded > 0 {
+			discarded = formatBytes(r.Discarded)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t", r.Name, formatBytes(r.Size))
+		if showOutput {
+			output := "-"
+			if r.OutputSize > 0 {
+				output = formatBytes(r.OutputSize)
+			}
+			fmt.Fprintf(tw, "%s\t", output)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", discarded, formatDuration(r.Duration), r.Verification)
+	}
+	return tw.Flush()
+}
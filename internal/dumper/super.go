@@ -0,0 +1,374 @@
+package dumper
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	pb "github.com/OhMyDitzzy/go-payload-dumper/protos"
+)
+
+// Logical partition (liblp) metadata format, see
+// system/core/fs_mgr/liblp/include/liblp/metadata_format.h.
+const (
+	lpGeometryMagic      = 0x616c4467
+	lpHeaderMagic        = 0x414c5030
+	lpMajorVersion       = 10
+	lpSectorSize         = 512
+	lpReservedBytes      = 4096
+	lpGeometrySize       = 4096
+	lpGeometryStructSize = 52
+	lpHeaderSizeV1_0     = 128
+	lpHeaderSizeV1_2     = 256
+
+	lpPartitionEntrySize   = 52
+	lpExtentEntrySize      = 24
+	lpGroupEntrySize       = 48
+	lpBlockDeviceEntrySize = 64
+	lpNameSize             = 36
+
+	lpPartitionAttrReadonly = 1 << 0
+	lpTargetTypeLinear      = 0
+	lpHeaderFlagVirtualAB   = 1 << 0
+
+	lpDefaultMetadataSize = 65536
+	lpDefaultAlignment    = 1 << 20
+	lpLogicalBlockSize    = 4096
+	lpSuperPartitionName  = "super"
+)
+
+// SuperOptions controls how BuildSuperImage assembles super.img.
+type SuperOptions struct {
+	// Size is the size of the super partition. When 0 it is computed from
+	// the group sizes in the manifest.
+	Size int64
+	// Sparse writes super.img in the Android sparse format.
+	Sparse bool
+	// SparseCRC adds a CRC32 chunk to the sparse image.
+	SparseCRC bool
+	// SparseMaxSize splits the sparse image into files of at most this many
+	// bytes.
+	SparseMaxSize int64
+}
+
+type lpPartition struct {
+	name        string
+	group       int
+	image       string
+	size        uint64
+	firstExtent int
+	numExtents  int
+}
+
+type lpExtent struct {
+	sectors uint64
+	start   uint64
+}
+
+type lpGroup struct {
+	name    string
+	maxSize uint64
+}
+
+// lpMetadata is the metadata of a super partition laid out like lpmake does:
+// every group and partition exists for slots a and b, and only the slot a
+// partitions have extents.
+type lpMetadata struct {
+	size               uint64
+	slots              uint32
+	firstLogicalSector uint64
+	virtualAB          bool
+	groups             []lpGroup
+	partitions         []lpPartition
+	extents            []lpExtent
+}
+
+// BuildSuperImage assembles super.img in the output directory from the
+// dynamic partition metadata of the manifest and the raw images of its
+// member partitions, which must have been extracted already.
+func (d *Dumper) BuildSuperImage(opts SuperOptions) error {
+	dpm := d.manifest.GetDynamicPartitionMetadata()
+	if len(dpm.GetGroups()) == 0 {
+		return fmt.Errorf("payload has no dynamic partition metadata")
+	}
+
+	md, err := d.planSuper(dpm, opts.Size)
+	if err != nil {
+		return err
+	}
+
+	blob, err := md.serialize()
+	if err != nil {
+		return err
+	}
+
+	outPath := filepath.Join(d.outDir, lpSuperPartitionName+".img")
+	var f *os.File
+	if opts.Sparse {
+		f, err = os.CreateTemp(d.outDir, "."+lpSuperPartitionName+"-*.img")
+		if err == nil {
+			defer os.Remove(f.Name())
+		}
+	} else {
+		f, err = os.Create(outPath)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	out := &outputImage{File: f, sparse: true}
+	if err := out.Truncate(int64(md.size)); err != nil {
+		return err
+	}
+
+	geometry := md.geometry()
+	for _, off := range []int64{lpReservedBytes, lpReservedBytes + lpGeometrySize} {
+		if _, err := out.WriteAt(geometry, off); err != nil {
+			return err
+		}
+	}
+	for slot := uint32(0); slot < md.slots; slot++ {
+		for _, off := range []uint64{md.primaryMetadataOffset(slot), md.backupMetadataOffset(slot)} {
+			if _, err := out.WriteAt(blob, int64(off)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, p := range md.partitions {
+		if p.numExtents == 0 {
+			continue
+		}
+		if err := md.copyPartition(out, p); err != nil {
+			return fmt.Errorf("failed to copy %s into super image: %w", p.name, err)
+		}
+	}
+
+	if opts.Sparse {
+		care := md.careMap()
+		if _, err := writeSparseImage(outPath, f, int64(md.size), lpLogicalBlockSize, care, opts.SparseCRC, opts.SparseMaxSize); err != nil {
+			return fmt.Errorf("failed to write sparse image: %w", err)
+		}
+	}
+
+	return f.Close()
+}
+
+func (d *Dumper) planSuper(dpm *pb.DynamicPartitionMetadata, size int64) (*lpMetadata, error) {
+	md := &lpMetadata{slots: 2, virtualAB: dpm.GetSnapshotEnabled()}
+	if md.virtualAB {
+		// Virtual A/B devices keep a third metadata slot for snapshots.
+		md.slots = 3
+	}
+
+	sizes := make(map[string]uint64)
+	for _, part := range d.manifest.Partitions {
+		sizes[part.GetPartitionName()] = part.GetNewPartitionInfo().GetSize()
+	}
+
+	metadataEnd := uint64(lpReservedBytes + 2*(lpGeometrySize+lpDefaultMetadataSize*int(md.slots)))
+	md.firstLogicalSector = alignUp(metadataEnd, lpDefaultAlignment) / lpSectorSize
+
+	// Slot b groups only need room of their own when both slots live in
+	// super, which is not the case for virtual A/B.
+	var groupsSize uint64
+	for _, g := range dpm.GetGroups() {
+		groupsSize += g.GetSize()
+	}
+	if !md.virtualAB {
+		groupsSize *= 2
+	}
+	if size%lpLogicalBlockSize != 0 {
+		return nil, fmt.Errorf("super partition size %d is not a multiple of %d", size, lpLogicalBlockSize)
+	}
+	md.size = uint64(size)
+	if size == 0 {
+		md.size = md.firstLogicalSector*lpSectorSize + alignUp(groupsSize, lpDefaultAlignment)
+	}
+
+	md.groups = append(md.groups, lpGroup{name: "default"})
+	next := md.firstLogicalSector * lpSectorSize
+	for _, suffix := range []string{"_a", "_b"} {
+		for _, g := range dpm.GetGroups() {
+			md.groups = append(md.groups, lpGroup{name: g.GetName() + suffix, maxSize: g.GetSize()})
+			group := len(md.groups) - 1
+
+			var used uint64
+			for _, name := range g.GetPartitionNames() {
+				p := lpPartition{name: name + suffix, group: group, firstExtent: len(md.extents)}
+				if suffix == "_a" {
+					partSize, ok := sizes[name]
+					if !ok {
+						return nil, fmt.Errorf("partition %s of group %s is not in the payload", name, g.GetName())
+					}
+					p.size = alignUp(partSize, lpLogicalBlockSize)
+					p.image = filepath.Join(d.outDir, name+".img")
+				}
+
+				if p.size > 0 {
+					start := alignUp(next, lpDefaultAlignment)
+					if size != 0 && start+p.size > md.size {
+						return nil, fmt.Errorf("partition %s does not fit in a %d byte super partition", p.name, md.size)
+					}
+					md.extents = append(md.extents, lpExtent{sectors: p.size / lpSectorSize, start: start / lpSectorSize})
+					p.numExtents = 1
+					next = start + p.size
+					used += p.size
+				}
+				md.partitions = append(md.partitions, p)
+			}
+
+			if g.GetSize() > 0 && used > g.GetSize() {
+				return nil, fmt.Errorf("partitions of group %s need %d bytes, the group allows %d", g.GetName(), used, g.GetSize())
+			}
+		}
+	}
+
+	// Without a size from the caller super grows to fit groups that do not
+	// declare their size.
+	if size == 0 {
+		md.size = max(md.size, alignUp(next, lpDefaultAlignment))
+	}
+
+	return md, nil
+}
+
+func alignUp(n, alignment uint64) uint64 {
+	return (n + alignment - 1) / alignment * alignment
+}
+
+func (md *lpMetadata) primaryMetadataOffset(slot uint32) uint64 {
+	return lpReservedBytes + 2*lpGeometrySize + uint64(slot)*lpDefaultMetadataSize
+}
+
+func (md *lpMetadata) backupMetadataOffset(slot uint32) uint64 {
+	return md.primaryMetadataOffset(md.slots) + uint64(slot)*lpDefaultMetadataSize
+}
+
+func (md *lpMetadata) geometry() []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, []uint32{lpGeometryMagic, lpGeometryStructSize})
+	b.Write(make([]byte, sha256.Size))
+	binary.Write(&b, binary.LittleEndian, []uint32{lpDefaultMetadataSize, md.slots, lpLogicalBlockSize})
+
+	geometry := b.Bytes()
+	sum := sha256.Sum256(geometry)
+	copy(geometry[8:], sum[:])
+	return append(geometry, make([]byte, lpGeometrySize-len(geometry))...)
+}
+
+// serialize encodes the metadata header and tables like liblp's
+// SerializeMetadata.
+func (md *lpMetadata) serialize() ([]byte, error) {
+	var partitions, extents, groups, devices bytes.Buffer
+
+	for _, p := range md.partitions {
+		partitions.Write(lpName(p.name))
+		binary.Write(&partitions, binary.LittleEndian, []uint32{lpPartitionAttrReadonly, uint32(p.firstExtent), uint32(p.numExtents), uint32(p.group)})
+	}
+	for _, e := range md.extents {
+		binary.Write(&extents, binary.LittleEndian, e.sectors)
+		binary.Write(&extents, binary.LittleEndian, uint32(lpTargetTypeLinear))
+		binary.Write(&extents, binary.LittleEndian, e.start)
+		binary.Write(&extents, binary.LittleEndian, uint32(0))
+	}
+	for _, g := range md.groups {
+		groups.Write(lpName(g.name))
+		binary.Write(&groups, binary.LittleEndian, uint32(0))
+		binary.Write(&groups, binary.LittleEndian, g.maxSize)
+	}
+	binary.Write(&devices, binary.LittleEndian, md.firstLogicalSector)
+	binary.Write(&devices, binary.LittleEndian, []uint32{lpDefaultAlignment, 0})
+	binary.Write(&devices, binary.LittleEndian, md.size)
+	devices.Write(lpName(lpSuperPartitionName))
+	binary.Write(&devices, binary.LittleEndian, uint32(0))
+
+	var tables bytes.Buffer
+	var descriptors []uint32
+	for _, t := range []struct {
+		buf       *bytes.Buffer
+		entrySize uint32
+	}{
+		{&partitions, lpPartitionEntrySize},
+		{&extents, lpExtentEntrySize},
+		{&groups, lpGroupEntrySize},
+		{&devices, lpBlockDeviceEntrySize},
+	} {
+		descriptors = append(descriptors, uint32(tables.Len()), uint32(t.buf.Len())/t.entrySize, t.entrySize)
+		tables.Write(t.buf.Bytes())
+	}
+
+	// The virtual A/B flag needs the 1.2 header, which adds a flags field.
+	minor, headerSize := uint16(0), uint32(lpHeaderSizeV1_0)
+	if md.virtualAB {
+		minor, headerSize = 2, lpHeaderSizeV1_2
+	}
+
+	var header bytes.Buffer
+	binary.Write(&header, binary.LittleEndian, uint32(lpHeaderMagic))
+	binary.Write(&header, binary.LittleEndian, []uint16{lpMajorVersion, minor})
+	binary.Write(&header, binary.LittleEndian, headerSize)
+	header.Write(make([]byte, sha256.Size))
+	binary.Write(&header, binary.LittleEndian, uint32(tables.Len()))
+	tablesSum := sha256.Sum256(tables.Bytes())
+	header.Write(tablesSum[:])
+	binary.Write(&header, binary.LittleEndian, descriptors)
+	if md.virtualAB {
+		binary.Write(&header, binary.LittleEndian, uint32(lpHeaderFlagVirtualAB))
+		header.Write(make([]byte, lpHeaderSizeV1_2-lpHeaderSizeV1_0-4))
+	}
+
+	blob := header.Bytes()
+	headerSum := sha256.Sum256(blob)
+	copy(blob[12:], headerSum[:])
+	blob = append(blob, tables.Bytes()...)
+
+	if len(blob) > lpDefaultMetadataSize {
+		return nil, fmt.Errorf("super metadata is %d bytes, more than the %d bytes reserved for it", len(blob), lpDefaultMetadataSize)
+	}
+	return blob, nil
+}
+
+func lpName(name string) []byte {
+	b := make([]byte, lpNameSize)
+	copy(b, name)
+	return b
+}
+
+// copyPartition copies the image of p into its extent, leaving zero blocks as
+// holes.
+func (md *lpMetadata) copyPartition(out *outputImage, p lpPartition) error {
+	img, err := os.Open(p.image)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	e := md.extents[p.firstExtent]
+	startBlock := e.start * lpSectorSize / lpLogicalBlockSize
+	numBlocks := e.sectors * lpSectorSize / lpLogicalBlockSize
+	extents := []*pb.Extent{{StartBlock: &startBlock, NumBlocks: &numBlocks}}
+
+	op := &pb.InstallOperation{DstExtents: extents}
+	return streamDstExtents(op, img, out, lpLogicalBlockSize)
+}
+
+// careMap marks the blocks of the metadata and the partition extents as data;
+// everything else in super is free space.
+func (md *lpMetadata) careMap() []bool {
+	care := make([]bool, alignUp(md.size, lpLogicalBlockSize)/lpLogicalBlockSize)
+	for b := uint64(0); b < md.firstLogicalSector*lpSectorSize/lpLogicalBlockSize; b++ {
+		care[b] = true
+	}
+	for _, e := range md.extents {
+		start := e.start * lpSectorSize / lpLogicalBlockSize
+		for b := start; b < start+e.sectors*lpSectorSize/lpLogicalBlockSize; b++ {
+			care[b] = true
+		}
+	}
+	return care
+}
@@ -0,0 +1,138 @@
+package dumper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/OhMyDitzzy/go-payload-dumper/protos"
+	"google.golang.org/protobuf/proto"
+)
+
+// sparseReadAt reads p at off from the image a single sparse file expands
+// to, DONT_CARE blocks reading as zeros.
+func sparseReadAt(t *testing.T, data, p []byte, off int64) {
+	t.Helper()
+
+	clear(p)
+	blockSize := int64(binary.LittleEndian.Uint32(data[12:]))
+	total := int(binary.LittleEndian.Uint32(data[20:]))
+	pos, chunk := int64(0), int64(sparseHeaderSize)
+	for i := 0; i < total; i++ {
+		kind := binary.LittleEndian.Uint16(data[chunk:])
+		n := int64(binary.LittleEndian.Uint32(data[chunk+4:])) * blockSize
+		size := int64(binary.LittleEndian.Uint32(data[chunk+8:]))
+		body := data[chunk+sparseChunkHeaderSize : chunk+size]
+		if kind == chunkTypeRaw && int64(len(body)) != n {
+			t.Fatalf("raw chunk at block %d has a size of %d bytes for %d blocks", pos/blockSize, size, n/blockSize)
+		}
+
+		// The part of p that this chunk covers.
+		lo, hi := max(pos, off), min(pos+n, off+int64(len(p)))
+		for j := lo; j < hi; j++ {
+			switch kind {
+			case chunkTypeRaw:
+				p[j-off] = body[j-pos]
+			case chunkTypeFill:
+				p[j-off] = body[(j-pos)%4]
+			}
+		}
+		pos += n
+		chunk += size
+	}
+	if chunk != int64(len(data)) {
+		t.Fatalf("chunks end at %d of %d bytes", chunk, len(data))
+	}
+}
+
+func TestBuildSuperImageOver4GiB(t *testing.T) {
+	// A 5 GiB super partition whose members take the first few MiB; the
+	// free space after them is DONT_CARE in the sparse image.
+	const superSize = 5 << 30
+
+	dir := t.TempDir()
+	rng := rand.New(rand.NewSource(1))
+	images := map[string][]byte{
+		"system": make([]byte, 3<<20),
+		"vendor": make([]byte, 1<<20+4096),
+	}
+	for name, data := range images {
+		rng.Read(data[:len(data)/2])
+		if err := os.WriteFile(filepath.Join(dir, name+".img"), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := &Dumper{
+		outDir: dir,
+		manifest: &pb.DeltaArchiveManifest{
+			Partitions: []*pb.PartitionUpdate{
+				{PartitionName: proto.String("system"), NewPartitionInfo: &pb.PartitionInfo{Size: proto.Uint64(uint64(len(images["system"])))}},
+				{PartitionName: proto.String("vendor"), NewPartitionInfo: &pb.PartitionInfo{Size: proto.Uint64(uint64(len(images["vendor"])))}},
+			},
+			DynamicPartitionMetadata: &pb.DynamicPartitionMetadata{
+				Groups: []*pb.DynamicPartitionGroup{
+					{Name: proto.String("main"), PartitionNames: []string{"system", "vendor"}},
+				},
+				SnapshotEnabled: proto.Bool(true),
+			},
+		},
+	}
+
+	// With three metadata slots the partitions start at 1 MiB, each one
+	// aligned to 1 MiB.
+	offsets := map[string]int64{"system": 1 << 20, "vendor": 4 << 20}
+
+	for _, sparse := range []bool{false, true} {
+		if err := d.BuildSuperImage(SuperOptions{Size: superSize, Sparse: sparse, SparseCRC: true}); err != nil {
+			t.Fatalf("sparse %v: %v", sparse, err)
+		}
+
+		path := filepath.Join(dir, lpSuperPartitionName+".img")
+		var readAt func(p []byte, off int64)
+		if sparse {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if blocks := binary.LittleEndian.Uint32(data[16:]); blocks != superSize/lpLogicalBlockSize {
+				t.Fatalf("sparse super.img has %d blocks, want %d", blocks, superSize/lpLogicalBlockSize)
+			}
+			readAt = func(p []byte, off int64) { sparseReadAt(t, data, p, off) }
+		} else {
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			stat, err := f.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stat.Size() != superSize {
+				t.Fatalf("super.img is %d bytes, want %d", stat.Size(), superSize)
+			}
+			readAt = func(p []byte, off int64) {
+				if _, err := f.ReadAt(p, off); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		for name, data := range images {
+			got := make([]byte, len(data))
+			readAt(got, offsets[name])
+			if !bytes.Equal(got, data) {
+				t.Fatalf("sparse %v: %s is not at offset %d of super.img", sparse, name, offsets[name])
+			}
+		}
+		tail := make([]byte, 1<<20)
+		readAt(tail, superSize-int64(len(tail)))
+		if !bytes.Equal(tail, make([]byte, len(tail))) {
+			t.Fatalf("sparse %v: the end of super.img is not zero", sparse)
+		}
+	}
+}
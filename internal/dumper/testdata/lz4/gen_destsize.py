@@ -0,0 +1,21 @@
+# Prints the destSize golden table of lz4_test.go, using liblz4 1.9.4:
+#   python3 gen_destsize.py /path/to/liblz4.so.1.9.4
+import ctypes, hashlib, sys
+
+lib = ctypes.CDLL(sys.argv[1])
+assert lib.LZ4_versionNumber() == 10904
+data = open("input.bin", "rb").read()
+
+for offset in (0, 30000, 70000):
+    src = data[offset:offset + 65536]
+    for target in (64, 1000, 4096):
+        for level in (0, 3, 9, 10, 11, 12):
+            dst = ctypes.create_string_buffer(target)
+            size = ctypes.c_int(len(src))
+            if level == 0:
+                n = lib.LZ4_compress_destSize(src, dst, ctypes.byref(size), target)
+            else:
+                state = ctypes.create_string_buffer(lib.LZ4_sizeofStateHC())
+                n = lib.LZ4_compress_HC_destSize(state, src, dst, ctypes.byref(size), target, level)
+            digest = hashlib.sha256(dst.raw[:n]).hexdigest()
+            print('{%d, %d, %d, %d, %d, "%s"},' % (offset, target, level, size.value, n, digest))
@@ -0,0 +1,84 @@
+# Generates the LZ4DIFF fixture (lz4diff.src, lz4diff.dst, lz4diff.patch)
+# with liblz4 1.9.4:
+#   python3 gen_lz4diff.py /path/to/liblz4.so.1.9.4
+#
+# Source and destination are EROFS style: the data is cut into 4 KiB
+# clusters with LZ4_compress_HC_destSize and each compressed block is zero
+# padded at the front. The last destination cluster gets a postfix patch,
+# the inner patch is a bzip2 BSDF2 patch.
+import bz2, ctypes, hashlib, struct, sys
+
+lib = ctypes.CDLL(sys.argv[1])
+assert lib.LZ4_versionNumber() == 10904
+CLUSTER = 4096
+LEVEL = 9
+
+
+def varint(v):
+    out = bytearray()
+    while True:
+        b = v & 0x7F
+        v >>= 7
+        if v:
+            out.append(b | 0x80)
+        else:
+            out.append(b)
+            return bytes(out)
+
+
+def field(num, v):
+    if isinstance(v, int):
+        return varint(num << 3) + varint(v)
+    return varint(num << 3 | 2) + varint(len(v)) + v
+
+
+def compress(data):
+    clusters, blocks, pos = [], [], 0
+    while pos < len(data):
+        state = ctypes.create_string_buffer(lib.LZ4_sizeofStateHC())
+        dst = ctypes.create_string_buffer(CLUSTER)
+        size = ctypes.c_int(len(data) - pos)
+        n = lib.LZ4_compress_HC_destSize(state, data[pos:], dst, ctypes.byref(size), CLUSTER, LEVEL)
+        clusters.append(bytes(CLUSTER - n) + dst.raw[:n])
+        blocks.append((pos, size.value))
+        pos += size.value
+    return clusters, blocks
+
+
+def bsdf2(old, new, alg=0):
+    add = min(len(old), len(new))
+    ctrl = struct.pack("<QQQ", add, len(new) - add, 0)
+    diff = bytes((n - o) & 0xFF for o, n in zip(old, new))
+    extra = new[add:]
+    if alg == 1:
+        ctrl, diff, extra = bz2.compress(ctrl), bz2.compress(diff), bz2.compress(extra)
+    return (b"BSDF2" + bytes([alg] * 3) + struct.pack("<QQQ", len(ctrl), len(diff), len(new))
+            + ctrl + diff + extra)
+
+
+data = open("input.bin", "rb").read()
+old = data
+new = old[:5000] + b"inserted by the update " * 40 + old[5000:60000].replace(b"system", b"SYSTEM") + old[61000:]
+
+src_clusters, src_blocks = compress(old)
+dst_clusters, dst_blocks = compress(new)
+actual = list(dst_clusters)
+actual[-1] = b"postfix!" + actual[-1][8:]
+
+def file_info(blocks, clusters, postfix):
+    out = b""
+    for i, (offset, length) in enumerate(blocks):
+        block = field(1, offset) + field(2, length) + field(3, CLUSTER)
+        if postfix and i == len(blocks) - 1:
+            block += field(4, bsdf2(clusters[i], actual[i]))
+            block += field(5, hashlib.sha256(clusters[i]).digest())
+        out += field(1, block)
+    return out + field(2, field(1, 2) + field(2, LEVEL)) + field(3, 1)
+
+header = field(1, file_info(src_blocks, src_clusters, False)) + field(2, file_info(dst_blocks, dst_clusters, True)) + field(3, 0)
+patch = b"LZ4DIFF" + struct.pack(">II", 1, len(header)) + header + bsdf2(old, new, 1)
+
+open("lz4diff.src", "wb").write(b"".join(src_clusters))
+open("lz4diff.dst", "wb").write(b"".join(actual))
+open("lz4diff.patch", "wb").write(patch)
+print(len(src_blocks), len(dst_blocks), len(patch))
@@ -0,0 +1,16 @@
+#!/bin/sh
+# Regenerates the puffin fixtures with gzip 1.12 and puffin's command line
+# tool from AOSP external/puffin:
+#   sh gen.sh
+set -e
+python3 gen_input.py
+
+# Dynamic Huffman blocks from a deflater other than Go's, at two levels.
+gzip -n -9 -c src.txt >src.gz
+gzip -n -6 -c dst.txt >dst.gz
+
+# The PUFFDIFF patch update_engine would ship for src.gz -> dst.gz.
+puffin --operation=puffdiff --src_file=src.gz --dst_file=dst.gz \
+	--src_file_type=gzip --dst_file_type=gzip --patch_file=gzip.puffdiff
+
+rm src.txt dst.txt
@@ -0,0 +1,22 @@
+# Writes src.txt and dst.txt: about 100 KiB of log-like text, and a copy
+# with some lines changed, inserted and removed, so that the deflate streams
+# of the two differ in places but share most of their matches.
+import random
+
+rng = random.Random(1)
+words = ["payload", "partition", "extent", "block", "hash", "verity", "system",
+         "vendor", "boot", "update", "engine", "delta", "source", "target"]
+lines = []
+for i in range(1500):
+    n = rng.randint(3, 12)
+    lines.append("%05d %s %08x\n" % (i, " ".join(rng.choice(words) for _ in range(n)), rng.getrandbits(32)))
+
+with open("src.txt", "w") as f:
+    f.writelines(lines)
+
+for i in range(0, len(lines), 100):
+    lines[i] = lines[i].upper()
+del lines[700:720]
+lines[100:100] = ["inserted %d\n" % i for i in range(20)]
+with open("dst.txt", "w") as f:
+    f.writelines(lines)
@@ -0,0 +1,104 @@
+# Generates the hash tree and FEC golden files for verity_test.go and
+# fec_test.go, independently of the Go code:
+#   python3 gen.py
+#
+# The image is 260 data blocks, block i holding the SHA-256 digests of
+# "verity" || le32(i*128+j) for j = 0..127, except blocks 10 to 19, which are
+# zero. The hash tree follows the data; FEC covers data and tree, like
+# avbtool lays out a partition.
+import hashlib, struct
+
+BS = 4096
+DATA_BLOCKS = 260
+
+
+def data_image():
+    out = bytearray()
+    for i in range(DATA_BLOCKS):
+        if 10 <= i < 20:
+            out += bytes(BS)
+            continue
+        for j in range(BS // 32):
+            out += hashlib.sha256(b"verity" + struct.pack("<I", i * 128 + j)).digest()
+    return bytes(out)
+
+
+def hash_tree(data, alg, salt):
+    """dm-verity format 1: salted block hashes, digests padded to a power of
+    two, levels padded to whole blocks, top level first."""
+    ds = hashlib.new(alg).digest_size
+    pad = 1
+    while pad < ds:
+        pad *= 2
+    levels, cur = [], data
+    while True:
+        level = b"".join(hashlib.new(alg, salt + cur[i:i + BS]).digest() + bytes(pad - ds)
+                         for i in range(0, len(cur), BS))
+        level += bytes(-len(level) % BS)
+        levels.append(level)
+        if len(level) <= BS:
+            break
+        cur = level
+    return b"".join(reversed(levels))
+
+
+def fec(data, roots):
+    """libfec: RS(255, 255-roots) over GF(2^8) with polynomial 0x11d,
+    interleaved over the whole input, followed by the header block."""
+    exp, log, x = [0] * 512, [0] * 256, 1
+    for i in range(255):
+        exp[i], log[x] = x, i
+        x <<= 1
+        if x & 0x100:
+            x ^= 0x11D
+    for i in range(255, 512):
+        exp[i] = exp[i - 255]
+
+    def mul(a, b):
+        return 0 if a == 0 or b == 0 else exp[log[a] + log[b]]
+
+    g = [1]
+    for i in range(roots):
+        ng = [0] * (len(g) + 1)
+        for j, c in enumerate(g):
+            ng[j] ^= c
+            ng[j + 1] ^= mul(c, exp[i])
+        g = ng
+
+    def parity(msg):
+        r = list(msg) + [0] * roots
+        for i in range(len(msg)):
+            c = r[i]
+            if c:
+                for j in range(1, len(g)):
+                    r[i + j] ^= mul(g[j], c)
+        return bytes(r[len(msg):])
+
+    n = 255 - roots
+    nb = len(data) // BS
+    rounds = (nb + n - 1) // n
+    out = bytearray()
+    for i in range(rounds):
+        blocks = [data[(j * rounds + i) * BS:(j * rounds + i + 1) * BS] or bytes(BS) for j in range(n)]
+        for k in range(BS):
+            out += parity([b[k] for b in blocks])
+    header = struct.pack("<IIIIIQ", 0xFECFECFE, 0, 60, roots, len(out), len(data)) + hashlib.sha256(out).digest()
+    block = bytearray(BS)
+    block[:60] = header
+    block[-60:] = header
+    return bytes(out) + bytes(block)
+
+
+SALTS = {
+    "sha1-nosalt": ("sha1", b""),
+    "sha1-salt": ("sha1", bytes.fromhex("5a3d4c7e9b1f2a6c8d0e3b5f7a9c1e2d4f6a8b0c")),
+    "sha256-salt": ("sha256", bytes.fromhex("aee087a5be3b982978c923f566a94613496b417f2af592639bc80d141e34dfe7")),
+}
+
+data = data_image()
+for name, (alg, salt) in SALTS.items():
+    open("tree-%s.bin" % name, "wb").write(hash_tree(data, alg, salt))
+
+image = data + hash_tree(data, *SALTS["sha256-salt"])
+for roots in (2, 8):
+    open("fec-%d.bin" % roots, "wb").write(fec(image, roots))
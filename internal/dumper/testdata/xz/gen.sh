@@ -0,0 +1,32 @@
+#!/bin/sh
+# Regenerates the xz fixtures with xz 5.6.4:
+#   sh gen.sh
+set -e
+python3 gen_input.py
+
+xz -T1 -c --check=crc32 --x86 --lzma2 input.bin >x86.xz
+xz -T1 -c --check=crc64 --x86=start=4096 --lzma2 input.bin >x86-start.xz
+xz -T1 -c --check=sha256 --arm --lzma2 input.bin >arm.xz
+xz -T1 -c --check=crc32 --armthumb --lzma2 input.bin >armthumb.xz
+xz -T1 -c --check=crc64 --arm64 --lzma2 input.bin >arm64.xz
+xz -T1 -c --check=sha256 --arm64=start=8192 --lzma2 input.bin >arm64-start.xz
+xz -T1 -c --check=crc32 --delta=dist=1 --lzma2 input.bin >delta1.xz
+xz -T1 -c --check=none --delta=dist=4 --lzma2 input.bin >delta4.xz
+xz -T1 -c --check=crc64 --delta=dist=256 --lzma2 input.bin >delta256.xz
+xz -T1 -c --check=crc64 --delta=dist=4 --arm64 --lzma2=preset=1 input.bin >delta-arm64.xz
+
+# Multi-block files: single-threaded xz leaves the sizes out of the block
+# headers, multi-threaded xz records them.
+xz -T1 -c --check=sha256 --block-size=3000 --x86 --lzma2 input.bin >blocks.xz
+xz -T2 -c --check=crc32 --block-size=5000 --armthumb --lzma2 input.bin >blocks-mt.xz
+
+# Two concatenated streams with different checks and stream padding.
+head -c 10000 input.bin | xz -T1 -c --check=crc32 --arm --lzma2 >head.tmp
+tail -c +10001 input.bin | xz -T1 -c --check=sha256 --x86 --lzma2 >tail.tmp
+cat head.tmp >concat.xz
+head -c 8 /dev/zero >>concat.xz
+cat tail.tmp >>concat.xz
+rm head.tmp tail.tmp
+
+# A filter the decoder does not implement.
+printf 'unsupported filter\n' | xz -T1 -c --sparc --lzma2 >sparc.xz
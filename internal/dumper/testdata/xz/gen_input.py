@@ -0,0 +1,74 @@
+# Writes input.bin, a 24 KiB mix of machine code patterns for the xz BCJ
+# filter fixtures:
+#   python3 gen_input.py
+#
+# Each 2 KiB stretch is x86 CALL/JMP, ARM BL, Thumb BL or ARM64 BL/ADRP
+# instructions between random filler words, so every filter finds something
+# to convert in every block.
+import random, struct
+
+rng = random.Random(17)
+filler = [rng.getrandbits(32) for _ in range(64)]
+
+
+def x86():
+    out = bytearray()
+    while len(out) < 2048:
+        r = rng.random()
+        if r < 0.4:
+            # CALL/JMP rel32 with a near target, high byte 00 or ff.
+            out += bytes([rng.choice((0xE8, 0xE9))]) + struct.pack("<i", rng.randint(-0x800000, 0x800000))
+        elif r < 0.5:
+            # Back to back opcodes exercise the prev_mask state.
+            out += bytes(rng.choice(((0xE8, 0xE8), (0xE9, 0x00, 0xE8), (0x0F, 0xE8, 0xFF))))
+        else:
+            out += struct.pack("<I", rng.choice(filler))
+    return out[:2048]
+
+
+def arm():
+    out = bytearray()
+    while len(out) < 2048:
+        if rng.random() < 0.4:
+            out += struct.pack("<I", 0xEB000000 | rng.getrandbits(24))
+        else:
+            out += struct.pack("<I", rng.choice(filler))
+    return out
+
+
+def thumb():
+    out = bytearray()
+    while len(out) < 2048:
+        r = rng.random()
+        if r < 0.4:
+            v = rng.getrandbits(22)
+            out += struct.pack("<HH", 0xF000 | v >> 11, 0xF800 | v & 0x7FF)
+        elif r < 0.5:
+            # A lone BL prefix halfword is left alone.
+            out += struct.pack("<H", 0xF000 | rng.getrandbits(11))
+        else:
+            out += struct.pack("<H", rng.choice(filler) & 0xFFFF)
+    return out[:2048]
+
+
+def arm64():
+    out = bytearray()
+    while len(out) < 2048:
+        r = rng.random()
+        if r < 0.3:
+            out += struct.pack("<I", 0x94000000 | rng.getrandbits(26))
+        elif r < 0.6:
+            # ADRP, mostly within the +-512 MiB range the filter converts.
+            imm = rng.randint(-0x20000, 0x1FFFF) if rng.random() < 0.8 else rng.getrandbits(21)
+            imm &= 0x1FFFFF
+            out += struct.pack("<I", 0x90000000 | (imm & 3) << 29 | (imm >> 2) << 5 | rng.getrandbits(5))
+        else:
+            out += struct.pack("<I", rng.choice(filler))
+    return out
+
+
+data = bytearray()
+for _ in range(3):
+    for part in (x86, arm, thumb, arm64):
+        data += part()
+open("input.bin", "wb").write(data)
@@ -0,0 +1,12 @@
+#!/bin/sh
+# Regenerates the Zucchini fixtures with the zucchini command line tool from
+# Chromium's components/zucchini:
+#   sh gen.sh
+set -e
+python3 gen_input.py
+
+# The patches zucchini itself generates for each pair, with the element
+# detection and equivalences it picks.
+zucchini -gen aarch64-old.elf aarch64-new.elf aarch64.zuc
+zucchini -gen arm-old.elf arm-new.elf arm.zuc
+zucchini -gen old.dex new.dex dex.zuc
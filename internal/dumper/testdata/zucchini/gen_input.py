@@ -0,0 +1,435 @@
+# Writes the executable pairs for zucchini_test.go:
+#   python3 gen_input.py
+#
+# Each new file is the old one with INSERT_SIZE bytes of code inserted at
+# INSERT_AT, which moves everything after it, plus a couple of branches and
+# indices retargeted in place. The Go test builds its patches from exactly
+# these two facts, so keep zucchini_test.go in sync when changing them.
+#
+#   aarch64-{old,new}.elf  ELF64 AArch64 shared object: .text with every
+#                          branch and literal load form, .data pointers with
+#                          R_AARCH64_RELATIVE relocations, one into .bss.
+#   arm-{old,new}.elf      ELF32 ARM shared object: an ARM .text and a Thumb2
+#                          .text.thumb calling each other, .data pointers with
+#                          R_ARM_RELATIVE relocations.
+#   {old,new}.dex          DEX 035 file with one class whose code uses string,
+#                          type, field and method indices and every branch
+#                          width, and a packed-switch payload.
+import hashlib, struct, zlib
+
+INSERT_AT = {"aarch64": 0x224, "arm": 0x1C4, "dex": 0x142}
+INSERT_SIZE = {"aarch64": 0x30, "arm": 0x20, "dex": 0x8}
+
+
+def u16(v):
+    return struct.pack("<H", v & 0xFFFF)
+
+
+def u32(v):
+    return struct.pack("<I", v & 0xFFFFFFFF)
+
+
+def u64(v):
+    return struct.pack("<Q", v)
+
+
+def layout(program, base, size_of):
+    """Returns the label addresses and the end of program, a list of label
+    strings and instruction tuples, laid out at base."""
+    labels, pc = {}, base
+    for item in program:
+        if isinstance(item, str):
+            labels[item] = pc
+        else:
+            pc += size_of(item)
+    return labels, pc
+
+
+def assemble(program, base, size_of, encode, extern={}):
+    labels, _ = layout(program, base, size_of)
+    code, pc = b"", base
+    for item in program:
+        if not isinstance(item, str):
+            code += encode(item, pc, {**extern, **labels})
+            pc += size_of(item)
+    return code, labels
+
+
+# AArch64
+
+def a64(item, pc, labels):
+    op = item[0]
+    if op == "word":
+        return u32(item[1])
+    disp = labels[item[-1]] - pc
+    assert disp % 4 == 0
+    imm = disp >> 2
+    if op == "b":
+        return u32(0x14000000 | imm & 0x3FFFFFF)
+    if op == "bl":
+        return u32(0x94000000 | imm & 0x3FFFFFF)
+    if op == "b.cond":
+        return u32(0x54000000 | (imm & 0x7FFFF) << 5 | item[1])
+    if op == "cbz":
+        return u32(0xB4000000 | (imm & 0x7FFFF) << 5 | item[1])
+    if op == "cbnz":
+        return u32(0x35000000 | (imm & 0x7FFFF) << 5 | item[1])
+    if op == "tbz":
+        return u32(0x36000000 | item[1] << 19 | (imm & 0x3FFF) << 5)
+    if op == "tbnz":
+        return u32(0xB7000000 | (item[1] - 32) << 19 | (imm & 0x3FFF) << 5)
+    if op == "ldr":
+        return u32(0x58000000 | (imm & 0x7FFFF) << 5 | item[1])
+    if op == "ldrsw":
+        return u32(0x98000000 | (imm & 0x7FFFF) << 5 | item[1])
+    if op == "adr":
+        # Not a reference Zucchini knows; only the raw delta fixes it.
+        return u32(0x10000000 | (disp & 3) << 29 | ((disp >> 2) & 0x7FFFF) << 5 | item[1])
+    raise ValueError(op)
+
+
+A64_ADD = ("word", 0x91000400)   # add x0, x0, #1
+A64_MOV = ("word", 0xAA0203E1)   # mov x1, x2
+A64_RET = ("word", 0xD65F03C0)   # ret
+
+
+def aarch64_program(new):
+    p = ["f0", A64_ADD, ("bl", "f2"), ("b.cond", 0, "f0_end"), ("cbz", 3, "f1"),
+         A64_MOV, ("tbz", 5, "f0"), ("ldr", 2, "lit0"), "f0_end", A64_RET]
+    p += ["f1", ("bl", "f3"), ("cbnz", 1, "f1"), A64_ADD, ("ldrsw", 4, "lit1"),
+          ("b", "f2")] + [A64_ADD, A64_MOV] * 6 + [A64_RET]
+    p += ["lit0", ("word", 0x12345678), ("word", 0x9ABCDEF0), "lit1", ("word", 7), A64_RET]
+    p += ["f2"] + [A64_MOV, A64_ADD] * 20 + [("tbnz", 40, "f2"), ("b.cond", 1, "f1"), A64_RET]
+    if new:
+        # The inserted function, called from f3 below.
+        p += ["g", A64_ADD, ("bl", "f0"), ("cbz", 0, "g_end"), ("b", "f3"),
+              A64_MOV, ("adr", 0, "g"), A64_ADD, ("b.cond", 11, "g"), ("ldr", 5, "lit1"),
+              A64_MOV, A64_ADD, "g_end", A64_RET]
+    p += ["f3", ("bl", "g" if new else "f1"), ("bl", "f0"), ("b.cond", 0, "f2"),
+          ("cbz", 2, "f3_end"), ("tbz", 7, "f1"), ("ldr", 3, "lit0"),
+          ("adr", 1, "f0"), A64_ADD, "f3_end", A64_RET]
+    p += ["f4"] + [A64_ADD] * 16 + [("bl", "f3"), ("b", "f0"), A64_RET]
+    return p
+
+
+# ARM and Thumb2
+
+def arm(item, pc, labels):
+    op = item[0]
+    if op == "word":
+        return u32(item[1])
+    disp = labels[item[-1]] - (pc + 8)
+    if op in ("b", "bl", "beq"):
+        base = {"b": 0xEA000000, "bl": 0xEB000000, "beq": 0x0A000000}[op]
+        assert disp % 4 == 0
+        return u32(base | (disp >> 2) & 0xFFFFFF)
+    if op == "blx":
+        assert disp % 2 == 0
+        return u32(0xFA000000 | ((disp >> 1) & 1) << 24 | (disp >> 2) & 0xFFFFFF)
+    raise ValueError(op)
+
+
+def thumb_size(item):
+    return 2 if item[0] in ("hw", "b16", "beq16") else 4
+
+
+def thumb(item, pc, labels):
+    op = item[0]
+    if op == "hw":
+        return u16(item[1])
+    target = labels[item[-1]]
+    if op == "blx":
+        disp = target - ((pc + 4) & ~3)
+    else:
+        disp = target - (pc + 4)
+    assert disp % 2 == 0
+    if op == "beq16":
+        return u16(0xD000 | (disp >> 1) & 0xFF)
+    if op == "b16":
+        return u16(0xE000 | (disp >> 1) & 0x7FF)
+    if op == "beq.w":
+        s, j2, j1 = (disp >> 20) & 1, (disp >> 19) & 1, (disp >> 18) & 1
+        return u16(0xF000 | s << 10 | (disp >> 12) & 0x3F) + u16(0x8000 | j1 << 13 | j2 << 11 | (disp >> 1) & 0x7FF)
+    s, i1, i2 = (disp >> 24) & 1, (disp >> 23) & 1, (disp >> 22) & 1
+    j1, j2 = i1 ^ s ^ 1, i2 ^ s ^ 1
+    second = {"bl": 0xD000, "b.w": 0x9000, "blx": 0xC000}[op]
+    return u16(0xF000 | s << 10 | (disp >> 12) & 0x3FF) + u16(second | j1 << 13 | j2 << 11 | (disp >> 1) & 0x7FF)
+
+
+ARM_ADD = ("word", 0xE2800001)   # add r0, r0, #1
+ARM_MOV = ("word", 0xE1A01002)   # mov r1, r2
+ARM_RET = ("word", 0xE12FFF1E)   # bx lr
+T_ADD = ("hw", 0x3001)           # adds r0, #1
+T_MOV = ("hw", 0x4611)           # mov r1, r2
+T_RET = ("hw", 0x4770)           # bx lr
+
+
+def arm_program(new):
+    p = ["a0", ARM_ADD, ("bl", "a1"), ("beq", "a0"), ("blx", "t0"), ARM_MOV, ARM_RET]
+    p += ["a1"] + [ARM_ADD, ARM_MOV] * 20 + [("b", "a0"), ("blx", "t1"), ARM_RET]
+    if new:
+        p += ["h", ARM_ADD, ("bl", "a0"), ("blx", "t2"), ("beq", "h"), ARM_MOV, ("b", "a2"), ARM_ADD, ARM_RET]
+    p += ["a2", ("bl", "h" if new else "a1"), ("beq", "a0"), ("blx", "t2"), ARM_MOV, ARM_RET]
+    p += ["a3"] + [ARM_ADD] * 12 + [("bl", "a2"), ("b", "a3"), ARM_RET]
+    return p
+
+
+def thumb_program():
+    p = ["t0", T_ADD, ("bl", "t1"), ("beq16", "t0"), ("b16", "t0_end"), T_MOV,
+         ("blx", "a0"), ("beq.w", "t2"), "t0_end", T_RET]
+    p += ["t1", T_ADD, T_MOV] + [T_ADD] * 10 + [("b.w", "t0"), ("blx", "a2"), ("bl", "t2"), T_RET]
+    p += ["t2", T_MOV, ("blx", "a3"), ("b16", "t2"), ("beq.w", "t0"), T_ADD, ("bl", "t0"), T_RET]
+    return p
+
+
+# ELF
+
+def shdr(is64, name, typ, flags, addr, off, size, link=0, info=0, align=1, entsize=0):
+    if is64:
+        return struct.pack("<IIQQQQIIQQ", name, typ, flags, addr, off, size, link, info, align, entsize)
+    return struct.pack("<IIIIIIIIII", name, typ, flags, addr, off, size, link, info, align, entsize)
+
+
+def phdr(is64, typ, flags, off, addr, filesz, memsz, align):
+    if is64:
+        return struct.pack("<IIQQQQQQ", typ, flags, off, addr, addr, filesz, memsz, align)
+    return struct.pack("<IIIIIIII", typ, off, addr, addr, filesz, memsz, flags, align)
+
+
+def build_elf(is64, text_sections, data_targets, bss_pointer):
+    """text_sections is a list of (name, code, offset). The relocations and
+    the data section follow them; the data holds a pointer to every address
+    in data_targets and one into .bss, each with a RELATIVE relocation. Data
+    is mapped 64 KiB above its file offset, code at its file offset."""
+    width = 8 if is64 else 4
+    data_delta = 0x10000
+
+    out = bytearray()
+    for _, code, off in text_sections:
+        out += bytes(off - len(out)) + code
+    text_end = len(out)
+
+    rel_off = (text_end + 15) & ~15
+    rel_entsize = 24 if is64 else 8
+    data_off = (rel_off + rel_entsize * (len(data_targets) + 2) + 15) & ~15
+    data_size = width * (len(data_targets) + 1)
+    bss_addr = data_off + data_size + data_delta
+    pointers = list(data_targets) + [bss_addr + bss_pointer]
+
+    rel = b""
+    for i, target in enumerate(pointers):
+        where = data_off + data_delta + i * width
+        rel += u64(where) + u64(1027) + u64(target) if is64 else u32(where) + u32(23)
+    # An absolute relocation, which Zucchini leaves to the raw delta.
+    rel += u64(data_off + data_delta) + u64(257) + u64(0) if is64 else u32(data_off + data_delta) + u32(2)
+    out += bytes(rel_off - len(out)) + rel
+    out += bytes(data_off - len(out)) + b"".join(u64(p) if is64 else u32(p) for p in pointers)
+
+    strtab = bytearray(b"\0")
+    def name(s):
+        strtab.extend(s.encode() + b"\0")
+        return len(strtab) - len(s) - 1
+
+    SHF_WRITE, SHF_ALLOC, SHF_EXECINSTR = 1, 2, 4
+    sections = [shdr(is64, 0, 0, 0, 0, 0, 0)]
+    for sname, code, off in text_sections:
+        sections.append(shdr(is64, name(sname), 1, SHF_ALLOC | SHF_EXECINSTR, off, off, len(code), align=4))
+    sections.append(shdr(is64, name(".rela.dyn" if is64 else ".rel.dyn"), 4 if is64 else 9, SHF_ALLOC,
+                         rel_off, rel_off, len(rel), align=width, entsize=rel_entsize))
+    sections.append(shdr(is64, name(".data"), 1, SHF_ALLOC | SHF_WRITE,
+                         data_off + data_delta, data_off, data_size, align=width))
+    sections.append(shdr(is64, name(".bss"), 8, SHF_ALLOC | SHF_WRITE,
+                         bss_addr, data_off + data_size, 0x40, align=width))
+    shstrndx = len(sections)
+    sections.append(None)
+    shstr_name = name(".shstrtab")
+    shstr_off = len(out)
+    sections[shstrndx] = shdr(is64, shstr_name, 3, 0, 0, shstr_off, len(strtab))
+    out += strtab
+    shoff = (len(out) + 7) & ~7
+    out += bytes(shoff - len(out)) + b"".join(sections)
+
+    # Code and relocations in one read-only segment, data in another.
+    phdrs = phdr(is64, 1, 5, 0, 0, rel_off + len(rel), rel_off + len(rel), 0x10000)
+    phdrs += phdr(is64, 1, 6, data_off, data_off + data_delta, data_size, data_size + 0x40, 0x10000)
+    ehsize, phentsize, shentsize = (64, 56, 64) if is64 else (52, 32, 40)
+    ident = b"\x7fELF" + bytes([2 if is64 else 1, 1, 1, 0]) + bytes(8)
+    if is64:
+        ehdr = ident + struct.pack("<HHIQQQIHHHHHH", 3, 183, 1, 0, ehsize, shoff, 0,
+                                   ehsize, phentsize, 2, shentsize, len(sections), shstrndx)
+    else:
+        ehdr = ident + struct.pack("<HHIIIIIHHHHHH", 3, 40, 1, 0, ehsize, shoff, 0x05000000,
+                                   ehsize, phentsize, 2, shentsize, len(sections), shstrndx)
+    out[:len(ehdr)] = ehdr
+    out[ehsize:ehsize + len(phdrs)] = phdrs
+    return bytes(out)
+
+
+def write_aarch64(new):
+    code, labels = assemble(aarch64_program(new), 0x100, lambda item: 4, a64)
+    targets = [labels[l] for l in ("f0", "f1", "f3", "f4", "lit0")]
+    return build_elf(True, [(".text", code, 0x100)], targets, 0x10)
+
+
+def write_arm(new):
+    # The ARM and Thumb code call each other, so lay out both first.
+    labels, end = layout(arm_program(new), 0x100, lambda item: 4)
+    toff = (end + 3) & ~3
+    tlabels, _ = layout(thumb_program(), toff, thumb_size)
+    code, _ = assemble(arm_program(new), 0x100, lambda item: 4, arm, tlabels)
+    tcode, _ = assemble(thumb_program(), toff, thumb_size, thumb, labels)
+    # A trailing halfword keeps the Thumb section from passing for ARM code.
+    tcode += u16(0xBF00)
+    targets = [labels["a0"], labels["a2"], tlabels["t0"] | 1, tlabels["t2"] | 1]
+    return build_elf(False, [(".text", code, 0x100), (".text.thumb", tcode, toff)], targets, 0x20)
+
+
+# DEX
+
+def uleb(v):
+    out = b""
+    while True:
+        b = v & 0x7F
+        v >>= 7
+        if v:
+            out += bytes([b | 0x80])
+        else:
+            return out + bytes([b])
+
+
+STRINGS = ["<init>", "I", "LFoo;", "Ljava/lang/Object;", "V", "VI", "bar", "foo", "hello", "world", "x"]
+S = {s: i for i, s in enumerate(STRINGS)}
+TYPES = ["I", "LFoo;", "Ljava/lang/Object;", "V"]
+T = {t: i for i, t in enumerate(TYPES)}
+
+
+def dex_code(new):
+    """The method bodies as lists of code units, with branches resolved by
+    assemble on unit addresses."""
+    def enc(item, pc, labels):
+        op = item[0]
+        if op == "units":
+            return b"".join(u16(u) for u in item[1])
+        disp = labels[item[-1]] - pc
+        if op == "goto":
+            return u16(0x28 | (disp & 0xFF) << 8)
+        if op == "goto/16":
+            return u16(0x29) + u16(disp)
+        if op == "goto/32":
+            return u16(0x2A) + u32(disp)
+        if op == "if-eqz":
+            return u16(0x38 | 1 << 8) + u16(disp)
+        if op == "if-ne":
+            return u16(0x33 | 0x10 << 8) + u16(disp)
+        if op == "packed-switch":
+            return u16(0x2B) + u32(disp)
+        raise ValueError(op)
+
+    def size(item):
+        if item[0] == "units":
+            return len(item[1])
+        return {"goto": 1, "goto/16": 2, "goto/32": 3, "if-eqz": 2, "if-ne": 2, "packed-switch": 3}[item[0]]
+
+    def const_string(s):
+        return ("units", [0x001A, S[s]])
+
+    foo = ["start", const_string("hello"), ("if-eqz", "tail"), ("units", [0x0052 | 0x10 << 8, 0]),
+           ("goto", "start"), ("units", [0x0022, T["LFoo;"]]), ("if-ne", "start")]
+    if new:
+        foo += [const_string("world"), ("units", [0x0000, 0x0000])]
+    foo += ["tail", ("units", [0x0070 | 0x10 << 8, 1, 0x0001]), const_string("world" if new else "hello"),
+            ("goto/16", "start"), ("units", [0x001C, T["Ljava/lang/Object;"]]), ("if-eqz", "start"),
+            ("packed-switch", "payload"), ("goto/32", "tail"), ("units", [0x000E, 0x0000]),
+            "payload", ("units", [0x0100, 2, 0, 0, 0, 0, 0, 0])]
+    bar = [("units", [0x0000, 0x0070 | 0x10 << 8, 2, 0x0001, 0x001F, T["LFoo;"]]), ("goto", "ret"),
+           ("units", [0x1B, S["bar"], 0]), "ret", ("units", [0x000E])]
+    init = [("units", [0x0070 | 0x10 << 8, 0, 0x0000, 0x000E])]
+    # Branches count code units, so assemble in units.
+    return [assemble(m, 0, size, enc)[0] for m in (init, foo, bar)]
+
+
+def build_dex(new):
+    string_ids, type_ids, proto_ids = 0x70, 0x70 + 4 * len(STRINGS), 0x70 + 4 * len(STRINGS) + 4 * len(TYPES)
+    field_ids = proto_ids + 12 * 2
+    method_ids = field_ids + 8
+    class_defs = method_ids + 8 * 3
+    data = class_defs + 32
+
+    out = bytearray(data)
+    # Code items: registers, ins, outs, tries, debug_info_off, insns_size.
+    code_offs = []
+    for insns in dex_code(new):
+        out += bytes(((len(out) + 3) & ~3) - len(out))
+        code_offs.append(len(out))
+        out += struct.pack("<HHHHII", 2, 1, 1, 0, 0, len(insns) // 2) + insns
+    out += bytes(((len(out) + 3) & ~3) - len(out))
+    type_list = len(out)
+    out += u32(1) + u16(T["I"]) + u16(0)
+    string_data = []
+    for s in STRINGS:
+        string_data.append(len(out))
+        out += uleb(len(s)) + s.encode() + b"\0"
+    class_data = len(out)
+    out += uleb(0) + uleb(1) + uleb(1) + uleb(2)
+    out += uleb(0) + uleb(1)                               # field x
+    out += uleb(0) + uleb(0x10001) + uleb(code_offs[0])    # <init>
+    out += uleb(1) + uleb(1) + uleb(code_offs[2])          # bar
+    out += uleb(1) + uleb(1) + uleb(code_offs[1])          # foo
+    out += bytes(((len(out) + 3) & ~3) - len(out))
+    map_off = len(out)
+    items = [(0x0000, 1, 0), (0x0001, len(STRINGS), string_ids), (0x0002, len(TYPES), type_ids),
+             (0x0003, 2, proto_ids), (0x0004, 1, field_ids), (0x0005, 3, method_ids),
+             (0x0006, 1, class_defs), (0x2001, 3, code_offs[0]), (0x1001, 1, type_list),
+             (0x2002, len(STRINGS), string_data[0]), (0x2000, 1, class_data), (0x1000, 1, map_off)]
+    out += u32(len(items)) + b"".join(u16(t) + u16(0) + u32(n) + u32(o) for t, n, o in items)
+
+    def put(off, b):
+        out[off:off + len(b)] = b
+    for i, off in enumerate(string_data):
+        put(string_ids + 4 * i, u32(off))
+    for i, t in enumerate(TYPES):
+        put(type_ids + 4 * i, u32(S[t]))
+    put(proto_ids, u32(S["V"]) + u32(T["V"]) + u32(0))
+    put(proto_ids + 12, u32(S["VI"]) + u32(T["V"]) + u32(type_list))
+    put(field_ids, u16(T["LFoo;"]) + u16(T["I"]) + u32(S["x"]))
+    for i, (proto, name) in enumerate([(0, "<init>"), (1, "bar"), (0, "foo")]):
+        put(method_ids + 8 * i, u16(T["LFoo;"]) + u16(proto) + u32(S[name]))
+    put(class_defs, u32(T["LFoo;"]) + u32(1) + u32(T["Ljava/lang/Object;"]) + u32(0) +
+        u32(0xFFFFFFFF) + u32(0) + u32(class_data) + u32(0))
+
+    header = b"dex\n035\0" + bytes(4 + 20) + struct.pack(
+        "<20I", len(out), 0x70, 0x12345678, 0, 0, map_off,
+        len(STRINGS), string_ids, len(TYPES), type_ids, 2, proto_ids, 1, field_ids,
+        3, method_ids, 1, class_defs, len(out) - data, data)
+    put(0, header)
+    put(12, hashlib.sha1(out[32:]).digest())
+    put(8, u32(zlib.adler32(bytes(out[12:]))))
+    return bytes(out), code_offs
+
+
+def main():
+    for name, write, program, label in (("aarch64", write_aarch64, aarch64_program, "f3"),
+                                        ("arm", write_arm, arm_program, "a2")):
+        old, new = write(False), write(True)
+        assert INSERT_AT[name] == layout(program(False), 0x100, lambda item: 4)[0][label]
+        check_insertion(name, old, new)
+        for suffix, data in (("old", old), ("new", new)):
+            with open("%s-%s.elf" % (name, suffix), "wb") as f:
+                f.write(data)
+    (old, code_offs), (new, _) = build_dex(False), build_dex(True)
+    # After the header, 11 code units into foo.
+    assert INSERT_AT["dex"] == code_offs[1] + 16 + 2 * 11
+    check_insertion("dex", old, new)
+    for suffix, data in (("old", old), ("new", new)):
+        with open("%s.dex" % suffix, "wb") as f:
+            f.write(data)
+
+
+def check_insertion(name, old, new):
+    at, size = INSERT_AT[name], INSERT_SIZE[name]
+    assert len(new) == len(old) + size, (name, len(new) - len(old))
+    # The inserted code follows the same instruction in both files.
+    assert old[at - 4:at] == new[at - 4:at], name
+
+
+main()
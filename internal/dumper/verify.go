@@ -0,0 +1,149 @@
+package dumper
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	pb "github.com/OhMyDitzzy/go-payload-dumper/protos"
+)
+
+type VerificationStatus string
+
+const (
+	VerificationPassed  VerificationStatus = "verified"
+	VerificationFailed  VerificationStatus = "MISMATCH"
+	VerificationSkipped VerificationStatus = "skipped"
+	VerificationNoHash  VerificationStatus = "no hash"
+	// VerificationUnverifiable marks partitions whose hash tree or FEC data
+	// update_engine computes on the device in a way the dumper cannot
+	// reproduce, so the hash in the manifest cannot match. They are only
+	// extracted with Options.AllowUnverifiable.
+	VerificationUnverifiable VerificationStatus = "unverifiable (verity computed on device)"
+)
+
+// errVerityUnsupported is returned when a partition's hash tree or FEC data
+// cannot be generated, e.g. because of an unknown hash algorithm. The image is
+// still usable, it just cannot match new_partition_info.
+var errVerityUnsupported = errors.New("unsupported verity configuration")
+
+// verifyImage checks an extracted image against info: the file must be
+// exactly info.Size bytes long and hash to info.Hash.
+func verifyImage(f *os.File, info *pb.PartitionInfo) (VerificationStatus, error) {
+	if info == nil || len(info.Hash) == 0 {
+		return VerificationNoHash, nil
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		return VerificationFailed, err
+	}
+	if info.Size != nil && stat.Size() != int64(*info.Size) {
+		return VerificationFailed, fmt.Errorf("size mismatch: expected %d bytes, got %d", *info.Size, stat.Size())
+	}
+
+	if err := checkHash(io.NewSectionReader(f, 0, stat.Size()), info.Hash); err != nil {
+		return VerificationFailed, err
+	}
+	return VerificationPassed, nil
+}
+
+// verifyBaseImage checks a source image for an incremental OTA. Like
+// update_engine, only the first info.Size bytes are hashed, so images dumped
+// from a larger block device are accepted.
+func verifyBaseImage(f *os.File, info *pb.PartitionInfo) error {
+	if info == nil || len(info.Hash) == 0 {
+		return nil
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	size := stat.Size()
+	if info.Size != nil {
+		if size < int64(*info.Size) {
+			return fmt.Errorf("size mismatch: expected %d bytes, got %d", *info.Size, size)
+		}
+		size = int64(*info.Size)
+	}
+
+	return checkHash(io.NewSectionReader(f, 0, size), info.Hash)
+}
+
+// verifySourceHash checks the source extents of op against src_sha256_hash.
+func verifySourceHash(op *pb.InstallOperation, src io.ReaderAt, blockSize uint64) error {
+	readers := make([]io.Reader, 0, len(op.SrcExtents))
+	for _, ext := range op.SrcExtents {
+		offset := int64(*ext.StartBlock * blockSize)
+		size := int64(*ext.NumBlocks * blockSize)
+		readers = append(readers, io.NewSectionReader(src, offset, size))
+	}
+
+	if err := checkHash(io.MultiReader(readers...), op.SrcSha256Hash); err != nil {
+		return fmt.Errorf("source extents: %w", err)
+	}
+	return nil
+}
+
+func needsBaseImage(part *pb.PartitionUpdate) bool {
+	if part.OldPartitionInfo != nil && len(part.OldPartitionInfo.Hash) > 0 {
+		return true
+	}
+	for _, op := range part.Operations {
+		if len(op.SrcExtents) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func checkHash(r io.Reader, expected []byte) error {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return err
+	}
+
+	if sum := h.Sum(nil); !bytes.Equal(sum, expected) {
+		return fmt.Errorf("hash mismatch: expected %s, got %s",
+			hex.EncodeToString(expected), hex.EncodeToString(sum))
+	}
+	return nil
+}
+
+var errDataHashMismatch = errors.New("data hash mismatch")
+
+// hashingReader hashes everything read through it. When the underlying reader
+// is exhausted it reports errDataHashMismatch instead of io.EOF if the data
+// does not match the expected hash, so consumers never see a clean end of a
+// corrupted blob.
+type hashingReader struct {
+	r        io.Reader
+	h        hash.Hash
+	expected []byte
+}
+
+func newHashingReader(r io.Reader, expected []byte) *hashingReader {
+	return &hashingReader{r: r, h: sha256.New(), expected: expected}
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.h.Write(p[:n])
+	if err == io.EOF && r.expected != nil && !bytes.Equal(r.h.Sum(nil), r.expected) {
+		err = errDataHashMismatch
+	}
+	return n, err
+}
+
+// drain reads whatever is left and returns the result of the hash check.
+func (r *hashingReader) drain() error {
+	_, err := io.Copy(io.Discard, r)
+	return err
+}
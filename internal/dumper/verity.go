@@ -0,0 +1,98 @@
+package dumper
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"math/bits"
+	"os"
+
+	pb "github.com/OhMyDitzzy/go-payload-dumper/protos"
+)
+
+// newVerityHash returns the hash function for a hash_tree_algorithm.
+func newVerityHash(algorithm string) (func() hash.Hash, error) {
+	switch algorithm {
+	case "sha1":
+		return sha1.New, nil
+	case "sha256":
+		return sha256.New, nil
+	default:
+		return nil, fmt.Errorf("%w: hash tree algorithm %q", errVerityUnsupported, algorithm)
+	}
+}
+
+// writeHashTree computes the dm-verity hash tree of the partition's
+// hash_tree_data_extent and writes it to hash_tree_extent, which
+// update_engine fills in on the device instead of shipping it in the payload.
+func writeHashTree(f *os.File, part *pb.PartitionUpdate, blockSize uint64) error {
+	dataExt, treeExt := part.HashTreeDataExtent, part.HashTreeExtent
+	if treeExt.GetNumBlocks() == 0 {
+		return nil
+	}
+
+	newHash, err := newVerityHash(part.GetHashTreeAlgorithm())
+	if err != nil {
+		return err
+	}
+
+	data := io.NewSectionReader(f, int64(dataExt.GetStartBlock()*blockSize), int64(dataExt.GetNumBlocks()*blockSize))
+	tree, err := buildHashTree(bufio.NewReaderSize(data, copyBufferSize), dataExt.GetNumBlocks(), blockSize, newHash, part.HashTreeSalt)
+	if err != nil {
+		return err
+	}
+
+	if uint64(len(tree)) > treeExt.GetNumBlocks()*blockSize {
+		return fmt.Errorf("%w: hash tree needs %d bytes, the extent holds %d", errVerityUnsupported, len(tree), treeExt.GetNumBlocks()*blockSize)
+	}
+	_, err = f.WriteAt(tree, int64(treeExt.GetStartBlock()*blockSize))
+	return err
+}
+
+// buildHashTree builds a dm-verity (format version 1) hash tree over the
+// given number of blocks of data. Every block is hashed as salt || block and
+// digests are zero-padded to a power of two. Each level is padded to whole
+// blocks and hashed again until a level fits in a single block. The levels are
+// returned top level first, the layout veritysetup and update_engine use.
+func buildHashTree(data io.Reader, blocks, blockSize uint64, newHash func() hash.Hash, salt []byte) ([]byte, error) {
+	h := newHash()
+	digestSize := 1 << bits.Len(uint(h.Size()-1))
+
+	hashBlocks := func(r io.Reader, n uint64) ([]byte, error) {
+		level := make([]byte, 0, alignUp(n*uint64(digestSize), blockSize))
+		buf := make([]byte, blockSize)
+		for i := uint64(0); i < n; i++ {
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return nil, err
+			}
+			h.Reset()
+			h.Write(salt)
+			h.Write(buf)
+			level = h.Sum(level)
+			level = append(level, make([]byte, digestSize-h.Size())...)
+		}
+		return append(level, make([]byte, cap(level)-len(level))...), nil
+	}
+
+	level, err := hashBlocks(data, blocks)
+	if err != nil {
+		return nil, err
+	}
+	levels := [][]byte{level}
+	for uint64(len(level)) > blockSize {
+		if level, err = hashBlocks(bytes.NewReader(level), uint64(len(level))/blockSize); err != nil {
+			return nil, err
+		}
+		levels = append(levels, level)
+	}
+
+	var tree []byte
+	for i := len(levels) - 1; i >= 0; i-- {
+		tree = append(tree, levels[i]...)
+	}
+	return tree, nil
+}
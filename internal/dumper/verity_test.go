@@ -0,0 +1,145 @@
+package dumper
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/OhMyDitzzy/go-payload-dumper/protos"
+	"google.golang.org/protobuf/proto"
+)
+
+const verityDataBlocks = 260
+
+func testExtent(start, blocks uint64) *pb.Extent {
+	return &pb.Extent{StartBlock: proto.Uint64(start), NumBlocks: proto.Uint64(blocks)}
+}
+
+// verityTestData returns the data blocks the golden files in testdata/verity
+// were made from, see gen.py there.
+func verityTestData() []byte {
+	data := make([]byte, 0, verityDataBlocks*4096)
+	for i := 0; i < verityDataBlocks; i++ {
+		if i >= 10 && i < 20 {
+			data = append(data, make([]byte, 4096)...)
+			continue
+		}
+		for j := 0; j < 4096/sha256.Size; j++ {
+			sum := sha256.Sum256(binary.LittleEndian.AppendUint32([]byte("verity"), uint32(i*128+j)))
+			data = append(data, sum[:]...)
+		}
+	}
+	return data
+}
+
+// writeTestImage writes data to a temporary image of the given number of
+// blocks.
+func writeTestImage(t *testing.T, data []byte, blocks uint64) *os.File {
+	t.Helper()
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "image.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	if err := f.Truncate(int64(blocks * 4096)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestWriteHashTreeGolden(t *testing.T) {
+	data := verityTestData()
+
+	tests := []struct {
+		name      string
+		algorithm string
+		salt      string
+		golden    string
+	}{
+		{"sha1 without salt", "sha1", "", "tree-sha1-nosalt.bin"},
+		{"sha1 with salt", "sha1", "5a3d4c7e9b1f2a6c8d0e3b5f7a9c1e2d4f6a8b0c", "tree-sha1-salt.bin"},
+		{"sha256 with salt", "sha256", "aee087a5be3b982978c923f566a94613496b417f2af592639bc80d141e34dfe7", "tree-sha256-salt.bin"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := readTestdata(t, "verity/"+tt.golden)
+			treeBlocks := uint64(len(want)) / 4096
+
+			// The extent has a spare block, which must stay zero.
+			f := writeTestImage(t, data, verityDataBlocks+treeBlocks+1)
+			part := &pb.PartitionUpdate{
+				HashTreeDataExtent: testExtent(0, verityDataBlocks),
+				HashTreeExtent:     testExtent(verityDataBlocks, treeBlocks+1),
+				HashTreeAlgorithm:  proto.String(tt.algorithm),
+				HashTreeSalt:       mustHex(tt.salt),
+			}
+			if err := writeHashTree(f, part, 4096); err != nil {
+				t.Fatal(err)
+			}
+
+			got := make([]byte, len(want)+4096)
+			if _, err := f.ReadAt(got, verityDataBlocks*4096); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got[:len(want)], want) {
+				t.Fatal("hash tree does not match the golden file")
+			}
+			if !bytes.Equal(got[len(want):], make([]byte, 4096)) {
+				t.Fatal("hash tree extent is not zero past the tree")
+			}
+		})
+	}
+}
+
+func TestWriteHashTreeUnsupported(t *testing.T) {
+	data := verityTestData()
+
+	tests := []struct {
+		name       string
+		algorithm  string
+		treeBlocks uint64
+	}{
+		{"unknown algorithm", "md5", 4},
+		{"extent too small", "sha256", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := writeTestImage(t, data, verityDataBlocks+tt.treeBlocks)
+			part := &pb.PartitionUpdate{
+				HashTreeDataExtent: testExtent(0, verityDataBlocks),
+				HashTreeExtent:     testExtent(verityDataBlocks, tt.treeBlocks),
+				HashTreeAlgorithm:  proto.String(tt.algorithm),
+			}
+			if err := writeHashTree(f, part, 4096); !errors.Is(err, errVerityUnsupported) {
+				t.Fatalf("err = %v, want %v", err, errVerityUnsupported)
+			}
+		})
+	}
+}
+
+func TestBuildHashTreeSingleLevel(t *testing.T) {
+	// Two blocks hash into a single level of one block.
+	data := verityTestData()[:2*4096]
+	tree, err := buildHashTree(bytes.NewReader(data), 2, 4096, sha256.New, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tree) != 4096 {
+		t.Fatalf("tree is %d bytes, want 4096", len(tree))
+	}
+	for i := 0; i < 2; i++ {
+		sum := sha256.Sum256(data[i*4096 : (i+1)*4096])
+		if got := tree[i*32 : (i+1)*32]; !bytes.Equal(got, sum[:]) {
+			t.Fatalf("digest %d = %s, want %s", i, hex.EncodeToString(got), hex.EncodeToString(sum[:]))
+		}
+	}
+}
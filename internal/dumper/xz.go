@@ -0,0 +1,480 @@
+package dumper
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// XZ container support. github.com/ulikunitz/xz only accepts a lone LZMA2
+// filter, while payloads built for Android devices often run the data through
+// a BCJ filter first, so the container is parsed here and LZMA2 chunks are
+// handed to the lzma package.
+
+const (
+	xzHeaderMagic = "\xfd7zXZ\x00"
+	xzFooterMagic = "YZ"
+
+	xzFilterDelta    = 0x03
+	xzFilterX86      = 0x04
+	xzFilterPowerPC  = 0x05
+	xzFilterIA64     = 0x06
+	xzFilterARM      = 0x07
+	xzFilterARMThumb = 0x08
+	xzFilterSPARC    = 0x09
+	xzFilterARM64    = 0x0a
+	xzFilterRISCV    = 0x0b
+	xzFilterLZMA2    = 0x21
+
+	xzCheckNone   = 0x00
+	xzCheckCRC32  = 0x01
+	xzCheckCRC64  = 0x04
+	xzCheckSHA256 = 0x0a
+)
+
+var xzFilterNames = map[uint64]string{
+	xzFilterDelta:    "delta",
+	xzFilterX86:      "x86",
+	xzFilterPowerPC:  "PowerPC",
+	xzFilterIA64:     "IA-64",
+	xzFilterARM:      "ARM",
+	xzFilterARMThumb: "ARM-Thumb",
+	xzFilterSPARC:    "SPARC",
+	xzFilterARM64:    "ARM64",
+	xzFilterRISCV:    "RISC-V",
+	xzFilterLZMA2:    "LZMA2",
+}
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+type xzFilter struct {
+	id    uint64
+	props []byte
+}
+
+type xzRecord struct {
+	unpaddedSize     uint64
+	uncompressedSize uint64
+}
+
+// xzInput counts the bytes consumed so that block padding can be located
+// after the LZMA2 decoder stops. While tee is set everything read is also
+// written to it.
+type xzInput struct {
+	r   *bufio.Reader
+	n   uint64
+	tee hash.Hash
+}
+
+func (in *xzInput) Read(p []byte) (int, error) {
+	n, err := in.r.Read(p)
+	in.n += uint64(n)
+	if in.tee != nil {
+		in.tee.Write(p[:n])
+	}
+	return n, err
+}
+
+func (in *xzInput) ReadByte() (byte, error) {
+	b, err := in.r.ReadByte()
+	if err == nil {
+		in.n++
+		if in.tee != nil {
+			in.tee.Write([]byte{b})
+		}
+	}
+	return b, err
+}
+
+func (in *xzInput) full(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(in, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+func (in *xzInput) vli() (uint64, error) {
+	var v uint64
+	for i := 0; i < 9; i++ {
+		b, err := in.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		v |= uint64(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			if i > 0 && b == 0 {
+				return 0, errors.New("xz: invalid variable-length integer")
+			}
+			return v, nil
+		}
+	}
+	return 0, errors.New("xz: invalid variable-length integer")
+}
+
+// xzReader decompresses a sequence of xz streams.
+type xzReader struct {
+	in    *xzInput
+	check byte
+	err   error
+
+	block        io.Reader
+	blockHash    hash.Hash
+	blockStart   uint64
+	headerSize   uint64
+	uncompressed uint64
+	records      []xzRecord
+
+	// Sizes from the block header, -1 when not recorded.
+	compressedSize   int64
+	uncompressedSize int64
+}
+
+func newXZReader(r io.Reader) (io.Reader, error) {
+	z := &xzReader{in: &xzInput{r: bufio.NewReader(r)}}
+	if err := z.readStreamHeader(); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+func (z *xzReader) Read(p []byte) (int, error) {
+	for z.err == nil {
+		if z.block == nil {
+			z.err = z.nextBlock()
+			continue
+		}
+
+		n, err := z.block.Read(p)
+		if z.blockHash != nil {
+			z.blockHash.Write(p[:n])
+		}
+		z.uncompressed += uint64(n)
+		if err == io.EOF {
+			err = z.finishBlock()
+		}
+		if err != nil {
+			z.err = err
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+	return 0, z.err
+}
+
+func (z *xzReader) readStreamHeader() error {
+	b, err := z.in.full(12)
+	if err != nil {
+		return fmt.Errorf("xz: stream header: %w", err)
+	}
+	if string(b[:6]) != xzHeaderMagic {
+		return errors.New("xz: invalid stream header magic")
+	}
+	if crc32.ChecksumIEEE(b[6:8]) != binary.LittleEndian.Uint32(b[8:]) {
+		return errors.New("xz: stream header CRC mismatch")
+	}
+	if b[6] != 0 || b[7]&0xf0 != 0 {
+		return errors.New("xz: unsupported stream flags")
+	}
+	z.check = b[7]
+	z.records = z.records[:0]
+	return nil
+}
+
+func xzCheckSize(check byte) int {
+	if check == 0 {
+		return 0
+	}
+	return 4 << ((check - 1) / 3)
+}
+
+func (z *xzReader) newCheck() hash.Hash {
+	switch z.check {
+	case xzCheckCRC32:
+		return crc32.NewIEEE()
+	case xzCheckCRC64:
+		return crc64.New(crc64Table)
+	case xzCheckSHA256:
+		return sha256.New()
+	}
+	return nil
+}
+
+// nextBlock starts decoding the next block, or reads the index and footer
+// when the stream has no more blocks and moves on to a concatenated stream.
+func (z *xzReader) nextBlock() error {
+	z.blockStart = z.in.n
+	first, err := z.in.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if first == 0 {
+		if err := z.readIndexAndFooter(); err != nil {
+			return err
+		}
+		return z.nextStream()
+	}
+
+	rest, err := z.in.full(int(first)*4 + 3)
+	if err != nil {
+		return fmt.Errorf("xz: block header: %w", err)
+	}
+	header := append([]byte{first}, rest...)
+	z.headerSize = uint64(len(header))
+	if crc32.ChecksumIEEE(header[:len(header)-4]) != binary.LittleEndian.Uint32(header[len(header)-4:]) {
+		return errors.New("xz: block header CRC mismatch")
+	}
+
+	filters, err := z.parseBlockHeader(header[1 : len(header)-4])
+	if err != nil {
+		return err
+	}
+
+	last := filters[len(filters)-1]
+	if last.id != xzFilterLZMA2 {
+		return fmt.Errorf("xz: the last filter must be LZMA2, got %s", xzFilterName(last.id))
+	}
+	dictCap, err := lzma2DictCap(last.props)
+	if err != nil {
+		return err
+	}
+	lzma2, err := lzma.Reader2Config{DictCap: dictCap}.NewReader2(z.in)
+	if err != nil {
+		return fmt.Errorf("xz: %w", err)
+	}
+
+	var block io.Reader = lzma2
+	for i := len(filters) - 2; i >= 0; i-- {
+		if block, err = newXZFilterReader(filters[i], block); err != nil {
+			return err
+		}
+	}
+
+	z.block = block
+	z.blockHash = z.newCheck()
+	z.uncompressed = 0
+	return nil
+}
+
+func (z *xzReader) parseBlockHeader(b []byte) ([]xzFilter, error) {
+	flags := b[0]
+	if flags&0x3c != 0 {
+		return nil, errors.New("xz: unsupported block flags")
+	}
+	in := &xzInput{r: bufio.NewReader(bytes.NewReader(b[1:]))}
+
+	z.compressedSize, z.uncompressedSize = -1, -1
+	if flags&0x40 != 0 {
+		v, err := in.vli()
+		if err != nil {
+			return nil, err
+		}
+		z.compressedSize = int64(v)
+	}
+	if flags&0x80 != 0 {
+		v, err := in.vli()
+		if err != nil {
+			return nil, err
+		}
+		z.uncompressedSize = int64(v)
+	}
+
+	filters := make([]xzFilter, int(flags&3)+1)
+	for i := range filters {
+		id, err := in.vli()
+		if err != nil {
+			return nil, err
+		}
+		size, err := in.vli()
+		if err != nil {
+			return nil, err
+		}
+		if size > uint64(len(b)) {
+			return nil, errors.New("xz: invalid filter properties size")
+		}
+		props, err := in.full(int(size))
+		if err != nil {
+			return nil, err
+		}
+		filters[i] = xzFilter{id: id, props: props}
+	}
+
+	for {
+		c, err := in.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if c != 0 {
+			return nil, errors.New("xz: invalid block header padding")
+		}
+	}
+	return filters, nil
+}
+
+// finishBlock skips the block padding and verifies the check.
+func (z *xzReader) finishBlock() error {
+	compressed := z.in.n - z.blockStart - z.headerSize
+	if z.compressedSize >= 0 && compressed != uint64(z.compressedSize) {
+		return errors.New("xz: compressed size does not match the block header")
+	}
+	if z.uncompressedSize >= 0 && z.uncompressed != uint64(z.uncompressedSize) {
+		return errors.New("xz: uncompressed size does not match the block header")
+	}
+
+	if pad := (4 - compressed%4) % 4; pad > 0 {
+		b, err := z.in.full(int(pad))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(b, make([]byte, pad)) {
+			return errors.New("xz: invalid block padding")
+		}
+	}
+
+	size := xzCheckSize(z.check)
+	sum, err := z.in.full(size)
+	if err != nil {
+		return err
+	}
+	if z.blockHash != nil {
+		expected := z.blockHash.Sum(nil)
+		if z.check == xzCheckCRC32 || z.check == xzCheckCRC64 {
+			// The hash packages produce big-endian sums; xz stores
+			// CRCs little-endian.
+			for i, j := 0, len(expected)-1; i < j; i, j = i+1, j-1 {
+				expected[i], expected[j] = expected[j], expected[i]
+			}
+		}
+		if !bytes.Equal(sum, expected) {
+			return errors.New("xz: block check mismatch")
+		}
+	}
+
+	z.records = append(z.records, xzRecord{
+		unpaddedSize:     z.headerSize + compressed + uint64(size),
+		uncompressedSize: z.uncompressed,
+	})
+	z.block = nil
+	return nil
+}
+
+func (z *xzReader) readIndexAndFooter() error {
+	start := z.in.n - 1
+	crc := crc32.NewIEEE()
+	crc.Write([]byte{0})
+	z.in.tee = crc
+
+	count, err := z.in.vli()
+	if err != nil {
+		return err
+	}
+	if count != uint64(len(z.records)) {
+		return errors.New("xz: index does not match the number of blocks")
+	}
+	for _, rec := range z.records {
+		unpadded, err := z.in.vli()
+		if err != nil {
+			return err
+		}
+		uncompressed, err := z.in.vli()
+		if err != nil {
+			return err
+		}
+		if unpadded != rec.unpaddedSize || uncompressed != rec.uncompressedSize {
+			return errors.New("xz: index does not match the blocks")
+		}
+	}
+	if pad := (4 - (z.in.n-start)%4) % 4; pad > 0 {
+		if _, err := z.in.full(int(pad)); err != nil {
+			return err
+		}
+	}
+	indexSize := z.in.n - start
+	z.in.tee = nil
+	sum, err := z.in.full(4)
+	if err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(sum) != crc.Sum32() {
+		return errors.New("xz: index CRC mismatch")
+	}
+
+	footer, err := z.in.full(12)
+	if err != nil {
+		return fmt.Errorf("xz: stream footer: %w", err)
+	}
+	if string(footer[10:]) != xzFooterMagic {
+		return errors.New("xz: invalid stream footer magic")
+	}
+	if crc32.ChecksumIEEE(footer[4:10]) != binary.LittleEndian.Uint32(footer) {
+		return errors.New("xz: stream footer CRC mismatch")
+	}
+	if (uint64(binary.LittleEndian.Uint32(footer[4:]))+1)*4 != indexSize+4 {
+		return errors.New("xz: backward size does not match the index")
+	}
+	if footer[8] != 0 || footer[9] != z.check {
+		return errors.New("xz: stream footer flags do not match the header")
+	}
+	return nil
+}
+
+// nextStream skips stream padding and reads the header of a concatenated
+// stream, returning io.EOF at the end of the input.
+func (z *xzReader) nextStream() error {
+	for {
+		b, err := z.in.r.Peek(4)
+		if len(b) == 0 && err == io.EOF {
+			return io.EOF
+		}
+		if err != nil {
+			return fmt.Errorf("xz: stream padding: %w", err)
+		}
+		if !bytes.Equal(b, []byte{0, 0, 0, 0}) {
+			break
+		}
+		z.in.r.Discard(4)
+		z.in.n += 4
+	}
+	return z.readStreamHeader()
+}
+
+// xzMaxDictCap limits the dictionary allocated for a block. xz presets use
+// at most 64 MiB, and the limit keeps the value in range for 32-bit builds.
+const xzMaxDictCap = 1 << 30
+
+func lzma2DictCap(props []byte) (int, error) {
+	if len(props) != 1 || props[0] > 40 {
+		return 0, errors.New("xz: invalid LZMA2 properties")
+	}
+	if props[0] >= 38 {
+		return xzMaxDictCap, nil
+	}
+	size := (2 | int(props[0]&1)) << (props[0]/2 + 11)
+	return max(size, lzma.MinDictCap), nil
+}
+
+func xzFilterName(id uint64) string {
+	if name, ok := xzFilterNames[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%x", id)
+}
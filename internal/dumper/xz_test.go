@@ -0,0 +1,98 @@
+package dumper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// The fixtures in testdata/xz were made by xz 5.6.4 from input.bin, see
+// testdata/xz/gen.sh.
+func TestXZReaderFixtures(t *testing.T) {
+	want := readTestdata(t, "xz/input.bin")
+
+	tests := []struct {
+		name string
+		file string
+	}{
+		{"x86 crc32", "x86.xz"},
+		{"x86 start offset crc64", "x86-start.xz"},
+		{"ARM sha256", "arm.xz"},
+		{"ARM-Thumb crc32", "armthumb.xz"},
+		{"ARM64 crc64", "arm64.xz"},
+		{"ARM64 start offset sha256", "arm64-start.xz"},
+		{"delta distance 1", "delta1.xz"},
+		{"delta distance 4 no check", "delta4.xz"},
+		{"delta distance 256", "delta256.xz"},
+		{"delta and ARM64", "delta-arm64.xz"},
+		{"blocks", "blocks.xz"},
+		{"blocks with sizes", "blocks-mt.xz"},
+		{"concatenated streams", "concat.xz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := readTestdata(t, "xz/"+tt.file)
+
+			// Read whole buffers and single bytes, so that BCJ
+			// instructions are also split across reads.
+			for _, wrap := range []func(io.Reader) io.Reader{
+				func(r io.Reader) io.Reader { return r },
+				iotest.OneByteReader,
+			} {
+				r, err := newXZReader(wrap(bytes.NewReader(data)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := io.ReadAll(wrap(r))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Fatalf("decoded %d bytes do not match the %d byte input", len(got), len(want))
+				}
+			}
+		})
+	}
+}
+
+func TestXZReaderCorrupt(t *testing.T) {
+	// x86.xz is a single stream with one block and a CRC32 check. The index
+	// sits before the 12 byte footer, the check right before the index.
+	data := readTestdata(t, "xz/x86.xz")
+	footer := len(data) - 12
+	index := footer - int(binary.LittleEndian.Uint32(data[footer+4:])+1)*4
+
+	corrupt := func(off int) []byte {
+		b := bytes.Clone(data)
+		b[off] ^= 0x55
+		return b
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{"header magic", corrupt(1), "invalid stream header magic"},
+		{"header CRC", corrupt(8), "stream header CRC mismatch"},
+		{"block check", corrupt(index - 1), "block check mismatch"},
+		{"index CRC", corrupt(footer - 1), "index CRC mismatch"},
+		{"footer magic", corrupt(len(data) - 1), "invalid stream footer magic"},
+		{"truncated", data[:len(data)-20], "EOF"},
+		{"unsupported filter", readTestdata(t, "xz/sparc.xz"), "unsupported filter SPARC"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := newXZReader(bytes.NewReader(tt.data))
+			if err == nil {
+				_, err = io.ReadAll(r)
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package dumper
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Decoders for the xz delta and branch/call/jump filters. The BCJ filters are
+// ports of the liblzma simple filters; they turn absolute branch targets back
+// into the relative ones of the original code.
+
+func newXZFilterReader(f xzFilter, r io.Reader) (io.Reader, error) {
+	if f.id == xzFilterDelta {
+		if len(f.props) != 1 {
+			return nil, fmt.Errorf("xz: invalid delta filter properties")
+		}
+		return &xzDeltaReader{r: r, distance: int(f.props[0]) + 1}, nil
+	}
+
+	var start uint32
+	switch len(f.props) {
+	case 0:
+	case 4:
+		start = binary.LittleEndian.Uint32(f.props)
+	default:
+		return nil, fmt.Errorf("xz: invalid %s filter properties", xzFilterName(f.id))
+	}
+
+	b := &bcjReader{r: r, pos: start, buf: make([]byte, 0, 64<<10)}
+	switch f.id {
+	case xzFilterX86:
+		x86 := &bcjX86{prevPos: ^uint32(4)}
+		b.code = x86.code
+	case xzFilterARM:
+		b.code = bcjARM
+	case xzFilterARMThumb:
+		b.code = bcjARMThumb
+	case xzFilterARM64:
+		if start%4 != 0 {
+			return nil, fmt.Errorf("xz: invalid ARM64 filter start offset %d", start)
+		}
+		b.code = bcjARM64
+	default:
+		return nil, fmt.Errorf("xz: unsupported filter %s", xzFilterName(f.id))
+	}
+	return b, nil
+}
+
+type xzDeltaReader struct {
+	r        io.Reader
+	distance int
+	history  [256]byte
+	pos      uint8
+}
+
+func (d *xzDeltaReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	for i := range p[:n] {
+		p[i] += d.history[uint8(d.distance+int(d.pos))]
+		d.history[d.pos] = p[i]
+		d.pos--
+	}
+	return n, err
+}
+
+// bcjReader runs a BCJ filter over the decompressed stream. code converts as
+// much of its input as it can and returns how many bytes are final; the rest
+// is kept until more data arrives, or passed through unchanged at the end.
+type bcjReader struct {
+	r    io.Reader
+	code func(buf []byte, pos uint32) int
+	pos  uint32
+	err  error
+
+	buf      []byte
+	start    int
+	filtered int
+}
+
+func (b *bcjReader) Read(p []byte) (int, error) {
+	for {
+		if b.start < b.filtered {
+			n := copy(p, b.buf[b.start:b.filtered])
+			b.start += n
+			return n, nil
+		}
+		if b.err != nil {
+			return 0, b.err
+		}
+
+		n := copy(b.buf[:cap(b.buf)], b.buf[b.start:])
+		b.buf, b.start, b.filtered = b.buf[:n], 0, 0
+
+		m, err := io.ReadFull(b.r, b.buf[n:cap(b.buf)])
+		b.buf = b.buf[:n+m]
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		if err != nil {
+			b.err = err
+		}
+
+		b.filtered = b.code(b.buf, b.pos)
+		b.pos += uint32(b.filtered)
+		if b.err != nil {
+			b.filtered = len(b.buf)
+		}
+	}
+}
+
+func bcjX86Test(b byte) bool {
+	return b == 0 || b == 0xff
+}
+
+type bcjX86 struct {
+	prevMask uint32
+	prevPos  uint32
+}
+
+var (
+	bcjX86AllowedStatus = [8]bool{true, true, true, false, true, false, false, false}
+	bcjX86BitNumber     = [8]uint32{0, 1, 2, 2, 3, 3, 3, 3}
+)
+
+func (x *bcjX86) code(buf []byte, pos uint32) int {
+	if len(buf) < 5 {
+		return 0
+	}
+	if pos-x.prevPos > 5 {
+		x.prevPos = pos - 5
+	}
+
+	limit := len(buf) - 5
+	i := 0
+	for i <= limit {
+		b := buf[i]
+		if b != 0xe8 && b != 0xe9 {
+			i++
+			continue
+		}
+
+		offset := pos + uint32(i) - x.prevPos
+		x.prevPos = pos + uint32(i)
+		if offset > 5 {
+			x.prevMask = 0
+		} else {
+			for j := uint32(0); j < offset; j++ {
+				x.prevMask &= 0x77
+				x.prevMask <<= 1
+			}
+		}
+
+		b = buf[i+4]
+		if bcjX86Test(b) && bcjX86AllowedStatus[(x.prevMask>>1)&7] && x.prevMask>>1 < 0x10 {
+			src := binary.LittleEndian.Uint32(buf[i+1:])
+			var dest uint32
+			for {
+				dest = src - (pos + uint32(i) + 5)
+				if x.prevMask == 0 {
+					break
+				}
+				k := bcjX86BitNumber[x.prevMask>>1]
+				if !bcjX86Test(byte(dest >> (24 - k*8))) {
+					break
+				}
+				src = dest ^ (1<<(32-k*8) - 1)
+			}
+			dest &= 0x01ffffff
+			dest |= -(dest >> 24) << 24
+			binary.LittleEndian.PutUint32(buf[i+1:], dest)
+			i += 5
+			x.prevMask = 0
+		} else {
+			i++
+			x.prevMask |= 1
+			if bcjX86Test(b) {
+				x.prevMask |= 0x10
+			}
+		}
+	}
+	return i
+}
+
+func bcjARM(buf []byte, pos uint32) int {
+	i := 0
+	for ; i+4 <= len(buf); i += 4 {
+		if buf[i+3] != 0xeb {
+			continue
+		}
+		src := (uint32(buf[i+2])<<16 | uint32(buf[i+1])<<8 | uint32(buf[i])) << 2
+		dest := (src - (pos + uint32(i) + 8)) >> 2
+		buf[i+2] = byte(dest >> 16)
+		buf[i+1] = byte(dest >> 8)
+		buf[i] = byte(dest)
+	}
+	return i
+}
+
+func bcjARMThumb(buf []byte, pos uint32) int {
+	i := 0
+	for ; i+4 <= len(buf); i += 2 {
+		if buf[i+1]&0xf8 != 0xf0 || buf[i+3]&0xf8 != 0xf8 {
+			continue
+		}
+		src := (uint32(buf[i+1]&7)<<19 | uint32(buf[i])<<11 | uint32(buf[i+3]&7)<<8 | uint32(buf[i+2])) << 1
+		dest := (src - (pos + uint32(i) + 4)) >> 1
+		buf[i+1] = 0xf0 | byte(dest>>19)&7
+		buf[i] = byte(dest >> 11)
+		buf[i+3] = 0xf8 | byte(dest>>8)&7
+		buf[i+2] = byte(dest)
+		i += 2
+	}
+	return i
+}
+
+func bcjARM64(buf []byte, pos uint32) int {
+	i := 0
+	for ; i+4 <= len(buf); i += 4 {
+		pc := pos + uint32(i)
+		instr := binary.LittleEndian.Uint32(buf[i:])
+
+		switch {
+		case instr>>26 == 0x25:
+			// BL
+			instr = 0x94000000 | (instr-pc>>2)&0x03ffffff
+			binary.LittleEndian.PutUint32(buf[i:], instr)
+
+		case instr&0x9f000000 == 0x90000000:
+			// ADRP
+			src := (instr>>29)&3 | (instr>>3)&0x001ffffc
+			if (src+0x00020000)&0x001c0000 != 0 {
+				continue
+			}
+			dest := src - pc>>12
+			instr &= 0x9000001f
+			instr |= (dest & 3) << 29
+			instr |= (dest & 0x0003fffc) << 3
+			instr |= -(dest & 0x00020000) & 0x00e00000
+			binary.LittleEndian.PutUint32(buf[i:], instr)
+		}
+	}
+	return i
+}
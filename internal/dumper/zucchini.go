@@ -0,0 +1,394 @@
+package dumper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	zucchiniMagic        = uint32('Z') | uint32('u')<<8 | uint32('c')<<16 | uint32('c')<<24
+	zucchiniMajorVersion = 1
+	// zucchiniElementVersion is the version of every Zucchini disassembler,
+	// recorded in each element header.
+	zucchiniElementVersion = 1
+)
+
+// Executable types are four character codes, stored like the magic.
+const (
+	zucchiniExeTypeNoOp       = uint32('N') | uint32('o')<<8 | uint32('O')<<16 | uint32('p')<<24
+	zucchiniExeTypeWin32X86   = uint32('P') | uint32('x')<<8 | uint32('8')<<16 | uint32('6')<<24
+	zucchiniExeTypeWin32X64   = uint32('P') | uint32('x')<<8 | uint32('6')<<16 | uint32('4')<<24
+	zucchiniExeTypeElfX86     = uint32('E') | uint32('x')<<8 | uint32('8')<<16 | uint32('6')<<24
+	zucchiniExeTypeElfX64     = uint32('E') | uint32('x')<<8 | uint32('6')<<16 | uint32('4')<<24
+	zucchiniExeTypeElfAArch32 = uint32('E') | uint32('A')<<8 | uint32('3')<<16 | uint32('2')<<24
+	zucchiniExeTypeElfAArch64 = uint32('E') | uint32('A')<<8 | uint32('6')<<16 | uint32('4')<<24
+	zucchiniExeTypeDex        = uint32('D') | uint32('E')<<8 | uint32('X')<<16 | uint32(' ')<<24
+	zucchiniExeTypeZtf        = uint32('Z') | uint32('T')<<8 | uint32('F')<<16 | uint32(' ')<<24
+)
+
+var zucchiniExeTypes = map[uint32]string{
+	zucchiniExeTypeNoOp:       "NoOp",
+	zucchiniExeTypeWin32X86:   "Win32 x86",
+	zucchiniExeTypeWin32X64:   "Win32 x64",
+	zucchiniExeTypeElfX86:     "ELF x86",
+	zucchiniExeTypeElfX64:     "ELF x64",
+	zucchiniExeTypeElfAArch32: "ELF AArch32",
+	zucchiniExeTypeElfAArch64: "ELF AArch64",
+	zucchiniExeTypeDex:        "DEX",
+	zucchiniExeTypeZtf:        "ZTF",
+}
+
+type zucchiniPatch struct {
+	oldSize  uint32
+	oldCRC   uint32
+	newSize  uint32
+	newCRC   uint32
+	elements []zucchiniElement
+}
+
+type zucchiniElement struct {
+	oldOffset, oldLength uint32
+	newOffset, newLength uint32
+	exeType              uint32
+
+	srcSkip, dstSkip, copyCount []byte
+	extraData                   []byte
+	rawDeltaSkip, rawDeltaDiff  []byte
+	referenceDelta              []byte
+	extraTargets                map[uint8][]byte
+}
+
+type zucchiniEquivalence struct {
+	srcOffset, dstOffset, length uint32
+}
+
+// ApplyZucchini applies a Zucchini ensemble patch to old.
+//
+// Elements are rebuilt from equivalences, extra data and raw deltas. Elements
+// of executable types additionally have their references (branch targets,
+// relocations, DEX item indices) corrected by disassembling the old and new
+// element. ARM ELF and DEX executables are supported; patches with x86,
+// Windows or ZTF elements are rejected rather than producing an image that
+// only looks right.
+func ApplyZucchini(old, patch []byte) ([]byte, error) {
+	patch, err := decodeZucchiniPatch(patch)
+	if err != nil {
+		return nil, fmt.Errorf("invalid zucchini patch: %w", err)
+	}
+
+	p, err := parseZucchiniPatch(patch)
+	if err != nil {
+		return nil, fmt.Errorf("invalid zucchini patch: %w", err)
+	}
+
+	if uint32(len(old)) != p.oldSize || crc32.ChecksumIEEE(old) != p.oldCRC {
+		return nil, fmt.Errorf("zucchini source does not match the patch (size %d, expected %d)", len(old), p.oldSize)
+	}
+
+	out := make([]byte, p.newSize)
+	for i := range p.elements {
+		e := &p.elements[i]
+		if uint64(e.oldOffset)+uint64(e.oldLength) > uint64(len(old)) ||
+			uint64(e.newOffset)+uint64(e.newLength) > uint64(len(out)) {
+			return nil, fmt.Errorf("zucchini element %d is out of range", i)
+		}
+
+		oldElem := old[e.oldOffset : e.oldOffset+e.oldLength]
+		newElem := out[e.newOffset : e.newOffset+e.newLength]
+		if err := e.apply(oldElem, newElem); err != nil {
+			return nil, fmt.Errorf("zucchini element %d (%s): %w", i, zucchiniExeTypes[e.exeType], err)
+		}
+	}
+
+	if crc := crc32.ChecksumIEEE(out); crc != p.newCRC {
+		return nil, fmt.Errorf("zucchini output CRC mismatch: expected %08x, got %08x", p.newCRC, crc)
+	}
+	return out, nil
+}
+
+// decodeZucchiniPatch undoes the brotli compression that delta_generator and
+// puffdiff apply to Zucchini patches. Patches that already start with the
+// Zucchini magic are returned as is.
+func decodeZucchiniPatch(patch []byte) ([]byte, error) {
+	if len(patch) >= 4 && binary.LittleEndian.Uint32(patch) == zucchiniMagic {
+		return patch, nil
+	}
+	return io.ReadAll(brotli.NewReader(bytes.NewReader(patch)))
+}
+
+// apply rebuilds an element in the order zucchini_apply does. The old
+// element is disassembled first, so unsupported or malformed executables are
+// rejected before any output is produced.
+func (e *zucchiniElement) apply(old, out []byte) error {
+	oldTypes, err := zucchiniDisassemble(e.exeType, old)
+	if err != nil {
+		return fmt.Errorf("old element: %w", err)
+	}
+	if err := e.applyEquivalencesAndExtraData(old, out); err != nil {
+		return err
+	}
+	if err := e.applyRawDelta(out); err != nil {
+		return err
+	}
+	return e.applyReferencesCorrection(oldTypes, old, out)
+}
+
+func (e *zucchiniElement) equivalences() func() (zucchiniEquivalence, bool, error) {
+	srcSkip, dstSkip, copyCount := e.srcSkip, e.dstSkip, e.copyCount
+	var prevSrc, prevDst int64
+
+	return func() (zucchiniEquivalence, bool, error) {
+		if len(srcSkip) == 0 || len(dstSkip) == 0 || len(copyCount) == 0 {
+			return zucchiniEquivalence{}, false, nil
+		}
+
+		length, n := binary.Uvarint(copyCount)
+		if n <= 0 {
+			return zucchiniEquivalence{}, false, fmt.Errorf("invalid equivalence length")
+		}
+		copyCount = copyCount[n:]
+
+		srcDiff, n := binary.Varint(srcSkip)
+		if n <= 0 {
+			return zucchiniEquivalence{}, false, fmt.Errorf("invalid equivalence source offset")
+		}
+		srcSkip = srcSkip[n:]
+
+		dstDiff, n := binary.Uvarint(dstSkip)
+		if n <= 0 {
+			return zucchiniEquivalence{}, false, fmt.Errorf("invalid equivalence destination offset")
+		}
+		dstSkip = dstSkip[n:]
+
+		src := prevSrc + srcDiff
+		dst := prevDst + int64(dstDiff)
+		if src < 0 || src+int64(length) > 1<<32 || dst+int64(length) > 1<<32 {
+			return zucchiniEquivalence{}, false, fmt.Errorf("equivalence out of range")
+		}
+		prevSrc = src + int64(length)
+		prevDst = dst + int64(length)
+
+		return zucchiniEquivalence{srcOffset: uint32(src), dstOffset: uint32(dst), length: uint32(length)}, true, nil
+	}
+}
+
+func (e *zucchiniElement) applyEquivalencesAndExtraData(old, out []byte) error {
+	extra := e.extraData
+	next := e.equivalences()
+	pos := uint32(0)
+
+	takeExtra := func(n uint32) error {
+		if uint32(len(extra)) < n {
+			return fmt.Errorf("extra data exhausted")
+		}
+		copy(out[pos:pos+n], extra[:n])
+		extra = extra[n:]
+		pos += n
+		return nil
+	}
+
+	for {
+		eq, ok, err := next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if eq.dstOffset < pos || uint64(eq.dstOffset)+uint64(eq.length) > uint64(len(out)) ||
+			uint64(eq.srcOffset)+uint64(eq.length) > uint64(len(old)) {
+			return fmt.Errorf("equivalence out of range")
+		}
+
+		if err := takeExtra(eq.dstOffset - pos); err != nil {
+			return err
+		}
+		pos += uint32(copy(out[pos:pos+eq.length], old[eq.srcOffset:eq.srcOffset+eq.length]))
+	}
+
+	if err := takeExtra(uint32(len(out)) - pos); err != nil {
+		return err
+	}
+	if len(extra) != 0 {
+		return fmt.Errorf("%d bytes of extra data left over", len(extra))
+	}
+	return nil
+}
+
+func (e *zucchiniElement) applyRawDelta(out []byte) error {
+	skip, diff := e.rawDeltaSkip, e.rawDeltaDiff
+	next := e.equivalences()
+
+	eq, ok, err := next()
+	if err != nil {
+		return err
+	}
+
+	var base, compensation uint64
+	for len(skip) > 0 && len(diff) > 0 {
+		offsetDiff, n := binary.Uvarint(skip)
+		if n <= 0 {
+			return fmt.Errorf("invalid raw delta offset")
+		}
+		skip = skip[n:]
+		copyOffset := offsetDiff + compensation
+		compensation = copyOffset + 1
+
+		d := int8(diff[0])
+		diff = diff[1:]
+		if d == 0 {
+			return fmt.Errorf("invalid raw delta")
+		}
+
+		for ok && base+uint64(eq.length) <= copyOffset {
+			base += uint64(eq.length)
+			if eq, ok, err = next(); err != nil {
+				return err
+			}
+		}
+		if !ok {
+			return fmt.Errorf("raw delta outside of equivalences")
+		}
+
+		pos := uint64(eq.dstOffset) + copyOffset - base
+		out[pos] += byte(d)
+	}
+
+	if len(skip) != 0 || len(diff) != 0 {
+		return fmt.Errorf("raw delta streams have different lengths")
+	}
+	return nil
+}
+
+type zucchiniReader struct {
+	data []byte
+	err  error
+}
+
+func (r *zucchiniReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.data) {
+		r.err = fmt.Errorf("truncated patch")
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *zucchiniReader) u8() uint8 {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *zucchiniReader) u16() uint16 {
+	if b := r.take(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *zucchiniReader) u32() uint32 {
+	if b := r.take(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *zucchiniReader) buffer() []byte {
+	n := r.u32()
+	return r.take(int(n))
+}
+
+func parseZucchiniPatch(data []byte) (*zucchiniPatch, error) {
+	r := &zucchiniReader{data: data}
+
+	if r.u32() != zucchiniMagic {
+		return nil, fmt.Errorf("bad magic")
+	}
+	if major := r.u16(); r.err == nil && major != zucchiniMajorVersion {
+		return nil, fmt.Errorf("unsupported major version %d", major)
+	}
+	r.u16()
+
+	p := &zucchiniPatch{
+		oldSize: r.u32(),
+		oldCRC:  r.u32(),
+		newSize: r.u32(),
+		newCRC:  r.u32(),
+	}
+
+	// New elements are listed in order and cover the whole new image; the
+	// gaps between executables are NoOp elements.
+	var newEnd uint64
+	count := r.u32()
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		e := zucchiniElement{
+			oldOffset: r.u32(),
+			oldLength: r.u32(),
+			newOffset: r.u32(),
+			newLength: r.u32(),
+			exeType:   r.u32(),
+		}
+		version := r.u16()
+		if r.err != nil {
+			break
+		}
+		name, ok := zucchiniExeTypes[e.exeType]
+		if !ok {
+			return nil, fmt.Errorf("element %d has unknown executable type %08x", i, e.exeType)
+		}
+		if version != zucchiniElementVersion {
+			return nil, fmt.Errorf("element %d has unsupported %s version %d", i, name, version)
+		}
+		if e.oldLength == 0 || e.newLength == 0 {
+			return nil, fmt.Errorf("element %d is empty", i)
+		}
+		if uint64(e.newOffset) != newEnd {
+			return nil, fmt.Errorf("element %d does not follow the previous one in the new image", i)
+		}
+		newEnd += uint64(e.newLength)
+
+		e.srcSkip = r.buffer()
+		e.dstSkip = r.buffer()
+		e.copyCount = r.buffer()
+		e.extraData = r.buffer()
+		e.rawDeltaSkip = r.buffer()
+		e.rawDeltaDiff = r.buffer()
+		e.referenceDelta = r.buffer()
+
+		pools := r.u32()
+		for j := uint32(0); j < pools && r.err == nil; j++ {
+			tag := r.u8()
+			if e.extraTargets == nil {
+				e.extraTargets = make(map[uint8][]byte)
+			}
+			if _, dup := e.extraTargets[tag]; dup {
+				return nil, fmt.Errorf("element %d has duplicate extra targets for pool %d", i, tag)
+			}
+			e.extraTargets[tag] = r.buffer()
+		}
+
+		p.elements = append(p.elements, e)
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	if newEnd != uint64(p.newSize) {
+		return nil, fmt.Errorf("elements do not cover the new image")
+	}
+	if len(r.data) != 0 {
+		return nil, fmt.Errorf("%d trailing bytes", len(r.data))
+	}
+	return p, nil
+}
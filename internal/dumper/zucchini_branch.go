@@ -0,0 +1,246 @@
+package dumper
+
+import "encoding/binary"
+
+// armBranch reads and writes the target of one encoding of a PC relative ARM
+// instruction. Targets are RVAs, computed from the instruction's RVA.
+type armBranch struct {
+	width uint32
+	// thumb2 codes are two halfwords, the first one in the high bits.
+	thumb2 bool
+	// instrAlign is the alignment of the instruction, pc what is added to
+	// its RVA before the displacement.
+	instrAlign, pc uint32
+	// decode returns the displacement and the alignment of the target, or a
+	// zero alignment if code is not this instruction.
+	decode func(code uint32) (disp int32, align uint32)
+	// encode stores disp into code.
+	encode func(code uint32, disp int32) (uint32, bool)
+}
+
+var (
+	armA24 = armBranch{width: 4, instrAlign: 4, pc: 8, decode: decodeA24, encode: encodeA24}
+	armT8  = armBranch{width: 2, instrAlign: 2, pc: 4, decode: decodeT8, encode: encodeT8}
+	armT11 = armBranch{width: 2, instrAlign: 2, pc: 4, decode: decodeT11, encode: encodeT11}
+	armT20 = armBranch{width: 4, thumb2: true, instrAlign: 2, pc: 4, decode: decodeT20, encode: encodeT20}
+	armT24 = armBranch{width: 4, thumb2: true, instrAlign: 2, pc: 4, decode: decodeT24, encode: encodeT24}
+
+	arm64Immd14 = armBranch{width: 4, instrAlign: 4, decode: decodeImmd14, encode: encodeImmd14}
+	arm64Immd19 = armBranch{width: 4, instrAlign: 4, decode: decodeImmd19, encode: encodeImmd19}
+	arm64Immd26 = armBranch{width: 4, instrAlign: 4, decode: decodeImmd26, encode: encodeImmd26}
+)
+
+func (b *armBranch) fetch(image []byte, offset uint32) uint32 {
+	switch {
+	case b.width == 2:
+		return uint32(binary.LittleEndian.Uint16(image[offset:]))
+	case b.thumb2:
+		return uint32(binary.LittleEndian.Uint16(image[offset:]))<<16 | uint32(binary.LittleEndian.Uint16(image[offset+2:]))
+	}
+	return binary.LittleEndian.Uint32(image[offset:])
+}
+
+func (b *armBranch) store(image []byte, offset, code uint32) {
+	switch {
+	case b.width == 2:
+		binary.LittleEndian.PutUint16(image[offset:], uint16(code))
+	case b.thumb2:
+		binary.LittleEndian.PutUint16(image[offset:], uint16(code>>16))
+		binary.LittleEndian.PutUint16(image[offset+2:], uint16(code))
+	default:
+		binary.LittleEndian.PutUint32(image[offset:], code)
+	}
+}
+
+// read returns the target of the instruction code at rva.
+func (b *armBranch) read(rva, code uint32) (uint32, bool) {
+	if rva%b.instrAlign != 0 {
+		return 0, false
+	}
+	disp, align := b.decode(code)
+	if align == 0 {
+		return 0, false
+	}
+	return (rva+b.pc)&^(align-1) + uint32(disp), true
+}
+
+// write returns code pointed at target, if the instruction can reach it.
+func (b *armBranch) write(rva, target, code uint32) (uint32, bool) {
+	if rva%b.instrAlign != 0 {
+		return 0, false
+	}
+	_, align := b.decode(code)
+	if align == 0 || target%align != 0 {
+		return 0, false
+	}
+	return b.encode(code, int32(target-(rva+b.pc)&^(align-1)))
+}
+
+// signExtend extends the sign bit at position bit of v.
+func signExtend(v uint32, bit uint) int32 {
+	return int32(v<<(31-bit)) >> (31 - bit)
+}
+
+// fitsSigned reports whether v fits in a bits wide two's complement field.
+func fitsSigned(v int32, bits uint) bool {
+	return v >= -1<<(bits-1) && v < 1<<(bits-1)
+}
+
+// decodeA24 decodes B, BL and BLX (immediate) in ARM mode. BLX switches to
+// Thumb, so its target only needs halfword alignment.
+func decodeA24(code uint32) (int32, uint32) {
+	if op := code >> 24 & 0xF; op != 0xA && op != 0xB {
+		return 0, 0
+	}
+	disp := signExtend(code&0xFFFFFF, 23) << 2
+	if code>>28 == 0xF {
+		return disp | int32(code>>24&1)<<1, 2
+	}
+	return disp, 4
+}
+
+func encodeA24(code uint32, disp int32) (uint32, bool) {
+	if !fitsSigned(disp, 26) {
+		return 0, false
+	}
+	if code>>28 == 0xF {
+		if disp%2 != 0 {
+			return 0, false
+		}
+		code = code&^(1<<24) | uint32(disp>>1&1)<<24
+	} else if disp%4 != 0 {
+		return 0, false
+	}
+	return code&0xFF000000 | uint32(disp>>2)&0xFFFFFF, true
+}
+
+// decodeT8 decodes the 16-bit conditional B in Thumb2.
+func decodeT8(code uint32) (int32, uint32) {
+	if code&0xF000 != 0xD000 || code&0x0F00 == 0x0F00 {
+		return 0, 0
+	}
+	return signExtend(code&0xFF, 7) << 1, 2
+}
+
+func encodeT8(code uint32, disp int32) (uint32, bool) {
+	if disp%2 != 0 || !fitsSigned(disp, 9) {
+		return 0, false
+	}
+	return code&0xFF00 | uint32(disp>>1)&0xFF, true
+}
+
+// decodeT11 decodes the 16-bit unconditional B in Thumb2.
+func decodeT11(code uint32) (int32, uint32) {
+	if code&0xF800 != 0xE000 {
+		return 0, 0
+	}
+	return signExtend(code&0x7FF, 10) << 1, 2
+}
+
+func encodeT11(code uint32, disp int32) (uint32, bool) {
+	if disp%2 != 0 || !fitsSigned(disp, 12) {
+		return 0, false
+	}
+	return code&0xF800 | uint32(disp>>1)&0x7FF, true
+}
+
+// decodeT20 decodes the 32-bit conditional B in Thumb2.
+func decodeT20(code uint32) (int32, uint32) {
+	if code&0xF800D000 != 0xF0008000 || code&0x03C00000 == 0x03C00000 {
+		return 0, 0
+	}
+	imm11, j2, j1 := code&0x7FF, code>>11&1, code>>13&1
+	imm6, s := code>>16&0x3F, code>>26&1
+	return signExtend(s<<20|j2<<19|j1<<18|imm6<<12|imm11<<1, 20), 2
+}
+
+func encodeT20(code uint32, disp int32) (uint32, bool) {
+	if disp%2 != 0 || !fitsSigned(disp, 21) {
+		return 0, false
+	}
+	d := uint32(disp)
+	s, j2, j1 := d>>20&1, d>>19&1, d>>18&1
+	imm6, imm11 := d>>12&0x3F, d>>1&0x7FF
+	return code&0xFBC0D000 | s<<26 | imm6<<16 | j1<<13 | j2<<11 | imm11, true
+}
+
+// decodeT24 decodes the 32-bit B, BL and BLX in Thumb2. BLX switches to ARM,
+// so its target needs word alignment.
+func decodeT24(code uint32) (int32, uint32) {
+	bits := code & 0xF800D000
+	if bits != 0xF0009000 && bits != 0xF000D000 && bits != 0xF000C000 {
+		return 0, 0
+	}
+	imm11, j2, j1 := code&0x7FF, code>>11&1, code>>13&1
+	imm10, s := code>>16&0x3FF, code>>26&1
+	i1, i2 := j1^s^1, j2^s^1
+	disp := signExtend(s<<24|i1<<23|i2<<22|imm10<<12|imm11<<1, 24)
+	if bits == 0xF000C000 {
+		if code&1 != 0 {
+			return 0, 0
+		}
+		return disp, 4
+	}
+	return disp, 2
+}
+
+func encodeT24(code uint32, disp int32) (uint32, bool) {
+	if disp%2 != 0 || !fitsSigned(disp, 25) {
+		return 0, false
+	}
+	if code&0xF800D000 == 0xF000C000 && disp%4 != 0 {
+		return 0, false
+	}
+	d := uint32(disp)
+	s, i1, i2 := d>>24&1, d>>23&1, d>>22&1
+	imm10, imm11 := d>>12&0x3FF, d>>1&0x7FF
+	return code&0xF800D000 | s<<26 | imm10<<16 | (i1^s^1)<<13 | (i2^s^1)<<11 | imm11, true
+}
+
+// decodeImmd14 decodes TBZ and TBNZ.
+func decodeImmd14(code uint32) (int32, uint32) {
+	if op := code >> 24 & 0x7F; op != 0x36 && op != 0x37 {
+		return 0, 0
+	}
+	return signExtend(code>>5&0x3FFF, 13) << 2, 4
+}
+
+func encodeImmd14(code uint32, disp int32) (uint32, bool) {
+	if disp%4 != 0 || !fitsSigned(disp, 16) {
+		return 0, false
+	}
+	return code&0xFFF8001F | (uint32(disp)>>2&0x3FFF)<<5, true
+}
+
+// decodeImmd19 decodes B.cond, CBZ, CBNZ and the literal forms of LDR, LDRSW
+// and PRFM.
+func decodeImmd19(code uint32) (int32, uint32) {
+	op := code >> 24 & 0x7F
+	if code&0xFF000010 != 0x54000000 && op != 0x34 && op != 0x35 &&
+		code&0xBF000000 != 0x18000000 && code>>24 != 0x98 && code>>24 != 0xD8 {
+		return 0, 0
+	}
+	return signExtend(code>>5&0x7FFFF, 18) << 2, 4
+}
+
+func encodeImmd19(code uint32, disp int32) (uint32, bool) {
+	if disp%4 != 0 || !fitsSigned(disp, 21) {
+		return 0, false
+	}
+	return code&0xFF00001F | (uint32(disp)>>2&0x7FFFF)<<5, true
+}
+
+// decodeImmd26 decodes B and BL.
+func decodeImmd26(code uint32) (int32, uint32) {
+	if op := code >> 26; op != 0x05 && op != 0x25 {
+		return 0, 0
+	}
+	return signExtend(code&0x3FFFFFF, 25) << 2, 4
+}
+
+func encodeImmd26(code uint32, disp int32) (uint32, bool) {
+	if disp%4 != 0 || !fitsSigned(disp, 28) {
+		return 0, false
+	}
+	return code&0xFC000000 | uint32(disp)>>2&0x3FFFFFF, true
+}
@@ -0,0 +1,729 @@
+package dumper
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+)
+
+// DEX map item types.
+const (
+	dexTypeHeaderItem               = 0x0000
+	dexTypeStringIDItem             = 0x0001
+	dexTypeTypeIDItem               = 0x0002
+	dexTypeProtoIDItem              = 0x0003
+	dexTypeFieldIDItem              = 0x0004
+	dexTypeMethodIDItem             = 0x0005
+	dexTypeClassDefItem             = 0x0006
+	dexTypeCallSiteIDItem           = 0x0007
+	dexTypeMethodHandleItem         = 0x0008
+	dexTypeMapList                  = 0x1000
+	dexTypeTypeList                 = 0x1001
+	dexTypeAnnotationSetRefList     = 0x1002
+	dexTypeAnnotationSetItem        = 0x1003
+	dexTypeClassDataItem            = 0x2000
+	dexTypeCodeItem                 = 0x2001
+	dexTypeStringDataItem           = 0x2002
+	dexTypeDebugInfoItem            = 0x2003
+	dexTypeAnnotationItem           = 0x2004
+	dexTypeEncodedArrayItem         = 0x2005
+	dexTypeAnnotationsDirectoryItem = 0x2006
+)
+
+// Target pools of the DEX disassembler.
+const (
+	dexPoolStringID = iota
+	dexPoolTypeID
+	dexPoolProtoID
+	dexPoolFieldID
+	dexPoolMethodID
+	dexPoolCallSiteID
+	dexPoolMethodHandle
+	dexPoolTypeList
+	dexPoolAnnotationSetRefList
+	dexPoolAnnotationSet
+	dexPoolClassData
+	dexPoolCode
+	dexPoolStringData
+	dexPoolAnnotation
+	dexPoolEncodedArray
+	dexPoolAnnotationsDirectory
+	dexPoolCallSite
+)
+
+const dexHeaderSize = 0x70
+
+// dexItemSizes holds the size of the fixed part of the items of each type,
+// used to check that a map item fits the file. Items of other types take at
+// least a byte.
+var dexItemSizes = map[uint16]uint32{
+	dexTypeHeaderItem:               dexHeaderSize,
+	dexTypeStringIDItem:             4,
+	dexTypeTypeIDItem:               4,
+	dexTypeProtoIDItem:              12,
+	dexTypeFieldIDItem:              8,
+	dexTypeMethodIDItem:             8,
+	dexTypeClassDefItem:             32,
+	dexTypeCallSiteIDItem:           4,
+	dexTypeMethodHandleItem:         8,
+	dexTypeMapList:                  4,
+	dexTypeTypeList:                 4,
+	dexTypeAnnotationSetRefList:     4,
+	dexTypeAnnotationSetItem:        4,
+	dexTypeCodeItem:                 16,
+	dexTypeAnnotationsDirectoryItem: 16,
+}
+
+// dexMapItem is an entry of the map list.
+type dexMapItem struct {
+	typ          uint16
+	size, offset uint32
+}
+
+// dexInstruction describes a group of Dalvik opcodes sharing a format.
+type dexInstruction struct {
+	opcode  uint8
+	layout  uint8 // size in 16-bit code units
+	format  byte  // last character of the format ID
+	variant uint8 // number of opcodes in the group
+}
+
+var dexInstructions = func() (table [256]*dexInstruction) {
+	groups := []dexInstruction{
+		{0x00, 1, 'x', 1}, {0x01, 1, 'x', 1}, {0x02, 2, 'x', 1}, {0x03, 3, 'x', 1},
+		{0x04, 1, 'x', 1}, {0x05, 2, 'x', 1}, {0x06, 3, 'x', 1}, {0x07, 1, 'x', 1},
+		{0x08, 2, 'x', 1}, {0x09, 3, 'x', 1}, {0x0A, 1, 'x', 4}, {0x0E, 1, 'x', 1},
+		{0x0F, 1, 'x', 3}, {0x12, 1, 'n', 1}, {0x13, 2, 's', 1}, {0x14, 3, 'i', 1},
+		{0x15, 2, 'h', 1}, {0x16, 2, 's', 1}, {0x17, 3, 'i', 1}, {0x18, 5, 'l', 1},
+		{0x19, 2, 'h', 1}, {0x1A, 2, 'c', 1}, {0x1B, 3, 'c', 1}, {0x1C, 2, 'c', 1},
+		{0x1D, 1, 'x', 2}, {0x1F, 2, 'c', 1}, {0x20, 2, 'c', 1}, {0x21, 1, 'x', 1},
+		{0x22, 2, 'c', 1}, {0x23, 2, 'c', 1}, {0x24, 3, 'c', 1}, {0x25, 3, 'c', 1},
+		{0x26, 3, 't', 1}, {0x27, 1, 'x', 1}, {0x28, 1, 't', 1}, {0x29, 2, 't', 1},
+		{0x2A, 3, 't', 1}, {0x2B, 3, 't', 2}, {0x2D, 2, 'x', 5}, {0x32, 2, 't', 6},
+		{0x38, 2, 't', 6}, {0x44, 2, 'x', 14}, {0x52, 2, 'c', 14}, {0x60, 2, 'c', 14},
+		{0x6E, 3, 'c', 5}, {0x74, 3, 'c', 5}, {0x7B, 1, 'x', 21}, {0x90, 2, 'x', 32},
+		{0xB0, 1, 'x', 32}, {0xD0, 2, 's', 8}, {0xD8, 2, 'b', 11}, {0xFA, 4, 'c', 1},
+		{0xFB, 4, 'c', 1}, {0xFC, 3, 'c', 1}, {0xFD, 3, 'c', 1}, {0xFE, 2, 'c', 1},
+		{0xFF, 2, 'c', 1},
+	}
+	for i := range groups {
+		for op := range int(groups[i].variant) {
+			table[int(groups[i].opcode)+op] = &groups[i]
+		}
+	}
+	return table
+}()
+
+// zucchiniDex finds the references of a DEX file: item indices and offsets
+// in the fixed size items and lists, and the indices and branches in code.
+type zucchiniDex struct {
+	image []byte
+	items map[uint16]dexMapItem
+
+	typeLists, annotationSetRefLists, annotationSets []uint32
+	annotationsDirectories                           []uint32
+	fieldAnnotations, methodAnnotations              []uint32
+	parameterAnnotations                             []uint32
+	codeItems                                        []uint32
+}
+
+func parseZucchiniDex(image []byte) (*zucchiniDex, error) {
+	le := binary.LittleEndian
+	if len(image) < dexHeaderSize || string(image[:4]) != "dex\n" || image[7] != 0 {
+		return nil, fmt.Errorf("not a DEX file")
+	}
+	switch string(image[4:7]) {
+	case "035", "037", "038", "039":
+	default:
+		return nil, fmt.Errorf("unsupported DEX version %q", image[4:7])
+	}
+	fileSize, mapOff := le.Uint32(image[0x20:]), le.Uint32(image[0x34:])
+	if fileSize < dexHeaderSize || uint64(fileSize) > uint64(len(image)) || mapOff < dexHeaderSize {
+		return nil, fmt.Errorf("invalid DEX header")
+	}
+	d := &zucchiniDex{image: image[:fileSize], items: make(map[uint16]dexMapItem)}
+
+	if uint64(mapOff)+4 > uint64(fileSize) {
+		return nil, fmt.Errorf("map list out of range")
+	}
+	count := le.Uint32(d.image[mapOff:])
+	if uint64(mapOff)+4+uint64(count)*12 > uint64(fileSize) {
+		return nil, fmt.Errorf("map list out of range")
+	}
+	for i := range count {
+		b := d.image[mapOff+4+i*12:]
+		item := dexMapItem{typ: le.Uint16(b), size: le.Uint32(b[4:]), offset: le.Uint32(b[8:])}
+		if _, dup := d.items[item.typ]; dup {
+			return nil, fmt.Errorf("duplicate map item type %#x", item.typ)
+		}
+		size, ok := dexItemSizes[item.typ]
+		if !ok {
+			size = 1
+		}
+		if uint64(item.offset)+uint64(item.size)*uint64(size) > uint64(fileSize) {
+			return nil, fmt.Errorf("map item %#x out of range", item.typ)
+		}
+		d.items[item.typ] = item
+	}
+	for _, typ := range []uint16{
+		dexTypeStringIDItem, dexTypeTypeIDItem, dexTypeProtoIDItem, dexTypeFieldIDItem,
+		dexTypeMethodIDItem, dexTypeClassDefItem, dexTypeTypeList, dexTypeCodeItem,
+	} {
+		if _, ok := d.items[typ]; !ok {
+			return nil, fmt.Errorf("missing map item %#x", typ)
+		}
+	}
+
+	var err error
+	if d.typeLists, err = d.itemOffsets(dexTypeTypeList, 2); err != nil {
+		return nil, err
+	}
+	if d.annotationSetRefLists, err = d.itemOffsets(dexTypeAnnotationSetRefList, 4); err != nil {
+		return nil, err
+	}
+	if d.annotationSets, err = d.itemOffsets(dexTypeAnnotationSetItem, 4); err != nil {
+		return nil, err
+	}
+	if err := d.parseAnnotationsDirectories(); err != nil {
+		return nil, err
+	}
+	if err := d.parseCodeItems(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// itemOffsets returns the offsets of the elements of the lists of a map item,
+// each list being a 4-byte aligned count followed by elements of the given
+// size.
+func (d *zucchiniDex) itemOffsets(typ uint16, size uint32) ([]uint32, error) {
+	item, ok := d.items[typ]
+	if !ok {
+		return nil, nil
+	}
+	var offsets []uint32
+	pos := uint64(item.offset)
+	for range item.size {
+		pos = (pos + 3) &^ 3
+		if pos+4 > uint64(len(d.image)) {
+			return nil, fmt.Errorf("map item %#x out of range", typ)
+		}
+		n := uint64(binary.LittleEndian.Uint32(d.image[pos:]))
+		pos += 4
+		if pos+n*uint64(size) > uint64(len(d.image)) {
+			return nil, fmt.Errorf("map item %#x out of range", typ)
+		}
+		for range n {
+			offsets = append(offsets, uint32(pos))
+			pos += uint64(size)
+		}
+	}
+	return offsets, nil
+}
+
+// parseAnnotationsDirectories collects the directories and the field, method
+// and parameter annotation entries that follow each of them.
+func (d *zucchiniDex) parseAnnotationsDirectories() error {
+	item, ok := d.items[dexTypeAnnotationsDirectoryItem]
+	if !ok {
+		return nil
+	}
+	le := binary.LittleEndian
+	pos := uint64(item.offset)
+	for range item.size {
+		pos = (pos + 3) &^ 3
+		if pos+16 > uint64(len(d.image)) {
+			return fmt.Errorf("annotations directory out of range")
+		}
+		fields := uint64(le.Uint32(d.image[pos+4:]))
+		methods := uint64(le.Uint32(d.image[pos+8:]))
+		params := uint64(le.Uint32(d.image[pos+12:]))
+		d.annotationsDirectories = append(d.annotationsDirectories, uint32(pos))
+		pos += 16
+		if pos+(fields+methods+params)*8 > uint64(len(d.image)) {
+			return fmt.Errorf("annotations directory out of range")
+		}
+		for _, part := range []struct {
+			n       uint64
+			offsets *[]uint32
+		}{{fields, &d.fieldAnnotations}, {methods, &d.methodAnnotations}, {params, &d.parameterAnnotations}} {
+			for range part.n {
+				*part.offsets = append(*part.offsets, uint32(pos))
+				pos += 8
+			}
+		}
+	}
+	return nil
+}
+
+// parseCodeItems walks the code items to find where each one starts.
+func (d *zucchiniDex) parseCodeItems() error {
+	item := d.items[dexTypeCodeItem]
+	le := binary.LittleEndian
+	pos := uint64(item.offset)
+	end := uint64(len(d.image))
+	errTruncated := fmt.Errorf("code item out of range")
+
+	uleb := func() (uint32, bool) {
+		if pos >= end {
+			return 0, false
+		}
+		v, n := binary.Uvarint(d.image[pos:min(end, pos+5)])
+		if n <= 0 || v > math.MaxUint32 {
+			return 0, false
+		}
+		pos += uint64(n)
+		return uint32(v), true
+	}
+
+	for range item.size {
+		pos = (pos + 3) &^ 3
+		if pos+16 > end {
+			return errTruncated
+		}
+		d.codeItems = append(d.codeItems, uint32(pos))
+		tries := uint64(le.Uint16(d.image[pos+6:]))
+		insns := uint64(le.Uint32(d.image[pos+12:]))
+		pos += 16 + insns*2
+		if pos > end {
+			return errTruncated
+		}
+		if tries == 0 {
+			continue
+		}
+
+		pos = (pos+3)&^3 + tries*8
+		if pos > end {
+			return errTruncated
+		}
+		handlers, ok := uleb()
+		if !ok {
+			return errTruncated
+		}
+		for range handlers {
+			if pos >= end {
+				return errTruncated
+			}
+			size, n := dexSleb128(d.image[pos:min(end, pos+5)])
+			if n <= 0 || size < -65536 || size > 65536 {
+				return errTruncated
+			}
+			pos += uint64(n)
+			pairs := size
+			if pairs < 0 {
+				pairs = -pairs
+			}
+			for range 2 * pairs {
+				if _, ok := uleb(); !ok {
+					return errTruncated
+				}
+			}
+			if size <= 0 {
+				if _, ok := uleb(); !ok {
+					return errTruncated
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// dexSleb128 decodes a signed LEB128 value of at most 32 bits.
+func dexSleb128(b []byte) (int32, int) {
+	var v uint32
+	for i, c := range b {
+		v |= uint32(c&0x7F) << (7 * i)
+		if c&0x80 == 0 {
+			if shift := 7 * (i + 1); shift < 32 && c&0x40 != 0 {
+				v |= ^uint32(0) << shift
+			}
+			return int32(v), i + 1
+		}
+	}
+	return 0, 0
+}
+
+// instructions calls fn for every instruction in the code items starting at
+// or after lo, up to hi, with the instruction's offset and opcode. Payloads
+// of switch and fill-array-data instructions are skipped, and an unknown
+// opcode ends its code item.
+func (d *zucchiniDex) instructions(lo, hi uint32, fn func(offset uint32, op uint8, instr *dexInstruction) bool) {
+	le := binary.LittleEndian
+	i, _ := slices.BinarySearch(d.codeItems, lo)
+	// The code item containing lo starts before it.
+	if i > 0 && (i == len(d.codeItems) || d.codeItems[i] > lo) {
+		i--
+	}
+	for ; i < len(d.codeItems) && d.codeItems[i] < hi; i++ {
+		start := uint64(d.codeItems[i]) + 16
+		end := start + uint64(le.Uint32(d.image[d.codeItems[i]+12:]))*2
+		for pos := start; pos+2 <= end; {
+			unit := le.Uint16(d.image[pos:])
+			op := uint8(unit)
+			var size uint64
+			switch {
+			case unit == 0x0100 && pos+4 <= end:
+				size = 4 + 2*uint64(le.Uint16(d.image[pos+2:]))
+			case unit == 0x0200 && pos+4 <= end:
+				size = 2 + 4*uint64(le.Uint16(d.image[pos+2:]))
+			case unit == 0x0300 && pos+8 <= end:
+				width := uint64(le.Uint16(d.image[pos+2:]))
+				count := uint64(le.Uint32(d.image[pos+4:]))
+				size = 4 + (count*width+1)/2
+			default:
+				instr := dexInstructions[op]
+				if instr == nil || pos+uint64(instr.layout)*2 > end {
+					size = 0
+					break
+				}
+				if pos >= uint64(lo) && pos < uint64(hi) && !fn(uint32(pos), op, instr) {
+					return
+				}
+				pos += uint64(instr.layout) * 2
+				continue
+			}
+			if size == 0 {
+				break
+			}
+			pos += size * 2
+		}
+	}
+}
+
+type dexRefReader = func(lo, hi uint32) func() (zucchiniRef, bool)
+
+// codeRefs reads the references of the instructions accepted by filter, which
+// returns the location of the reference within the instruction. target maps
+// the location to the referenced offset.
+func (d *zucchiniDex) codeRefs(filter func(op uint8, instr *dexInstruction) (uint32, bool), target func(location uint32) uint32) dexRefReader {
+	return func(lo, hi uint32) func() (zucchiniRef, bool) {
+		var refs []zucchiniRef
+		d.instructions(lo, hi, func(offset uint32, op uint8, instr *dexInstruction) bool {
+			rel, ok := filter(op, instr)
+			if !ok {
+				return true
+			}
+			location := offset + rel
+			if location >= hi {
+				return false
+			}
+			if t := target(location); t != zucchiniInvalidOffset && t != dexNullTarget {
+				refs = append(refs, zucchiniRef{location: location, target: t})
+			}
+			return true
+		})
+		return sliceRefs(refs)
+	}
+}
+
+func sliceRefs(refs []zucchiniRef) func() (zucchiniRef, bool) {
+	return func() (zucchiniRef, bool) {
+		if len(refs) == 0 {
+			return zucchiniRef{}, false
+		}
+		ref := refs[0]
+		refs = refs[1:]
+		return ref, true
+	}
+}
+
+// itemRefs reads the references at rel bytes into each of the fixed size items
+// of a map item.
+func (d *zucchiniDex) itemRefs(typ uint16, itemSize, rel uint32, target func(location uint32) uint32) dexRefReader {
+	return func(lo, hi uint32) func() (zucchiniRef, bool) {
+		item, ok := d.items[typ]
+		if !ok {
+			return sliceRefs(nil)
+		}
+		var refs []zucchiniRef
+		start := uint64(item.offset) + uint64(rel)
+		first := uint64(0)
+		if uint64(lo) > start {
+			first = (uint64(lo) - start + uint64(itemSize) - 1) / uint64(itemSize)
+		}
+		for i := first; i < uint64(item.size); i++ {
+			location := start + i*uint64(itemSize)
+			if location >= uint64(hi) {
+				break
+			}
+			t := target(uint32(location))
+			if t == zucchiniInvalidOffset {
+				break
+			}
+			if t != dexNullTarget {
+				refs = append(refs, zucchiniRef{location: uint32(location), target: t})
+			}
+		}
+		return sliceRefs(refs)
+	}
+}
+
+// listRefs reads the references at rel bytes into each of the given list
+// elements.
+func (d *zucchiniDex) listRefs(offsets []uint32, rel uint32, target func(location uint32) uint32) dexRefReader {
+	return func(lo, hi uint32) func() (zucchiniRef, bool) {
+		var refs []zucchiniRef
+		i, _ := slices.BinarySearch(offsets, max(lo, rel)-rel)
+		for ; i < len(offsets) && offsets[i]+rel < hi; i++ {
+			location := offsets[i] + rel
+			if location < lo {
+				continue
+			}
+			t := target(location)
+			if t == zucchiniInvalidOffset {
+				break
+			}
+			if t != dexNullTarget {
+				refs = append(refs, zucchiniRef{location: location, target: t})
+			}
+		}
+		return sliceRefs(refs)
+	}
+}
+
+// dexNullTarget marks references that are absent, like a zero offset or a
+// NO_INDEX index.
+const dexNullTarget = zucchiniInvalidOffset - 1
+
+// indexTarget reads an index of the given width into the items of a map
+// item.
+func (d *zucchiniDex) indexTarget(width uint32, typ uint16, itemSize uint32) func(location uint32) uint32 {
+	return func(location uint32) uint32 {
+		if uint64(location)+uint64(width) > uint64(len(d.image)) {
+			return zucchiniInvalidOffset
+		}
+		var index uint32
+		if width == 2 {
+			index = uint32(binary.LittleEndian.Uint16(d.image[location:]))
+		} else {
+			index = binary.LittleEndian.Uint32(d.image[location:])
+			if index == math.MaxUint32 {
+				return dexNullTarget
+			}
+		}
+		item, ok := d.items[typ]
+		if !ok || index >= item.size {
+			return zucchiniInvalidOffset
+		}
+		return item.offset + index*itemSize
+	}
+}
+
+func (d *zucchiniDex) writeIndex(width uint32, typ uint16, itemSize uint32) func(ref zucchiniRef) {
+	return func(ref zucchiniRef) {
+		item, ok := d.items[typ]
+		if !ok || uint64(ref.location)+uint64(width) > uint64(len(d.image)) {
+			return
+		}
+		index := (ref.target - item.offset) / itemSize
+		if index >= item.size || (width == 2 && index > math.MaxUint16) {
+			return
+		}
+		if width == 2 {
+			binary.LittleEndian.PutUint16(d.image[ref.location:], uint16(index))
+		} else {
+			binary.LittleEndian.PutUint32(d.image[ref.location:], index)
+		}
+	}
+}
+
+// offsetTarget reads a 32-bit file offset. Zero means no item.
+func (d *zucchiniDex) offsetTarget(location uint32) uint32 {
+	if uint64(location)+4 > uint64(len(d.image)) {
+		return zucchiniInvalidOffset
+	}
+	offset := binary.LittleEndian.Uint32(d.image[location:])
+	if offset == 0 {
+		return dexNullTarget
+	}
+	if offset >= uint32(len(d.image)) {
+		return zucchiniInvalidOffset
+	}
+	return offset
+}
+
+func (d *zucchiniDex) writeOffset(ref zucchiniRef) {
+	if uint64(ref.location)+4 <= uint64(len(d.image)) {
+		binary.LittleEndian.PutUint32(d.image[ref.location:], ref.target)
+	}
+}
+
+// relCodeTarget reads a branch displacement of the given width, counted in
+// code units from the start of the instruction.
+func (d *zucchiniDex) relCodeTarget(width uint32) func(location uint32) uint32 {
+	return func(location uint32) uint32 {
+		if uint64(location)+uint64(width) > uint64(len(d.image)) {
+			return zucchiniInvalidOffset
+		}
+		instr, disp := int64(location)-2, int64(0)
+		switch width {
+		case 1:
+			instr, disp = int64(location)-1, int64(int8(d.image[location]))
+		case 2:
+			disp = int64(int16(binary.LittleEndian.Uint16(d.image[location:])))
+		default:
+			disp = int64(int32(binary.LittleEndian.Uint32(d.image[location:])))
+		}
+		target := instr + disp*2
+		if target < 0 || target >= int64(len(d.image)) {
+			return zucchiniInvalidOffset
+		}
+		return uint32(target)
+	}
+}
+
+func (d *zucchiniDex) writeRelCode(width uint32) func(ref zucchiniRef) {
+	return func(ref zucchiniRef) {
+		if uint64(ref.location)+uint64(width) > uint64(len(d.image)) {
+			return
+		}
+		instr := int64(ref.location) - 2
+		if width == 1 {
+			instr = int64(ref.location) - 1
+		}
+		diff := int64(ref.target) - instr
+		if diff%2 != 0 {
+			return
+		}
+		disp := diff / 2
+		switch width {
+		case 1:
+			if disp >= math.MinInt8 && disp <= math.MaxInt8 {
+				d.image[ref.location] = byte(disp)
+			}
+		case 2:
+			if disp >= math.MinInt16 && disp <= math.MaxInt16 {
+				binary.LittleEndian.PutUint16(d.image[ref.location:], uint16(disp))
+			}
+		default:
+			if disp >= math.MinInt32 && disp <= math.MaxInt32 {
+				binary.LittleEndian.PutUint32(d.image[ref.location:], uint32(disp))
+			}
+		}
+	}
+}
+
+// opcodes returns a code filter accepting the given opcodes of format 'c',
+// with the reference at rel bytes into the instruction.
+func opcodes(format byte, rel uint32, ops ...uint8) func(op uint8, instr *dexInstruction) (uint32, bool) {
+	return func(op uint8, instr *dexInstruction) (uint32, bool) {
+		return rel, instr.format == format && slices.Contains(ops, op)
+	}
+}
+
+func (d *zucchiniDex) refTypes() []zucchiniRefType {
+	const stringIDSize, typeIDSize, protoIDSize, fieldIDSize, methodIDSize = 4, 4, 12, 8, 8
+	const classDefSize, callSiteIDSize, methodHandleSize = 32, 4, 8
+
+	index := func(width uint32, typ uint16, size uint32) (func(uint32) uint32, func(zucchiniRef)) {
+		return d.indexTarget(width, typ, size), d.writeIndex(width, typ, size)
+	}
+	var types []zucchiniRefType
+	add := func(pool uint8, width uint32, read dexRefReader, write func(zucchiniRef)) {
+		types = append(types, zucchiniRefType{pool: pool, width: width, read: read, write: write})
+	}
+
+	methodHandles := func(fieldTypes bool) func(location uint32) uint32 {
+		fieldTarget, _ := index(2, dexTypeFieldIDItem, fieldIDSize)
+		methodTarget, _ := index(2, dexTypeMethodIDItem, methodIDSize)
+		return func(location uint32) uint32 {
+			// The field or method index follows the method handle type and
+			// an unused halfword.
+			kind := binary.LittleEndian.Uint16(d.image[location-4:])
+			if (kind <= 3) != fieldTypes || kind > 8 {
+				return dexNullTarget
+			}
+			if fieldTypes {
+				return fieldTarget(location)
+			}
+			return methodTarget(location)
+		}
+	}
+
+	toString32, writeString32 := index(4, dexTypeStringIDItem, stringIDSize)
+	add(dexPoolStringID, 4, d.itemRefs(dexTypeTypeIDItem, typeIDSize, 0, toString32), writeString32)
+	add(dexPoolStringID, 4, d.itemRefs(dexTypeProtoIDItem, protoIDSize, 0, toString32), writeString32)
+	add(dexPoolStringID, 4, d.itemRefs(dexTypeFieldIDItem, fieldIDSize, 4, toString32), writeString32)
+	add(dexPoolStringID, 4, d.itemRefs(dexTypeMethodIDItem, methodIDSize, 4, toString32), writeString32)
+	add(dexPoolStringID, 4, d.itemRefs(dexTypeClassDefItem, classDefSize, 16, toString32), writeString32)
+	toString16, writeString16 := index(2, dexTypeStringIDItem, stringIDSize)
+	add(dexPoolStringID, 2, d.codeRefs(opcodes('c', 2, 0x1A), toString16), writeString16)
+	add(dexPoolStringID, 4, d.codeRefs(opcodes('c', 2, 0x1B), toString32), writeString32)
+
+	toType32, writeType32 := index(4, dexTypeTypeIDItem, typeIDSize)
+	toType16, writeType16 := index(2, dexTypeTypeIDItem, typeIDSize)
+	add(dexPoolTypeID, 4, d.itemRefs(dexTypeProtoIDItem, protoIDSize, 4, toType32), writeType32)
+	add(dexPoolTypeID, 2, d.itemRefs(dexTypeFieldIDItem, fieldIDSize, 0, toType16), writeType16)
+	add(dexPoolTypeID, 2, d.itemRefs(dexTypeFieldIDItem, fieldIDSize, 2, toType16), writeType16)
+	add(dexPoolTypeID, 2, d.itemRefs(dexTypeMethodIDItem, methodIDSize, 0, toType16), writeType16)
+	add(dexPoolTypeID, 4, d.itemRefs(dexTypeClassDefItem, classDefSize, 0, toType32), writeType32)
+	add(dexPoolTypeID, 4, d.itemRefs(dexTypeClassDefItem, classDefSize, 8, toType32), writeType32)
+	add(dexPoolTypeID, 2, d.listRefs(d.typeLists, 0, toType16), writeType16)
+	add(dexPoolTypeID, 2, d.codeRefs(opcodes('c', 2, 0x1C, 0x1F, 0x20, 0x22, 0x23, 0x24, 0x25), toType16), writeType16)
+
+	toProto16, writeProto16 := index(2, dexTypeProtoIDItem, protoIDSize)
+	add(dexPoolProtoID, 2, d.codeRefs(func(op uint8, instr *dexInstruction) (uint32, bool) {
+		switch op {
+		case 0xFA, 0xFB:
+			return 6, true
+		case 0xFF:
+			return 2, true
+		}
+		return 0, false
+	}, toProto16), writeProto16)
+	add(dexPoolProtoID, 2, d.itemRefs(dexTypeMethodIDItem, methodIDSize, 2, toProto16), writeProto16)
+
+	toField16, writeField16 := index(2, dexTypeFieldIDItem, fieldIDSize)
+	toField32, writeField32 := index(4, dexTypeFieldIDItem, fieldIDSize)
+	add(dexPoolFieldID, 2, d.codeRefs(func(op uint8, instr *dexInstruction) (uint32, bool) {
+		return 2, op >= 0x52 && op < 0x52+28
+	}, toField16), writeField16)
+	add(dexPoolFieldID, 2, d.itemRefs(dexTypeMethodHandleItem, methodHandleSize, 4, methodHandles(true)), writeField16)
+	add(dexPoolFieldID, 4, d.listRefs(d.fieldAnnotations, 0, toField32), writeField32)
+
+	toMethod16, writeMethod16 := index(2, dexTypeMethodIDItem, methodIDSize)
+	toMethod32, writeMethod32 := index(4, dexTypeMethodIDItem, methodIDSize)
+	add(dexPoolMethodID, 2, d.codeRefs(func(op uint8, instr *dexInstruction) (uint32, bool) {
+		return 2, (op >= 0x6E && op < 0x6E+5) || (op >= 0x74 && op < 0x74+5) || op == 0xFA || op == 0xFB
+	}, toMethod16), writeMethod16)
+	add(dexPoolMethodID, 2, d.itemRefs(dexTypeMethodHandleItem, methodHandleSize, 4, methodHandles(false)), writeMethod16)
+	add(dexPoolMethodID, 4, d.listRefs(d.methodAnnotations, 0, toMethod32), writeMethod32)
+	add(dexPoolMethodID, 4, d.listRefs(d.parameterAnnotations, 0, toMethod32), writeMethod32)
+
+	toCallSite16, writeCallSite16 := index(2, dexTypeCallSiteIDItem, callSiteIDSize)
+	add(dexPoolCallSiteID, 2, d.codeRefs(opcodes('c', 2, 0xFC, 0xFD), toCallSite16), writeCallSite16)
+
+	toMethodHandle16, writeMethodHandle16 := index(2, dexTypeMethodHandleItem, methodHandleSize)
+	add(dexPoolMethodHandle, 2, d.codeRefs(opcodes('c', 2, 0xFE), toMethodHandle16), writeMethodHandle16)
+
+	add(dexPoolTypeList, 4, d.itemRefs(dexTypeProtoIDItem, protoIDSize, 8, d.offsetTarget), d.writeOffset)
+	add(dexPoolTypeList, 4, d.itemRefs(dexTypeClassDefItem, classDefSize, 12, d.offsetTarget), d.writeOffset)
+
+	add(dexPoolAnnotationSetRefList, 4, d.listRefs(d.parameterAnnotations, 4, d.offsetTarget), d.writeOffset)
+
+	add(dexPoolAnnotationSet, 4, d.listRefs(d.annotationSetRefLists, 0, d.offsetTarget), d.writeOffset)
+	add(dexPoolAnnotationSet, 4, d.listRefs(d.annotationsDirectories, 0, d.offsetTarget), d.writeOffset)
+	add(dexPoolAnnotationSet, 4, d.listRefs(d.fieldAnnotations, 4, d.offsetTarget), d.writeOffset)
+	add(dexPoolAnnotationSet, 4, d.listRefs(d.methodAnnotations, 4, d.offsetTarget), d.writeOffset)
+
+	add(dexPoolClassData, 4, d.itemRefs(dexTypeClassDefItem, classDefSize, 24, d.offsetTarget), d.writeOffset)
+
+	add(dexPoolCode, 1, d.codeRefs(opcodes('t', 1, 0x28), d.relCodeTarget(1)), d.writeRelCode(1))
+	add(dexPoolCode, 2, d.codeRefs(func(op uint8, instr *dexInstruction) (uint32, bool) {
+		return 2, op == 0x29 || (op >= 0x32 && op < 0x3E)
+	}, d.relCodeTarget(2)), d.writeRelCode(2))
+	add(dexPoolCode, 4, d.codeRefs(opcodes('t', 2, 0x26, 0x2A, 0x2B, 0x2C), d.relCodeTarget(4)), d.writeRelCode(4))
+
+	add(dexPoolStringData, 4, d.itemRefs(dexTypeStringIDItem, stringIDSize, 0, d.offsetTarget), d.writeOffset)
+
+	add(dexPoolAnnotation, 4, d.listRefs(d.annotationSets, 0, d.offsetTarget), d.writeOffset)
+
+	add(dexPoolEncodedArray, 4, d.itemRefs(dexTypeClassDefItem, classDefSize, 28, d.offsetTarget), d.writeOffset)
+
+	add(dexPoolAnnotationsDirectory, 4, d.itemRefs(dexTypeClassDefItem, classDefSize, 20, d.offsetTarget), d.writeOffset)
+
+	add(dexPoolCallSite, 4, d.itemRefs(dexTypeCallSiteIDItem, callSiteIDSize, 0, d.offsetTarget), d.writeOffset)
+
+	return types
+}
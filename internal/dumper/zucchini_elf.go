@@ -0,0 +1,551 @@
+package dumper
+
+import (
+	"cmp"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"sort"
+)
+
+const (
+	zucchiniRVABound   = 1<<31 - 1
+	zucchiniInvalidRVA = 1<<32 - 2
+)
+
+// Target pools of the ARM ELF disassemblers.
+const (
+	zucchiniELFPoolReloc = iota
+	zucchiniELFPoolAbs32
+	zucchiniELFPoolRel32
+)
+
+// zucchiniRangeIsBounded reports whether [begin, begin+size) lies below bound.
+func zucchiniRangeIsBounded(begin, size, bound uint64) bool {
+	return begin < bound && size <= bound-begin
+}
+
+// zucchiniAddressUnit maps a range of file offsets to the same number of
+// virtual addresses.
+type zucchiniAddressUnit struct {
+	offset, rva, size uint32
+}
+
+// zucchiniAddressTranslator converts between file offsets and RVAs of the
+// sections of an executable.
+type zucchiniAddressTranslator struct {
+	byRVA, byOffset []zucchiniAddressUnit
+}
+
+func newZucchiniAddressTranslator(units []zucchiniAddressUnit) (*zucchiniAddressTranslator, error) {
+	for _, u := range units {
+		if !zucchiniRangeIsBounded(uint64(u.offset), uint64(u.size), zucchiniOffsetBound) ||
+			!zucchiniRangeIsBounded(uint64(u.rva), uint64(u.size), zucchiniRVABound) {
+			return nil, fmt.Errorf("section out of range")
+		}
+	}
+
+	// Units that overlap in RVA merge when they agree on the mapping; units
+	// that merely touch stay apart otherwise.
+	units = slices.DeleteFunc(slices.Clone(units), func(u zucchiniAddressUnit) bool { return u.size == 0 })
+	slices.SortFunc(units, func(a, b zucchiniAddressUnit) int {
+		return cmp.Or(cmp.Compare(a.rva, b.rva), cmp.Compare(a.size, b.size), cmp.Compare(a.offset, b.offset))
+	})
+	units = slices.Compact(units)
+	if len(units) > 1 {
+		slow := 0
+		for _, fast := range units[1:] {
+			s := &units[slow]
+			if s.rva+s.size < fast.rva {
+				slow++
+				units[slow] = fast
+				continue
+			}
+			if fast.offset < s.offset || fast.offset-s.offset != fast.rva-s.rva {
+				if s.rva+s.size == fast.rva {
+					slow++
+					units[slow] = fast
+					continue
+				}
+				return nil, fmt.Errorf("sections overlap with different mappings")
+			}
+			s.size = max(s.rva+s.size, fast.rva+fast.size) - s.rva
+		}
+		units = units[:slow+1]
+	}
+
+	byOffset := slices.Clone(units)
+	slices.SortFunc(byOffset, func(a, b zucchiniAddressUnit) int { return cmp.Compare(a.offset, b.offset) })
+	var offsetBound, rvaBound uint32
+	for i, u := range byOffset {
+		if i > 0 && byOffset[i-1].offset+byOffset[i-1].size > u.offset {
+			return nil, fmt.Errorf("sections overlap in the file")
+		}
+		offsetBound = max(offsetBound, u.offset+u.size)
+		rvaBound = max(rvaBound, u.rva+u.size)
+	}
+	if offsetBound != 0 && !zucchiniRangeIsBounded(uint64(offsetBound), uint64(rvaBound), zucchiniOffsetBound) {
+		return nil, fmt.Errorf("sections out of range")
+	}
+	return &zucchiniAddressTranslator{byRVA: units, byOffset: byOffset}, nil
+}
+
+func (t *zucchiniAddressTranslator) rvaToOffset(rva uint32) uint32 {
+	i := sort.Search(len(t.byRVA), func(i int) bool { return t.byRVA[i].rva > rva }) - 1
+	if i < 0 || rva-t.byRVA[i].rva >= t.byRVA[i].size {
+		return zucchiniInvalidOffset
+	}
+	return rva - t.byRVA[i].rva + t.byRVA[i].offset
+}
+
+func (t *zucchiniAddressTranslator) offsetToRVA(offset uint32) uint32 {
+	i := sort.Search(len(t.byOffset), func(i int) bool { return t.byOffset[i].offset > offset }) - 1
+	if i < 0 || offset-t.byOffset[i].offset >= t.byOffset[i].size {
+		return zucchiniInvalidRVA
+	}
+	return offset - t.byOffset[i].offset + t.byOffset[i].rva
+}
+
+// zucchiniELFSection is the part of a section header the disassembler uses.
+type zucchiniELFSection struct {
+	typ, flags    uint64
+	addr, offset  uint64
+	size, entsize uint64
+}
+
+// zucchiniELF finds the references of a little endian ARM ELF executable:
+// RELATIVE relocations, the absolute pointers they relocate, and the PC
+// relative branches and loads in executable sections.
+type zucchiniELF struct {
+	image      []byte
+	is64       bool
+	translator *zucchiniAddressTranslator
+
+	relocType uint32
+	relocs    []zucchiniELFSection
+	abs32     []uint32
+
+	branches []*armBranch
+	rel32    [][]uint32
+}
+
+func parseZucchiniELF(image []byte, is64 bool) (*zucchiniELF, error) {
+	e := &zucchiniELF{is64: is64}
+	ehdrSize, shdrSize, phdrSize := 52, 40, 32
+	class, machine := elf.ELFCLASS32, elf.EM_ARM
+	if is64 {
+		ehdrSize, shdrSize, phdrSize = 64, 64, 56
+		class, machine = elf.ELFCLASS64, elf.EM_AARCH64
+	}
+
+	le := binary.LittleEndian
+	if len(image) < ehdrSize || string(image[:4]) != elf.ELFMAG ||
+		elf.Class(image[elf.EI_CLASS]) != class || elf.Data(image[elf.EI_DATA]) != elf.ELFDATA2LSB ||
+		elf.Version(image[elf.EI_VERSION]) != elf.EV_CURRENT {
+		return nil, fmt.Errorf("not a little endian %v ELF file", class)
+	}
+	typ := elf.Type(le.Uint16(image[16:]))
+	if (typ != elf.ET_EXEC && typ != elf.ET_DYN) || elf.Machine(le.Uint16(image[18:])) != machine ||
+		elf.Version(le.Uint32(image[20:])) != elf.EV_CURRENT {
+		return nil, fmt.Errorf("not a %v executable", machine)
+	}
+
+	var shoff, phoff uint64
+	var shentsize, shnum, phnum, shstrndx uint16
+	if is64 {
+		phoff, shoff = le.Uint64(image[32:]), le.Uint64(image[40:])
+		phnum, shentsize, shnum, shstrndx = le.Uint16(image[56:]), le.Uint16(image[58:]), le.Uint16(image[60:]), le.Uint16(image[62:])
+	} else {
+		phoff, shoff = uint64(le.Uint32(image[28:])), uint64(le.Uint32(image[32:]))
+		phnum, shentsize, shnum, shstrndx = le.Uint16(image[44:]), le.Uint16(image[46:]), le.Uint16(image[48:]), le.Uint16(image[50:])
+	}
+	if int(shentsize) != shdrSize {
+		return nil, fmt.Errorf("unexpected section header size %d", shentsize)
+	}
+
+	size := uint64(len(image))
+	covers := func(offset, n uint64) bool { return offset <= size && n <= size-offset }
+	sectionsEnd := shoff + uint64(shnum)*uint64(shdrSize)
+	segmentsEnd := phoff + uint64(phnum)*uint64(phdrSize)
+	if !covers(shoff, uint64(shnum)*uint64(shdrSize)) || !covers(phoff, uint64(phnum)*uint64(phdrSize)) {
+		return nil, fmt.Errorf("header tables out of range")
+	}
+
+	sections := make([]zucchiniELFSection, shnum)
+	for i := range sections {
+		h := image[shoff+uint64(i*shdrSize):]
+		if is64 {
+			sections[i] = zucchiniELFSection{
+				typ: uint64(le.Uint32(h[4:])), flags: le.Uint64(h[8:]),
+				addr: le.Uint64(h[16:]), offset: le.Uint64(h[24:]),
+				size: le.Uint64(h[32:]), entsize: le.Uint64(h[56:]),
+			}
+		} else {
+			sections[i] = zucchiniELFSection{
+				typ: uint64(le.Uint32(h[4:])), flags: uint64(le.Uint32(h[8:])),
+				addr: uint64(le.Uint32(h[12:])), offset: uint64(le.Uint32(h[16:])),
+				size: uint64(le.Uint32(h[20:])), entsize: uint64(le.Uint32(h[36:])),
+			}
+		}
+	}
+	if shstrndx >= shnum {
+		return nil, fmt.Errorf("invalid section name table index %d", shstrndx)
+	}
+	if strtab := sections[shstrndx]; strtab.size > 0 {
+		if !covers(strtab.offset, strtab.size) || image[strtab.offset+strtab.size-1] != 0 {
+			return nil, fmt.Errorf("invalid section name table")
+		}
+	}
+
+	offsetBound := max(sectionsEnd, segmentsEnd)
+	var units []zucchiniAddressUnit
+	for _, s := range sections {
+		if s.size == 0 {
+			continue
+		}
+		if !zucchiniRangeIsBounded(s.addr, s.size, zucchiniRVABound) ||
+			!zucchiniRangeIsBounded(s.offset, s.size, zucchiniOffsetBound) {
+			continue
+		}
+		if elf.SectionType(s.typ) != elf.SHT_NOBITS {
+			if !covers(s.offset, s.size) {
+				return nil, fmt.Errorf("section out of range")
+			}
+			offsetBound = max(offsetBound, s.offset+s.size)
+		}
+		if s.addr > 0 {
+			units = append(units, zucchiniAddressUnit{offset: uint32(s.offset), rva: uint32(s.addr), size: uint32(s.size)})
+		}
+	}
+	var err error
+	if e.translator, err = newZucchiniAddressTranslator(units); err != nil {
+		return nil, err
+	}
+
+	for i := range uint64(phnum) {
+		h := image[phoff+i*uint64(phdrSize):]
+		var offset, filesz uint64
+		if is64 {
+			offset, filesz = le.Uint64(h[8:]), le.Uint64(h[32:])
+		} else {
+			offset, filesz = uint64(le.Uint32(h[4:])), uint64(le.Uint32(h[16:]))
+		}
+		if !zucchiniRangeIsBounded(offset, filesz, zucchiniOffsetBound) {
+			return nil, fmt.Errorf("segment out of range")
+		}
+		offsetBound = max(offsetBound, offset+filesz)
+	}
+	if offsetBound > size {
+		return nil, fmt.Errorf("image is truncated")
+	}
+	e.image = image[:offsetBound]
+
+	relSize := uint64(8)
+	e.relocType = uint32(elf.R_ARM_RELATIVE)
+	e.branches = []*armBranch{&armA24, &armT8, &armT11, &armT20, &armT24}
+	if is64 {
+		relSize = 16
+		e.relocType = uint32(elf.R_AARCH64_RELATIVE)
+		e.branches = []*armBranch{&arm64Immd14, &arm64Immd19, &arm64Immd26}
+	}
+	var exec []zucchiniELFSection
+	for _, s := range sections {
+		if s.size == 0 || !covers(s.offset, s.size) || s.offset+s.size > offsetBound {
+			continue
+		}
+		if t := elf.SectionType(s.typ); (t == elf.SHT_REL || t == elf.SHT_RELA) && s.entsize >= relSize {
+			e.relocs = append(e.relocs, s)
+		}
+		if elf.SectionFlag(s.flags)&elf.SHF_EXECINSTR != 0 && elf.SectionType(s.typ) != elf.SHT_NOBITS {
+			exec = append(exec, s)
+		}
+	}
+	slices.SortStableFunc(e.relocs, func(a, b zucchiniELFSection) int { return cmp.Compare(a.offset, b.offset) })
+	slices.SortStableFunc(exec, func(a, b zucchiniELFSection) int { return cmp.Compare(a.offset, b.offset) })
+
+	e.findAbs32()
+	e.rel32 = make([][]uint32, len(e.branches))
+	for _, s := range exec {
+		e.findRel32(s)
+	}
+	for _, locations := range e.rel32 {
+		slices.Sort(locations)
+	}
+	return e, nil
+}
+
+// width is the size of pointers and relocation offsets.
+func (e *zucchiniELF) width() uint32 {
+	if e.is64 {
+		return 8
+	}
+	return 4
+}
+
+func (e *zucchiniELF) readWord(offset uint32) (uint64, bool) {
+	if uint64(offset)+uint64(e.width()) > uint64(len(e.image)) {
+		return 0, false
+	}
+	if e.is64 {
+		return binary.LittleEndian.Uint64(e.image[offset:]), true
+	}
+	return uint64(binary.LittleEndian.Uint32(e.image[offset:])), true
+}
+
+func (e *zucchiniELF) writeWord(offset uint32, v uint64) {
+	if uint64(offset)+uint64(e.width()) > uint64(len(e.image)) {
+		return
+	}
+	if e.is64 {
+		binary.LittleEndian.PutUint64(e.image[offset:], v)
+	} else {
+		binary.LittleEndian.PutUint32(e.image[offset:], uint32(v))
+	}
+}
+
+// readRelocs returns the RELATIVE relocations whose entries start in
+// [lo, hi), as references from the entry to the pointer it relocates.
+// Bounds inside a section are moved to entry boundaries.
+func (e *zucchiniELF) readRelocs(lo, hi uint32) func() (zucchiniRef, bool) {
+	sections := e.relocs
+	if len(sections) == 0 {
+		return func() (zucchiniRef, bool) { return zucchiniRef{}, false }
+	}
+	alignUp := func(v, align uint64) uint64 { return (v + align - 1) / align * align }
+
+	i := max(sort.Search(len(sections), func(i int) bool { return sections[i].offset > uint64(lo) })-1, 0)
+	cursor := sections[i].offset
+	if cursor < uint64(lo) {
+		cursor += alignUp(uint64(lo)-cursor, sections[i].entsize)
+	}
+	end := uint64(hi)
+	if j := sort.Search(len(sections), func(j int) bool { return sections[j].offset > uint64(hi) }) - 1; j >= 0 {
+		if s := sections[j]; end-s.offset < s.size {
+			end = s.offset + alignUp(end-s.offset, s.entsize)
+		}
+	}
+
+	return func() (zucchiniRef, bool) {
+		for ; i < len(sections); cursor += sections[i].entsize {
+			s := sections[i]
+			if cursor >= s.offset+s.size {
+				if i++; i == len(sections) {
+					return zucchiniRef{}, false
+				}
+				cursor = sections[i].offset
+				s = sections[i]
+			}
+			if cursor+s.entsize > end {
+				return zucchiniRef{}, false
+			}
+
+			rOffset, ok := e.readWord(uint32(cursor))
+			if !ok {
+				return zucchiniRef{}, false
+			}
+			info, _ := e.readWord(uint32(cursor) + e.width())
+			typ := uint32(info & 0xFF)
+			if e.is64 {
+				typ = uint32(info)
+			}
+			if typ != e.relocType || (e.is64 && rOffset&0x7FFFFFFF != rOffset) {
+				continue
+			}
+			target := e.translator.rvaToOffset(uint32(rOffset))
+			if target == zucchiniInvalidOffset || uint64(target)+uint64(e.width()) > uint64(len(e.image)) {
+				continue
+			}
+			location := uint32(cursor)
+			cursor += s.entsize
+			return zucchiniRef{location: location, target: target}, true
+		}
+		return zucchiniRef{}, false
+	}
+}
+
+func (e *zucchiniELF) writeReloc(ref zucchiniRef) {
+	e.writeWord(ref.location, uint64(e.translator.offsetToRVA(ref.target)))
+}
+
+// findAbs32 collects the pointers the relocations point at, dropping those
+// that do not point into a section and those overlapping a previous one.
+func (e *zucchiniELF) findAbs32() {
+	var locations []uint32
+	next := e.readRelocs(0, uint32(len(e.image)))
+	for ref, ok := next(); ok; ref, ok = next() {
+		locations = append(locations, ref.target)
+	}
+	slices.Sort(locations)
+
+	width := e.width()
+	prevEnd := uint32(0)
+	for _, location := range locations {
+		if _, ok := e.abs32Target(location); !ok || (len(e.abs32) > 0 && location < prevEnd) {
+			continue
+		}
+		e.abs32 = append(e.abs32, location)
+		prevEnd = location + width
+	}
+}
+
+func (e *zucchiniELF) abs32Target(location uint32) (uint32, bool) {
+	v, ok := e.readWord(location)
+	if !ok || v >= zucchiniRVABound {
+		return 0, false
+	}
+	target := e.translator.rvaToOffset(uint32(v))
+	return target, target != zucchiniInvalidOffset
+}
+
+func (e *zucchiniELF) readAbs32(lo, hi uint32) func() (zucchiniRef, bool) {
+	locations := e.abs32
+	i, _ := slices.BinarySearch(locations, lo)
+	return func() (zucchiniRef, bool) {
+		for ; i < len(locations) && locations[i] < hi; i++ {
+			if target, ok := e.abs32Target(locations[i]); ok {
+				i++
+				return zucchiniRef{location: locations[i-1], target: target}, true
+			}
+		}
+		return zucchiniRef{}, false
+	}
+}
+
+func (e *zucchiniELF) writeAbs32(ref zucchiniRef) {
+	if rva := e.translator.offsetToRVA(ref.target); rva != zucchiniInvalidRVA {
+		e.writeWord(ref.location, uint64(rva))
+	}
+}
+
+// findRel32 scans an executable section for branches between the abs32
+// pointers and keeps those whose target lies in a section.
+func (e *zucchiniELF) findRel32(s zucchiniELFSection) {
+	start, end := uint32(s.offset), uint32(s.offset+s.size)
+	branches := e.branches
+	thumb := false
+	if !e.is64 {
+		thumb = isThumb2Section(e.image[start:end], s.addr, s.size)
+		if thumb {
+			branches = e.branches[1:]
+		} else {
+			branches = e.branches[:1]
+		}
+	}
+
+	scan := func(lo, hi uint32) {
+		align := uint32(4)
+		if thumb {
+			align = 2
+		}
+		for off := (lo + align - 1) &^ (align - 1); off < hi; {
+			size := uint32(4)
+			candidates := branches
+			if thumb {
+				if off+2 > hi {
+					break
+				}
+				size = 2
+				if binary.LittleEndian.Uint16(e.image[off:])&0xF800 >= 0xE800 {
+					size = 4
+					candidates = branches[2:]
+				} else {
+					candidates = branches[:2]
+				}
+			}
+			if off+size > hi {
+				break
+			}
+			rva := e.translator.offsetToRVA(off)
+			if rva == zucchiniInvalidRVA {
+				off += size
+				continue
+			}
+			for _, b := range candidates {
+				target, ok := b.read(rva, b.fetch(e.image, off))
+				if ok && e.translator.rvaToOffset(target) != zucchiniInvalidOffset {
+					kind := slices.Index(e.branches, b)
+					e.rel32[kind] = append(e.rel32[kind], off)
+					break
+				}
+			}
+			off += size
+		}
+	}
+
+	// The gaps between the abs32 pointers in the section.
+	width := e.width()
+	lo := start
+	i, _ := slices.BinarySearch(e.abs32, start)
+	for ; i < len(e.abs32) && e.abs32[i] < end; i++ {
+		scan(lo, e.abs32[i])
+		lo = min(e.abs32[i]+width, end)
+	}
+	scan(lo, end)
+}
+
+// isThumb2Section guesses whether an ARM32 section holds Thumb2 code. ARM
+// instructions are mostly unconditional, so their top nibble is usually 0xE.
+func isThumb2Section(code []byte, addr, size uint64) bool {
+	if addr%4 != 0 || size%4 != 0 {
+		return true
+	}
+	words, arm := len(code)/4, 0
+	for i := 0; i+4 <= len(code); i += 4 {
+		if code[i+3]&0xF0 == 0xE0 {
+			arm++
+		}
+	}
+	return words == 0 || float64(arm) < float64(words)*0.4
+}
+
+func (e *zucchiniELF) readRel32(kind int) func(lo, hi uint32) func() (zucchiniRef, bool) {
+	b := e.branches[kind]
+	return func(lo, hi uint32) func() (zucchiniRef, bool) {
+		locations := e.rel32[kind]
+		i, _ := slices.BinarySearch(locations, lo)
+		return func() (zucchiniRef, bool) {
+			for ; i < len(locations) && locations[i] < hi; i++ {
+				location := locations[i]
+				rva, ok := b.read(e.translator.offsetToRVA(location), b.fetch(e.image, location))
+				if !ok {
+					continue
+				}
+				if target := e.translator.rvaToOffset(rva); target != zucchiniInvalidOffset {
+					i++
+					return zucchiniRef{location: location, target: target}, true
+				}
+			}
+			return zucchiniRef{}, false
+		}
+	}
+}
+
+func (e *zucchiniELF) writeRel32(kind int) func(ref zucchiniRef) {
+	b := e.branches[kind]
+	return func(ref zucchiniRef) {
+		if uint64(ref.location)+uint64(b.width) > uint64(len(e.image)) {
+			return
+		}
+		code, ok := b.write(e.translator.offsetToRVA(ref.location), e.translator.offsetToRVA(ref.target), b.fetch(e.image, ref.location))
+		if ok {
+			b.store(e.image, ref.location, code)
+		}
+	}
+}
+
+func (e *zucchiniELF) refTypes() []zucchiniRefType {
+	types := []zucchiniRefType{
+		{pool: zucchiniELFPoolReloc, width: e.width(), read: e.readRelocs, write: e.writeReloc},
+		{pool: zucchiniELFPoolAbs32, width: e.width(), read: e.readAbs32, write: e.writeAbs32},
+	}
+	for kind, b := range e.branches {
+		types = append(types, zucchiniRefType{
+			pool:  zucchiniELFPoolRel32,
+			width: b.width,
+			read:  e.readRel32(kind),
+			write: e.writeRel32(kind),
+		})
+	}
+	return types
+}
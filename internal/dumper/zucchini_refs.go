@@ -0,0 +1,277 @@
+package dumper
+
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+)
+
+const (
+	zucchiniOffsetBound   = 1<<31 - 1
+	zucchiniInvalidOffset = 1<<32 - 2
+)
+
+// zucchiniRef is a reference at location pointing at target, both offsets
+// into an element.
+type zucchiniRef struct {
+	location, target uint32
+}
+
+// zucchiniRefType is one kind of reference an executable holds, like the
+// branches of one instruction encoding. Types pointing at the same kind of
+// target share a pool, and the pool's targets are what reference deltas
+// index into.
+type zucchiniRefType struct {
+	pool  uint8
+	width uint32
+	// read returns the references located in [lo, hi) in location order.
+	read func(lo, hi uint32) func() (zucchiniRef, bool)
+	// write stores ref into the image the type was disassembled from.
+	write func(ref zucchiniRef)
+}
+
+// zucchiniDisassemble returns the reference types of an element, in the order
+// Zucchini visits them. Raw elements have none.
+func zucchiniDisassemble(exeType uint32, image []byte) ([]zucchiniRefType, error) {
+	switch exeType {
+	case zucchiniExeTypeNoOp:
+		return nil, nil
+	case zucchiniExeTypeElfAArch32, zucchiniExeTypeElfAArch64:
+		elf, err := parseZucchiniELF(image, exeType == zucchiniExeTypeElfAArch64)
+		if err != nil {
+			return nil, err
+		}
+		return elf.refTypes(), nil
+	case zucchiniExeTypeDex:
+		dex, err := parseZucchiniDex(image)
+		if err != nil {
+			return nil, err
+		}
+		return dex.refTypes(), nil
+	}
+	return nil, fmt.Errorf("reference correction for %s executables is not supported", zucchiniExeTypes[exeType])
+}
+
+// applyReferencesCorrection rewrites the references of the new element. The
+// targets of each pool are collected from the old element, projected into the
+// new one and completed with the patch's extra targets. Every old reference
+// inside an equivalence is then written at its new location, pointing at the
+// target its reference delta selects relative to the projected old target.
+func (e *zucchiniElement) applyReferencesCorrection(oldTypes []zucchiniRefType, old, out []byte) error {
+	deltas := e.referenceDelta
+	if len(oldTypes) == 0 {
+		if len(deltas) != 0 {
+			return fmt.Errorf("unexpected reference delta")
+		}
+		return nil
+	}
+
+	newTypes, err := zucchiniDisassemble(e.exeType, out)
+	if err != nil {
+		return fmt.Errorf("new element: %w", err)
+	}
+
+	var eqs []zucchiniEquivalence
+	next := e.equivalences()
+	for {
+		eq, ok, err := next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		eqs = append(eqs, eq)
+	}
+	mapper := newZucchiniOffsetMapper(eqs, uint32(len(old)), uint32(len(out)))
+
+	var pools []uint8
+	for _, t := range oldTypes {
+		pools = append(pools, t.pool)
+	}
+	slices.Sort(pools)
+	pools = slices.Compact(pools)
+
+	for _, pool := range pools {
+		var targets []uint32
+		for _, t := range oldTypes {
+			if t.pool != pool {
+				continue
+			}
+			next := t.read(0, uint32(len(old)))
+			for ref, ok := next(); ok; ref, ok = next() {
+				targets = append(targets, ref.target)
+			}
+		}
+		slices.Sort(targets)
+		targets = mapper.forwardProjectAll(slices.Compact(targets))
+		extra, err := decodeZucchiniExtraTargets(e.extraTargets[pool])
+		if err != nil {
+			return err
+		}
+		targets = append(targets, extra...)
+		slices.Sort(targets)
+		targets = slices.Compact(targets)
+
+		for i, t := range oldTypes {
+			if t.pool != pool {
+				continue
+			}
+			for _, eq := range eqs {
+				next := t.read(eq.srcOffset, eq.srcOffset+eq.length)
+				for ref, ok := next(); ok; ref, ok = next() {
+					delta, n := binary.Varint(deltas)
+					if n <= 0 || delta < math.MinInt32 || delta > math.MaxInt32 {
+						return fmt.Errorf("reference delta exhausted")
+					}
+					deltas = deltas[n:]
+
+					key := int64(zucchiniNearestKey(targets, mapper.extendedForwardProject(ref.target))) + delta
+					if key < 0 || key >= int64(len(targets)) {
+						return fmt.Errorf("invalid reference delta")
+					}
+					newTypes[i].write(zucchiniRef{
+						location: ref.location - eq.srcOffset + eq.dstOffset,
+						target:   targets[key],
+					})
+				}
+			}
+		}
+	}
+
+	if len(deltas) != 0 {
+		return fmt.Errorf("%d bytes of reference delta left over", len(deltas))
+	}
+	return nil
+}
+
+// decodeZucchiniExtraTargets decodes the sorted list of new targets that no
+// old target projects to.
+func decodeZucchiniExtraTargets(b []byte) ([]uint32, error) {
+	var targets []uint32
+	var compensation uint64
+	for len(b) > 0 {
+		diff, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid extra target")
+		}
+		b = b[n:]
+		target := diff + compensation
+		if target > math.MaxUint32 {
+			return nil, fmt.Errorf("invalid extra target")
+		}
+		targets = append(targets, uint32(target))
+		compensation = target + 1
+	}
+	return targets, nil
+}
+
+// zucchiniNearestKey returns the index of the target closest to offset,
+// preferring the lower one on ties.
+func zucchiniNearestKey(targets []uint32, offset uint32) uint32 {
+	i := sort.Search(len(targets), func(i int) bool { return targets[i] > offset })
+	if i > 0 && (i == len(targets) || targets[i]-offset >= offset-targets[i-1]) {
+		i--
+	}
+	return uint32(i)
+}
+
+// zucchiniOffsetMapper projects offsets of the old element into the new one
+// through the equivalences, pruned so no two of them overlap in the source.
+type zucchiniOffsetMapper struct {
+	eqs              []zucchiniEquivalence
+	oldSize, newSize uint32
+}
+
+func newZucchiniOffsetMapper(eqs []zucchiniEquivalence, oldSize, newSize uint32) *zucchiniOffsetMapper {
+	return &zucchiniOffsetMapper{
+		eqs:     pruneZucchiniEquivalences(slices.Clone(eqs)),
+		oldSize: oldSize,
+		newSize: newSize,
+	}
+}
+
+// pruneZucchiniEquivalences sorts eqs by source and resolves overlaps: an
+// equivalence is cut short where a longer one starts, and otherwise the later
+// ones give up their overlapping head.
+func pruneZucchiniEquivalences(eqs []zucchiniEquivalence) []zucchiniEquivalence {
+	slices.SortStableFunc(eqs, func(a, b zucchiniEquivalence) int {
+		return cmp.Compare(a.srcOffset, b.srcOffset)
+	})
+	srcEnd := func(eq zucchiniEquivalence) uint32 { return eq.srcOffset + eq.length }
+
+	for cur := 0; cur < len(eqs); cur++ {
+		reaped := false
+		next := cur + 1
+		for ; next < len(eqs); next++ {
+			if eqs[next].srcOffset >= srcEnd(eqs[cur]) {
+				break
+			}
+			if eqs[cur].length < eqs[next].length {
+				eqs[cur].length -= srcEnd(eqs[cur]) - eqs[next].srcOffset
+				reaped = true
+				break
+			}
+		}
+
+		if reaped {
+			for r := cur + 1; r < next; r++ {
+				eqs[r].length = 0
+			}
+			cur = next - 1
+			continue
+		}
+		for r := cur + 1; r < next; r++ {
+			delta := srcEnd(eqs[cur]) - eqs[r].srcOffset
+			eqs[r].length -= min(eqs[r].length, delta)
+			eqs[r].srcOffset += delta
+			eqs[r].dstOffset += delta
+		}
+	}
+
+	return slices.DeleteFunc(eqs, func(eq zucchiniEquivalence) bool { return eq.length == 0 })
+}
+
+// extendedForwardProject maps any offset to the new element. Offsets outside
+// the equivalences go through the nearest one and are clamped to the element;
+// offsets past the old element keep their distance from its end.
+func (m *zucchiniOffsetMapper) extendedForwardProject(offset uint32) uint32 {
+	if offset >= m.oldSize {
+		delta := offset - m.oldSize
+		if m.newSize < zucchiniOffsetBound && delta < zucchiniOffsetBound-m.newSize {
+			return delta + m.newSize
+		}
+		return zucchiniOffsetBound - 1
+	}
+
+	i := sort.Search(len(m.eqs), func(i int) bool { return offset < m.eqs[i].srcOffset })
+	var eq zucchiniEquivalence
+	if i > 0 && (i == len(m.eqs) || offset < m.eqs[i-1].srcOffset+m.eqs[i-1].length ||
+		offset-(m.eqs[i-1].srcOffset+m.eqs[i-1].length) < m.eqs[i].srcOffset-offset) {
+		eq = m.eqs[i-1]
+	} else {
+		eq = m.eqs[i]
+	}
+	projected := int64(offset) - int64(eq.srcOffset) + int64(eq.dstOffset)
+	return uint32(min(max(projected, 0), int64(m.newSize)-1))
+}
+
+// forwardProjectAll maps sorted offsets that lie inside an equivalence and
+// drops the others.
+func (m *zucchiniOffsetMapper) forwardProjectAll(offsets []uint32) []uint32 {
+	projected := offsets[:0]
+	cur := 0
+	for _, offset := range offsets {
+		for cur < len(m.eqs) && m.eqs[cur].srcOffset+m.eqs[cur].length <= offset {
+			cur++
+		}
+		if cur < len(m.eqs) && m.eqs[cur].srcOffset <= offset {
+			projected = append(projected, offset-m.eqs[cur].srcOffset+m.eqs[cur].dstOffset)
+		}
+	}
+	slices.Sort(projected)
+	return projected
+}
@@ -0,0 +1,424 @@
+package dumper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+// makeZucchiniPatch serializes an ensemble patch turning old into new.
+func makeZucchiniPatch(old, new []byte, elements ...zucchiniElement) []byte {
+	buffer := func(p, b []byte) []byte {
+		p = binary.LittleEndian.AppendUint32(p, uint32(len(b)))
+		return append(p, b...)
+	}
+
+	p := binary.LittleEndian.AppendUint32(nil, zucchiniMagic)
+	p = binary.LittleEndian.AppendUint16(p, zucchiniMajorVersion)
+	p = binary.LittleEndian.AppendUint16(p, 0)
+	for _, v := range []uint32{uint32(len(old)), crc32.ChecksumIEEE(old), uint32(len(new)), crc32.ChecksumIEEE(new), uint32(len(elements))} {
+		p = binary.LittleEndian.AppendUint32(p, v)
+	}
+
+	for _, e := range elements {
+		for _, v := range []uint32{e.oldOffset, e.oldLength, e.newOffset, e.newLength, e.exeType} {
+			p = binary.LittleEndian.AppendUint32(p, v)
+		}
+		p = binary.LittleEndian.AppendUint16(p, zucchiniElementVersion)
+		for _, b := range [][]byte{e.srcSkip, e.dstSkip, e.copyCount, e.extraData, e.rawDeltaSkip, e.rawDeltaDiff, e.referenceDelta} {
+			p = buffer(p, b)
+		}
+		p = binary.LittleEndian.AppendUint32(p, uint32(len(e.extraTargets)))
+		for _, pool := range slices.Sorted(maps.Keys(e.extraTargets)) {
+			p = append(p, pool)
+			p = buffer(p, e.extraTargets[pool])
+		}
+	}
+	return p
+}
+
+// makeZucchiniElement builds a single element that copies old[4:20] to
+// new[2:18], takes "XX" and "YYY" from the extra data and adds 1 to new[7]
+// through the raw delta.
+func makeZucchiniElement(old []byte, exeType uint32) (e zucchiniElement, new []byte) {
+	new = append([]byte("XX"), old[4:20]...)
+	new[7]++
+	new = append(new, "YYY"...)
+
+	return zucchiniElement{
+		oldLength:    uint32(len(old)),
+		newLength:    uint32(len(new)),
+		exeType:      exeType,
+		srcSkip:      binary.AppendVarint(nil, 4),
+		dstSkip:      binary.AppendUvarint(nil, 2),
+		copyCount:    binary.AppendUvarint(nil, 16),
+		extraData:    []byte("XXYYY"),
+		rawDeltaSkip: binary.AppendUvarint(nil, 5),
+		rawDeltaDiff: []byte{1},
+	}, new
+}
+
+// diffZucchiniElement builds the element turning old into new through eqs.
+// Every reference of old inside an equivalence must have a counterpart of the
+// same type at its projected location in new; the targets of the pairs become
+// the reference deltas and extra targets. The bytes of those references are
+// left out of the raw delta, so only reference correction gets them right.
+func diffZucchiniElement(t *testing.T, exeType uint32, old, new []byte, eqs []zucchiniEquivalence) zucchiniElement {
+	t.Helper()
+
+	e := zucchiniElement{oldLength: uint32(len(old)), newLength: uint32(len(new)), exeType: exeType}
+	var prevSrc, prevDst uint32
+	for _, eq := range eqs {
+		e.srcSkip = binary.AppendVarint(e.srcSkip, int64(eq.srcOffset)-int64(prevSrc))
+		e.dstSkip = binary.AppendUvarint(e.dstSkip, uint64(eq.dstOffset-prevDst))
+		e.copyCount = binary.AppendUvarint(e.copyCount, uint64(eq.length))
+		e.extraData = append(e.extraData, new[prevDst:eq.dstOffset]...)
+		prevSrc, prevDst = eq.srcOffset+eq.length, eq.dstOffset+eq.length
+	}
+	e.extraData = append(e.extraData, new[prevDst:]...)
+
+	oldTypes, err := zucchiniDisassemble(exeType, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTypes, err := zucchiniDisassemble(exeType, new)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapper := newZucchiniOffsetMapper(eqs, uint32(len(old)), uint32(len(new)))
+	corrected := make([]bool, len(new))
+
+	var pools []uint8
+	for _, typ := range oldTypes {
+		pools = append(pools, typ.pool)
+	}
+	slices.Sort(pools)
+	for _, pool := range slices.Compact(pools) {
+		var targets []uint32
+		var pairs [][2]zucchiniRef
+		for i, typ := range oldTypes {
+			if typ.pool != pool {
+				continue
+			}
+			next := typ.read(0, uint32(len(old)))
+			for ref, ok := next(); ok; ref, ok = next() {
+				targets = append(targets, ref.target)
+			}
+
+			newRefs := make(map[uint32]zucchiniRef)
+			next = newTypes[i].read(0, uint32(len(new)))
+			for ref, ok := next(); ok; ref, ok = next() {
+				newRefs[ref.location] = ref
+			}
+			for _, eq := range eqs {
+				next := typ.read(eq.srcOffset, eq.srcOffset+eq.length)
+				for ref, ok := next(); ok; ref, ok = next() {
+					location := ref.location - eq.srcOffset + eq.dstOffset
+					newRef, ok := newRefs[location]
+					if !ok {
+						t.Fatalf("pool %d: reference at %#x has no counterpart at %#x", pool, ref.location, location)
+					}
+					pairs = append(pairs, [2]zucchiniRef{ref, newRef})
+					for j := range typ.width {
+						corrected[location+j] = true
+					}
+				}
+			}
+		}
+		slices.Sort(targets)
+		targets = mapper.forwardProjectAll(slices.Compact(targets))
+
+		var extra []uint32
+		for _, pair := range pairs {
+			if _, found := slices.BinarySearch(targets, pair[1].target); !found {
+				extra = append(extra, pair[1].target)
+			}
+		}
+		slices.Sort(extra)
+		extra = slices.Compact(extra)
+		if len(extra) != 0 {
+			var b []byte
+			compensation := uint32(0)
+			for _, target := range extra {
+				b = binary.AppendUvarint(b, uint64(target-compensation))
+				compensation = target + 1
+			}
+			if e.extraTargets == nil {
+				e.extraTargets = make(map[uint8][]byte)
+			}
+			e.extraTargets[pool] = b
+		}
+		targets = append(targets, extra...)
+		slices.Sort(targets)
+
+		for _, pair := range pairs {
+			key, _ := slices.BinarySearch(targets, pair[1].target)
+			nearest := zucchiniNearestKey(targets, mapper.extendedForwardProject(pair[0].target))
+			e.referenceDelta = binary.AppendVarint(e.referenceDelta, int64(key)-int64(nearest))
+		}
+	}
+
+	var base, compensation uint32
+	for _, eq := range eqs {
+		for j := range eq.length {
+			if d := new[eq.dstOffset+j] - old[eq.srcOffset+j]; d != 0 && !corrected[eq.dstOffset+j] {
+				e.rawDeltaSkip = binary.AppendUvarint(e.rawDeltaSkip, uint64(base+j-compensation))
+				e.rawDeltaDiff = append(e.rawDeltaDiff, d)
+				compensation = base + j + 1
+			}
+		}
+		base += eq.length
+	}
+	return e
+}
+
+func brotliBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := brotli.NewWriter(&buf)
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestApplyZucchini(t *testing.T) {
+	old := []byte("The quick brown fox jumps over the lazy dog")
+	elem, want := makeZucchiniElement(old, zucchiniExeTypeNoOp)
+	raw := makeZucchiniPatch(old, want, elem)
+
+	with := func(exeType uint32, edit func(e *zucchiniElement)) []byte {
+		e, _ := makeZucchiniElement(old, exeType)
+		if edit != nil {
+			edit(&e)
+		}
+		return makeZucchiniPatch(old, want, e)
+	}
+	// The element version follows the patch header and the element's five
+	// offsets and lengths.
+	badVersion := slices.Clone(raw)
+	badVersion[28+20]++
+
+	tests := []struct {
+		name    string
+		old     []byte
+		patch   []byte
+		wantErr string
+	}{
+		{name: "uncompressed", old: old, patch: raw},
+		{name: "brotli", old: old, patch: brotliBytes(t, raw)},
+		{name: "wrong source", old: bytes.ToUpper(old), patch: raw, wantErr: "source does not match"},
+		{name: "not an executable", old: old, patch: with(zucchiniExeTypeElfAArch64, nil), wantErr: "ELF AArch64"},
+		{name: "unsupported executable", old: old, patch: with(zucchiniExeTypeWin32X86, nil), wantErr: "Win32 x86 executables is not supported"},
+		{name: "unknown executable", old: old, patch: with(0x12345678, nil), wantErr: "unknown executable type 12345678"},
+		{name: "element version", old: old, patch: badVersion, wantErr: "unsupported NoOp version 2"},
+		{name: "empty element", old: old, patch: with(zucchiniExeTypeNoOp, func(e *zucchiniElement) { e.oldLength = 0 }), wantErr: "is empty"},
+		{name: "element gap", old: old, patch: with(zucchiniExeTypeNoOp, func(e *zucchiniElement) { e.newOffset = 1 }), wantErr: "does not follow"},
+		{name: "short element", old: old, patch: with(zucchiniExeTypeNoOp, func(e *zucchiniElement) { e.newLength-- }), wantErr: "do not cover"},
+		{name: "reference delta for raw element", old: old, patch: with(zucchiniExeTypeNoOp, func(e *zucchiniElement) { e.referenceDelta = []byte{0} }), wantErr: "unexpected reference delta"},
+		{name: "truncated", old: old, patch: raw[:len(raw)-3], wantErr: "truncated patch"},
+		{name: "not brotli", old: old, patch: []byte("garbage"), wantErr: "invalid zucchini patch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ApplyZucchini(tt.old, tt.patch)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// zucchiniFixtures are the executable pairs of testdata/zucchini. Each new
+// file is the old one with insertSize bytes inserted at insertAt, see
+// gen_input.py there.
+var zucchiniFixtures = []struct {
+	name               string
+	exeType            uint32
+	old, new           string
+	insertAt, insertSz uint32
+}{
+	{"aarch64", zucchiniExeTypeElfAArch64, "aarch64-old.elf", "aarch64-new.elf", 0x224, 0x30},
+	{"arm", zucchiniExeTypeElfAArch32, "arm-old.elf", "arm-new.elf", 0x1C4, 0x20},
+	{"dex", zucchiniExeTypeDex, "old.dex", "new.dex", 0x142, 0x8},
+}
+
+func TestApplyZucchiniReferences(t *testing.T) {
+	for _, f := range zucchiniFixtures {
+		t.Run(f.name, func(t *testing.T) {
+			old := readTestdata(t, filepath.Join("zucchini", f.old))
+			new := readTestdata(t, filepath.Join("zucchini", f.new))
+			eqs := []zucchiniEquivalence{
+				{srcOffset: 0, dstOffset: 0, length: f.insertAt},
+				{srcOffset: f.insertAt, dstOffset: f.insertAt + f.insertSz, length: uint32(len(old)) - f.insertAt},
+			}
+			e := diffZucchiniElement(t, f.exeType, old, new, eqs)
+			if len(e.referenceDelta) == 0 || len(e.extraTargets) == 0 {
+				t.Fatal("the fixture has no moved references or new targets")
+			}
+
+			got, err := ApplyZucchini(old, makeZucchiniPatch(old, new, e))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, new) {
+				t.Fatalf("patched output does not match %s", f.new)
+			}
+
+			// The raw delta leaves the references alone, so the patch only
+			// works with them corrected.
+			raw := e
+			raw.exeType, raw.referenceDelta, raw.extraTargets = zucchiniExeTypeNoOp, nil, nil
+			if _, err := ApplyZucchini(old, makeZucchiniPatch(old, new, raw)); err == nil || !strings.Contains(err.Error(), "CRC mismatch") {
+				t.Fatalf("err = %v without reference correction, want a CRC mismatch", err)
+			}
+		})
+	}
+
+	t.Run("ensemble", func(t *testing.T) {
+		// Executables between raw data, as in a partition image.
+		var old, new []byte
+		var elements []zucchiniElement
+		add := func(exeType uint32, o, n []byte, eqs []zucchiniEquivalence) {
+			e := diffZucchiniElement(t, exeType, o, n, eqs)
+			e.oldOffset, e.newOffset = uint32(len(old)), uint32(len(new))
+			elements = append(elements, e)
+			old, new = append(old, o...), append(new, n...)
+		}
+
+		add(zucchiniExeTypeNoOp, []byte("old image header"), []byte("new image header"), []zucchiniEquivalence{{0, 0, 16}})
+		for _, f := range zucchiniFixtures {
+			o := readTestdata(t, filepath.Join("zucchini", f.old))
+			n := readTestdata(t, filepath.Join("zucchini", f.new))
+			add(f.exeType, o, n, []zucchiniEquivalence{
+				{srcOffset: 0, dstOffset: 0, length: f.insertAt},
+				{srcOffset: f.insertAt, dstOffset: f.insertAt + f.insertSz, length: uint32(len(o)) - f.insertAt},
+			})
+		}
+		add(zucchiniExeTypeNoOp, []byte("trailer"), []byte("Trailer!"), []zucchiniEquivalence{{1, 1, 6}})
+
+		got, err := ApplyZucchini(old, brotliBytes(t, makeZucchiniPatch(old, new, elements...)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, new) {
+			t.Fatal("patched output does not match the new image")
+		}
+	})
+
+	// Made by Chromium's own zucchini, so these check the patch format and
+	// the disassemblers against zucchini rather than against this code.
+	for _, f := range zucchiniFixtures {
+		t.Run(f.name+" zucchini", func(t *testing.T) {
+			patch, err := os.ReadFile(filepath.Join("testdata", "zucchini", f.name+".zuc"))
+			if errors.Is(err, fs.ErrNotExist) {
+				t.Skipf("testdata/zucchini/%s.zuc has not been generated, see gen.sh there", f.name)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			old := readTestdata(t, filepath.Join("zucchini", f.old))
+			new := readTestdata(t, filepath.Join("zucchini", f.new))
+			got, err := ApplyZucchini(old, patch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, new) {
+				t.Fatalf("patched output does not match %s", f.new)
+			}
+		})
+	}
+}
+
+func TestArmBranches(t *testing.T) {
+	// Instructions of the fixtures as llvm-objdump decodes them. Thumb2
+	// codes hold the first halfword in the high bits.
+	tests := []struct {
+		name      string
+		branch    *armBranch
+		rva, code uint32
+		target    uint32
+	}{
+		{name: "a64 bl", branch: &arm64Immd26, rva: 0x104, code: 0x9400001D, target: 0x178},
+		{name: "a64 bl back", branch: &arm64Immd26, rva: 0x228, code: 0x97FFFFB6, target: 0x100},
+		{name: "a64 b.eq", branch: &arm64Immd19, rva: 0x108, code: 0x540000A0, target: 0x11C},
+		{name: "a64 cbz", branch: &arm64Immd19, rva: 0x10C, code: 0xB40000A3, target: 0x120},
+		{name: "a64 ldr literal", branch: &arm64Immd19, rva: 0x118, code: 0x58000282, target: 0x168},
+		{name: "a64 tbz", branch: &arm64Immd14, rva: 0x114, code: 0x362FFF60, target: 0x100},
+		{name: "a64 tbnz", branch: &arm64Immd14, rva: 0x218, code: 0xB747FB00, target: 0x178},
+		{name: "arm bl", branch: &armA24, rva: 0x104, code: 0xEB000003, target: 0x118},
+		{name: "arm beq", branch: &armA24, rva: 0x108, code: 0x0AFFFFFC, target: 0x100},
+		{name: "arm blx", branch: &armA24, rva: 0x10C, code: 0xFA000048, target: 0x234},
+		{name: "arm blx odd halfword", branch: &armA24, rva: 0x1BC, code: 0xFB000021, target: 0x24A},
+		{name: "thumb beq", branch: &armT8, rva: 0x23A, code: 0xD0FB, target: 0x234},
+		{name: "thumb b", branch: &armT11, rva: 0x23C, code: 0xE004, target: 0x248},
+		{name: "thumb beq.w", branch: &armT20, rva: 0x244, code: 0xF0008014, target: 0x270},
+		{name: "thumb beq.w back", branch: &armT20, rva: 0x278, code: 0xF43FAFDC, target: 0x234},
+		{name: "thumb bl", branch: &armT24, rva: 0x236, code: 0xF000F808, target: 0x24A},
+		{name: "thumb blx", branch: &armT24, rva: 0x240, code: 0xF7FFEF5E, target: 0x100},
+		{name: "thumb b.w", branch: &armT24, rva: 0x262, code: 0xF7FFBFE7, target: 0x234},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, ok := tt.branch.read(tt.rva, tt.code)
+			if !ok || target != tt.target {
+				t.Fatalf("read = %#x, %v, want %#x", target, ok, tt.target)
+			}
+			if code, ok := tt.branch.write(tt.rva, tt.target, tt.code); !ok || code != tt.code {
+				t.Fatalf("write = %08x, %v, want %08x", code, ok, tt.code)
+			}
+
+			// Retargeting keeps the instruction and only moves the target.
+			moved := tt.target + 0x40
+			code, ok := tt.branch.write(tt.rva, moved, tt.code)
+			if !ok {
+				t.Fatalf("cannot write target %#x", moved)
+			}
+			if target, ok := tt.branch.read(tt.rva, code); !ok || target != moved {
+				t.Fatalf("read after write = %#x, %v, want %#x", target, ok, moved)
+			}
+		})
+	}
+
+	others := []struct {
+		name   string
+		branch *armBranch
+		code   uint32
+	}{
+		{"a64 nop", &arm64Immd26, 0xD503201F},
+		{"a64 add", &arm64Immd19, 0x91000420},
+		{"arm mov", &armA24, 0xE1A00000},
+		{"thumb nop", &armT8, 0xBF00},
+		{"thumb b as beq", &armT8, 0xE004},
+		{"thumb bl as beq.w", &armT20, 0xF000F808},
+	}
+	for _, tt := range others {
+		t.Run(tt.name, func(t *testing.T) {
+			if target, ok := tt.branch.read(0x100, tt.code); ok {
+				t.Fatalf("read %08x as a branch to %#x", tt.code, target)
+			}
+		})
+	}
+}